@@ -1,31 +1,46 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"sync"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 	// _ "net/http/pprof"
 
-	"github.com/vova4o/yandexadv/internal/agent/collector"
+	"github.com/spf13/pflag"
+
+	"github.com/vova4o/yandexadv/internal/agent/deadletter"
 	"github.com/vova4o/yandexadv/internal/agent/flags"
-	"github.com/vova4o/yandexadv/internal/agent/metrics"
+	"github.com/vova4o/yandexadv/internal/agent/runner"
 	"github.com/vova4o/yandexadv/internal/agent/sender"
 	"github.com/vova4o/yandexadv/package/logger"
+	"go.uber.org/zap"
 )
 
 var (
-	pollCount    int64
-	metricsMutex sync.Mutex
+	buildVersion = "N/A"
+	buildDate    = "N/A"
+	buildCommit  = "N/A"
 )
 
-// AllMetrics структура для хранения всех метрик
-type AllMetrics struct {
-	RuntimeMetrics    []metrics.Metrics `json:"runtime_metrics"`
-	AdditionalMetrics []metrics.Metrics `json:"additional_metrics"`
-}
-
 func main() {
+	// Подкоманда send разбирается до запуска основного цикла агента
+	if len(os.Args) > 1 && os.Args[1] == runner.SendCommand {
+		os.Exit(sendCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == runner.StdinCommand {
+		os.Exit(stdinCommand(os.Args[2:]))
+	}
+
 	config := flags.NewConfig()
+	if config.UserAgent == "" {
+		config.UserAgent = "metrics-agent/" + buildVersion
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
 
 	logger, err := logger.NewLogger("info", config.AgenLogFileName)
 	if err != nil {
@@ -34,100 +49,132 @@ func main() {
 	}
 
 	logger.Info("Starting agent")
+	logger.Info("Build version: " + buildVersion + ", date: " + buildDate + ", commit: " + buildCommit)
 	logger.Info("Server address: " + config.ServerAddress)
-	logger.Info("Secret key: " + config.SecretKey)
+	logger.Info("Secret key configured: " + fmt.Sprintf("%t", config.SecretKey != ""))
 	logger.Info("Rate limit: " + fmt.Sprintf("%d", config.RateLimit))
 
-	tickerPoll := time.NewTicker(config.PollInterval)
-	tickerReport := time.NewTicker(config.ReportInterval)
-
-	if config.RateLimit == 0 {
-		// Старый способ отправки метрик
-		go func() {
-			for range tickerPoll.C {
-				pollCount++
-				metricsMutex.Lock()
-				runtimeMetrics := collector.CollectMetrics(pollCount)
-				additionalMetrics := collector.CollectCPUAndMemMetrics(pollCount)
-				metricsMutex.Unlock()
-
-				allMetrics := append(runtimeMetrics, additionalMetrics...)
-				sender.SendMetricsBatch(config, allMetrics)
-			}
-		}()
+	if err := sender.ValidateLocalAddress(config.LocalAddress); err != nil {
+		logger.Error("Invalid local address", zap.Error(err))
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-		go func() {
-			for range tickerReport.C {
-				metricsMutex.Lock()
-				runtimeMetrics := collector.CollectMetrics(pollCount)
-				additionalMetrics := collector.CollectCPUAndMemMetrics(pollCount)
-				metricsMutex.Unlock()
+	deadletter.Default.Configure(config.DeadLetterFile, config.DeadLetterSize)
 
-				allMetrics := append(runtimeMetrics, additionalMetrics...)
-				sender.SendMetricsBatch(config, allMetrics)
-			}
-		}()
-
-		select {}
-	} else {
-		// Новый способ отправки метрик с использованием горутин и каналов
-		metricsChan := make(chan AllMetrics, config.RateLimit)
-		var wg sync.WaitGroup
-
-		// Запускаем воркеры
-		for i := 0; i < config.RateLimit; i++ {
-			wg.Add(1)
-			go worker(metricsChan, &wg, config)
-		}
+	// Создание контекста, который отменяется сигналами завершения работы
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-		// Горутина для сбора runtime метрик
-		go func() {
-			for range tickerPoll.C {
-				pollCount++
-				metricsMutex.Lock()
-				runtimeMetrics := collector.CollectMetrics(pollCount)
-				metricsMutex.Unlock()
+	// Работа агента до получения сигнала, с финальной отправкой метрик
+	agent := runner.New(config, logger, sender.HTTPSender{})
 
-				metricsChan <- AllMetrics{RuntimeMetrics: runtimeMetrics}
+	// Проверочная отправка до запуска цикла, чтобы ошибка конфигурации была видна сразу
+	if !config.NoSelfTest && !config.PollOnly {
+		if err := agent.SelfTest(ctx); err != nil {
+			logger.Error("Self-test failed", zap.Error(err))
+			fmt.Fprintln(os.Stderr, err)
+			stop()
+			os.Exit(1)
+		}
+		logger.Info("Self-test passed")
+	}
+
+	// Отладочный сервер останавливается вместе с агентом по отмене контекста
+	debugDone := make(chan struct{})
+	go func() {
+		defer close(debugDone)
+		if config.DebugAddress == "" {
+			return
+		}
+		if err := agent.ServeDebug(ctx, config.DebugAddress); err != nil {
+			logger.Error("Debug server failed", zap.Error(err))
+		}
+	}()
+
+	// Слежение за файлом метрик останавливается вместе с агентом по отмене контекста
+	tailDone := make(chan struct{})
+	go func() {
+		defer close(tailDone)
+		if config.TailFile == "" {
+			return
+		}
+		if err := agent.TailFile(ctx, config.TailFile, config.PollInterval); err != nil {
+			logger.Error("Failed to tail metrics file", zap.Error(err))
+		}
+	}()
+
+	// SIGHUP перечитывает конфигурацию и применяет ее без перезапуска
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				updated := flags.Reload()
+				if updated.UserAgent == "" {
+					updated.UserAgent = config.UserAgent
+				}
+				if err := agent.Reload(updated); err != nil {
+					logger.Error("Failed to reload config", zap.Error(err))
+				}
 			}
-		}()
+		}
+	}()
 
-		// Горутина для сбора дополнительных метрик
-		go func() {
-			for range tickerPoll.C {
-				metricsMutex.Lock()
-				additionalMetrics := collector.CollectCPUAndMemMetrics(pollCount)
-				metricsMutex.Unlock()
+	agent.Run(ctx)
+	stop()
+	<-debugDone
+	<-tailDone
 
-				metricsChan <- AllMetrics{AdditionalMetrics: additionalMetrics}
-			}
-		}()
-
-		// Горутина для отправки метрик на сервер
-		go func() {
-			for range tickerReport.C {
-				metricsMutex.Lock()
-				var combinedMetrics AllMetrics
-				for i := 0; i < config.RateLimit; i++ {
-					metrics := <-metricsChan
-					combinedMetrics.RuntimeMetrics = append(combinedMetrics.RuntimeMetrics, metrics.RuntimeMetrics...)
-					combinedMetrics.AdditionalMetrics = append(combinedMetrics.AdditionalMetrics, metrics.AdditionalMetrics...)
-				}
-				metricsMutex.Unlock()
+	logger.Info("Agent exiting")
+}
 
-				allMetrics := append(combinedMetrics.RuntimeMetrics, combinedMetrics.AdditionalMetrics...)
-				sender.SendMetricsBatch(config, allMetrics)
-			}
-		}()
+// sendCommand отправляет одну метрику, заданную аргументами, и возвращает код завершения
+func sendCommand(args []string) int {
+	// Флаги подкоманды неизвестны конфигурации агента и пропускаются при ее разборе
+	pflag.CommandLine.ParseErrorsWhitelist.UnknownFlags = true
+	os.Args = append([]string{os.Args[0]}, args...)
+	config := flags.NewConfig()
+	if config.UserAgent == "" {
+		config.UserAgent = "metrics-agent/" + buildVersion
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "send:", err)
+		return 2
+	}
 
-		select {}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := runner.SendOnce(ctx, config, sender.HTTPSender{}, args); err != nil {
+		fmt.Fprintln(os.Stderr, "send:", err)
+		return 2
 	}
+	return 0
 }
 
-func worker(metricsChan chan AllMetrics, wg *sync.WaitGroup, config *flags.Config) {
-	defer wg.Done()
-	for metrics := range metricsChan {
-		allMetrics := append(metrics.RuntimeMetrics, metrics.AdditionalMetrics...)
-		sender.SendMetricsBatch(config, allMetrics)
+// stdinCommand отправляет метрики, прочитанные из стандартного ввода, и возвращает код завершения
+func stdinCommand(args []string) int {
+	os.Args = append([]string{os.Args[0]}, args...)
+	config := flags.NewConfig()
+	if config.UserAgent == "" {
+		config.UserAgent = "metrics-agent/" + buildVersion
+	}
+	if err := config.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "stdin:", err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := runner.SendReader(ctx, config, sender.HTTPSender{}, os.Stdin); err != nil {
+		fmt.Fprintln(os.Stderr, "stdin:", err)
+		return 2
 	}
+	return 0
 }
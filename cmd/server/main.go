@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/vova4o/yandexadv/internal/server/flags"
 	"github.com/vova4o/yandexadv/internal/server/handler"
+	"github.com/vova4o/yandexadv/internal/server/lifecycle"
 	"github.com/vova4o/yandexadv/internal/server/middleware"
 	"github.com/vova4o/yandexadv/internal/server/service"
 	"github.com/vova4o/yandexadv/internal/server/storage"
@@ -26,9 +28,23 @@ var (
 )
 
 func main() {
+	// Подкоманда validate только проверяет конфигурацию, сервер не запускается
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validateCommand(os.Args[2:]))
+	}
+
+	startTime := time.Now()
 	config := flags.NewConfig()
+	// Сервер не запускается с конфигурацией, которую отклоняет validate
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
 
-	logger, err := logger.NewLogger("info", config.ServerLogFile)
+	logLevel := "info"
+	if config.Debug {
+		logLevel = "debug"
+	}
+	logger, err := logger.NewLogger(logLevel, config.ServerLogFile)
 	if err != nil {
 		log.Fatalf("Failed to create logger: %v", err)
 	}
@@ -39,43 +55,103 @@ func main() {
 		zap.String("commit", buildCommit),
 	)
 
-	middle := middleware.New(logger, config.SecretKey)
+	middle := middleware.New(logger, config)
 
 	stor := storage.Init(config, logger)
+	if collector, ok := stor.(middleware.PrometheusWriter); ok {
+		middle.REDMetrics.Register(collector)
+	}
+
+	service := service.New(stor, logger, config)
+	if err := service.ReloadTemplate(); err != nil {
+		logger.Error("Failed to load statistics template", zap.Error(err))
+		log.Fatalf("Failed to load statistics template: %v", err)
+	}
+
+	if config.RestoreURL != "" {
+		restored, err := service.RestoreRemote(context.Background(), config.RestoreURL)
+		if err != nil {
+			logger.Warn("Failed to restore from remote server, starting empty", zap.String("url", config.RestoreURL), zap.Error(err))
+		} else {
+			logger.Info("Restored metrics from remote server", zap.String("url", config.RestoreURL), zap.Int("metrics", restored))
+		}
+	}
 
-	service := service.New(stor, logger)
+	if config.Replica {
+		logger.Info("Running as read-only replica, metric updates are rejected")
+		if config.SecretKey == "" {
+			logger.Warn("SecretKey is not set, /import is disabled on the replica")
+		}
+	}
 
-	router := handler.New(service, middle, config.CryptoPath)
+	router := handler.New(service, middle, config)
+	router.SetBuildInfo(buildVersion, startTime)
 	router.RegisterRoutes()
 
 	// Создание канала для получения сигналов завершения работы
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
+	// SIGHUP перечитывает шаблон страницы статистики
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	// Фоновые горутины, завершения которых main ждет при остановке
+	var goroutines lifecycle.Group
+
 	// Запуск сервера в отдельной горутине
-	go func() {
+	goroutines.Go("server", func() {
 		if err := router.StartServer(config.ServerAddress); err != nil {
 			logger.Error("Failed to start server", zap.Error(err))
 			log.Fatalf("Failed to start server: %v", err)
 		}
-	}()
+	})
+
+	// Отправка снимка метрик на реплики
+	replicateCtx, stopReplication := context.WithCancel(context.Background())
+	defer stopReplication()
+	if len(config.ReplicaURLs) > 0 {
+		replicator := service.Replicator(config.ReplicaURLs, config.ReplicaInterval, config.SecretKey)
+		goroutines.Go("replication", func() {
+			replicator.Run(replicateCtx)
+		})
+		logger.Info("Replicating metrics", zap.Strings("replicas", config.ReplicaURLs), zap.Duration("interval", config.ReplicaInterval))
+	}
 
-	go func() {
+	pprofServer := &http.Server{Addr: ":6060"}
+	goroutines.Go("pprof", func() {
 		logger.Info("Starting ppof server on :6060")
-		if err := http.ListenAndServe(":6060", nil); err != nil {
+		if err := pprofServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			logger.Error("Failed to start pprof server", zap.Error(err))
 			log.Fatalf("Failed to start pprof server: %v", err)
 		}
-	}()
+	})
 
 	// Ожидание сигнала завершения работы
-	<-stop
+	for waiting := true; waiting; {
+		select {
+		case <-reload:
+			if err := service.ReloadTemplate(); err != nil {
+				logger.Error("Failed to reload statistics template", zap.Error(err))
+			} else {
+				logger.Info("Statistics template reloaded")
+			}
+		case <-stop:
+			waiting = false
+		}
+	}
 
-	// Создание контекста с тайм-аутом для завершения работы сервера
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	stopReplication()
 
-	if err := stor.Stop(); err != nil {
+	// Каждому шагу остановки отводится свое время ShutdownTimeout.
+	// Сохранение хранилища не прерывается, а только отмечается в логе, если оно затянулось
+	storageCtx, cancelStorage := shutdownContext(config)
+	defer cancelStorage()
+	err = lifecycle.StopWithin(storageCtx, stor.Stop, func() {
+		logger.Warn("Storage stop takes longer than shutdown timeout, waiting for it to finish",
+			zap.Duration("timeout", config.ShutdownTimeout))
+	})
+	if err != nil {
 		logger.Error("Failed to stop storage", zap.Error(err))
 	}
 
@@ -83,10 +159,45 @@ func main() {
 	logger.Info("Shutting down server...")
 
 	// Завершение работы сервера
-	if err := router.StopServer(ctx); err != nil {
+	serverCtx, cancelServer := shutdownContext(config)
+	defer cancelServer()
+	if err := router.StopServer(serverCtx); err != nil {
 		logger.Error("Server forced to shutdown", zap.Error(err))
-		log.Fatalf("Server forced to shutdown: %v", err)
+	}
+
+	pprofCtx, cancelPprof := shutdownContext(config)
+	defer cancelPprof()
+	if err := pprofServer.Shutdown(pprofCtx); err != nil {
+		logger.Error("Failed to stop pprof server", zap.Error(err))
+	}
+
+	waitCtx, cancelWait := shutdownContext(config)
+	defer cancelWait()
+	if stuck := goroutines.Wait(waitCtx); len(stuck) > 0 {
+		logger.Error("Goroutines did not finish before shutdown deadline", zap.Strings("goroutines", stuck))
 	}
 
 	logger.Info("Server exiting")
 }
+
+// shutdownContext создает контекст с тайм-аутом для одного шага остановки сервера
+func shutdownContext(config *flags.Config) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), config.ShutdownTimeout)
+}
+
+// validateCommand загружает и проверяет конфигурацию и возвращает код завершения
+func validateCommand(args []string) int {
+	os.Args = append([]string{os.Args[0]}, args...)
+
+	config, err := flags.Load()
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		return 1
+	}
+
+	fmt.Println("configuration is valid")
+	return 0
+}
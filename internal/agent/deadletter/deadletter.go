@@ -0,0 +1,100 @@
+// Package deadletter сохраняет в файл метрики, которые агент не смог доставить
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+// Entry запись файла недоставленных метрик, одна строка JSON на каждую потерю
+type Entry struct {
+	Time    time.Time         `json:"time"`
+	Reason  string            `json:"reason"`
+	Metrics []metrics.Metrics `json:"metrics"`
+}
+
+// Writer дописывает недоставленные метрики в файл. Когда файл превышает maxSize,
+// он переименовывается в path.1, предыдущая копия перезаписывается
+type Writer struct {
+	mu      sync.Mutex
+	path    string // пустой путь отключает запись
+	maxSize int64  // размер файла в байтах, после которого он ротируется, 0 - без ротации
+}
+
+// Default общий файл недоставленных метрик агента, по умолчанию отключен
+var Default = &Writer{}
+
+// New создает запись недоставленных метрик в файл path
+func New(path string, maxSize int64) *Writer {
+	return &Writer{path: path, maxSize: maxSize}
+}
+
+// Configure задает путь к файлу и размер ротации, пустой путь отключает запись
+func (w *Writer) Configure(path string, maxSize int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.path = path
+	w.maxSize = maxSize
+}
+
+// Write дописывает метрики, потерянные по причине reason
+func (w *Writer) Write(reason string, metricsData []metrics.Metrics) error {
+	if len(metricsData) == 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.path == "" {
+		return nil
+	}
+
+	line, err := json.Marshal(Entry{Time: time.Now(), Reason: reason, Metrics: metricsData})
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead-letter entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	if err := w.rotate(int64(len(line))); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+	_, err = file.Write(line)
+	return errors.Join(err, file.Close())
+}
+
+// rotate переименовывает файл, если запись size байт превысит maxSize.
+// Вызывается под блокировкой
+func (w *Writer) rotate(size int64) error {
+	if w.maxSize <= 0 {
+		return nil
+	}
+
+	info, err := os.Stat(w.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat dead-letter file: %w", err)
+	}
+	if info.Size() == 0 || info.Size()+size <= w.maxSize {
+		return nil
+	}
+
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate dead-letter file: %w", err)
+	}
+	return nil
+}
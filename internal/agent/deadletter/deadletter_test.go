@@ -0,0 +1,67 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+// readEntries читает все записи файла недоставленных метрик
+func readEntries(t *testing.T, path string) []Entry {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry Entry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	assert.NoError(t, scanner.Err())
+	return entries
+}
+
+func TestWriter(t *testing.T) {
+	value := 1.5
+	batch := []metrics.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}}
+
+	t.Run("Entries appended", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dead.jsonl")
+		w := New(path, 0)
+
+		assert.NoError(t, w.Write("send_failed", batch))
+		assert.NoError(t, w.Write("backpressure", batch))
+
+		entries := readEntries(t, path)
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, "send_failed", entries[0].Reason)
+			assert.Equal(t, "backpressure", entries[1].Reason)
+			assert.Equal(t, batch, entries[1].Metrics)
+		}
+	})
+
+	t.Run("Rotated when full", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dead.jsonl")
+		w := New(path, 150)
+
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, w.Write("send_failed", batch))
+		}
+
+		assert.Len(t, readEntries(t, path), 1)
+		assert.Len(t, readEntries(t, path+".1"), 1, "only the latest rotated file is kept")
+	})
+
+	t.Run("Disabled without path", func(t *testing.T) {
+		assert.NoError(t, New("", 0).Write("send_failed", batch))
+	})
+}
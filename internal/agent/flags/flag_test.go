@@ -35,3 +35,74 @@ func TestNewConfig(t *testing.T) {
 	os.Unsetenv("REPORT_INTERVAL")
 	os.Unsetenv("POLL_INTERVAL")
 }
+
+func TestGetLabels(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set("Labels", "host=web1, env = prod,broken,,=empty")
+	assert.Equal(t, map[string]string{"host": "web1", "env": "prod"}, GetLabels())
+
+	viper.Set("Labels", "")
+	assert.Empty(t, GetLabels())
+}
+
+func TestGetRetryDelay(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	for value, want := range map[string]time.Duration{
+		"2":     2 * time.Second,
+		"500ms": 500 * time.Millisecond,
+		"1m":    time.Minute,
+		"soon":  0,
+	} {
+		viper.Set("RetryDelay", value)
+		assert.Equal(t, want, GetRetryDelay(), value)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, (&Config{MaxRetries: 2, RetryDelay: time.Second}).Validate())
+	// Без повторов задержка не используется
+	assert.NoError(t, (&Config{}).Validate())
+
+	err := (&Config{MaxRetries: -1}).Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "MaxRetries")
+	}
+
+	err = (&Config{MaxRetries: 1}).Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "RetryDelay")
+	}
+
+	assert.NoError(t, (&Config{QueuePolicy: "block"}).Validate())
+	err = (&Config{QueuePolicy: "drop-newest"}).Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "QueuePolicy")
+	}
+
+	assert.NoError(t, (&Config{Compression: "deflate"}).Validate())
+	err = (&Config{Compression: "brotli"}).Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Compression")
+	}
+
+	assert.NoError(t, (&Config{ReportMode: "json"}).Validate())
+	err = (&Config{ReportMode: "stream"}).Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "ReportMode")
+	}
+}
+
+func TestGetCompressionNoGzip(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set("Compression", "deflate")
+	assert.Equal(t, "deflate", GetCompression())
+
+	viper.Set("no-gzip", true)
+	assert.Equal(t, "none", GetCompression())
+}
@@ -1,7 +1,10 @@
 package flags
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,20 +21,63 @@ type Config struct {
 	SecretKey       string
 	RateLimit       int
 	CryptoPath      string
+	BatchSize       int
+	PollOnly        bool
+	QueueSize       int
+	QueuePolicy     string
+	UserAgent       string
+	Compression     string
+	RetryBudget     time.Duration
+	MaxRetries      int
+	RetryDelay      time.Duration
+	ChangedOnly     bool
+	Labels          map[string]string
+	DebugAddress    string
+	ReportMode      string
+	NoSelfTest      bool
+	DeadLetterFile  string
+	DeadLetterSize  int64
+	LocalAddress    string
+	MetricPrefix    string
+	TailFile        string
 }
 
 // GetFlags устанавливает и получает флаги
 func GetFlags() {
 	// Define the flags and bind them to viper
-	pflag.StringP("ServerAddress", "a", "localhost:8080", "HTTP server network address")
+	pflag.StringP("ServerAddress", "a", "localhost:8080", "HTTP server network address or unix:///path to a socket")
 	pflag.IntP("ReportInterval", "r", 10, "Interval between fetching reportable metrics in seconds")
 	pflag.IntP("PollInterval", "p", 2, "Interval between polling metrics in seconds")
 	pflag.StringP("AgentLogName", "m", "agentlog.log", "Agent log file name")
 	pflag.StringP("Key", "k", "", "Key for the server")
 	pflag.IntP("RateLimit", "l", 0, "Rate limit for the server")
 	pflag.String("crypto-key", "", "Crypto key file path")
+	pflag.Int("BatchSize", 0, "Maximum number of metrics per batch request, 0 disables chunking")
+	pflag.Bool("PollOnly", false, "Only poll and log metrics without reporting them to the server")
+	pflag.Int("QueueSize", 10, "Maximum number of polled snapshots waiting to be reported")
+	pflag.String("QueuePolicy", "drop-oldest", "Snapshot queue overflow policy: drop-oldest or block")
+	pflag.String("UserAgent", "", "User-Agent header for requests, defaults to the agent build version")
+	pflag.String("Compression", "gzip", "Request body compression: gzip, deflate or none")
+	pflag.Int("RetryBudget", 0, "Time budget in seconds for retries within one report cycle, 0 disables the budget")
+	pflag.Int("MaxRetries", 2, "Maximum number of retries after a failed request, 0 disables retries")
+	pflag.String("RetryDelay", "1s", "Delay before the first retry, e.g. 500ms or 2s, a bare number is seconds; each next retry waits twice that delay longer")
+	pflag.Bool("ChangedOnly", false, "Report only gauges changed since the last successful report, counters are always sent")
+	pflag.Bool("no-gzip", false, "Deprecated alias of --Compression=none")
+	pflag.Bool("no-self-test", false, "Skip sending a probe metric at startup")
+	pflag.String("DebugAddress", "", "Address of the debug HTTP server exposing /config and /metrics, empty disables it")
+	pflag.String("ReportMode", "batch", "How metrics are reported: batch, single (one URL request per metric) or json (one JSON request per metric)")
+	pflag.String("DeadLetterFile", "", "JSON lines file for metrics dropped after all retries or on queue overflow, empty disables it")
+	pflag.Int("DeadLetterMaxSize", 10, "Dead-letter file size in megabytes after which it is rotated, 0 disables rotation")
+	pflag.String("MetricPrefix", "", "Prefix added to the names of all reported metrics, e.g. myapp.")
+	pflag.String("TailFile", "", "JSON or NDJSON file to watch, metrics appended to it are reported, empty disables it")
+	pflag.String("LocalAddress", "", "Local IP address outgoing connections to the server are made from, empty lets the system choose")
+	pflag.String("Labels", "", "Comma-separated key=value labels added to every reported metric, e.g. host=web1,env=prod")
 	pflag.StringP("config", "c", "", "Path to the configuration file")
 
+	if err := pflag.CommandLine.MarkDeprecated("no-gzip", "use --Compression=none instead"); err != nil {
+		log.Println(err)
+	}
+
 	// Parse the command-line flags
 	pflag.Parse()
 
@@ -50,6 +96,26 @@ func GetFlags() {
 	bindFlagToViper("Key")
 	bindFlagToViper("RateLimit")
 	bindFlagToViper("crypto-key")
+	bindFlagToViper("BatchSize")
+	bindFlagToViper("PollOnly")
+	bindFlagToViper("QueueSize")
+	bindFlagToViper("QueuePolicy")
+	bindFlagToViper("UserAgent")
+	bindFlagToViper("Compression")
+	bindFlagToViper("RetryBudget")
+	bindFlagToViper("MaxRetries")
+	bindFlagToViper("RetryDelay")
+	bindFlagToViper("ChangedOnly")
+	bindFlagToViper("no-gzip")
+	bindFlagToViper("no-self-test")
+	bindFlagToViper("Labels")
+	bindFlagToViper("DebugAddress")
+	bindFlagToViper("ReportMode")
+	bindFlagToViper("DeadLetterFile")
+	bindFlagToViper("DeadLetterMaxSize")
+	bindFlagToViper("LocalAddress")
+	bindFlagToViper("MetricPrefix")
+	bindFlagToViper("TailFile")
 	bindFlagToViper("config")
 
 	// Set the environment variable names
@@ -61,6 +127,26 @@ func GetFlags() {
 	bindEnvToViper("Key", "KEY")
 	bindEnvToViper("RateLimit", "RATE_LIMIT")
 	bindEnvToViper("crypto-key", "CRYPTO_KEY")
+	bindEnvToViper("BatchSize", "BATCH_SIZE")
+	bindEnvToViper("PollOnly", "POLL_ONLY")
+	bindEnvToViper("QueueSize", "QUEUE_SIZE")
+	bindEnvToViper("QueuePolicy", "QUEUE_POLICY")
+	bindEnvToViper("UserAgent", "USER_AGENT")
+	bindEnvToViper("Compression", "COMPRESSION")
+	bindEnvToViper("RetryBudget", "RETRY_BUDGET")
+	bindEnvToViper("MaxRetries", "MAX_RETRIES")
+	bindEnvToViper("RetryDelay", "RETRY_DELAY")
+	bindEnvToViper("ChangedOnly", "CHANGED_ONLY")
+	bindEnvToViper("no-gzip", "NO_GZIP")
+	bindEnvToViper("no-self-test", "NO_SELF_TEST")
+	bindEnvToViper("Labels", "LABELS")
+	bindEnvToViper("DebugAddress", "DEBUG_ADDRESS")
+	bindEnvToViper("ReportMode", "REPORT_MODE")
+	bindEnvToViper("DeadLetterFile", "DEAD_LETTER_FILE")
+	bindEnvToViper("DeadLetterMaxSize", "DEAD_LETTER_MAX_SIZE")
+	bindEnvToViper("LocalAddress", "LOCAL_ADDRESS")
+	bindEnvToViper("MetricPrefix", "METRIC_PREFIX")
+	bindEnvToViper("TailFile", "TAIL_FILE")
 	bindEnvToViper("config", "CONFIG")
 
 	configFile := viper.GetString("config")
@@ -92,6 +178,22 @@ func bindEnvToViper(viperKey, envKey string) {
 // NewConfig создает новую конфигурацию
 func NewConfig() *Config {
 	GetFlags()
+	return load()
+}
+
+// Reload перечитывает файл конфигурации и переменные окружения и возвращает новую конфигурацию.
+// Флаги командной строки разбираются один раз при запуске в NewConfig
+func Reload() *Config {
+	if configFile := viper.GetString("config"); configFile != "" {
+		if err := viper.ReadInConfig(); err != nil {
+			log.Println(err)
+		}
+	}
+	return load()
+}
+
+// load собирает конфигурацию из текущих значений viper
+func load() *Config {
 	return &Config{
 		ServerAddress:   GetServerAddress(),
 		ReportInterval:  GetReportInterval(),
@@ -100,14 +202,179 @@ func NewConfig() *Config {
 		SecretKey:       GetKey(),
 		RateLimit:       GetRateLimit(),
 		CryptoPath:      CryptoPath(),
+		BatchSize:       GetBatchSize(),
+		PollOnly:        GetPollOnly(),
+		QueueSize:       GetQueueSize(),
+		QueuePolicy:     GetQueuePolicy(),
+		UserAgent:       GetUserAgent(),
+		Compression:     GetCompression(),
+		RetryBudget:     GetRetryBudget(),
+		MaxRetries:      GetMaxRetries(),
+		RetryDelay:      GetRetryDelay(),
+		ChangedOnly:     GetChangedOnly(),
+		Labels:          GetLabels(),
+		DebugAddress:    GetDebugAddress(),
+		ReportMode:      GetReportMode(),
+		NoSelfTest:      GetNoSelfTest(),
+		DeadLetterFile:  GetDeadLetterFile(),
+		DeadLetterSize:  GetDeadLetterSize(),
+		LocalAddress:    GetLocalAddress(),
+		MetricPrefix:    GetMetricPrefix(),
+		TailFile:        GetTailFile(),
 	}
 }
 
+// Validate проверяет конфигурацию и возвращает все найденные ошибки
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("MaxRetries must not be negative, got %d", c.MaxRetries))
+	}
+	if c.MaxRetries > 0 && c.RetryDelay <= 0 {
+		errs = append(errs, fmt.Errorf("RetryDelay must be positive when retries are enabled, got %s", c.RetryDelay))
+	}
+	if err := checkOneOf("QueuePolicy", c.QueuePolicy, "drop-oldest", "block"); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkOneOf("Compression", c.Compression, "gzip", "deflate", "none"); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkOneOf("ReportMode", c.ReportMode, "batch", "single", "json"); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkOneOf проверяет, что значение параметра name входит в allowed.
+// Пустое значение допустимо и означает значение по умолчанию
+func checkOneOf(name, value string, allowed ...string) error {
+	if value == "" {
+		return nil
+	}
+	for _, v := range allowed {
+		if value == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s must be one of %s, got %q", name, strings.Join(allowed, ", "), value)
+}
+
+// redacted заменяет значение секретных полей при выводе конфигурации
+const redacted = "[REDACTED]"
+
+// Redacted возвращает копию конфигурации, в которой скрыты секретные значения
+func (c Config) Redacted() Config {
+	if c.SecretKey != "" {
+		c.SecretKey = redacted
+	}
+	return c
+}
+
 // GetRateLimit возвращает ограничение скорости
 func GetRateLimit() int {
 	return viper.GetInt("RateLimit")
 }
 
+// GetBatchSize возвращает максимальное количество метрик в одном пакете
+func GetBatchSize() int {
+	return viper.GetInt("BatchSize")
+}
+
+// GetPollOnly возвращает флаг режима только сбора метрик
+func GetPollOnly() bool {
+	return viper.GetBool("PollOnly")
+}
+
+// GetQueueSize возвращает размер очереди снимков метрик
+func GetQueueSize() int {
+	return viper.GetInt("QueueSize")
+}
+
+// GetQueuePolicy возвращает политику переполнения очереди снимков метрик
+func GetQueuePolicy() string {
+	return viper.GetString("QueuePolicy")
+}
+
+// GetReportMode возвращает способ отправки метрик: batch, single или json
+func GetReportMode() string {
+	return viper.GetString("ReportMode")
+}
+
+// GetChangedOnly возвращает флаг отправки только изменившихся gauge-метрик
+func GetChangedOnly() bool {
+	return viper.GetBool("ChangedOnly")
+}
+
+// GetDeadLetterFile возвращает путь к файлу недоставленных метрик
+func GetDeadLetterFile() string {
+	return viper.GetString("DeadLetterFile")
+}
+
+// GetDeadLetterSize возвращает размер файла недоставленных метрик в байтах, после которого он ротируется
+func GetDeadLetterSize() int64 {
+	return viper.GetInt64("DeadLetterMaxSize") << 20
+}
+
+// GetLocalAddress возвращает локальный адрес, с которого устанавливаются соединения с сервером
+func GetLocalAddress() string {
+	return viper.GetString("LocalAddress")
+}
+
+// GetMetricPrefix возвращает префикс имен отправляемых метрик
+func GetMetricPrefix() string {
+	return viper.GetString("MetricPrefix")
+}
+
+// GetTailFile возвращает путь к файлу, дописанные в который метрики отправляются на сервер
+func GetTailFile() string {
+	return viper.GetString("TailFile")
+}
+
+// GetNoSelfTest возвращает флаг пропуска проверочной отправки при запуске
+func GetNoSelfTest() bool {
+	return viper.GetBool("no-self-test")
+}
+
+// GetDebugAddress возвращает адрес отладочного HTTP-сервера агента
+func GetDebugAddress() string {
+	return viper.GetString("DebugAddress")
+}
+
+// GetLabels возвращает метки, добавляемые агентом ко всем метрикам.
+// Значение задается списком key=value через запятую, некорректные элементы пропускаются
+func GetLabels() map[string]string {
+	labels := make(map[string]string)
+	for _, entry := range strings.Split(viper.GetString("Labels"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			log.Printf("Skipping invalid label %q", entry)
+			continue
+		}
+		labels[key] = value
+	}
+	return labels
+}
+
+// GetUserAgent возвращает значение заголовка User-Agent
+func GetUserAgent() string {
+	return viper.GetString("UserAgent")
+}
+
+// GetCompression возвращает режим сжатия тела запроса.
+// Устаревший флаг no-gzip равнозначен Compression=none
+func GetCompression() string {
+	if viper.GetBool("no-gzip") {
+		return "none"
+	}
+	return viper.GetString("Compression")
+}
+
 // GetKey возвращает ключ
 func GetKey() string {
 	return viper.GetString("Key")
@@ -123,6 +390,32 @@ func GetServerAddress() string {
 	return viper.GetString("ServerAddress")
 }
 
+// GetRetryBudget возвращает бюджет времени на повторные попытки в одном цикле отправки
+func GetRetryBudget() time.Duration {
+	return time.Duration(viper.GetInt("RetryBudget")) * time.Second
+}
+
+// GetMaxRetries возвращает максимальное количество попыток отправки запроса
+func GetMaxRetries() int {
+	return viper.GetInt("MaxRetries")
+}
+
+// GetRetryDelay возвращает задержку перед первой повторной попыткой.
+// Значение задается длительностью, например 500ms, число без единиц считается секундами.
+// Некорректное значение возвращается как 0 и отклоняется Validate
+func GetRetryDelay() time.Duration {
+	value := strings.TrimSpace(viper.GetString("RetryDelay"))
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid RetryDelay %q: %v", value, err)
+		return 0
+	}
+	return delay
+}
+
 // GetReportInterval возвращает интервал для отправки метрик
 func GetReportInterval() time.Duration {
 	return time.Duration(viper.GetInt("ReportInterval")) * time.Second
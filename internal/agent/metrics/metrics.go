@@ -13,4 +13,6 @@ type Metrics struct {
 	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
 	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
 	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+
+	Labels map[string]string `json:"labels,omitempty"` // метки метрики, например host или env
 }
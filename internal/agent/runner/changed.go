@@ -0,0 +1,72 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+// sendReport отправляет пакет метрик с метками по умолчанию и префиксом имен. В режиме ChangedOnly gauge-метрики,
+// не изменившиеся с последней успешной отправки, пропускаются
+func (a *Agent) sendReport(ctx context.Context, allMetrics []metrics.Metrics) {
+	cfg := a.cfg()
+	batch := withPrefix(withLabels(coalesce(allMetrics), cfg.Labels), cfg.MetricPrefix)
+	a.setLastSnapshot(batch)
+	if !cfg.ChangedOnly {
+		_ = a.send(ctx, cfg, batch)
+		return
+	}
+
+	batch = a.changedOnly(batch)
+	if len(batch) == 0 {
+		return
+	}
+
+	// Значения запоминаются, только если сервер принял весь пакет
+	if err := a.send(ctx, cfg, batch); err == nil {
+		a.rememberReported(batch)
+	}
+}
+
+// reportKey возвращает ключ метрики для сравнения с последней отправкой: имя вместе с метками.
+// JSON сортирует метки и экранирует значения, поэтому разные наборы меток не совпадают
+func reportKey(metric metrics.Metrics) string {
+	key, _ := json.Marshal(struct {
+		ID     string            `json:"id"`
+		Labels map[string]string `json:"labels,omitempty"`
+	}{metric.ID, metric.Labels})
+	return string(key)
+}
+
+// changedOnly оставляет counter-метрики и gauge-метрики, значение которых отличается от последнего отправленного
+func (a *Agent) changedOnly(batch []metrics.Metrics) []metrics.Metrics {
+	a.reportedMu.Lock()
+	defer a.reportedMu.Unlock()
+
+	changed := make([]metrics.Metrics, 0, len(batch))
+	for _, metric := range batch {
+		if metric.MType == "gauge" && metric.Value != nil {
+			if last, ok := a.reported[reportKey(metric)]; ok && last == *metric.Value {
+				continue
+			}
+		}
+		changed = append(changed, metric)
+	}
+	return changed
+}
+
+// rememberReported запоминает значения успешно отправленных gauge-метрик
+func (a *Agent) rememberReported(batch []metrics.Metrics) {
+	a.reportedMu.Lock()
+	defer a.reportedMu.Unlock()
+
+	if a.reported == nil {
+		a.reported = make(map[string]float64)
+	}
+	for _, metric := range batch {
+		if metric.MType == "gauge" && metric.Value != nil {
+			a.reported[reportKey(metric)] = *metric.Value
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package runner
+
+import "github.com/vova4o/yandexadv/internal/agent/metrics"
+
+// coalesce объединяет повторы метрик перед отправкой: для gauge остается последнее значение,
+// дельты counter суммируются. Порядок метрик соответствует первому появлению
+func coalesce(batch []metrics.Metrics) []metrics.Metrics {
+	result := make([]metrics.Metrics, 0, len(batch))
+	index := make(map[string]int, len(batch))
+
+	for _, metric := range batch {
+		key := metric.MType + ":" + metric.ID
+		i, seen := index[key]
+		if !seen {
+			index[key] = len(result)
+			result = append(result, copyMetric(metric))
+			continue
+		}
+
+		switch metric.MType {
+		case "counter":
+			if metric.Delta == nil {
+				continue
+			}
+			if result[i].Delta == nil {
+				result[i].Delta = new(int64)
+			}
+			*result[i].Delta += *metric.Delta
+		default:
+			result[i] = copyMetric(metric)
+		}
+	}
+
+	return result
+}
+
+// copyMetric копирует метрику вместе со значениями, чтобы суммирование не меняло исходные снимки
+func copyMetric(metric metrics.Metrics) metrics.Metrics {
+	if metric.Delta != nil {
+		delta := *metric.Delta
+		metric.Delta = &delta
+	}
+	if metric.Value != nil {
+		value := *metric.Value
+		metric.Value = &value
+	}
+	return metric
+}
@@ -0,0 +1,68 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// debugShutdownTimeout время на завершение отладочного сервера
+const debugShutdownTimeout = time.Second
+
+// DebugHandler возвращает обработчик отладочного сервера агента:
+// /config - текущая конфигурация без секретов, /metrics - последний снимок метрик
+func (a *Agent) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		writeDebugJSON(w, a.cfg().Redacted())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeDebugJSON(w, a.LastSnapshot())
+	})
+	return mux
+}
+
+// writeDebugJSON отдает значение в формате JSON
+func writeDebugJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ServeDebug запускает отладочный сервер на addr и останавливает его при отмене ctx
+func (a *Agent) ServeDebug(ctx context.Context, addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           a.DebugHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+	a.logger.Info("Debug server started", zap.String("address", addr))
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), debugShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
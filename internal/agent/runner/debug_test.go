@@ -0,0 +1,70 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vova4o/yandexadv/internal/agent/flags"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+func TestDebugHandler(t *testing.T) {
+	cfg := &flags.Config{ServerAddress: "localhost:8080", SecretKey: "secret", QueueSize: 1}
+	agent := New(cfg, newTestLogger(), SendFunc(func(context.Context, *flags.Config, []metrics.Metrics) error { return nil }))
+
+	value := 1.5
+	agent.setLastSnapshot([]metrics.Metrics{{ID: "Alloc", MType: "gauge", Value: &value}})
+
+	t.Run("Config is redacted", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		agent.DebugHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		assert.NotContains(t, w.Body.String(), "secret")
+
+		var got flags.Config
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+		assert.Equal(t, "localhost:8080", got.ServerAddress)
+		assert.Equal(t, "[REDACTED]", got.SecretKey)
+		assert.Equal(t, "secret", cfg.SecretKey, "running config must not change")
+	})
+
+	t.Run("Last snapshot", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		agent.DebugHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var got []metrics.Metrics
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+		if assert.Len(t, got, 1) {
+			assert.Equal(t, "Alloc", got[0].ID)
+			assert.Equal(t, value, *got[0].Value)
+		}
+	})
+}
+
+func TestServeDebugStopsWithContext(t *testing.T) {
+	agent := New(&flags.Config{QueueSize: 1}, newTestLogger(), SendFunc(func(context.Context, *flags.Config, []metrics.Metrics) error { return nil }))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- agent.ServeDebug(ctx, "127.0.0.1:0")
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("debug server did not stop")
+	}
+}
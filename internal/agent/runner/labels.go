@@ -0,0 +1,39 @@
+package runner
+
+import "github.com/vova4o/yandexadv/internal/agent/metrics"
+
+// withLabels добавляет метки по умолчанию к каждой метрике пакета.
+// Метки, уже заданные у метрики, имеют приоритет над метками по умолчанию
+func withLabels(batch []metrics.Metrics, defaults map[string]string) []metrics.Metrics {
+	if len(defaults) == 0 {
+		return batch
+	}
+
+	labeled := make([]metrics.Metrics, len(batch))
+	for i, metric := range batch {
+		labels := make(map[string]string, len(defaults)+len(metric.Labels))
+		for k, v := range defaults {
+			labels[k] = v
+		}
+		for k, v := range metric.Labels {
+			labels[k] = v
+		}
+		metric.Labels = labels
+		labeled[i] = metric
+	}
+	return labeled
+}
+
+// withPrefix добавляет префикс к именам метрик пакета. Пустой префикс оставляет пакет без изменений
+func withPrefix(batch []metrics.Metrics, prefix string) []metrics.Metrics {
+	if prefix == "" {
+		return batch
+	}
+
+	prefixed := make([]metrics.Metrics, len(batch))
+	for i, metric := range batch {
+		metric.ID = prefix + metric.ID
+		prefixed[i] = metric
+	}
+	return prefixed
+}
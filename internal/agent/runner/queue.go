@@ -0,0 +1,86 @@
+package runner
+
+import (
+	"context"
+	"sync"
+
+	"github.com/vova4o/yandexadv/internal/agent/deadletter"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+	"github.com/vova4o/yandexadv/internal/agent/stats"
+	"go.uber.org/zap"
+)
+
+// Политики поведения очереди снимков при переполнении
+const (
+	PolicyBlock      = "block"       // сборщик ждет, пока отправитель освободит место
+	PolicyDropOldest = "drop-oldest" // самый старый снимок выбрасывается
+)
+
+// snapshotQueue ограниченная очередь снимков метрик между сбором и отправкой
+type snapshotQueue struct {
+	ch     chan []metrics.Metrics
+	policy string
+	mu     sync.Mutex
+}
+
+// newSnapshotQueue создает очередь заданного размера
+func newSnapshotQueue(size int, policy string) *snapshotQueue {
+	if size <= 0 {
+		size = 1
+	}
+	return &snapshotQueue{
+		ch:     make(chan []metrics.Metrics, size),
+		policy: policy,
+	}
+}
+
+// push добавляет снимок в очередь и возвращает метрики из выброшенных снимков
+func (q *snapshotQueue) push(ctx context.Context, snapshot []metrics.Metrics) []metrics.Metrics {
+	if q.policy != PolicyDropOldest {
+		select {
+		case q.ch <- snapshot:
+		case <-ctx.Done():
+		}
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var dropped []metrics.Metrics
+	for {
+		select {
+		case q.ch <- snapshot:
+			return dropped
+		default:
+		}
+
+		select {
+		case old := <-q.ch:
+			dropped = append(dropped, old...)
+		default:
+		}
+	}
+}
+
+// drain забирает все накопленные снимки без ожидания
+func (q *snapshotQueue) drain() [][]metrics.Metrics {
+	var snapshots [][]metrics.Metrics
+	for {
+		select {
+		case snapshot := <-q.ch:
+			snapshots = append(snapshots, snapshot)
+		default:
+			return snapshots
+		}
+	}
+}
+
+// dropOverflow учитывает метрики, вытесненные из переполненной очереди,
+// и сохраняет их в файл недоставленных метрик
+func (a *Agent) dropOverflow(dropped []metrics.Metrics) {
+	a.drops.Add(stats.DropBackpressure, len(dropped))
+	if err := deadletter.Default.Write(stats.DropBackpressure, dropped); err != nil {
+		a.logger.Error("Failed to write dead-letter file", zap.Error(err))
+	}
+}
@@ -0,0 +1,68 @@
+package runner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+// snapshotWithID создает снимок из одной метрики для проверки порядка
+func snapshotWithID(id string) []metrics.Metrics {
+	return []metrics.Metrics{{ID: id, MType: "gauge"}}
+}
+
+func TestSnapshotQueueDropOldest(t *testing.T) {
+	q := newSnapshotQueue(2, PolicyDropOldest)
+
+	// Медленный потребитель забирает первый снимок и долго его обрабатывает
+	received := make(chan string, 1)
+	go func() {
+		snapshot := <-q.ch
+		received <- snapshot[0].ID
+		time.Sleep(time.Second)
+	}()
+
+	assert.Empty(t, q.push(context.Background(), snapshotWithID("s1")))
+	assert.Equal(t, "s1", <-received)
+
+	dropped := 0
+	done := make(chan struct{})
+	go func() {
+		for _, id := range []string{"s2", "s3", "s4", "s5", "s6"} {
+			dropped += len(q.push(context.Background(), snapshotWithID(id)))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("push blocked with drop-oldest policy")
+	}
+
+	rest := q.drain()
+	assert.Equal(t, 3, dropped)
+	assert.Len(t, rest, 2)
+	assert.Equal(t, "s5", rest[0][0].ID)
+	assert.Equal(t, "s6", rest[1][0].ID)
+}
+
+func TestSnapshotQueueBlock(t *testing.T) {
+	q := newSnapshotQueue(1, PolicyBlock)
+
+	assert.Empty(t, q.push(context.Background(), snapshotWithID("s1")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	assert.Empty(t, q.push(ctx, snapshotWithID("s2")))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	rest := q.drain()
+	assert.Len(t, rest, 1)
+	assert.Equal(t, "s1", rest[0][0].ID)
+}
@@ -0,0 +1,80 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/vova4o/yandexadv/internal/agent/flags"
+	"go.uber.org/zap"
+)
+
+// cfg возвращает текущую конфигурацию агента
+func (a *Agent) cfg() *flags.Config {
+	return a.config.Load()
+}
+
+// Reload применяет новую конфигурацию к работающему агенту.
+// Интервалы, ключ, адрес сервера и параметры отправки меняются на лету,
+// поля, требующие перезапуска, должны совпадать с текущими
+func (a *Agent) Reload(config *flags.Config) error {
+	if err := checkReload(a.cfg(), config); err != nil {
+		return err
+	}
+
+	a.config.Store(config)
+	select {
+	case a.reloaded <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// checkReload проверяет, что новая конфигурация может быть применена без перезапуска
+func checkReload(current, updated *flags.Config) error {
+	var errs []error
+	if err := updated.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if updated.PollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("PollInterval must be positive, got %s", updated.PollInterval))
+	}
+	if updated.ReportInterval <= 0 {
+		errs = append(errs, fmt.Errorf("ReportInterval must be positive, got %s", updated.ReportInterval))
+	}
+
+	for name, changed := range map[string]bool{
+		"RateLimit":         current.RateLimit != updated.RateLimit,
+		"PollOnly":          current.PollOnly != updated.PollOnly,
+		"QueueSize":         current.QueueSize != updated.QueueSize,
+		"QueuePolicy":       current.QueuePolicy != updated.QueuePolicy,
+		"AgentLogName":      current.AgenLogFileName != updated.AgenLogFileName,
+		"DebugAddress":      current.DebugAddress != updated.DebugAddress,
+		"DeadLetterFile":    current.DeadLetterFile != updated.DeadLetterFile,
+		"DeadLetterMaxSize": current.DeadLetterSize != updated.DeadLetterSize,
+		"LocalAddress":      current.LocalAddress != updated.LocalAddress,
+		"TailFile":          current.TailFile != updated.TailFile,
+	} {
+		if changed {
+			errs = append(errs, fmt.Errorf("%s cannot be changed without restart", name))
+		}
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// applyReload перезапускает таймеры с интервалами из новой конфигурации.
+// tickerReport равен nil в режиме PollOnly
+func (a *Agent) applyReload(tickerPoll, tickerReport *time.Ticker) {
+	cfg := a.cfg()
+	tickerPoll.Reset(cfg.PollInterval)
+	if tickerReport != nil {
+		tickerReport.Reset(cfg.ReportInterval)
+	}
+	a.logger.Info("Agent config reloaded",
+		zap.Duration("poll_interval", cfg.PollInterval),
+		zap.Duration("report_interval", cfg.ReportInterval),
+		zap.String("server_address", cfg.ServerAddress))
+}
@@ -0,0 +1,71 @@
+package runner
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vova4o/yandexadv/internal/agent/flags"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+func TestReloadReportInterval(t *testing.T) {
+	var sends atomic.Int64
+	var lastAddress atomic.Value
+	send := func(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+		sends.Add(1)
+		lastAddress.Store(cfg.ServerAddress)
+		return nil
+	}
+
+	cfg := &flags.Config{
+		ServerAddress:  "old:8080",
+		PollInterval:   10 * time.Millisecond,
+		ReportInterval: time.Hour,
+		QueueSize:      10,
+	}
+	agent := New(cfg, newTestLogger(), SendFunc(send))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		agent.Run(ctx)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, sends.Load(), "nothing is reported before the hourly interval")
+
+	updated := *cfg
+	updated.ServerAddress = "new:8080"
+	updated.ReportInterval = 20 * time.Millisecond
+	assert.NoError(t, agent.Reload(&updated))
+
+	assert.Eventually(t, func() bool { return sends.Load() > 0 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "new:8080", lastAddress.Load())
+
+	cancel()
+	<-done
+}
+
+func TestReloadRejectsImmutableFields(t *testing.T) {
+	cfg := &flags.Config{
+		PollInterval:   time.Second,
+		ReportInterval: time.Second,
+		QueueSize:      10,
+		RateLimit:      2,
+	}
+	agent := New(cfg, newTestLogger(), SendFunc(func(context.Context, *flags.Config, []metrics.Metrics) error { return nil }))
+
+	updated := *cfg
+	updated.RateLimit = 4
+	updated.ReportInterval = 0
+	err := agent.Reload(&updated)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "RateLimit cannot be changed without restart")
+		assert.Contains(t, err.Error(), "ReportInterval must be positive")
+	}
+	assert.Same(t, cfg, agent.cfg(), "rejected config must not be applied")
+}
@@ -0,0 +1,379 @@
+// Package runner содержит основной цикл агента: сбор метрик и их отправку на сервер
+package runner
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vova4o/yandexadv/internal/agent/collector"
+	"github.com/vova4o/yandexadv/internal/agent/flags"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+	"github.com/vova4o/yandexadv/internal/agent/stats"
+	"github.com/vova4o/yandexadv/package/logger"
+	"go.uber.org/zap"
+)
+
+// flushTimeout время на финальную отправку метрик при завершении работы
+const flushTimeout = 5 * time.Second
+
+// MetricSender интерфейс отправки метрик на сервер.
+// Методы возвращают ошибку, если хотя бы часть метрик не доставлена
+type MetricSender interface {
+	SendBatch(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error
+	Send(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error
+	SendJSON(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error
+}
+
+// SendFunc функция отправки метрик на сервер, реализующая MetricSender
+type SendFunc func(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error
+
+// SendBatch отправляет метрики пакетом
+func (f SendFunc) SendBatch(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	return f(ctx, cfg, metricsData)
+}
+
+// Send отправляет метрики по одной через URL
+func (f SendFunc) Send(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	return f(ctx, cfg, metricsData)
+}
+
+// SendJSON отправляет метрики по одной в формате JSON
+func (f SendFunc) SendJSON(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	return f(ctx, cfg, metricsData)
+}
+
+// Способы отправки метрик на сервер
+const (
+	ReportModeBatch  = "batch"  // все метрики одним запросом на /updates/
+	ReportModeSingle = "single" // по одному запросу через URL на каждую метрику
+	ReportModeJSON   = "json"   // по одному JSON-запросу на каждую метрику
+)
+
+// send отправляет метрики способом, выбранным в ReportMode.
+// Неизвестный способ отправляет метрики пакетом
+func (a *Agent) send(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	switch cfg.ReportMode {
+	case ReportModeSingle:
+		return a.sender.Send(ctx, cfg, metricsData)
+	case ReportModeJSON:
+		return a.sender.SendJSON(ctx, cfg, metricsData)
+	default:
+		return a.sender.SendBatch(ctx, cfg, metricsData)
+	}
+}
+
+// AllMetrics структура для хранения всех метрик
+type AllMetrics struct {
+	RuntimeMetrics    []metrics.Metrics `json:"runtime_metrics"`
+	AdditionalMetrics []metrics.Metrics `json:"additional_metrics"`
+}
+
+// Agent структура агента
+type Agent struct {
+	config    atomic.Pointer[flags.Config] // текущая конфигурация, заменяется при перезагрузке
+	reloaded  chan struct{}                // сигнал циклу агента применить новую конфигурацию
+	logger    *logger.Logger
+	sender    MetricSender
+	drops     *stats.DropStats
+	queue     *snapshotQueue
+	pollCount int64
+	mu        sync.Mutex
+
+	reported   map[string]float64 // последние успешно отправленные значения gauge-метрик по reportKey
+	reportedMu sync.Mutex
+
+	last   []metrics.Metrics // последний отправленный снимок метрик для отладочного сервера
+	lastMu sync.Mutex
+}
+
+// New создает нового агента
+func New(config *flags.Config, logger *logger.Logger, sender MetricSender) *Agent {
+	a := &Agent{
+		reloaded: make(chan struct{}, 1),
+		logger:   logger,
+		sender:   sender,
+		drops:    stats.Drops,
+		queue:    newSnapshotQueue(config.QueueSize, config.QueuePolicy),
+	}
+	a.config.Store(config)
+	return a
+}
+
+// Run запускает сбор и отправку метрик до отмены контекста.
+// При отмене контекста накопленные метрики отправляются в последний раз
+func (a *Agent) Run(ctx context.Context) {
+	cfg := a.cfg()
+	tickerPoll := time.NewTicker(cfg.PollInterval)
+	defer tickerPoll.Stop()
+
+	if cfg.PollOnly {
+		a.runPollOnly(ctx, tickerPoll)
+		return
+	}
+
+	tickerReport := time.NewTicker(cfg.ReportInterval)
+	defer tickerReport.Stop()
+
+	if cfg.RateLimit == 0 {
+		a.runSequential(ctx, tickerPoll, tickerReport)
+		return
+	}
+	a.runWorkers(ctx, tickerPoll, tickerReport)
+}
+
+// runPollOnly только собирает и логирует метрики, ничего не отправляя на сервер
+func (a *Agent) runPollOnly(ctx context.Context, tickerPoll *time.Ticker) {
+	a.logger.Info("Poll-only mode: metrics will not be reported")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.reloaded:
+			a.applyReload(tickerPoll, nil)
+		case <-tickerPoll.C:
+			allMetrics := a.poll()
+			a.setLastSnapshot(allMetrics)
+			a.logger.Info("Polled metrics", zap.Int("count", len(allMetrics)), zap.Any("metrics", allMetrics))
+		}
+	}
+}
+
+// runSequential собирает снимки метрик в ограниченную очередь
+// и отправляет накопленное по таймеру отчета
+func (a *Agent) runSequential(ctx context.Context, tickerPoll, tickerReport *time.Ticker) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tickerPoll.C:
+				a.dropOverflow(a.queue.push(ctx, a.poll()))
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			a.flush()
+			return
+		case <-a.reloaded:
+			a.applyReload(tickerPoll, tickerReport)
+		case <-tickerReport.C:
+			a.report(ctx, a.queue.drain())
+		}
+	}
+}
+
+// flush выполняет финальную отправку накопленных метрик с ограничением по времени.
+// Контекст агента к этому моменту отменен, поэтому отправка идет с отдельным таймаутом
+func (a *Agent) flush() {
+	a.logger.Info("Flushing pending metrics before shutdown")
+
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.report(ctx, a.queue.drain())
+	}()
+
+	select {
+	case <-done:
+		a.logger.Info("Pending metrics flushed")
+	case <-ctx.Done():
+		a.logger.Error("Timed out flushing pending metrics")
+	}
+}
+
+// report отправляет накопленные снимки метрик вместе с метриками агента
+func (a *Agent) report(ctx context.Context, snapshots [][]metrics.Metrics) {
+	var allMetrics []metrics.Metrics
+	for _, snapshot := range snapshots {
+		allMetrics = append(allMetrics, snapshot...)
+	}
+	if len(allMetrics) == 0 {
+		allMetrics = a.collect()
+	}
+
+	allMetrics = append(allMetrics, stats.Default.Metrics()...)
+	a.sendReport(ctx, allMetrics)
+
+	a.logger.Info("Dropped metrics", zap.Int64("total", a.drops.Total()), zap.Any("by_reason", a.drops.Snapshot()))
+}
+
+// runWorkers новый способ отправки метрик с использованием горутин и каналов
+func (a *Agent) runWorkers(ctx context.Context, tickerPoll, tickerReport *time.Ticker) {
+	// RateLimit не меняется при перезагрузке конфигурации
+	rateLimit := a.cfg().RateLimit
+	metricsChan := make(chan AllMetrics, rateLimit)
+	var wg sync.WaitGroup
+
+	// Отправки воркеров не прерываются отменой ctx: после нее метрики, оставшиеся в канале,
+	// и финальный снимок отправляются с общим ограничением flushTimeout
+	sendCtx, cancelSend := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelSend()
+
+	// Запускаем воркеры
+	for i := 0; i < rateLimit; i++ {
+		wg.Add(1)
+		go a.worker(sendCtx, metricsChan, &wg)
+	}
+
+	// Завершение: сначала сборщики, затем воркеры, затем финальная отправка
+	var pollWg sync.WaitGroup
+	stop := func() {
+		a.logger.Info("Flushing pending metrics before shutdown")
+		timer := time.AfterFunc(flushTimeout, cancelSend)
+		defer timer.Stop()
+
+		pollWg.Wait()
+		close(metricsChan)
+		wg.Wait()
+		a.report(sendCtx, a.queue.drain())
+
+		if sendCtx.Err() != nil {
+			a.logger.Error("Timed out flushing pending metrics")
+			return
+		}
+		a.logger.Info("Pending metrics flushed")
+	}
+
+	// Горутина для сбора runtime метрик
+	pollWg.Add(1)
+	go func() {
+		defer pollWg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tickerPoll.C:
+				a.mu.Lock()
+				a.pollCount++
+				runtimeMetrics := collector.CollectMetrics(a.pollCount)
+				a.mu.Unlock()
+
+				select {
+				case metricsChan <- AllMetrics{RuntimeMetrics: runtimeMetrics}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	// Горутина для сбора дополнительных метрик
+	pollWg.Add(1)
+	go func() {
+		defer pollWg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tickerPoll.C:
+				a.mu.Lock()
+				additionalMetrics := collector.CollectCPUAndMemMetrics(a.pollCount)
+				a.mu.Unlock()
+
+				select {
+				case metricsChan <- AllMetrics{AdditionalMetrics: additionalMetrics}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	// Отправка метрик на сервер
+	for {
+		select {
+		case <-ctx.Done():
+			stop()
+			return
+		case <-a.reloaded:
+			a.applyReload(tickerPoll, tickerReport)
+		case <-tickerReport.C:
+			var combinedMetrics AllMetrics
+			for i := 0; i < rateLimit; i++ {
+				select {
+				case metrics := <-metricsChan:
+					combinedMetrics.RuntimeMetrics = append(combinedMetrics.RuntimeMetrics, metrics.RuntimeMetrics...)
+					combinedMetrics.AdditionalMetrics = append(combinedMetrics.AdditionalMetrics, metrics.AdditionalMetrics...)
+				case <-ctx.Done():
+					stop()
+					return
+				}
+			}
+
+			allMetrics := append(combinedMetrics.RuntimeMetrics, combinedMetrics.AdditionalMetrics...)
+			allMetrics = append(allMetrics, stats.Default.Metrics()...)
+			a.sendReport(ctx, allMetrics)
+		}
+	}
+}
+
+// worker отправляет метрики, полученные из канала, до его закрытия.
+// Отмена ctx прерывает отправку, которая выполняется в этот момент
+func (a *Agent) worker(ctx context.Context, metricsChan chan AllMetrics, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for metrics := range metricsChan {
+		allMetrics := append(metrics.RuntimeMetrics, metrics.AdditionalMetrics...)
+		allMetrics = append(allMetrics, stats.Default.Metrics()...)
+		a.sendReport(ctx, allMetrics)
+	}
+}
+
+// poll увеличивает счетчик опросов и собирает метрики
+func (a *Agent) poll() []metrics.Metrics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.pollCount++
+	runtimeMetrics := collector.CollectMetrics(a.pollCount)
+	additionalMetrics := collector.CollectCPUAndMemMetrics(a.pollCount)
+
+	return append(runtimeMetrics, additionalMetrics...)
+}
+
+// collect собирает метрики без увеличения счетчика опросов
+func (a *Agent) collect() []metrics.Metrics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	runtimeMetrics := collector.CollectMetrics(a.pollCount)
+	additionalMetrics := collector.CollectCPUAndMemMetrics(a.pollCount)
+
+	return append(runtimeMetrics, additionalMetrics...)
+}
+
+// setLastSnapshot запоминает последний снимок метрик
+func (a *Agent) setLastSnapshot(snapshot []metrics.Metrics) {
+	a.lastMu.Lock()
+	defer a.lastMu.Unlock()
+
+	a.last = snapshot
+}
+
+// LastSnapshot возвращает последний отправленный снимок метрик,
+// в режиме PollOnly - последний собранный
+func (a *Agent) LastSnapshot() []metrics.Metrics {
+	a.lastMu.Lock()
+	defer a.lastMu.Unlock()
+
+	return append([]metrics.Metrics(nil), a.last...)
+}
+
+// PollCount возвращает количество выполненных опросов
+func (a *Agent) PollCount() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.pollCount
+}
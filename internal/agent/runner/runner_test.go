@@ -0,0 +1,579 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vova4o/yandexadv/internal/agent/flags"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+	"github.com/vova4o/yandexadv/internal/agent/sender"
+	"github.com/vova4o/yandexadv/internal/agent/stats"
+	"github.com/vova4o/yandexadv/package/logger"
+	"go.uber.org/zap"
+)
+
+// newTestLogger создает логгер, который ничего не пишет
+func newTestLogger() *logger.Logger {
+	return &logger.Logger{ZapLogger: zap.NewNop()}
+}
+
+// mockSender мок-реализация интерфейса MetricSender
+type mockSender struct {
+	mock.Mock
+}
+
+func (m *mockSender) SendBatch(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	args := m.Called(ctx, cfg, metricsData)
+	return args.Error(0)
+}
+
+func (m *mockSender) Send(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	args := m.Called(ctx, cfg, metricsData)
+	return args.Error(0)
+}
+
+func (m *mockSender) SendJSON(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	args := m.Called(ctx, cfg, metricsData)
+	return args.Error(0)
+}
+
+func TestRunPollOnly(t *testing.T) {
+	var sends atomic.Int64
+	send := func(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+		sends.Add(1)
+		return nil
+	}
+
+	cfg := &flags.Config{
+		PollInterval:   10 * time.Millisecond,
+		ReportInterval: 10 * time.Millisecond,
+		PollOnly:       true,
+	}
+	agent := New(cfg, newTestLogger(), SendFunc(send))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	agent.Run(ctx)
+
+	assert.Greater(t, agent.PollCount(), int64(1))
+	assert.Equal(t, int64(0), sends.Load())
+}
+
+func TestRunSequentialSends(t *testing.T) {
+	var sends atomic.Int64
+	send := func(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+		assert.NotEmpty(t, metricsData)
+		sends.Add(1)
+		return nil
+	}
+
+	cfg := &flags.Config{
+		PollInterval:   10 * time.Millisecond,
+		ReportInterval: 10 * time.Millisecond,
+	}
+	agent := New(cfg, newTestLogger(), SendFunc(send))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	agent.Run(ctx)
+
+	assert.Greater(t, sends.Load(), int64(0))
+}
+
+func TestRunCountsBackpressureDrops(t *testing.T) {
+	send := func(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error { return nil }
+
+	cfg := &flags.Config{
+		PollInterval:   5 * time.Millisecond,
+		ReportInterval: time.Hour,
+		QueueSize:      1,
+		QueuePolicy:    PolicyDropOldest,
+	}
+	agent := New(cfg, newTestLogger(), SendFunc(send))
+	agent.drops = stats.NewDropStats()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	agent.Run(ctx)
+
+	assert.Greater(t, agent.drops.Snapshot()[stats.DropBackpressure], int64(0))
+}
+
+func TestRunFlushesOnCancel(t *testing.T) {
+	tests := []struct {
+		name      string
+		rateLimit int
+	}{
+		{name: "Sequential", rateLimit: 0},
+		{name: "Workers", rateLimit: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var flushes atomic.Int64
+			send := func(sendCtx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+				// Финальная отправка идет после отмены контекста агента, но со своим живым контекстом
+				if ctx.Err() != nil && sendCtx.Err() == nil && len(metricsData) > 0 {
+					flushes.Add(1)
+				}
+				return nil
+			}
+
+			cfg := &flags.Config{
+				PollInterval:   time.Hour,
+				ReportInterval: time.Hour,
+				RateLimit:      tt.rateLimit,
+				QueueSize:      10,
+				QueuePolicy:    PolicyDropOldest,
+			}
+			agent := New(cfg, newTestLogger(), SendFunc(send))
+
+			done := make(chan struct{})
+			go func() {
+				agent.Run(ctx)
+				close(done)
+			}()
+
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("agent did not stop on cancel")
+			}
+
+			assert.Equal(t, int64(1), flushes.Load())
+		})
+	}
+}
+
+func TestRunWorkersSendAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var live, cancelled atomic.Int64
+	send := func(sendCtx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+		// Отправка зависает до остановки агента
+		<-ctx.Done()
+		if sendCtx.Err() == nil {
+			live.Add(1)
+		} else {
+			cancelled.Add(1)
+		}
+		return nil
+	}
+
+	cfg := &flags.Config{
+		PollInterval:   5 * time.Millisecond,
+		ReportInterval: time.Hour,
+		RateLimit:      1,
+	}
+	agent := New(cfg, newTestLogger(), SendFunc(send))
+
+	done := make(chan struct{})
+	go func() {
+		agent.Run(ctx)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("agent did not stop on cancel")
+	}
+
+	// Начатая отправка, метрики из канала и финальный снимок уходят с живым контекстом
+	assert.GreaterOrEqual(t, live.Load(), int64(2))
+	assert.Equal(t, int64(0), cancelled.Load())
+}
+
+func TestRunWorkersReportPath(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]metrics.Metrics
+	send := func(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, metricsData)
+		return nil
+	}
+
+	cfg := &flags.Config{
+		PollInterval:   5 * time.Millisecond,
+		ReportInterval: time.Hour,
+		RateLimit:      1,
+		Labels:         map[string]string{"host": "web1"},
+		MetricPrefix:   "myapp.",
+	}
+	agent := New(cfg, newTestLogger(), SendFunc(send))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	agent.Run(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !assert.NotEmpty(t, batches) {
+		return
+	}
+	for _, batch := range batches {
+		for _, m := range batch {
+			assert.True(t, strings.HasPrefix(m.ID, "myapp."), m.ID)
+			assert.Equal(t, cfg.Labels, m.Labels, m.ID)
+		}
+	}
+	assert.NotEmpty(t, agent.LastSnapshot())
+
+	ids := make([]string, 0, len(batches[0]))
+	for _, m := range batches[0] {
+		ids = append(ids, m.ID)
+	}
+	assert.Contains(t, ids, "myapp.AgentSendAttempts")
+}
+
+func TestReportSelfMetricsAfterFailures(t *testing.T) {
+	var requests atomic.Int64
+	var mu sync.Mutex
+	var accepted []metrics.Metrics
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Первый отчет не принимается ни с одной из двух попыток
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&accepted))
+	}))
+	defer server.Close()
+
+	cfg := &flags.Config{
+		ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+		Compression:   sender.CompressionNone,
+		MaxRetries:    1,
+		RetryDelay:    time.Millisecond,
+		QueueSize:     10,
+	}
+	agent := New(cfg, newTestLogger(), sender.HTTPSender{})
+	agent.drops = stats.NewDropStats()
+	stats.Default.Metrics()
+
+	value := 1.5
+	snapshot := [][]metrics.Metrics{{{ID: "Alloc", MType: "gauge", Value: &value}}}
+	agent.report(context.Background(), snapshot)
+	agent.report(context.Background(), snapshot)
+
+	mu.Lock()
+	defer mu.Unlock()
+	deltas := make(map[string]int64)
+	for _, m := range accepted {
+		if m.Delta != nil {
+			deltas[m.ID] = *m.Delta
+		}
+	}
+	// Каждая попытка учитывается отдельно
+	assert.Equal(t, int64(2), deltas["AgentSendAttempts"])
+	assert.Equal(t, int64(2), deltas["AgentSendFailures"])
+	assert.Equal(t, int64(3), requests.Load())
+}
+
+func TestReportCallOrdering(t *testing.T) {
+	cfg := &flags.Config{
+		QueueSize:   10,
+		QueuePolicy: PolicyDropOldest,
+	}
+	sender := new(mockSender)
+	sender.On("SendBatch", mock.Anything, cfg, mock.Anything).Return(nil)
+
+	agent := New(cfg, newTestLogger(), sender)
+	agent.drops = stats.NewDropStats()
+
+	ctx := context.Background()
+	first := []metrics.Metrics{{ID: "first", MType: "gauge"}}
+	second := []metrics.Metrics{{ID: "second", MType: "gauge"}}
+	third := []metrics.Metrics{{ID: "third", MType: "gauge"}}
+
+	agent.queue.push(ctx, first)
+	agent.queue.push(ctx, second)
+	agent.report(context.Background(), agent.queue.drain())
+	agent.queue.push(ctx, third)
+	agent.report(context.Background(), agent.queue.drain())
+
+	sender.AssertNumberOfCalls(t, "SendBatch", 2)
+	sender.AssertNotCalled(t, "Send", mock.Anything, mock.Anything, mock.Anything)
+	sender.AssertNotCalled(t, "SendJSON", mock.Anything, mock.Anything, mock.Anything)
+
+	firstBatch := sender.Calls[0].Arguments.Get(2).([]metrics.Metrics)
+	assert.Equal(t, "first", firstBatch[0].ID)
+	assert.Equal(t, "second", firstBatch[1].ID)
+
+	secondBatch := sender.Calls[1].Arguments.Get(2).([]metrics.Metrics)
+	assert.Equal(t, "third", secondBatch[0].ID)
+}
+
+func TestReportCoalescesSnapshots(t *testing.T) {
+	cfg := &flags.Config{
+		QueueSize:   10,
+		QueuePolicy: PolicyDropOldest,
+	}
+	sender := new(mockSender)
+	sender.On("SendBatch", mock.Anything, cfg, mock.Anything).Return(nil)
+
+	agent := New(cfg, newTestLogger(), sender)
+	agent.drops = stats.NewDropStats()
+
+	gauge := func(v float64) *float64 { return &v }
+	counter := func(d int64) *int64 { return &d }
+
+	ctx := context.Background()
+	agent.queue.push(ctx, []metrics.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: gauge(1)},
+		{ID: "PollCount", MType: "counter", Delta: counter(1)},
+	})
+	agent.queue.push(ctx, []metrics.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: gauge(2)},
+		{ID: "PollCount", MType: "counter", Delta: counter(2)},
+	})
+	agent.queue.push(ctx, []metrics.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: gauge(3)},
+		{ID: "PollCount", MType: "counter", Delta: counter(3)},
+	})
+	agent.report(context.Background(), agent.queue.drain())
+
+	sender.AssertNumberOfCalls(t, "SendBatch", 1)
+	batch := sender.Calls[0].Arguments.Get(2).([]metrics.Metrics)
+
+	var allocs, polls int
+	for _, m := range batch {
+		switch m.ID {
+		case "Alloc":
+			allocs++
+			assert.Equal(t, 3.0, *m.Value)
+		case "PollCount":
+			polls++
+			assert.Equal(t, int64(6), *m.Delta)
+		}
+	}
+	assert.Equal(t, 1, allocs)
+	assert.Equal(t, 1, polls)
+}
+
+func TestReportChangedOnly(t *testing.T) {
+	var batches [][]metrics.Metrics
+	var sendErr error
+	send := func(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+		batches = append(batches, metricsData)
+		return sendErr
+	}
+
+	cfg := &flags.Config{QueueSize: 10, ChangedOnly: true}
+	agent := New(cfg, newTestLogger(), SendFunc(send))
+	agent.drops = stats.NewDropStats()
+
+	gauge := func(v float64) *float64 { return &v }
+	counter := func(d int64) *int64 { return &d }
+	snapshot := func(alloc, heap float64) [][]metrics.Metrics {
+		return [][]metrics.Metrics{{
+			{ID: "Alloc", MType: "gauge", Value: gauge(alloc)},
+			{ID: "HeapInuse", MType: "gauge", Value: gauge(heap)},
+			{ID: "PollCount", MType: "counter", Delta: counter(1)},
+		}}
+	}
+	ids := func(batch []metrics.Metrics) []string {
+		var result []string
+		for _, m := range batch {
+			if m.ID == "Alloc" || m.ID == "HeapInuse" || m.ID == "PollCount" {
+				result = append(result, m.ID)
+			}
+		}
+		return result
+	}
+
+	agent.report(context.Background(), snapshot(1, 10))
+	assert.Equal(t, []string{"Alloc", "HeapInuse", "PollCount"}, ids(batches[0]))
+
+	// HeapInuse не изменился и пропускается, счетчик отправляется всегда
+	agent.report(context.Background(), snapshot(2, 10))
+	assert.Equal(t, []string{"Alloc", "PollCount"}, ids(batches[1]))
+
+	// Неудачная отправка не запоминается
+	sendErr = errors.New("server unavailable")
+	agent.report(context.Background(), snapshot(3, 10))
+	sendErr = nil
+	agent.report(context.Background(), snapshot(3, 10))
+	assert.Equal(t, []string{"Alloc", "PollCount"}, ids(batches[3]))
+
+	agent.report(context.Background(), snapshot(3, 10))
+	assert.Equal(t, []string{"PollCount"}, ids(batches[4]))
+}
+
+func TestReportChangedOnlyLabels(t *testing.T) {
+	var batches [][]metrics.Metrics
+	send := func(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+		batches = append(batches, metricsData)
+		return nil
+	}
+
+	cfg := &flags.Config{QueueSize: 10, ChangedOnly: true}
+	agent := New(cfg, newTestLogger(), SendFunc(send))
+
+	value := 1.5
+	metric := func(labels map[string]string) []metrics.Metrics {
+		return []metrics.Metrics{{ID: "Temp", MType: "gauge", Value: &value, Labels: labels}}
+	}
+
+	agent.sendReport(context.Background(), metric(map[string]string{"room": "a"}))
+	// То же имя с другими метками - другая метрика, она отправляется
+	agent.sendReport(context.Background(), metric(map[string]string{"room": "b"}))
+	agent.sendReport(context.Background(), metric(map[string]string{"room": "a"}))
+
+	assert.Len(t, batches, 2)
+}
+
+func TestReportMode(t *testing.T) {
+	tests := []struct {
+		mode   string
+		method string
+	}{
+		{mode: "", method: "SendBatch"},
+		{mode: ReportModeBatch, method: "SendBatch"},
+		{mode: ReportModeSingle, method: "Send"},
+		{mode: ReportModeJSON, method: "SendJSON"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" for "+tt.mode, func(t *testing.T) {
+			cfg := &flags.Config{QueueSize: 10, ReportMode: tt.mode}
+			sender := new(mockSender)
+			sender.On(tt.method, mock.Anything, cfg, mock.Anything).Return(nil)
+
+			agent := New(cfg, newTestLogger(), sender)
+			agent.drops = stats.NewDropStats()
+
+			value := 1.5
+			agent.report(context.Background(), [][]metrics.Metrics{{{ID: "Alloc", MType: "gauge", Value: &value}}})
+
+			sender.AssertNumberOfCalls(t, tt.method, 1)
+			assert.Len(t, sender.Calls, 1, "only the selected send function is invoked")
+		})
+	}
+}
+
+func TestReportInjectsLabels(t *testing.T) {
+	cfg := &flags.Config{QueueSize: 10, Labels: map[string]string{"host": "web1", "env": "prod"}}
+	sender := new(mockSender)
+	sender.On("SendBatch", mock.Anything, cfg, mock.Anything).Return(nil)
+
+	agent := New(cfg, newTestLogger(), sender)
+	agent.drops = stats.NewDropStats()
+
+	value := 1.5
+	agent.report(context.Background(), [][]metrics.Metrics{{
+		{ID: "Alloc", MType: "gauge", Value: &value},
+		{ID: "Custom", MType: "gauge", Value: &value, Labels: map[string]string{"env": "dev"}},
+	}})
+
+	sender.AssertNumberOfCalls(t, "SendBatch", 1)
+	batch := sender.Calls[0].Arguments.Get(2).([]metrics.Metrics)
+	if !assert.NotEmpty(t, batch) {
+		return
+	}
+	for _, m := range batch {
+		switch m.ID {
+		case "Custom":
+			// Собственные метки метрики имеют приоритет
+			assert.Equal(t, map[string]string{"host": "web1", "env": "dev"}, m.Labels)
+		default:
+			assert.Equal(t, cfg.Labels, m.Labels, m.ID)
+		}
+	}
+}
+
+func TestReportMetricPrefix(t *testing.T) {
+	cfg := &flags.Config{QueueSize: 10, MetricPrefix: "myapp."}
+	sender := new(mockSender)
+	sender.On("SendBatch", mock.Anything, cfg, mock.Anything).Return(nil)
+
+	agent := New(cfg, newTestLogger(), sender)
+	agent.drops = stats.NewDropStats()
+
+	value := 1.5
+	agent.report(context.Background(), [][]metrics.Metrics{{
+		{ID: "Alloc", MType: "gauge", Value: &value},
+	}})
+
+	sender.AssertNumberOfCalls(t, "SendBatch", 1)
+	batch := sender.Calls[0].Arguments.Get(2).([]metrics.Metrics)
+	if !assert.NotEmpty(t, batch) {
+		return
+	}
+	ids := make([]string, 0, len(batch))
+	for _, m := range batch {
+		assert.True(t, strings.HasPrefix(m.ID, "myapp."), m.ID)
+		ids = append(ids, m.ID)
+	}
+	assert.Contains(t, ids, "myapp.Alloc")
+}
+
+func TestSendOnce(t *testing.T) {
+	t.Run("Sends exactly one metric", func(t *testing.T) {
+		cfg := &flags.Config{}
+		delta := int64(1)
+		s := new(mockSender)
+		s.On("SendBatch", mock.Anything, cfg, []metrics.Metrics{{ID: "deploys", MType: "counter", Delta: &delta}}).Return(nil).Once()
+
+		err := SendOnce(context.Background(), cfg, s, []string{"--type", "counter", "--name", "deploys", "--value", "1", "-a", "localhost:9090"})
+		assert.NoError(t, err)
+		s.AssertExpectations(t)
+		s.AssertNumberOfCalls(t, "SendBatch", 1)
+		s.AssertNotCalled(t, "Send", mock.Anything, mock.Anything, mock.Anything)
+		s.AssertNotCalled(t, "SendJSON", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Send error returned", func(t *testing.T) {
+		cfg := &flags.Config{}
+		s := new(mockSender)
+		s.On("SendBatch", mock.Anything, cfg, mock.Anything).Return(errors.New("server unavailable")).Once()
+
+		err := SendOnce(context.Background(), cfg, s, []string{"--type", "counter", "--name", "deploys", "--value", "1"})
+		assert.EqualError(t, err, "server unavailable")
+		s.AssertExpectations(t)
+	})
+
+	t.Run("Gauge value", func(t *testing.T) {
+		metric, err := ParseSendArgs([]string{"--type=gauge", "--name=load", "--value=0.5"})
+		assert.NoError(t, err)
+		assert.Equal(t, 0.5, *metric.Value)
+		assert.Nil(t, metric.Delta)
+	})
+
+	t.Run("Invalid arguments", func(t *testing.T) {
+		for _, args := range [][]string{
+			{"--type", "counter", "--name", "deploys"},
+			{"--type", "counter", "--value", "1"},
+			{"--type", "counter", "--name", "deploys", "--value", "1.5"},
+			{"--type", "histogram", "--name", "deploys", "--value", "1"},
+		} {
+			s := new(mockSender)
+			err := SendOnce(context.Background(), &flags.Config{}, s, args)
+			assert.Error(t, err, args)
+			s.AssertNotCalled(t, "SendBatch", mock.Anything, mock.Anything, mock.Anything)
+		}
+	})
+}
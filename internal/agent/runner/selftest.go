@@ -0,0 +1,32 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+// selfTestMetric имя проверочной метрики. Агент и так отправляет этот счетчик, поэтому фильтры сервера,
+// пропускающие обычные отчеты, пропускают и проверку, а нулевое приращение не меняет значение
+const selfTestMetric = "PollCount"
+
+// selfTestTimeout время на проверочную отправку вместе с повторами
+const selfTestTimeout = 10 * time.Second
+
+// SelfTest отправляет на сервер проверочную метрику и возвращает ошибку,
+// если сервер ее не принял. Позволяет сразу обнаружить неверный адрес или ключ
+func (a *Agent) SelfTest(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+
+	cfg := a.cfg()
+	delta := int64(0)
+	probe := withPrefix(withLabels([]metrics.Metrics{{ID: selfTestMetric, MType: "counter", Delta: &delta}}, cfg.Labels), cfg.MetricPrefix)
+
+	if err := a.send(ctx, cfg, probe); err != nil {
+		return fmt.Errorf("self-test: probe metric was not accepted by %s, check the server address and key: %w", cfg.ServerAddress, err)
+	}
+	return nil
+}
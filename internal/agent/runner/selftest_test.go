@@ -0,0 +1,58 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vova4o/yandexadv/internal/agent/flags"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+func TestSelfTest(t *testing.T) {
+	t.Run("Accepted probe", func(t *testing.T) {
+		var probe []metrics.Metrics
+		send := func(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+			probe = metricsData
+			return nil
+		}
+		agent := New(&flags.Config{QueueSize: 1}, newTestLogger(), SendFunc(send))
+
+		assert.NoError(t, agent.SelfTest(context.Background()))
+		if assert.Len(t, probe, 1) {
+			assert.Equal(t, selfTestMetric, probe[0].ID)
+			assert.Equal(t, "counter", probe[0].MType)
+			assert.Equal(t, int64(0), *probe[0].Delta)
+		}
+	})
+
+	t.Run("Probe with prefix and labels", func(t *testing.T) {
+		var probe []metrics.Metrics
+		send := func(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+			probe = metricsData
+			return nil
+		}
+		cfg := &flags.Config{QueueSize: 1, MetricPrefix: "myapp.", Labels: map[string]string{"host": "web1"}}
+		agent := New(cfg, newTestLogger(), SendFunc(send))
+
+		assert.NoError(t, agent.SelfTest(context.Background()))
+		if assert.Len(t, probe, 1) {
+			assert.Equal(t, "myapp."+selfTestMetric, probe[0].ID)
+			assert.Equal(t, cfg.Labels, probe[0].Labels)
+		}
+	})
+
+	t.Run("Rejected probe", func(t *testing.T) {
+		send := func(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+			return errors.New("status code 400")
+		}
+		agent := New(&flags.Config{ServerAddress: "localhost:1", QueueSize: 1}, newTestLogger(), SendFunc(send))
+
+		err := agent.SelfTest(context.Background())
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "localhost:1")
+			assert.Contains(t, err.Error(), "status code 400")
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/pflag"
+	"github.com/vova4o/yandexadv/internal/agent/flags"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+// SendCommand имя подкоманды агента для разовой отправки метрики
+const SendCommand = "send"
+
+// ParseSendArgs разбирает аргументы подкоманды send: --type, --name и --value.
+// Остальные флаги агента пропускаются, они разбираются при загрузке конфигурации
+func ParseSendArgs(args []string) (metrics.Metrics, error) {
+	fs := pflag.NewFlagSet(SendCommand, pflag.ContinueOnError)
+	fs.ParseErrorsWhitelist.UnknownFlags = true
+	mType := fs.String("type", "", "Metric type: gauge or counter")
+	name := fs.String("name", "", "Metric name")
+	value := fs.String("value", "", "Metric value")
+
+	if err := fs.Parse(args); err != nil {
+		return metrics.Metrics{}, err
+	}
+	if *name == "" {
+		return metrics.Metrics{}, errors.New("metric name is required")
+	}
+	if *value == "" {
+		return metrics.Metrics{}, errors.New("metric value is required")
+	}
+
+	metric := metrics.Metrics{ID: *name, MType: *mType}
+	switch *mType {
+	case "gauge":
+		v, err := strconv.ParseFloat(*value, 64)
+		if err != nil {
+			return metrics.Metrics{}, fmt.Errorf("invalid gauge value %q: %w", *value, err)
+		}
+		metric.Value = &v
+	case "counter":
+		d, err := strconv.ParseInt(*value, 10, 64)
+		if err != nil {
+			return metrics.Metrics{}, fmt.Errorf("invalid counter value %q: %w", *value, err)
+		}
+		metric.Delta = &d
+	default:
+		return metrics.Metrics{}, fmt.Errorf("unknown metric type %q", *mType)
+	}
+
+	return metric, nil
+}
+
+// SendOnce разбирает аргументы подкоманды send и отправляет одну метрику.
+// Возвращает ошибку, если сервер не принял метрику
+func SendOnce(ctx context.Context, cfg *flags.Config, sender MetricSender, args []string) error {
+	metric, err := ParseSendArgs(args)
+	if err != nil {
+		return err
+	}
+
+	return sender.SendBatch(ctx, cfg, withPrefix(withLabels([]metrics.Metrics{metric}, cfg.Labels), cfg.MetricPrefix))
+}
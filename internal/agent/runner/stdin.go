@@ -0,0 +1,89 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/vova4o/yandexadv/internal/agent/flags"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+// StdinCommand имя подкоманды агента для отправки метрик из стандартного ввода
+const StdinCommand = "stdin"
+
+// ReadMetrics читает метрики в формате JSON: один массив или по одной метрике в строке (NDJSON).
+// Массивы и отдельные метрики можно чередовать
+func ReadMetrics(r io.Reader) ([]metrics.Metrics, error) {
+	dec := json.NewDecoder(r)
+	var result []metrics.Metrics
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON input: %w", err)
+		}
+
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+			var batch []metrics.Metrics
+			if err := json.Unmarshal(raw, &batch); err != nil {
+				return nil, fmt.Errorf("invalid metrics array: %w", err)
+			}
+			result = append(result, batch...)
+			continue
+		}
+
+		var metric metrics.Metrics
+		if err := json.Unmarshal(raw, &metric); err != nil {
+			return nil, fmt.Errorf("invalid metric: %w", err)
+		}
+		result = append(result, metric)
+	}
+
+	for i, metric := range result {
+		if err := validateInput(metric); err != nil {
+			return nil, fmt.Errorf("metric %d: %w", i, err)
+		}
+	}
+	return result, nil
+}
+
+// validateInput проверяет метрику, прочитанную из входного потока
+func validateInput(metric metrics.Metrics) error {
+	if metric.ID == "" {
+		return errors.New("metric id is required")
+	}
+	switch metric.MType {
+	case "gauge":
+		if metric.Value == nil {
+			return fmt.Errorf("gauge %s has no value", metric.ID)
+		}
+	case "counter":
+		if metric.Delta == nil {
+			return fmt.Errorf("counter %s has no delta", metric.ID)
+		}
+	default:
+		return fmt.Errorf("unknown metric type %q", metric.MType)
+	}
+	return nil
+}
+
+// SendReader читает метрики из r и отправляет их одним пакетом.
+// Возвращает ошибку, если сервер не принял пакет
+func SendReader(ctx context.Context, cfg *flags.Config, sender MetricSender, r io.Reader) error {
+	batch, err := ReadMetrics(r)
+	if err != nil {
+		return err
+	}
+	if len(batch) == 0 {
+		return errors.New("no metrics in input")
+	}
+
+	return sender.SendBatch(ctx, cfg, withPrefix(withLabels(batch, cfg.Labels), cfg.MetricPrefix))
+}
@@ -0,0 +1,73 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vova4o/yandexadv/internal/agent/flags"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+func TestSendReader(t *testing.T) {
+	t.Run("NDJSON sent as one batch", func(t *testing.T) {
+		cfg := &flags.Config{Labels: map[string]string{"host": "web1"}}
+		s := new(mockSender)
+		s.On("SendBatch", mock.Anything, cfg, mock.Anything).Return(nil).Once()
+
+		input := `{"id":"Alloc","type":"gauge","value":1.5}
+{"id":"deploys","type":"counter","delta":2}
+`
+		assert.NoError(t, SendReader(context.Background(), cfg, s, strings.NewReader(input)))
+		s.AssertExpectations(t)
+
+		batch := s.Calls[0].Arguments.Get(2).([]metrics.Metrics)
+		if assert.Len(t, batch, 2) {
+			assert.Equal(t, "Alloc", batch[0].ID)
+			assert.Equal(t, 1.5, *batch[0].Value)
+			assert.Equal(t, int64(2), *batch[1].Delta)
+			assert.Equal(t, cfg.Labels, batch[1].Labels)
+		}
+	})
+
+	t.Run("Send error returned", func(t *testing.T) {
+		cfg := &flags.Config{}
+		s := new(mockSender)
+		s.On("SendBatch", mock.Anything, cfg, mock.Anything).Return(errors.New("server unavailable")).Once()
+
+		err := SendReader(context.Background(), cfg, s, strings.NewReader(`{"id":"Alloc","type":"gauge","value":1.5}`))
+		assert.EqualError(t, err, "server unavailable")
+		s.AssertExpectations(t)
+	})
+
+	t.Run("Empty input not sent", func(t *testing.T) {
+		s := new(mockSender)
+		assert.Error(t, SendReader(context.Background(), &flags.Config{}, s, strings.NewReader("\n")))
+		s.AssertNotCalled(t, "SendBatch", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestReadMetrics(t *testing.T) {
+	t.Run("Array and objects", func(t *testing.T) {
+		got, err := ReadMetrics(strings.NewReader(`[{"id":"a","type":"gauge","value":1},{"id":"b","type":"gauge","value":2}] {"id":"c","type":"counter","delta":3}`))
+		assert.NoError(t, err)
+		if assert.Len(t, got, 3) {
+			assert.Equal(t, "c", got[2].ID)
+		}
+	})
+
+	t.Run("Invalid input", func(t *testing.T) {
+		for _, input := range []string{
+			`{"id":"a","type":"gauge"}`,
+			`{"type":"counter","delta":1}`,
+			`{"id":"a","type":"histogram","value":1}`,
+			`{"id":"a",`,
+		} {
+			_, err := ReadMetrics(strings.NewReader(input))
+			assert.Error(t, err, input)
+		}
+	})
+}
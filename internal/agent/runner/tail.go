@@ -0,0 +1,156 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fileTail читает строки, дописанные в файл, с учетом его усечения и ротации
+type fileTail struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	offset  int64  // позиция, до которой файл прочитан
+	partial []byte // последняя строка без перевода строки, дочитывается при следующем опросе
+}
+
+// newFileTail начинает следить за файлом path с его текущего конца.
+// Если файла еще нет, он будет прочитан с начала, когда появится
+func newFileTail(path string) (*fileTail, error) {
+	t := &fileTail{path: path}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	t.file, t.info, t.offset = file, info, info.Size()
+	return t, nil
+}
+
+// poll возвращает полные строки, дописанные с прошлого опроса
+func (t *fileTail) poll() ([]byte, error) {
+	info, err := os.Stat(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Файл переименован при ротации, новый еще не создан
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	switch {
+	case t.file == nil || !os.SameFile(info, t.info):
+		// Дочитывание старого файла после ротации, новый читается с начала
+		if t.file != nil {
+			rest, err := t.readFrom(t.file)
+			if err != nil {
+				return nil, err
+			}
+			data = rest
+			t.file.Close()
+			t.file = nil
+		}
+		file, err := os.Open(t.path)
+		if err != nil {
+			return nil, err
+		}
+		t.file, t.offset = file, 0
+	case info.Size() < t.offset:
+		// Файл усечен, незавершенная строка уже не будет дописана
+		t.offset, t.partial = 0, nil
+	}
+	t.info = info
+
+	rest, err := t.readFrom(t.file)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, rest...), nil
+}
+
+// readFrom читает файл от текущей позиции до конца и возвращает полные строки
+func (t *fileTail) readFrom(file *os.File) ([]byte, error) {
+	if _, err := file.Seek(t.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	t.offset += int64(len(buf))
+
+	data := append(t.partial, buf...)
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		t.partial = data
+		return nil, nil
+	}
+	t.partial = append([]byte(nil), data[end+1:]...)
+	return data[:end+1], nil
+}
+
+// close закрывает файл
+func (t *fileTail) close() {
+	if t.file != nil {
+		t.file.Close()
+	}
+}
+
+// TailFile раз в interval проверяет файл path и отправляет метрики из дописанных строк
+// в формате JSON или NDJSON. Существующее содержимое файла не отправляется.
+// Работает до отмены контекста
+func (a *Agent) TailFile(ctx context.Context, path string, interval time.Duration) error {
+	tail, err := newFileTail(path)
+	if err != nil {
+		return err
+	}
+	defer tail.close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		data, err := tail.poll()
+		if err != nil {
+			a.logger.Error("Failed to read metrics file", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		batch, err := ReadMetrics(bytes.NewReader(data))
+		if err != nil {
+			a.logger.Error("Invalid metrics in file", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		cfg := a.cfg()
+		a.send(ctx, cfg, withPrefix(withLabels(batch, cfg.Labels), cfg.MetricPrefix))
+	}
+}
@@ -0,0 +1,87 @@
+package runner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vova4o/yandexadv/internal/agent/flags"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+func TestTailFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.ndjson")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"id":"Old","type":"gauge","value":1}`+"\n"), 0o644))
+
+	var mu sync.Mutex
+	var sent []string
+	send := func(_ context.Context, _ *flags.Config, batch []metrics.Metrics) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, m := range batch {
+			sent = append(sent, m.ID)
+		}
+		return nil
+	}
+	sentIDs := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), sent...)
+	}
+
+	agent := New(&flags.Config{Labels: map[string]string{}}, newTestLogger(), SendFunc(send))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, agent.TailFile(ctx, path, 5*time.Millisecond))
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Дождаться, пока слежение начнется с текущего конца файла
+	time.Sleep(30 * time.Millisecond)
+
+	appendLine := func(line string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if assert.NoError(t, err) {
+			_, err = f.WriteString(line)
+			assert.NoError(t, err)
+			f.Close()
+		}
+	}
+
+	appendLine(`{"id":"Appended","type":"counter","delta":3}` + "\n")
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"Appended"}, sentIDs())
+	}, time.Second, 5*time.Millisecond, "only appended metrics are sent")
+
+	// Незавершенная строка ждет перевода строки
+	appendLine(`{"id":"Partial","type":"gauge",`)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, []string{"Appended"}, sentIDs())
+	appendLine(`"value":2}` + "\n")
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"Appended", "Partial"}, sentIDs())
+	}, time.Second, 5*time.Millisecond)
+
+	// После усечения файл читается с начала
+	assert.NoError(t, os.WriteFile(path, []byte(`{"id":"Truncated","type":"gauge","value":3}`+"\n"), 0o644))
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"Appended", "Partial", "Truncated"}, sentIDs())
+	}, time.Second, 5*time.Millisecond)
+
+	// После ротации новый файл читается с начала
+	assert.NoError(t, os.Rename(path, path+".1"))
+	assert.NoError(t, os.WriteFile(path, []byte(`{"id":"Rotated","type":"gauge","value":4}`+"\n"), 0o644))
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"Appended", "Partial", "Truncated", "Rotated"}, sentIDs())
+	}, time.Second, 5*time.Millisecond)
+}
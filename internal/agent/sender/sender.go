@@ -2,31 +2,53 @@ package sender
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"context"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/vova4o/yandexadv/internal/agent/deadletter"
 	"github.com/vova4o/yandexadv/internal/agent/flags"
 	"github.com/vova4o/yandexadv/internal/agent/metrics"
+	"github.com/vova4o/yandexadv/internal/agent/stats"
 )
 
 const (
-	maxRetries = 3
-	retryDelay = 1 * time.Second
+	defaultRetryDelay = 1 * time.Second
+	unixScheme        = "unix://"
+)
+
+// Заголовки защиты от повтора подписанных запросов
+const (
+	nonceHeader     = "X-Nonce"
+	timestampHeader = "X-Timestamp"
+)
+
+// Режимы сжатия тела запроса
+const (
+	CompressionGzip    = "gzip"
+	CompressionDeflate = "deflate"
+	CompressionNone    = "none"
 )
 
 // createTLSConfig creates TLS configuration with the provided certificate
 func createTLSConfig(certPath string) (*tls.Config, error) {
 	return &tls.Config{
 		InsecureSkipVerify: true, // For development only
-		MinVersion: tls.VersionTLS12,
+		MinVersion:         tls.VersionTLS12,
 		CipherSuites: []uint16{
 			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
 			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
@@ -46,6 +68,90 @@ func getProtocol(cryptoPath string) string {
 	return "http"
 }
 
+// unixSocketPath возвращает путь к сокету, если адрес сервера задан как unix:///path
+func unixSocketPath(address string) (string, bool) {
+	if !strings.HasPrefix(address, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(address, unixScheme), true
+}
+
+// baseURL возвращает адрес сервера вместе со схемой.
+// Для unix-сокета хост в URL условный, соединение устанавливается через сокет
+func baseURL(cfg *flags.Config) string {
+	if _, ok := unixSocketPath(cfg.ServerAddress); ok {
+		return getProtocol(cfg.CryptoPath) + "://unix"
+	}
+	return fmt.Sprintf("%s://%s", getProtocol(cfg.CryptoPath), cfg.ServerAddress)
+}
+
+// ValidateLocalAddress проверяет, что локальный адрес является IP-адресом
+// одного из интерфейсов хоста. Пустой адрес допустим
+func ValidateLocalAddress(address string) error {
+	if address == "" {
+		return nil
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("invalid local address %q: not an IP address", address)
+	}
+
+	// Адрес, не назначенный интерфейсу, нельзя занять
+	listener, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return fmt.Errorf("invalid local address %q: %w", address, err)
+	}
+	return listener.Close()
+}
+
+// localTransport возвращает транспорт, устанавливающий соединения с локального адреса address
+func localTransport(address string) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: &net.TCPAddr{IP: net.ParseIP(address)},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// newClient создает HTTP-клиент с настройками TLS и заголовком User-Agent.
+// Клиент всегда сообщает серверу о поддержке gzip в ответах
+func newClient(cfg *flags.Config) (*resty.Client, error) {
+	client := resty.New()
+
+	// Соединение через unix-сокет, если адрес сервера задан как unix:///path
+	if socketPath, ok := unixSocketPath(cfg.ServerAddress); ok {
+		client.SetTransport(&http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		})
+	} else if cfg.LocalAddress != "" {
+		client.SetTransport(localTransport(cfg.LocalAddress))
+	}
+
+	// Configure TLS if crypto path is provided
+	if cfg.CryptoPath != "" {
+		tlsConfig, err := createTLSConfig(cfg.CryptoPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create TLS config: %w", err)
+		}
+		client.SetTLSClientConfig(tlsConfig)
+	}
+
+	if cfg.UserAgent != "" {
+		client.SetHeader("User-Agent", cfg.UserAgent)
+	}
+	client.SetHeader("Accept-Encoding", "gzip")
+
+	return client, nil
+}
+
 // CompressData сжимает данные с использованием gzip
 func CompressData(data []byte) ([]byte, error) {
 	var buf bytes.Buffer
@@ -61,29 +167,62 @@ func CompressData(data []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// ServerSupportsGzip проверяет, поддерживает ли сервер gzip-сжатие
-func ServerSupportsGzip(cfg *flags.Config) bool {
-	client := resty.New()
-	protocol := getProtocol(cfg.CryptoPath)
+// CompressDataDeflate сжимает данные с использованием deflate
+func CompressDataDeflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	if cfg.CryptoPath != "" {
-		tlsConfig, err := createTLSConfig(cfg.CryptoPath)
-		if err != nil {
-			log.Printf("Failed to create TLS config: %v", err)
-			return false
-		}
-		client.SetTLSClientConfig(tlsConfig)
+// requestEncoding определяет кодировку тела запроса по настройкам агента
+func requestEncoding(cfg *flags.Config) string {
+	switch cfg.Compression {
+	case CompressionNone:
+		return ""
+	case CompressionDeflate:
+		return CompressionDeflate
+	default:
+		return CompressionGzip
 	}
+}
 
-	resp, err := client.R().
-		SetHeader("Accept-Encoding", "gzip").
-		Get(fmt.Sprintf("%s://%s", protocol, cfg.ServerAddress))
+// setBody сжимает данные в выбранной кодировке и устанавливает тело запроса.
+// Если сжатие не уменьшает размер, данные отправляются как есть
+func setBody(request *resty.Request, data []byte, encoding string) error {
+	var compressed []byte
+	var err error
+	switch encoding {
+	case CompressionGzip:
+		compressed, err = CompressData(data)
+	case CompressionDeflate:
+		compressed, err = CompressDataDeflate(data)
+	default:
+		request.SetBody(data)
+		return nil
+	}
 	if err != nil {
-		log.Printf("Failed to check gzip support: %v\n", err)
-		return false
+		return err
+	}
+
+	if len(compressed) >= len(data) {
+		request.SetBody(data)
+		return nil
 	}
 
-	return resp.Header().Get("Content-Encoding") == "gzip"
+	request.SetHeader("Content-Encoding", encoding)
+	request.SetBody(compressed)
+	return nil
 }
 
 // calculateHash вычисляет HMAC-SHA256 хэш из данных и ключа
@@ -93,164 +232,321 @@ func calculateHash(data, key []byte) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// SendMetricsBatch отправляет метрики на сервер пакетом
-func SendMetricsBatch(cfg *flags.Config, metricsData []metrics.Metrics) {
-	client := resty.New()
-	protocol := getProtocol(cfg.CryptoPath)
+// newNonce возвращает случайный одноразовый идентификатор запроса
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
 
-	// Configure TLS if crypto path is provided
-	if cfg.CryptoPath != "" {
-		tlsConfig, err := createTLSConfig(cfg.CryptoPath)
-		if err != nil {
-			log.Printf("Failed to create TLS config: %v", err)
-			return
+// signedData возвращает данные, покрываемые подписью: тело, nonce и метка времени
+func signedData(data []byte, nonce, timestamp string) []byte {
+	signed := make([]byte, 0, len(data)+len(nonce)+len(timestamp))
+	signed = append(signed, data...)
+	signed = append(signed, nonce...)
+	return append(signed, timestamp...)
+}
+
+// signRequest подписывает данные запроса ключом key. Сервер запоминает nonce,
+// поэтому перед каждой попыткой отправки создаются новые nonce и метка времени
+func signRequest(request *resty.Request, data []byte, key string) error {
+	if key == "" {
+		request.SetHeader("HashSHA256", "")
+		return nil
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		log.Printf("Failed to generate nonce: %v\n", err)
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.SetHeader(nonceHeader, nonce).
+		SetHeader(timestampHeader, timestamp).
+		SetHeader("HashSHA256", calculateHash(signedData(data, nonce, timestamp), []byte(key)))
+	return nil
+}
+
+// HTTPSender отправляет метрики на сервер по HTTP
+type HTTPSender struct{}
+
+// SendBatch отправляет метрики пакетом
+func (HTTPSender) SendBatch(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	return SendMetricsBatch(ctx, cfg, metricsData)
+}
+
+// Send отправляет метрики по одной через URL
+func (HTTPSender) Send(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	return SendMetrics(ctx, cfg, metricsData)
+}
+
+// SendJSON отправляет метрики по одной в формате JSON
+func (HTTPSender) SendJSON(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	return SendMetricsJSON(ctx, cfg, metricsData)
+}
+
+// sendFailures учитывает метрики цикла отправки, которые не удалось доставить
+type sendFailures struct {
+	failed int
+	err    error // первая ошибка цикла
+}
+
+// add учитывает n недоставленных метрик
+func (f *sendFailures) add(n int, err error) {
+	f.failed += n
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+// result возвращает ошибку, если хотя бы одна из total метрик не доставлена
+func (f *sendFailures) result(total int) error {
+	if f.failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("failed to send %d of %d metrics: %w", f.failed, total, f.err)
+}
+
+// SendMetricsBatch отправляет метрики на сервер пакетом и возвращает ошибку,
+// если хотя бы один пакет не доставлен. Отмена ctx прерывает текущий запрос и повторные попытки
+func SendMetricsBatch(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	client, err := newClient(cfg)
+	if err != nil {
+		log.Printf("Failed to create client: %v", err)
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	url := baseURL(cfg) + "/updates"
+	log.Printf("Sending metrics to %s\n", url)
+	encoding := requestEncoding(cfg)
+	budget := newRetryBudget(cfg.RetryBudget)
+
+	var failures sendFailures
+	for _, chunk := range chunkMetrics(metricsData, cfg.BatchSize) {
+		if ctx.Err() != nil {
+			dropFailed(chunk)
+			failures.add(len(chunk), ctx.Err())
+			continue
+		}
+		if err := sendBatchChunk(ctx, client, cfg, url, encoding, budget, chunk); err != nil {
+			failures.add(len(chunk), err)
 		}
-		client.SetTLSClientConfig(tlsConfig)
 	}
+	return failures.result(len(metricsData))
+}
 
-	url := fmt.Sprintf("%s://%s/updates", protocol, cfg.ServerAddress)
-	log.Printf("Sending metrics to %s\n", url)	
-	useGzip := ServerSupportsGzip(cfg)
+// chunkMetrics разбивает метрики на пакеты размером не более size.
+// При size <= 0 метрики отправляются одним пакетом
+func chunkMetrics(metricsData []metrics.Metrics, size int) [][]metrics.Metrics {
+	if size <= 0 || len(metricsData) <= size {
+		return [][]metrics.Metrics{metricsData}
+	}
+
+	chunks := make([][]metrics.Metrics, 0, (len(metricsData)+size-1)/size)
+	for start := 0; start < len(metricsData); start += size {
+		end := start + size
+		if end > len(metricsData) {
+			end = len(metricsData)
+		}
+		chunks = append(chunks, metricsData[start:end])
+	}
+	return chunks
+}
 
+// sendBatchChunk отправляет один пакет метрик с повторными попытками
+func sendBatchChunk(ctx context.Context, client *resty.Client, cfg *flags.Config, url string, encoding string, budget *retryBudget, metricsData []metrics.Metrics) error {
 	// Сериализация метрик в JSON
 	jsonData, err := json.Marshal(metricsData)
 	if err != nil {
 		log.Printf("Failed to marshal metrics: %v\n", err)
-		return
-	}
-
-	var hash string
-	if cfg.SecretKey != "" {
-		hash = calculateHash(jsonData, []byte(cfg.SecretKey))
+		return err
 	}
 
 	request := client.R().
-		SetHeader("Content-Type", "application/json").
-		SetHeader("HashSHA256", hash)
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json")
 
-	if useGzip {
-		request.SetHeader("Content-Encoding", "gzip")
-		compressedData, err := CompressData(jsonData)
-		if err != nil {
-			log.Printf("Failed to compress data for metrics: %v\n", err)
-			return
-		}
-		request.SetBody(compressedData)
-	} else {
-		request.SetBody(jsonData)
+	if err := setBody(request, jsonData, encoding); err != nil {
+		log.Printf("Failed to compress data for metrics: %v\n", err)
+		return err
 	}
 
-	if err := sendWithRetry(request, url); err != nil {
+	sign := func(request *resty.Request) error {
+		return signRequest(request, jsonData, cfg.SecretKey)
+	}
+	if err := sendWithRetry(request, url, cfg, budget, sign); err != nil {
 		log.Printf("Failed to send metrics: %v\n", err)
+		dropFailed(metricsData)
+		return err
 	}
+	return nil
 }
 
-// SendMetrics отправляет метрики на сервер
-func SendMetrics(cfg *flags.Config, metricsData []metrics.Metrics) {
-	client := resty.New()
-	protocol := getProtocol(cfg.CryptoPath)
-
-	if cfg.CryptoPath != "" {
-		tlsConfig, err := createTLSConfig(cfg.CryptoPath)
-		if err != nil {
-			log.Printf("Failed to create TLS config: %v", err)
-			return
-		}
-		client.SetTLSClientConfig(tlsConfig)
+// SendMetrics отправляет метрики на сервер и возвращает ошибку, если хотя бы одна метрика не доставлена
+func SendMetrics(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	client, err := newClient(cfg)
+	if err != nil {
+		log.Printf("Failed to create client: %v", err)
+		return fmt.Errorf("failed to create client: %w", err)
 	}
+	base := baseURL(cfg)
 
-	useGzip := ServerSupportsGzip(cfg)
+	encoding := requestEncoding(cfg)
+	budget := newRetryBudget(cfg.RetryBudget)
 
+	var failures sendFailures
 	for _, metric := range metricsData {
 		var url string
 		if metric.Value == nil {
-			url = fmt.Sprintf("%s://%s/update/%s/%s/%v", protocol, cfg.ServerAddress, metric.MType, metric.ID, *metric.Delta)
+			url = fmt.Sprintf("%s/update/%s/%s/%v", base, metric.MType, metric.ID, *metric.Delta)
 		} else {
-			url = fmt.Sprintf("%s://%s/update/%s/%s/%v", protocol, cfg.ServerAddress, metric.MType, metric.ID, *metric.Value)
+			url = fmt.Sprintf("%s/update/%s/%s/%v", base, metric.MType, metric.ID, *metric.Value)
 		}
 
-		request := client.R().SetHeader("Content-Type", "text/plain")
+		request := client.R().SetContext(ctx).SetHeader("Content-Type", "text/plain")
 
-		if useGzip {
-			request.SetHeader("Content-Encoding", "gzip")
-			compressedData, err := CompressData([]byte(url))
-			if err != nil {
-				log.Printf("Failed to compress data for metric %s: %v\n", metric.ID, err)
-				continue
-			}
-			request.SetBody(compressedData)
-		} else {
-			request.SetBody(url)
+		if err := setBody(request, []byte(url), encoding); err != nil {
+			log.Printf("Failed to compress data for metric %s: %v\n", metric.ID, err)
+			failures.add(1, err)
+			continue
 		}
 
-		if err := sendWithRetry(request, url); err != nil {
+		if err := sendWithRetry(request, url, cfg, budget, nil); err != nil {
 			log.Printf("Failed to send metric %s: %v\n", metric.ID, err)
+			dropFailed([]metrics.Metrics{metric})
+			failures.add(1, err)
 		}
 	}
+	return failures.result(len(metricsData))
 }
 
 // SendMetricsJSON отправляет метрики на сервер в формате JSON
-func SendMetricsJSON(cfg *flags.Config, metricsData []metrics.Metrics) {
-	client := resty.New()
-	protocol := getProtocol(cfg.CryptoPath)
-
-	if cfg.CryptoPath != "" {
-		tlsConfig, err := createTLSConfig(cfg.CryptoPath)
-		if err != nil {
-			log.Printf("Failed to create TLS config: %v", err)
-			return
-		}
-		client.SetTLSClientConfig(tlsConfig)
+// и возвращает ошибку, если хотя бы одна метрика не доставлена
+func SendMetricsJSON(ctx context.Context, cfg *flags.Config, metricsData []metrics.Metrics) error {
+	client, err := newClient(cfg)
+	if err != nil {
+		log.Printf("Failed to create client: %v", err)
+		return fmt.Errorf("failed to create client: %w", err)
 	}
+	base := baseURL(cfg)
 
-	useGzip := ServerSupportsGzip(cfg)
+	encoding := requestEncoding(cfg)
+	budget := newRetryBudget(cfg.RetryBudget)
 
+	var failures sendFailures
 	for _, metric := range metricsData {
-		url := fmt.Sprintf("%s://%s/update/", protocol, cfg.ServerAddress)
+		url := base + "/update/"
 
 		// Сериализация метрики в JSON
 		jsonData, err := json.Marshal(metric)
 		if err != nil {
 			log.Printf("Failed to marshal metric %s: %v\n", metric.ID, err)
+			failures.add(1, err)
 			continue
 		}
 
-		request := client.R().SetHeader("Content-Type", "application/json")
+		request := client.R().SetContext(ctx).SetHeader("Content-Type", "application/json")
 
-		if useGzip {
-			request.SetHeader("Content-Encoding", "gzip")
-			compressedData, err := CompressData(jsonData)
-			if err != nil {
-				log.Printf("Failed to compress data for metric %s: %v\n", metric.ID, err)
-				continue
-			}
-			request.SetBody(compressedData)
-		} else {
-			request.SetBody(jsonData)
+		if err := setBody(request, jsonData, encoding); err != nil {
+			log.Printf("Failed to compress data for metric %s: %v\n", metric.ID, err)
+			failures.add(1, err)
+			continue
 		}
 
-		if err := sendWithRetry(request, url); err != nil {
+		if err := sendWithRetry(request, url, cfg, budget, nil); err != nil {
 			log.Printf("Failed to send metric %s: %v\n", metric.ID, err)
+			dropFailed([]metrics.Metrics{metric})
+			failures.add(1, err)
 		}
 	}
+	return failures.result(len(metricsData))
+}
+
+// dropFailed учитывает метрики, которые не удалось отправить, и сохраняет их в файл недоставленных метрик
+func dropFailed(metricsData []metrics.Metrics) {
+	stats.Drops.Add(stats.DropSendFailed, len(metricsData))
+	if err := deadletter.Default.Write(stats.DropSendFailed, metricsData); err != nil {
+		log.Printf("Failed to write dead-letter file: %v\n", err)
+	}
+}
+
+// retryBudget общий бюджет времени на повторные попытки в рамках одного цикла отправки
+type retryBudget struct {
+	deadline time.Time
+}
+
+// newRetryBudget создает бюджет длительностью d, при d <= 0 бюджет не ограничен
+func newRetryBudget(d time.Duration) *retryBudget {
+	if d <= 0 {
+		return &retryBudget{}
+	}
+	return &retryBudget{deadline: time.Now().Add(d)}
+}
+
+// allow сообщает, укладывается ли ожидание delay в оставшийся бюджет
+func (b *retryBudget) allow(delay time.Duration) bool {
+	return b.deadline.IsZero() || time.Now().Add(delay).Before(b.deadline)
+}
+
+// retryPolicy возвращает количество попыток и задержку перед первым повтором из конфигурации.
+// MaxRetries 0 отключает повторы, незаданная задержка заменяется значением по умолчанию
+func retryPolicy(cfg *flags.Config) (int, time.Duration) {
+	attempts, delay := 1, cfg.RetryDelay
+	if cfg.MaxRetries > 0 {
+		attempts += cfg.MaxRetries
+	}
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	return attempts, delay
 }
 
-// sendWithRetry отправляет запрос с повторными попытками в случае ошибки
-func sendWithRetry(request *resty.Request, url string) error {
-	delay := retryDelay
-	for i := 0; i < maxRetries; i++ {
+// sendWithRetry отправляет запрос с повторными попытками в случае ошибки.
+// Если задана sign, запрос подписывается заново перед каждой попыткой.
+// Повторы прекращаются, если следующее ожидание не укладывается в бюджет цикла
+// или отменен контекст запроса. Ошибка содержит количество выполненных попыток
+func sendWithRetry(request *resty.Request, url string, cfg *flags.Config, budget *retryBudget, sign func(*resty.Request) error) error {
+	ctx := request.Context()
+	attempts, delay := retryPolicy(cfg)
+	step := 2 * delay // каждое следующее ожидание длиннее предыдущего, по умолчанию 1с, 3с, 5с
+	made := 0
+	for made < attempts {
+		if sign != nil {
+			if err := sign(request); err != nil {
+				return err
+			}
+		}
+		made++
 		resp, err := request.Post(url)
+		if err == nil && resp.StatusCode() == 200 {
+			stats.Default.RecordSend(true)
+			return nil
+		}
+		stats.Default.RecordSend(false)
+		if ctx.Err() != nil {
+			log.Printf("Sending to %s cancelled: %v\n", url, ctx.Err())
+			return fmt.Errorf("sending to %s cancelled after %d of %d attempts: %w", url, made, attempts, ctx.Err())
+		}
 		if err != nil {
 			log.Printf("Failed to send request: %v\n", err)
-		} else if resp.StatusCode() == 200 {
-			return nil
 		} else {
 			log.Printf("Failed to send request: status code %d\n", resp.StatusCode())
 			log.Printf("Response body: %s\n", resp.String())
 		}
 
-		time.Sleep(delay)
-		delay += 2 * time.Second
+		if made == attempts {
+			break
+		}
+		if !budget.allow(delay) {
+			log.Printf("Retry budget exhausted, giving up on %s\n", url)
+			return fmt.Errorf("failed to send request to %s: retry budget exhausted after %d of %d attempts", url, made, attempts)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay += step
 	}
-	return fmt.Errorf("failed to send request after %d attempts", maxRetries)
+	return fmt.Errorf("failed to send request to %s after %d of %d attempts", url, made, attempts)
 }
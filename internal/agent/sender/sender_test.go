@@ -2,18 +2,34 @@ package sender_test
 
 import (
     "bytes"
+    "compress/flate"
     "compress/gzip"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
     "encoding/json"
     "io"
+    "net"
     "net/http"
     "net/http/httptest"
+    "os"
+    "path/filepath"
     "strings"
+    "sync/atomic"
     "testing"
+    "time"
 
+    "github.com/gin-gonic/gin"
     "github.com/stretchr/testify/assert"
+    "github.com/vova4o/yandexadv/internal/agent/deadletter"
     "github.com/vova4o/yandexadv/internal/agent/flags"
     "github.com/vova4o/yandexadv/internal/agent/metrics"
     "github.com/vova4o/yandexadv/internal/agent/sender"
+    serverflags "github.com/vova4o/yandexadv/internal/server/flags"
+    "github.com/vova4o/yandexadv/internal/server/middleware"
+    "github.com/vova4o/yandexadv/package/logger"
+    "go.uber.org/zap"
 )
 
 // Helper functions remain unchanged
@@ -39,79 +55,6 @@ func TestCompressData(t *testing.T) {
     assert.Equal(t, data, decompressedData)
 }
 
-func TestServerSupportsGzip(t *testing.T) {
-    tests := []struct {
-        name        string
-        useTLS      bool
-        responseEnc string
-        want        bool
-    }{
-        {
-            name:        "HTTP with gzip support",
-            useTLS:      false,
-            responseEnc: "gzip",
-            want:        true,
-        },
-        {
-            name:        "HTTPS with gzip support",
-            useTLS:      true,
-            responseEnc: "gzip",
-            want:        true,
-        },
-        {
-            name:        "HTTP without gzip support",
-            useTLS:      false,
-            responseEnc: "",
-            want:        false,
-        },
-        {
-            name:        "HTTPS without gzip support",
-            useTLS:      true,
-            responseEnc: "",
-            want:        false,
-        },
-    }
-
-    for _, tt := range tests {
-        t.Run(tt.name, func(t *testing.T) {
-            handler := func(w http.ResponseWriter, r *http.Request) {
-                if r.Method == http.MethodGet && r.URL.Path == "/" {
-                    // Обработка запроса для проверки поддержки gzip
-                    if tt.responseEnc == "gzip" {
-                        w.Header().Set("Content-Encoding", "gzip")
-                    }
-                    w.WriteHeader(http.StatusOK)
-                    return
-                }
-
-                // Для других путей или методов возвращаем 404
-                w.WriteHeader(http.StatusNotFound)
-            }
-
-            var server *httptest.Server
-            if tt.useTLS {
-                server = httptest.NewTLSServer(http.HandlerFunc(handler))
-                defer server.Close()
-            } else {
-                server = httptest.NewServer(http.HandlerFunc(handler))
-                defer server.Close()
-            }
-
-            cfg := &flags.Config{
-                ServerAddress: strings.TrimPrefix(server.URL, "http://"),
-                SecretKey:     "test_key",
-            }
-            if tt.useTLS {
-                cfg.ServerAddress = strings.TrimPrefix(server.URL, "https://")
-                cfg.CryptoPath = "./test_certs" // Путь можно оставить пустым, так как createTLSConfig игнорирует его содержимое
-            }
-
-            supportsGzip := sender.ServerSupportsGzip(cfg)
-            assert.Equal(t, tt.want, supportsGzip)
-        })
-    }
-}
-
 func TestSendMetricsBatch(t *testing.T) {
     tests := []struct {
         name       string
@@ -200,7 +143,7 @@ func TestSendMetricsBatch(t *testing.T) {
             cfg.ServerAddress = strings.TrimPrefix(server.URL, "http://") + "/updates"
 
             // Отправляем метрики
-            sender.SendMetricsBatch(cfg, metricsData)
+            sender.SendMetricsBatch(context.Background(), cfg, metricsData)
             // Если не произошло паники или ошибок, считаем тест пройденным
         })
     }
@@ -274,7 +217,7 @@ func TestSendMetrics(t *testing.T) {
                 {ID: "metric2", Delta: int64Ptr(20)},
             }
 
-            sender.SendMetrics(cfg, metricsData)
+            sender.SendMetrics(context.Background(), cfg, metricsData)
             // Проверка осуществляется через assert внутри обработчика
         })
     }
@@ -350,8 +293,545 @@ func TestSendMetricsJSON(t *testing.T) {
                 {ID: "metric2", Delta: int64Ptr(20)},
             }
 
-            sender.SendMetricsJSON(cfg, metricsData)
+            sender.SendMetricsJSON(context.Background(), cfg, metricsData)
             // Проверка осуществляется через assert внутри обработчика
         })
     }
-}
\ No newline at end of file
+}
+
+func TestSendMetricsBatchChunking(t *testing.T) {
+    tests := []struct {
+        name             string
+        batchSize        int
+        metricsCount     int
+        expectedRequests int
+    }{
+        {
+            name:             "Chunking disabled",
+            batchSize:        0,
+            metricsCount:     5,
+            expectedRequests: 1,
+        },
+        {
+            name:             "Batch size larger than metrics",
+            batchSize:        10,
+            metricsCount:     5,
+            expectedRequests: 1,
+        },
+        {
+            name:             "Metrics split into chunks",
+            batchSize:        2,
+            metricsCount:     5,
+            expectedRequests: 3,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var requests, received atomic.Int64
+            handler := func(w http.ResponseWriter, r *http.Request) {
+                if r.Method == http.MethodPost && r.URL.Path == "/updates" {
+                    var receivedData []metrics.Metrics
+                    err := json.NewDecoder(r.Body).Decode(&receivedData)
+                    assert.NoError(t, err)
+                    if tt.batchSize > 0 {
+                        assert.LessOrEqual(t, len(receivedData), tt.batchSize)
+                    }
+                    requests.Add(1)
+                    received.Add(int64(len(receivedData)))
+                }
+                w.WriteHeader(http.StatusOK)
+            }
+
+            server := httptest.NewServer(http.HandlerFunc(handler))
+            defer server.Close()
+
+            cfg := &flags.Config{
+                ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+                BatchSize:     tt.batchSize,
+                Compression:   sender.CompressionNone,
+            }
+
+            metricsData := make([]metrics.Metrics, 0, tt.metricsCount)
+            for i := 0; i < tt.metricsCount; i++ {
+                metricsData = append(metricsData, metrics.Metrics{ID: "metric", MType: "gauge", Value: float64Ptr(float64(i))})
+            }
+
+            sender.SendMetricsBatch(context.Background(), cfg, metricsData)
+
+            assert.Equal(t, int64(tt.expectedRequests), requests.Load())
+            assert.Equal(t, int64(tt.metricsCount), received.Load())
+        })
+    }
+}
+
+func TestSendMetricsBatchUserAgent(t *testing.T) {
+    userAgents := make(chan string, 1)
+    handler := func(w http.ResponseWriter, r *http.Request) {
+        userAgents <- r.Header.Get("User-Agent")
+        w.WriteHeader(http.StatusOK)
+    }
+
+    server := httptest.NewServer(http.HandlerFunc(handler))
+    defer server.Close()
+
+    cfg := &flags.Config{
+        ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+        UserAgent:     "metrics-agent/1.2.3",
+    }
+
+    sender.SendMetricsBatch(context.Background(), cfg, []metrics.Metrics{
+        {ID: "metric1", MType: "gauge", Value: float64Ptr(10)},
+    })
+
+    assert.Len(t, userAgents, 1)
+    assert.Equal(t, "metrics-agent/1.2.3", <-userAgents)
+}
+
+func TestSendMetricsBatchNonce(t *testing.T) {
+    type signedRequest struct {
+        body, hash, nonce, timestamp string
+    }
+    requests := make(chan signedRequest, 2)
+    handler := func(w http.ResponseWriter, r *http.Request) {
+        body, err := io.ReadAll(r.Body)
+        assert.NoError(t, err)
+        requests <- signedRequest{
+            body:      string(body),
+            hash:      r.Header.Get("HashSHA256"),
+            nonce:     r.Header.Get("X-Nonce"),
+            timestamp: r.Header.Get("X-Timestamp"),
+        }
+        w.WriteHeader(http.StatusOK)
+    }
+
+    server := httptest.NewServer(http.HandlerFunc(handler))
+    defer server.Close()
+
+    cfg := &flags.Config{
+        ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+        SecretKey:     "test_key",
+        Compression:   sender.CompressionNone,
+    }
+    metricsData := []metrics.Metrics{{ID: "metric1", MType: "gauge", Value: float64Ptr(10)}}
+
+    sender.SendMetricsBatch(context.Background(), cfg, metricsData)
+    sender.SendMetricsBatch(context.Background(), cfg, metricsData)
+    assert.Len(t, requests, 2)
+
+    first, second := <-requests, <-requests
+    assert.NotEmpty(t, first.nonce)
+    assert.NotEqual(t, first.nonce, second.nonce)
+
+    // Подпись покрывает тело, nonce и метку времени
+    h := hmac.New(sha256.New, []byte(cfg.SecretKey))
+    h.Write([]byte(first.body + first.nonce + first.timestamp))
+    assert.Equal(t, hex.EncodeToString(h.Sum(nil)), first.hash)
+}
+
+func TestSendMetricsBatchRetryWithReplayWindow(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+
+    // Сервер запоминает nonce до обработки запроса, поэтому повтор должен быть подписан заново
+    m := middleware.New(&logger.Logger{ZapLogger: zap.NewNop()}, &serverflags.Config{
+        SecretKey:    "test_key",
+        ReplayWindow: 60,
+    })
+    var requests atomic.Int64
+    router := gin.New()
+    router.POST("/updates/", m.CheckHash(), func(c *gin.Context) {
+        if requests.Add(1) == 1 {
+            c.Status(http.StatusInternalServerError)
+            return
+        }
+        c.Status(http.StatusOK)
+    })
+
+    server := httptest.NewServer(router)
+    defer server.Close()
+
+    cfg := &flags.Config{
+        ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+        SecretKey:     "test_key",
+        Compression:   sender.CompressionNone,
+        MaxRetries:    1,
+        RetryDelay:    time.Millisecond,
+    }
+
+    err := sender.SendMetricsBatch(context.Background(), cfg, []metrics.Metrics{
+        {ID: "metric1", MType: "gauge", Value: float64Ptr(10)},
+    })
+    assert.NoError(t, err)
+    assert.Equal(t, int64(2), requests.Load())
+}
+
+func TestSendMetricsBatchCompression(t *testing.T) {
+    tests := []struct {
+        name             string
+        compression      string
+        metricsCount     int
+        expectedEncoding string
+    }{
+        {
+            name:             "Gzip",
+            compression:      sender.CompressionGzip,
+            metricsCount:     50,
+            expectedEncoding: "gzip",
+        },
+        {
+            name:             "Deflate",
+            compression:      sender.CompressionDeflate,
+            metricsCount:     50,
+            expectedEncoding: "deflate",
+        },
+        {
+            name:             "None",
+            compression:      sender.CompressionNone,
+            metricsCount:     50,
+            expectedEncoding: "",
+        },
+        {
+            name:             "Small payload is not compressed",
+            compression:      sender.CompressionGzip,
+            metricsCount:     1,
+            expectedEncoding: "",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var probes, posts atomic.Int64
+            handler := func(w http.ResponseWriter, r *http.Request) {
+                if r.Method != http.MethodPost || r.URL.Path != "/updates" {
+                    probes.Add(1)
+                    w.WriteHeader(http.StatusOK)
+                    return
+                }
+
+                posts.Add(1)
+                assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+                assert.Equal(t, tt.expectedEncoding, r.Header.Get("Content-Encoding"))
+
+                var body io.Reader = r.Body
+                switch tt.expectedEncoding {
+                case "gzip":
+                    reader, err := gzip.NewReader(r.Body)
+                    assert.NoError(t, err)
+                    defer reader.Close()
+                    body = reader
+                case "deflate":
+                    reader := flate.NewReader(r.Body)
+                    defer reader.Close()
+                    body = reader
+                }
+
+                var receivedData []metrics.Metrics
+                err := json.NewDecoder(body).Decode(&receivedData)
+                assert.NoError(t, err)
+                assert.Len(t, receivedData, tt.metricsCount)
+                assert.Equal(t, "metric1", receivedData[0].ID)
+                w.WriteHeader(http.StatusOK)
+            }
+
+            server := httptest.NewServer(http.HandlerFunc(handler))
+            defer server.Close()
+
+            cfg := &flags.Config{
+                ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+                Compression:   tt.compression,
+            }
+
+            metricsData := make([]metrics.Metrics, 0, tt.metricsCount)
+            for i := 0; i < tt.metricsCount; i++ {
+                metricsData = append(metricsData, metrics.Metrics{ID: "metric1", MType: "gauge", Value: float64Ptr(10)})
+            }
+
+            sender.SendMetricsBatch(context.Background(), cfg, metricsData)
+
+            assert.Equal(t, int64(1), posts.Load())
+            // Поддержка gzip сервером не проверяется отдельным запросом
+            assert.Equal(t, int64(0), probes.Load())
+        })
+    }
+}
+
+func TestCompressDataDeflate(t *testing.T) {
+    data := []byte("test data")
+    compressedData, err := sender.CompressDataDeflate(data)
+    assert.NoError(t, err)
+
+    reader := flate.NewReader(bytes.NewReader(compressedData))
+    defer reader.Close()
+
+    decompressedData, err := io.ReadAll(reader)
+    assert.NoError(t, err)
+    assert.Equal(t, data, decompressedData)
+}
+
+func TestSendMetricsRetryBudget(t *testing.T) {
+    var requests atomic.Int64
+    handler := func(w http.ResponseWriter, r *http.Request) {
+        requests.Add(1)
+        w.WriteHeader(http.StatusInternalServerError)
+    }
+
+    server := httptest.NewServer(http.HandlerFunc(handler))
+    defer server.Close()
+
+    cfg := &flags.Config{
+        ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+        Compression:   sender.CompressionNone,
+        MaxRetries:    2,
+        RetryBudget:   200 * time.Millisecond,
+    }
+
+    const metricsCount = 20
+    metricsData := make([]metrics.Metrics, 0, metricsCount)
+    for i := 0; i < metricsCount; i++ {
+        metricsData = append(metricsData, metrics.Metrics{ID: "metric", MType: "gauge", Value: float64Ptr(float64(i))})
+    }
+
+    start := time.Now()
+    err := sender.SendMetricsJSON(context.Background(), cfg, metricsData)
+
+    // Без бюджета каждая метрика ждала бы повторов по несколько секунд
+    assert.Less(t, time.Since(start), time.Second)
+    assert.Equal(t, int64(metricsCount), requests.Load())
+    if assert.Error(t, err) {
+        assert.Contains(t, err.Error(), "retry budget exhausted after 1 of 3 attempts")
+    }
+}
+
+func TestSendMetricsRetryBudgetAllowsRetries(t *testing.T) {
+    var requests atomic.Int64
+    handler := func(w http.ResponseWriter, r *http.Request) {
+        requests.Add(1)
+        w.WriteHeader(http.StatusInternalServerError)
+    }
+
+    server := httptest.NewServer(http.HandlerFunc(handler))
+    defer server.Close()
+
+    // Ожидания 50мс и 150мс укладываются в бюджет, следующее ожидание 250мс - нет
+    cfg := &flags.Config{
+        ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+        Compression:   sender.CompressionNone,
+        MaxRetries:    4,
+        RetryDelay:    50 * time.Millisecond,
+        RetryBudget:   250 * time.Millisecond,
+    }
+
+    err := sender.SendMetricsBatch(context.Background(), cfg, []metrics.Metrics{
+        {ID: "Alloc", MType: "gauge", Value: float64Ptr(1.5)},
+    })
+
+    assert.Equal(t, int64(3), requests.Load())
+    if assert.Error(t, err) {
+        assert.Contains(t, err.Error(), "retry budget exhausted after 3 of 5 attempts")
+    }
+}
+
+func TestSendMetricsMaxRetries(t *testing.T) {
+    var requests atomic.Int64
+    handler := func(w http.ResponseWriter, r *http.Request) {
+        requests.Add(1)
+        w.WriteHeader(http.StatusInternalServerError)
+    }
+
+    server := httptest.NewServer(http.HandlerFunc(handler))
+    defer server.Close()
+
+    for _, maxRetries := range []int{0, 4} {
+        requests.Store(0)
+        cfg := &flags.Config{
+            ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+            Compression:   sender.CompressionNone,
+            MaxRetries:    maxRetries,
+            RetryDelay:    time.Millisecond,
+        }
+
+        sender.SendMetricsBatch(context.Background(), cfg, []metrics.Metrics{
+            {ID: "Alloc", MType: "gauge", Value: float64Ptr(1.5)},
+        })
+
+        // Первая попытка и maxRetries повторов
+        assert.Equal(t, int64(maxRetries+1), requests.Load())
+    }
+}
+
+func TestSendMetricsReturnsError(t *testing.T) {
+    handler := func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        if strings.Contains(r.URL.Path+string(body), "Broken") {
+            w.WriteHeader(http.StatusInternalServerError)
+        }
+    }
+
+    server := httptest.NewServer(http.HandlerFunc(handler))
+    defer server.Close()
+
+    cfg := &flags.Config{
+        ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+        Compression:   sender.CompressionNone,
+    }
+    healthy := []metrics.Metrics{{ID: "Alloc", MType: "gauge", Value: float64Ptr(1.5)}}
+    partial := append(healthy, metrics.Metrics{ID: "Broken", MType: "gauge", Value: float64Ptr(2)})
+
+    sends := map[string]func(context.Context, *flags.Config, []metrics.Metrics) error{
+        "Batch":  sender.SendMetricsBatch,
+        "Single": sender.SendMetrics,
+        "JSON":   sender.SendMetricsJSON,
+    }
+    for name, send := range sends {
+        t.Run(name, func(t *testing.T) {
+            assert.NoError(t, send(context.Background(), cfg, healthy))
+
+            err := send(context.Background(), cfg, partial)
+            if assert.Error(t, err) && name != "Batch" {
+                assert.Contains(t, err.Error(), "1 of 2 metrics")
+            }
+        })
+    }
+}
+
+func TestSendMetricsBatchDeadLetter(t *testing.T) {
+    handler := func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusInternalServerError)
+    }
+
+    server := httptest.NewServer(http.HandlerFunc(handler))
+    defer server.Close()
+
+    path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+    deadletter.Default.Configure(path, 0)
+    defer deadletter.Default.Configure("", 0)
+
+    cfg := &flags.Config{
+        ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+        Compression:   sender.CompressionNone,
+        RetryBudget:   time.Millisecond,
+    }
+    metricsData := []metrics.Metrics{
+        {ID: "Alloc", MType: "gauge", Value: float64Ptr(1.5)},
+        {ID: "PollCount", MType: "counter", Delta: int64Ptr(3)},
+    }
+
+    sender.SendMetricsBatch(context.Background(), cfg, metricsData)
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var entry deadletter.Entry
+    assert.NoError(t, json.Unmarshal(data, &entry))
+    assert.Equal(t, "send_failed", entry.Reason)
+    assert.Equal(t, metricsData, entry.Metrics)
+}
+
+func TestSendMetricsBatchUnixSocket(t *testing.T) {
+    socketPath := filepath.Join(t.TempDir(), "metrics.sock")
+    listener, err := net.Listen("unix", socketPath)
+    assert.NoError(t, err)
+
+    received := make(chan []metrics.Metrics, 1)
+    server := &http.Server{
+        Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            assert.Equal(t, "/updates", r.URL.Path)
+            var receivedData []metrics.Metrics
+            assert.NoError(t, json.NewDecoder(r.Body).Decode(&receivedData))
+            received <- receivedData
+            w.WriteHeader(http.StatusOK)
+        }),
+    }
+    go server.Serve(listener)
+    defer server.Close()
+
+    cfg := &flags.Config{
+        ServerAddress: "unix://" + socketPath,
+        Compression:   sender.CompressionNone,
+    }
+
+    sender.SendMetricsBatch(context.Background(), cfg, []metrics.Metrics{
+        {ID: "metric1", MType: "gauge", Value: float64Ptr(10)},
+    })
+
+    select {
+    case data := <-received:
+        assert.Len(t, data, 1)
+        assert.Equal(t, "metric1", data[0].ID)
+    default:
+        t.Fatal("metrics were not received over the unix socket")
+    }
+}
+
+func TestSendMetricsBatchCancel(t *testing.T) {
+    release := make(chan struct{})
+    handler := func(w http.ResponseWriter, r *http.Request) {
+        select {
+        case <-release:
+        case <-r.Context().Done():
+        }
+    }
+
+    server := httptest.NewServer(http.HandlerFunc(handler))
+    defer server.Close()
+    defer close(release)
+
+    cfg := &flags.Config{
+        ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+        Compression:   sender.CompressionNone,
+        MaxRetries:    2,
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    time.AfterFunc(50*time.Millisecond, cancel)
+
+    start := time.Now()
+    sender.SendMetricsBatch(ctx, cfg, []metrics.Metrics{
+        {ID: "metric1", MType: "gauge", Value: float64Ptr(10)},
+    })
+
+    // Без отмены запрос висел бы до ответа сервера, а затем ждал повторов
+    assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestSendMetricsBatchLocalAddress(t *testing.T) {
+    // Адреса 127.0.0.0/8, кроме 127.0.0.1, доступны не на всех системах
+    const localAddress = "127.0.0.2"
+    if err := sender.ValidateLocalAddress(localAddress); err != nil {
+        t.Skipf("loopback alias is not available: %v", err)
+    }
+
+    remote := make(chan string, 1)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host, _, _ := net.SplitHostPort(r.RemoteAddr)
+        remote <- host
+        w.WriteHeader(http.StatusOK)
+    }))
+    defer server.Close()
+
+    cfg := &flags.Config{
+        ServerAddress: strings.TrimPrefix(server.URL, "http://"),
+        Compression:   sender.CompressionNone,
+        LocalAddress:  localAddress,
+    }
+
+    sender.SendMetricsBatch(context.Background(), cfg, []metrics.Metrics{
+        {ID: "metric1", MType: "gauge", Value: float64Ptr(10)},
+    })
+
+    select {
+    case host := <-remote:
+        assert.Equal(t, localAddress, host)
+    default:
+        t.Fatal("metrics were not received")
+    }
+}
+
+func TestValidateLocalAddress(t *testing.T) {
+    assert.NoError(t, sender.ValidateLocalAddress(""))
+    assert.NoError(t, sender.ValidateLocalAddress("127.0.0.1"))
+    assert.Error(t, sender.ValidateLocalAddress("eth0"))
+    // Адрес из документационного диапазона не назначен ни одному интерфейсу
+    assert.Error(t, sender.ValidateLocalAddress("192.0.2.1"))
+}
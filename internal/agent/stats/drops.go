@@ -0,0 +1,61 @@
+package stats
+
+import "sync"
+
+// Причины, по которым агент выбрасывает метрики
+const (
+	DropBackpressure = "backpressure" // снимок вытеснен из переполненной очереди
+	DropSendFailed   = "send_failed"  // отправка не удалась после всех попыток
+)
+
+// DropStats счетчик выброшенных метрик с разбивкой по причинам
+type DropStats struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// Drops общий счетчик выброшенных метрик агента
+var Drops = NewDropStats()
+
+// NewDropStats создает новый счетчик выброшенных метрик
+func NewDropStats() *DropStats {
+	return &DropStats{
+		counts: make(map[string]int64),
+	}
+}
+
+// Add учитывает n выброшенных метрик по причине reason
+func (d *DropStats) Add(reason string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.counts[reason] += int64(n)
+}
+
+// Snapshot возвращает копию накопленных счетчиков
+func (d *DropStats) Snapshot() map[string]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	snapshot := make(map[string]int64, len(d.counts))
+	for reason, count := range d.counts {
+		snapshot[reason] = count
+	}
+	return snapshot
+}
+
+// Total возвращает общее количество выброшенных метрик
+func (d *DropStats) Total() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var total int64
+	for _, count := range d.counts {
+		total += count
+	}
+	return total
+}
@@ -0,0 +1,22 @@
+package stats
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDropStats(t *testing.T) {
+	d := NewDropStats()
+
+	d.Add(DropBackpressure, 3)
+	d.Add(DropSendFailed, 2)
+	d.Add(DropBackpressure, 1)
+	d.Add(DropSendFailed, 0)
+
+	assert.Equal(t, map[string]int64{
+		DropBackpressure: 4,
+		DropSendFailed:   2,
+	}, d.Snapshot())
+	assert.Equal(t, int64(6), d.Total())
+}
@@ -0,0 +1,79 @@
+// Package stats собирает метрики о работе самого агента
+package stats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+// Stats структура для хранения статистики отправок агента
+type Stats struct {
+	mu          sync.Mutex
+	attempts    int64     // количество попыток отправки с момента последнего отчета
+	failures    int64     // количество неудачных попыток с момента последнего отчета
+	total       int64     // общее количество попыток отправки
+	successes   int64     // общее количество успешных отправок
+	lastSuccess time.Time // время последней успешной отправки
+}
+
+// Default общий сборщик статистики агента
+var Default = New()
+
+// New создает новый сборщик статистики
+func New() *Stats {
+	return &Stats{}
+}
+
+// RecordSend учитывает результат очередной попытки отправки, включая повторные
+func (s *Stats) RecordSend(success bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attempts++
+	s.total++
+	if success {
+		s.successes++
+		s.lastSuccess = time.Now()
+		return
+	}
+	s.failures++
+}
+
+// Successes возвращает общее количество успешных отправок
+func (s *Stats) Successes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.successes
+}
+
+// Metrics возвращает метрики агента для отправки на сервер.
+// Счетчики передаются как прирост с момента предыдущего вызова
+func (s *Stats) Metrics() []metrics.Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts := s.attempts
+	failures := s.failures
+	s.attempts = 0
+	s.failures = 0
+
+	var successRate float64
+	if s.total > 0 {
+		successRate = float64(s.successes) / float64(s.total)
+	}
+
+	var lastSuccess float64
+	if !s.lastSuccess.IsZero() {
+		lastSuccess = float64(s.lastSuccess.Unix())
+	}
+
+	return []metrics.Metrics{
+		{ID: "AgentSendAttempts", MType: "counter", Delta: &attempts},
+		{ID: "AgentSendFailures", MType: "counter", Delta: &failures},
+		{ID: "AgentSendSuccessRate", MType: "gauge", Value: &successRate},
+		{ID: "AgentLastSuccessTime", MType: "gauge", Value: &lastSuccess},
+	}
+}
@@ -0,0 +1,50 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vova4o/yandexadv/internal/agent/metrics"
+)
+
+// findMetric ищет метрику по имени
+func findMetric(t *testing.T, batch []metrics.Metrics, id string) metrics.Metrics {
+	for _, m := range batch {
+		if m.ID == id {
+			return m
+		}
+	}
+	t.Fatalf("metric %s not found in batch", id)
+	return metrics.Metrics{}
+}
+
+func TestStatsMetrics(t *testing.T) {
+	s := New()
+
+	s.RecordSend(false)
+	s.RecordSend(false)
+	s.RecordSend(true)
+	s.RecordSend(false)
+
+	batch := s.Metrics()
+	assert.Len(t, batch, 4)
+
+	assert.Equal(t, int64(4), *findMetric(t, batch, "AgentSendAttempts").Delta)
+	assert.Equal(t, int64(3), *findMetric(t, batch, "AgentSendFailures").Delta)
+	assert.Equal(t, 0.25, *findMetric(t, batch, "AgentSendSuccessRate").Value)
+	assert.InDelta(t, float64(time.Now().Unix()), *findMetric(t, batch, "AgentLastSuccessTime").Value, 2)
+}
+
+func TestStatsCountersReset(t *testing.T) {
+	s := New()
+
+	s.RecordSend(false)
+	_ = s.Metrics()
+
+	batch := s.Metrics()
+	assert.Equal(t, int64(0), *findMetric(t, batch, "AgentSendAttempts").Delta)
+	assert.Equal(t, int64(0), *findMetric(t, batch, "AgentSendFailures").Delta)
+	assert.Equal(t, 0.0, *findMetric(t, batch, "AgentSendSuccessRate").Value)
+	assert.Equal(t, 0.0, *findMetric(t, batch, "AgentLastSuccessTime").Value)
+}
@@ -1,6 +1,13 @@
 package models
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
 
 // Metric структура для метрик
 type Metric struct {
@@ -12,9 +19,106 @@ type Metric struct {
 // Metrics структура для метрик с типом и значением
 type Metrics struct {
 	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
+	MType string   `json:"type"`            // параметр, принимающий значение gauge, counter или counterf
 	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge или приращение counterf
+
+	Labels map[string]string `json:"labels,omitempty"` // необязательные метки, метрики с разными метками хранятся отдельно
+
+	UpdatedAt time.Time `json:"-"` // время последнего обновления, заполняется хранилищем
+}
+
+// labelEscaper экранирует разделители в ключах и значениях меток
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `=`, `\=`)
+
+// LabelKey возвращает метки в каноническом виде k1=v1,k2=v2, отсортированные по ключу.
+// Символы \, запятая и = в ключах и значениях экранируются обратной косой чертой,
+// поэтому разные наборы меток не дают одинаковый ключ. Для метрики без меток возвращает пустую строку
+func (m Metrics) LabelKey() string {
+	if len(m.Labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labelEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(labelEscaper.Replace(m.Labels[k]))
+	}
+	return b.String()
+}
+
+// ValueString возвращает значение метрики в текстовом виде.
+// Для метрики без значения или неизвестного типа возвращает пустую строку
+func (m Metrics) ValueString() string {
+	switch m.MType {
+	case "gauge", "counterf":
+		if m.Value != nil {
+			return fmt.Sprintf("%v", *m.Value)
+		}
+	case "counter":
+		if m.Delta != nil {
+			return fmt.Sprintf("%v", *m.Delta)
+		}
+	}
+	return ""
+}
+
+// ValidationError ошибки проверки одной метрики из запроса
+type ValidationError struct {
+	Index  int      `json:"index"`  // позиция метрики в запросе
+	ID     string   `json:"id"`     // имя метрики
+	Errors []string `json:"errors"` // найденные ошибки
+}
+
+// ValidationReport результат проверки метрик без сохранения
+type ValidationReport struct {
+	Valid  bool              `json:"valid"`  // все метрики прошли проверку
+	Errors []ValidationError `json:"errors"` // ошибки по метрикам
+}
+
+// HistoryPoint значение gauge-метрики в истории
+type HistoryPoint struct {
+	Value     float64   `json:"value"`     // значение метрики
+	Timestamp time.Time `json:"timestamp"` // время обновления
+}
+
+// StorageStatus состояние хранилища для эндпоинта /status
+type StorageStatus struct {
+	Flush       string     `json:"flush"`                // состояние сохранения на диск: ok, error или disabled
+	LastFlush   *time.Time `json:"last_flush,omitempty"` // время последнего успешного сохранения
+	MetricCount int        `json:"metric_count"`         // количество метрик в хранилище
+}
+
+// Status сводное состояние сервера
+type Status struct {
+	Status  string        `json:"status"`  // ok или degraded
+	DB      string        `json:"db"`      // ok или unavailable
+	Storage StorageStatus `json:"storage"` // состояние хранилища
+	Uptime  string        `json:"uptime"`  // время работы сервера
+	Version string        `json:"version"` // версия сборки
+}
+
+// PingResult подробный ответ /ping?verbose=true
+type PingResult struct {
+	Status    string  `json:"status"`        // ok или error
+	DBLatency float64 `json:"db_latency_ms"` // время проверки БД в миллисекундах
+}
+
+// CounterDebug состояние counter-метрики для отладки накопления
+type CounterDebug struct {
+	ID        string `json:"id"`
+	Total     int64  `json:"total"`      // накопленное значение в хранилище
+	LastDelta *int64 `json:"last_delta"` // последнее примененное приращение, null если неизвестно
 }
 
 // HTTPError структура для ошибок с HTTP-статусом
@@ -27,8 +131,26 @@ type HTTPError struct {
 var (
 	ErrMetricTypeNotFound = errors.New("metric type not found")
 	ErrMetricNotFound     = errors.New("metric not found")
+	ErrStorageUnavailable = errors.New("storage unavailable")
+	ErrInvalidMetricValue = errors.New("invalid metric value")
+	ErrMetricNotAllowed   = errors.New("metric not allowed")
+	ErrFlushNotSupported  = errors.New("storage does not support flush")
+	ErrHistoryDisabled    = errors.New("metric history is disabled")
+	ErrNameTooLong        = errors.New("metric name or label too long")
+	ErrDeleteNotSupported = errors.New("storage does not support deletion")
+	ErrMetricTypeConflict = NewHTTPError(http.StatusConflict, "metric type conflict")
 )
 
+// OverloadError ошибка перегруженного хранилища: клиенту следует повторить запрос через RetryAfter
+type OverloadError struct {
+	RetryAfter time.Duration
+}
+
+// Error реализация интерфейса ошибки
+func (e *OverloadError) Error() string {
+	return fmt.Sprintf("storage overloaded, retry after %s", e.RetryAfter)
+}
+
 // Error реализация интерфейса ошибки
 func (e *HTTPError) Error() string {
 	return e.Message
@@ -40,3 +40,64 @@ func TestNewHTTPError(t *testing.T) {
 		})
 	}
 }
+
+func TestMetricsLabelKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "No labels", labels: nil, want: ""},
+		{name: "Empty labels", labels: map[string]string{}, want: ""},
+		{name: "Sorted by key", labels: map[string]string{"host": "a", "env": "prod"}, want: "env=prod,host=a"},
+		{name: "Separators escaped", labels: map[string]string{"a": "1,b=2"}, want: `a=1\,b\=2`},
+		{name: "Backslash escaped", labels: map[string]string{`a\`: `\`}, want: `a\\=\\`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Metrics{ID: "Alloc", MType: "gauge", Labels: tt.labels}).LabelKey(); got != tt.want {
+				t.Errorf("LabelKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("No collisions", func(t *testing.T) {
+		sets := []map[string]string{
+			{"a": "1,b=2"},
+			{"a": "1", "b": "2"},
+			{"a": `1\`, "b": "2"},
+			{"a": `1\,b=2`},
+		}
+		seen := make(map[string]int)
+		for i, labels := range sets {
+			key := Metrics{Labels: labels}.LabelKey()
+			if j, ok := seen[key]; ok {
+				t.Errorf("label sets %d and %d share key %q", j, i, key)
+			}
+			seen[key] = i
+		}
+	})
+}
+
+func TestMetricsValueString(t *testing.T) {
+	value := 10.5
+	delta := int64(7)
+	tests := []struct {
+		name   string
+		metric Metrics
+		want   string
+	}{
+		{name: "Gauge", metric: Metrics{MType: "gauge", Value: &value}, want: "10.5"},
+		{name: "Counter", metric: Metrics{MType: "counter", Delta: &delta}, want: "7"},
+		{name: "Float counter", metric: Metrics{MType: "counterf", Value: &value}, want: "10.5"},
+		{name: "Gauge without value", metric: Metrics{MType: "gauge", Delta: &delta}, want: ""},
+		{name: "Unknown type", metric: Metrics{MType: "histogram", Value: &value}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.metric.ValueString(); got != tt.want {
+				t.Errorf("ValueString() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
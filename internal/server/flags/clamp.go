@@ -0,0 +1,46 @@
+package flags
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ValueClamp ограничение значений метрик, имена которых начинаются с Prefix.
+// Пустой префикс задает ограничение для всех метрик
+type ValueClamp struct {
+	Prefix string
+	Min    float64
+	Max    float64
+}
+
+// ParseValueClamp разбирает ограничение вида "prefix=min:max".
+// Пропущенная граница не ограничивает значение, например "cpu.=0:" или "=:1e12"
+func ParseValueClamp(entry string) (ValueClamp, error) {
+	prefix, bounds, ok := strings.Cut(entry, "=")
+	if !ok {
+		return ValueClamp{}, fmt.Errorf("invalid value clamp %q: expected prefix=min:max", entry)
+	}
+	minStr, maxStr, ok := strings.Cut(bounds, ":")
+	if !ok {
+		return ValueClamp{}, fmt.Errorf("invalid value clamp %q: expected prefix=min:max", entry)
+	}
+
+	clamp := ValueClamp{Prefix: strings.TrimSpace(prefix), Min: math.Inf(-1), Max: math.Inf(1)}
+	var err error
+	if minStr = strings.TrimSpace(minStr); minStr != "" {
+		if clamp.Min, err = strconv.ParseFloat(minStr, 64); err != nil {
+			return ValueClamp{}, fmt.Errorf("invalid value clamp %q: %w", entry, err)
+		}
+	}
+	if maxStr = strings.TrimSpace(maxStr); maxStr != "" {
+		if clamp.Max, err = strconv.ParseFloat(maxStr, 64); err != nil {
+			return ValueClamp{}, fmt.Errorf("invalid value clamp %q: %w", entry, err)
+		}
+	}
+	if clamp.Min > clamp.Max {
+		return ValueClamp{}, fmt.Errorf("invalid value clamp %q: min is greater than max", entry)
+	}
+	return clamp, nil
+}
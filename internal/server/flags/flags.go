@@ -1,8 +1,14 @@
 package flags
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -18,10 +24,59 @@ type Config struct {
 	DBDSN           string
 	SecretKey       string
 	CryptoPath      string
+	CertFile        string
+	KeyFile         string
+	MaxBodySize     int64
+	AllowTypeChange bool
+	EmptyStatsText  string
+	AllowedOrigins  []string
+	MaxInFlight     int
+	StoreJitter     int
+	ReplayWindow    int
+	MetricWhitelist []string
+	AdminToken      string
+	MaxBatchSize    int
+	GzipMinSize     int
+	HistorySize     int
+	KeepAlive       bool
+	MaxConns        int
+	MetricAliases   map[string]string
+	GzipPoolSize    int
+	ContentTypes    []string
+	StatsTemplate   string
+	RejectPattern   string
+	RetryAfter      int
+	DBMaxConns      int
+	DBMinConns      int
+	DBConnLifetime  time.Duration
+	ReadCacheTTL    time.Duration
+	GaugePrecision  int
+	MaxNameLength   int
+	MaxLabelLength  int
+	Debug           bool
+	RejectOverride  bool
+	SlowRequest     time.Duration
+	RestoreURL      string
+	TLSMinVersion   string
+	TLSCiphers      []string
+	NoLogPaths      []string
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	DBFallback      bool
+	ValueClamps     []ValueClamp
+	ShutdownTimeout time.Duration
+	MaxGzipRatio    int
+	IngestQuota     int
+	QuotaWindow     time.Duration
+	Replica         bool
+	ReplicaURLs     []string
+	ReplicaInterval time.Duration
+
+	clampErrs []error // ошибки разбора ValueClamps, сообщаются из Validate
 }
 
 // GetFlags устанавливает и получает флаги
-func GetFlags() {
+func GetFlags() error {
 	// Set the environment variable names
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
 	bindEnvToViper("DatabaseDSN", "DATABASE_DSN")
@@ -32,6 +87,51 @@ func GetFlags() {
 	bindEnvToViper("ServerLoggerFile", "SERVER_LOGGER_FILE")
 	bindEnvToViper("Key", "KEY")
 	bindEnvToViper("CryptoKey", "CRYPTO_KEY")
+	bindEnvToViper("CertFile", "CERT_FILE")
+	bindEnvToViper("KeyFile", "KEY_FILE")
+	bindEnvToViper("MaxBodySize", "MAX_BODY_SIZE")
+	bindEnvToViper("AllowTypeChange", "ALLOW_TYPE_CHANGE")
+	bindEnvToViper("EmptyStatsText", "EMPTY_STATS_TEXT")
+	bindEnvToViper("AllowedOrigins", "ALLOWED_ORIGINS")
+	bindEnvToViper("MaxInFlight", "MAX_IN_FLIGHT")
+	bindEnvToViper("StoreJitter", "STORE_JITTER")
+	bindEnvToViper("ReplayWindow", "REPLAY_WINDOW")
+	bindEnvToViper("MetricWhitelist", "METRIC_WHITELIST")
+	bindEnvToViper("AdminToken", "ADMIN_TOKEN")
+	bindEnvToViper("MaxBatchSize", "MAX_BATCH_SIZE")
+	bindEnvToViper("GzipMinSize", "GZIP_MIN_SIZE")
+	bindEnvToViper("HistorySize", "HISTORY_SIZE")
+	bindEnvToViper("KeepAlive", "KEEP_ALIVE")
+	bindEnvToViper("MaxConns", "MAX_CONNS")
+	bindEnvToViper("GzipPoolSize", "GZIP_POOL_SIZE")
+	bindEnvToViper("ContentTypes", "CONTENT_TYPES")
+	bindEnvToViper("StatsTemplate", "STATS_TEMPLATE")
+	bindEnvToViper("RejectPattern", "REJECT_PATTERN")
+	bindEnvToViper("RetryAfter", "RETRY_AFTER")
+	bindEnvToViper("DBMaxConns", "DB_MAX_CONNS")
+	bindEnvToViper("DBMinConns", "DB_MIN_CONNS")
+	bindEnvToViper("DBConnLifetime", "DB_CONN_LIFETIME")
+	bindEnvToViper("ReadCacheTTL", "READ_CACHE_TTL")
+	bindEnvToViper("GaugePrecision", "GAUGE_PRECISION")
+	bindEnvToViper("MaxNameLength", "MAX_NAME_LENGTH")
+	bindEnvToViper("MaxLabelLength", "MAX_LABEL_LENGTH")
+	bindEnvToViper("Debug", "DEBUG")
+	bindEnvToViper("RejectMethodOverride", "REJECT_METHOD_OVERRIDE")
+	bindEnvToViper("SlowRequest", "SLOW_REQUEST")
+	bindEnvToViper("RestoreURL", "RESTORE_URL")
+	bindEnvToViper("TLSMinVersion", "TLS_MIN_VERSION")
+	bindEnvToViper("TLSCiphers", "TLS_CIPHERS")
+	bindEnvToViper("NoLogPaths", "NO_LOG_PATHS")
+	bindEnvToViper("BreakerFailures", "BREAKER_FAILURES")
+	bindEnvToViper("BreakerCooldown", "BREAKER_COOLDOWN")
+	bindEnvToViper("DBFallback", "DB_FALLBACK")
+	bindEnvToViper("ShutdownTimeout", "SHUTDOWN_TIMEOUT")
+	bindEnvToViper("MaxGzipRatio", "MAX_GZIP_RATIO")
+	bindEnvToViper("IngestQuota", "INGEST_QUOTA")
+	bindEnvToViper("QuotaWindow", "QUOTA_WINDOW")
+	bindEnvToViper("Replica", "REPLICA")
+	bindEnvToViper("ReplicaURLs", "REPLICA_URLS")
+	bindEnvToViper("ReplicaInterval", "REPLICA_INTERVAL")
 	bindEnvToViper("config", "CONFIG")
 
 	// Read the environment variables
@@ -39,22 +139,69 @@ func GetFlags() {
 
 	// Define the flags and bind them to viper
 	pflag.StringP("DatabaseDSN", "d", "", "Database DSN")
-	pflag.StringP("ServerAddress", "a", "localhost:9090", "HTTP server network address")
+	pflag.StringP("ServerAddress", "a", "localhost:9090", "HTTP server network address or unix:///path to a socket")
 	pflag.IntP("StoreInterval", "i", 300, "Interval in seconds to store the current server readings to disk")
 	pflag.StringP("FileStoragePath", "f", "", "Full filename where current values are saved")
 	pflag.BoolP("Restore", "r", true, "Whether to load previously saved values from the specified file at server startup")
 	pflag.StringP("ServerLoggerFile", "l", "serverlog.log", "Full filename where server logs are saved")
 	pflag.StringP("Key", "k", "", "Key for the server")
-	pflag.String("CryptoKey", "", "Path to TLS certificate directory")
+	pflag.String("CryptoKey", "", "Path to TLS certificate directory or comma-separated list of directories to search")
+	pflag.String("CertFile", "", "Path to TLS certificate file")
+	pflag.String("KeyFile", "", "Path to TLS private key file")
+	pflag.Int64("MaxBodySize", 1<<20, "Maximum request body size in bytes, 0 disables the limit")
+	pflag.Bool("AllowTypeChange", false, "Allow storing a metric under a name already used by a metric of another type")
+	pflag.String("EmptyStatsText", "No metrics yet", "Text shown on the statistics page when no metrics are stored")
+	pflag.String("AllowedOrigins", "", "Comma-separated list of origins allowed by CORS, * allows any origin")
+	pflag.Int("MaxInFlight", 0, "Maximum number of concurrent requests, 0 means unlimited")
+	pflag.Int("StoreJitter", 0, "Random deviation of the store interval in percent, 0 disables jitter")
+	pflag.Int("ReplayWindow", 0, "Window in seconds for rejecting stale or replayed signed requests, 0 disables the check")
+	pflag.String("MetricWhitelist", "", "Comma-separated list of metric names accepted for update, empty accepts any metric")
+	pflag.String("AdminToken", "", "Bearer token for admin endpoints, empty disables them")
+	pflag.Int("MaxBatchSize", 0, "Maximum number of metrics in one batch update, 0 means unlimited")
+	pflag.Int("GzipMinSize", 1024, "Minimum response size in bytes to compress with gzip")
+	pflag.Int("HistorySize", 0, "Number of recent values kept for each gauge, 0 disables history")
+	pflag.Bool("KeepAlive", true, "Enable HTTP keep-alive connections")
+	pflag.Int("MaxConns", 0, "Maximum number of simultaneous connections, 0 means unlimited")
+	pflag.Int("GzipPoolSize", 0, "Maximum number of gzip readers and writers reused at once, 0 means unlimited")
+	pflag.String("ContentTypes", "application/json,application/x-www-form-urlencoded,text/plain", "Comma-separated list of content types accepted by update handlers")
+	pflag.String("StatsTemplate", "", "Path to the statistics page template, empty uses the built-in template")
+	pflag.String("RejectPattern", "", "Regular expression for metric names to drop, e.g. names with UUIDs, empty accepts any name")
+	pflag.Int("RetryAfter", 1, "Time in seconds a write waits for a free database connection before failing with 429 and this Retry-After, 0 waits without limit")
+	pflag.Int("DBMaxConns", 10, "Maximum number of open database connections")
+	pflag.Int("DBMinConns", 2, "Number of idle database connections kept open")
+	pflag.Int("DBConnLifetime", 3600, "Maximum lifetime of a database connection in seconds")
+	pflag.Int("ReadCacheTTL", 0, "Lifetime in seconds of cached database reads, 0 disables the cache")
+	pflag.Int("BreakerFailures", 5, "Consecutive database failures after which requests fail fast, 0 disables the circuit breaker")
+	pflag.Int("BreakerCooldown", 30, "Time in seconds database requests fail fast before a trial request is let through")
+	pflag.Int("ShutdownTimeout", 5, "Time in seconds allowed for each shutdown step such as finishing in-flight requests; storage saving is always awaited")
+	pflag.Int("MaxGzipRatio", 100, "Maximum decompressed to compressed size ratio of request bodies, 0 disables the check")
+	pflag.Int("IngestQuota", 0, "Maximum number of metrics accepted from one client IP per quota window, 0 disables the quota")
+	pflag.Int("QuotaWindow", 86400, "Ingestion quota window in seconds")
+	pflag.Bool("Replica", false, "Run as a read-only replica: serve reads and reject metric updates with 405")
+	pflag.String("ReplicaURLs", "", "Comma-separated list of replica /import URLs to push the metrics dump to")
+	pflag.Int("ReplicaInterval", 30, "Interval in seconds between pushing the metrics dump to replicas")
+	pflag.Bool("DBFallback", false, "Keep metrics in memory while the database is unavailable and replay them on recovery, trading durability for availability; requires BreakerFailures")
+	pflag.Int("GaugePrecision", 0, "Number of decimal places gauge values are rounded to before storage, 0 disables rounding")
+	pflag.Int("MaxNameLength", 255, "Maximum metric name length in bytes, 0 disables the check")
+	pflag.Int("MaxLabelLength", 255, "Maximum label key and value length in bytes, 0 disables the check")
+	pflag.Bool("Debug", false, "Log at debug level including request bodies")
+	pflag.Bool("RejectMethodOverride", true, "Reject requests with X-HTTP-Method-Override headers instead of stripping them")
+	pflag.Int("SlowRequest", 1000, "Requests slower than this many milliseconds are logged at warn level, 0 disables it")
+	pflag.String("RestoreURL", "", "URL of another server's /dump to load the initial state from at startup")
+	pflag.String("TLSMinVersion", "1.2", "Minimum TLS version accepted by the server: 1.0, 1.1, 1.2 or 1.3")
+	pflag.String("TLSCiphers", defaultTLSCiphers, "Comma-separated list of TLS 1.2 cipher suites, empty uses the Go defaults")
+	pflag.String("NoLogPaths", "", "Comma-separated list of request paths excluded from access logging, e.g. /ping")
 	pflag.StringP("config", "c", "", "Path to the configuration file")
 
 	// Parse the command-line flags
-	pflag.Parse()
+	if err := pflag.CommandLine.Parse(os.Args[1:]); err != nil {
+		return fmt.Errorf("failed to parse flags: %w", err)
+	}
 
 	// Check for unknown flags
 	for _, arg := range pflag.Args() {
 		if !strings.HasPrefix(arg, "-") {
-			log.Fatalf("Unknown flag: %v", arg)
+			return fmt.Errorf("unknown flag: %v", arg)
 		}
 	}
 
@@ -67,6 +214,51 @@ func GetFlags() {
 	bindFlagToViper("ServerLoggerFile")
 	bindFlagToViper("Key")
 	bindFlagToViper("CryptoKey")
+	bindFlagToViper("CertFile")
+	bindFlagToViper("KeyFile")
+	bindFlagToViper("MaxBodySize")
+	bindFlagToViper("AllowTypeChange")
+	bindFlagToViper("EmptyStatsText")
+	bindFlagToViper("AllowedOrigins")
+	bindFlagToViper("MaxInFlight")
+	bindFlagToViper("StoreJitter")
+	bindFlagToViper("ReplayWindow")
+	bindFlagToViper("MetricWhitelist")
+	bindFlagToViper("AdminToken")
+	bindFlagToViper("MaxBatchSize")
+	bindFlagToViper("GzipMinSize")
+	bindFlagToViper("HistorySize")
+	bindFlagToViper("KeepAlive")
+	bindFlagToViper("MaxConns")
+	bindFlagToViper("GzipPoolSize")
+	bindFlagToViper("ContentTypes")
+	bindFlagToViper("StatsTemplate")
+	bindFlagToViper("RejectPattern")
+	bindFlagToViper("RetryAfter")
+	bindFlagToViper("DBMaxConns")
+	bindFlagToViper("DBMinConns")
+	bindFlagToViper("DBConnLifetime")
+	bindFlagToViper("ReadCacheTTL")
+	bindFlagToViper("GaugePrecision")
+	bindFlagToViper("MaxNameLength")
+	bindFlagToViper("MaxLabelLength")
+	bindFlagToViper("Debug")
+	bindFlagToViper("RejectMethodOverride")
+	bindFlagToViper("SlowRequest")
+	bindFlagToViper("RestoreURL")
+	bindFlagToViper("TLSMinVersion")
+	bindFlagToViper("TLSCiphers")
+	bindFlagToViper("NoLogPaths")
+	bindFlagToViper("BreakerFailures")
+	bindFlagToViper("BreakerCooldown")
+	bindFlagToViper("DBFallback")
+	bindFlagToViper("ShutdownTimeout")
+	bindFlagToViper("MaxGzipRatio")
+	bindFlagToViper("IngestQuota")
+	bindFlagToViper("QuotaWindow")
+	bindFlagToViper("Replica")
+	bindFlagToViper("ReplicaURLs")
+	bindFlagToViper("ReplicaInterval")
 	bindFlagToViper("config")
 
 	// Read configuration from JSON file if specified
@@ -76,11 +268,12 @@ func GetFlags() {
 		viper.SetConfigFile(configFile)
 		viper.SetConfigType("json")
 		if err := viper.ReadInConfig(); err != nil {
-			log.Fatalf("Error reading config file: %v", err)
+			return fmt.Errorf("error reading config file: %w", err)
 		}
 	}
 
 	log.Println("Configuration loaded successfully")
+	return nil
 }
 
 func bindFlagToViper(flagName string) {
@@ -102,9 +295,23 @@ func bindEnvToViper(viperKey, envKey string) {
 	}
 }
 
-// NewConfig создает новый экземпляр конфигурации
+// NewConfig создает новый экземпляр конфигурации.
+// При ошибке конфигурации завершает программу
 func NewConfig() *Config {
-	GetFlags()
+	config, err := Load()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	return config
+}
+
+// Load читает конфигурацию из флагов, переменных окружения и файла конфигурации
+func Load() (*Config, error) {
+	if err := GetFlags(); err != nil {
+		return nil, err
+	}
+
+	clamps, clampErrs := ValueClamps()
 	return &Config{
 		ServerAddress:   Address(),
 		StoreInterval:   Interval(),
@@ -114,7 +321,152 @@ func NewConfig() *Config {
 		DBDSN:           DBDSN(),
 		SecretKey:       Key(),
 		CryptoPath:      CryptoPath(),
+		CertFile:        CertFile(),
+		KeyFile:         KeyFile(),
+		MaxBodySize:     MaxBodySize(),
+		AllowTypeChange: AllowTypeChange(),
+		EmptyStatsText:  EmptyStatsText(),
+		AllowedOrigins:  AllowedOrigins(),
+		MaxInFlight:     MaxInFlight(),
+		StoreJitter:     StoreJitter(),
+		ReplayWindow:    ReplayWindow(),
+		MetricWhitelist: MetricWhitelist(),
+		AdminToken:      AdminToken(),
+		MaxBatchSize:    MaxBatchSize(),
+		GzipMinSize:     GzipMinSize(),
+		HistorySize:     HistorySize(),
+		KeepAlive:       KeepAlive(),
+		MaxConns:        MaxConns(),
+		MetricAliases:   MetricAliases(),
+		GzipPoolSize:    GzipPoolSize(),
+		ContentTypes:    ContentTypes(),
+		StatsTemplate:   StatsTemplate(),
+		RejectPattern:   RejectPattern(),
+		RetryAfter:      RetryAfter(),
+		DBMaxConns:      DBMaxConns(),
+		DBMinConns:      DBMinConns(),
+		DBConnLifetime:  DBConnLifetime(),
+		ReadCacheTTL:    ReadCacheTTL(),
+		GaugePrecision:  GaugePrecision(),
+		MaxNameLength:   MaxNameLength(),
+		MaxLabelLength:  MaxLabelLength(),
+		Debug:           Debug(),
+		RejectOverride:  RejectMethodOverride(),
+		SlowRequest:     SlowRequest(),
+		RestoreURL:      RestoreURL(),
+		TLSMinVersion:   TLSMinVersion(),
+		TLSCiphers:      TLSCiphers(),
+		NoLogPaths:      NoLogPaths(),
+		BreakerFailures: BreakerFailures(),
+		BreakerCooldown: BreakerCooldown(),
+		DBFallback:      DBFallback(),
+		ValueClamps:     clamps,
+		ShutdownTimeout: ShutdownTimeout(),
+		MaxGzipRatio:    MaxGzipRatio(),
+		IngestQuota:     IngestQuota(),
+		QuotaWindow:     QuotaWindow(),
+		Replica:         Replica(),
+		ReplicaURLs:     ReplicaURLs(),
+		ReplicaInterval: ReplicaInterval(),
+		clampErrs:       clampErrs,
+	}, nil
+}
+
+// Validate проверяет значения конфигурации и возвращает все найденные ошибки
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.ServerAddress == "" {
+		errs = append(errs, errors.New("ServerAddress must not be empty"))
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		errs = append(errs, errors.New("CertFile and KeyFile must be set together"))
+	}
+	if c.StoreJitter < 0 || c.StoreJitter > 100 {
+		errs = append(errs, fmt.Errorf("StoreJitter must be between 0 and 100, got %d", c.StoreJitter))
+	}
+
+	for name, value := range map[string]int64{
+		"StoreInterval":  int64(c.StoreInterval),
+		"MaxBodySize":    c.MaxBodySize,
+		"MaxInFlight":    int64(c.MaxInFlight),
+		"ReplayWindow":   int64(c.ReplayWindow),
+		"MaxBatchSize":   int64(c.MaxBatchSize),
+		"GzipMinSize":    int64(c.GzipMinSize),
+		"HistorySize":    int64(c.HistorySize),
+		"MaxConns":       int64(c.MaxConns),
+		"GzipPoolSize":   int64(c.GzipPoolSize),
+		"RetryAfter":     int64(c.RetryAfter),
+		"DBMaxConns":     int64(c.DBMaxConns),
+		"DBMinConns":     int64(c.DBMinConns),
+		"GaugePrecision": int64(c.GaugePrecision),
+		"MaxNameLength":  int64(c.MaxNameLength),
+		"MaxLabelLength": int64(c.MaxLabelLength),
+		"MaxGzipRatio":   int64(c.MaxGzipRatio),
+		"IngestQuota":    int64(c.IngestQuota),
+	} {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %d", name, value))
+		}
+	}
+
+	if c.DBMaxConns > 0 && c.DBMinConns > c.DBMaxConns {
+		errs = append(errs, fmt.Errorf("DBMinConns %d must not exceed DBMaxConns %d", c.DBMinConns, c.DBMaxConns))
+	}
+	if c.DBConnLifetime < 0 {
+		errs = append(errs, fmt.Errorf("DBConnLifetime must not be negative, got %s", c.DBConnLifetime))
+	}
+	if c.SlowRequest < 0 {
+		errs = append(errs, fmt.Errorf("SlowRequest must not be negative, got %s", c.SlowRequest))
+	}
+	if c.ReadCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("ReadCacheTTL must not be negative, got %s", c.ReadCacheTTL))
+	}
+	if c.BreakerFailures < 0 {
+		errs = append(errs, fmt.Errorf("BreakerFailures must not be negative, got %d", c.BreakerFailures))
+	}
+	if c.IngestQuota > 0 && c.QuotaWindow <= 0 {
+		errs = append(errs, fmt.Errorf("QuotaWindow must be positive when IngestQuota is set, got %s", c.QuotaWindow))
+	}
+	if len(c.ReplicaURLs) > 0 && c.ReplicaInterval <= 0 {
+		errs = append(errs, fmt.Errorf("ReplicaInterval must be positive when ReplicaURLs is set, got %s", c.ReplicaInterval))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("ShutdownTimeout must be positive, got %s", c.ShutdownTimeout))
+	}
+	if c.BreakerCooldown < 0 {
+		errs = append(errs, fmt.Errorf("BreakerCooldown must not be negative, got %s", c.BreakerCooldown))
+	}
+	if c.DBFallback && c.BreakerFailures == 0 {
+		errs = append(errs, errors.New("DBFallback requires the circuit breaker, BreakerFailures must be positive"))
+	}
+
+	if c.TLSMinVersion != "" {
+		if _, err := ParseTLSVersion(c.TLSMinVersion); err != nil {
+			errs = append(errs, fmt.Errorf("TLSMinVersion: %w", err))
+		}
+	}
+	if _, err := ParseCipherSuites(c.TLSCiphers); err != nil {
+		errs = append(errs, fmt.Errorf("TLSCiphers: %w", err))
+	}
+
+	if c.RejectPattern != "" {
+		if _, err := regexp.Compile(c.RejectPattern); err != nil {
+			errs = append(errs, fmt.Errorf("RejectPattern is not a valid regular expression: %w", err))
+		}
+	}
+
+	errs = append(errs, c.clampErrs...)
+
+	// Псевдонимы применяются однократно, поэтому цепочки не разрешаются
+	for from, to := range c.MetricAliases {
+		if _, ok := c.MetricAliases[to]; ok {
+			errs = append(errs, fmt.Errorf("metric alias %s=%s points to another alias", from, to))
+		}
 	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
 }
 
 // Key возвращает ключ
@@ -147,6 +499,275 @@ func CryptoPath() string {
 	return viper.GetString("CryptoKey")
 }
 
+// CertFile возвращает путь к файлу сертификата
+func CertFile() string {
+	return viper.GetString("CertFile")
+}
+
+// KeyFile возвращает путь к файлу приватного ключа
+func KeyFile() string {
+	return viper.GetString("KeyFile")
+}
+
+// MaxBodySize возвращает максимальный размер тела запроса в байтах
+func MaxBodySize() int64 {
+	return viper.GetInt64("MaxBodySize")
+}
+
+// AllowTypeChange возвращает флаг, разрешающий хранить метрики разных типов под одним именем
+func AllowTypeChange() bool {
+	return viper.GetBool("AllowTypeChange")
+}
+
+// EmptyStatsText возвращает текст страницы статистики при отсутствии метрик
+func EmptyStatsText() string {
+	return viper.GetString("EmptyStatsText")
+}
+
+// AllowedOrigins возвращает список источников, которым разрешен CORS
+func AllowedOrigins() []string {
+	return stringList("AllowedOrigins")
+}
+
+// MetricWhitelist возвращает список имен метрик, разрешенных к обновлению
+func MetricWhitelist() []string {
+	return stringList("MetricWhitelist")
+}
+
+// AdminToken возвращает токен доступа к административным эндпоинтам
+func AdminToken() string {
+	return viper.GetString("AdminToken")
+}
+
+// MaxBatchSize возвращает максимальное количество метрик в одном пакете
+func MaxBatchSize() int {
+	return viper.GetInt("MaxBatchSize")
+}
+
+// GzipMinSize возвращает минимальный размер ответа для сжатия в байтах
+func GzipMinSize() int {
+	return viper.GetInt("GzipMinSize")
+}
+
+// HistorySize возвращает количество хранимых значений каждой gauge-метрики
+func HistorySize() int {
+	return viper.GetInt("HistorySize")
+}
+
+// KeepAlive возвращает флаг включения keep-alive соединений
+func KeepAlive() bool {
+	return viper.GetBool("KeepAlive")
+}
+
+// MaxConns возвращает максимальное количество одновременных соединений
+func MaxConns() int {
+	return viper.GetInt("MaxConns")
+}
+
+// GzipPoolSize возвращает максимальное количество одновременно переиспользуемых gzip-объектов
+func GzipPoolSize() int {
+	return viper.GetInt("GzipPoolSize")
+}
+
+// MetricAliases возвращает псевдонимы метрик из файла конфигурации: старое имя -> новое имя.
+// В файле псевдонимы задаются списком строк вида "old=new", чтобы viper не менял регистр имен
+func MetricAliases() map[string]string {
+	aliases := make(map[string]string)
+	for _, entry := range viper.GetStringSlice("MetricAliases") {
+		oldName, newName, ok := strings.Cut(entry, "=")
+		oldName, newName = strings.TrimSpace(oldName), strings.TrimSpace(newName)
+		if !ok || oldName == "" || newName == "" {
+			log.Printf("Skipping invalid metric alias %q", entry)
+			continue
+		}
+		aliases[oldName] = newName
+	}
+	return aliases
+}
+
+// ValueClamps возвращает ограничения значений метрик из файла конфигурации и ошибки разбора неверных записей.
+// В файле ограничения задаются списком строк вида "prefix=min:max"
+func ValueClamps() ([]ValueClamp, []error) {
+	var clamps []ValueClamp
+	var errs []error
+	for _, entry := range viper.GetStringSlice("ValueClamps") {
+		clamp, err := ParseValueClamp(entry)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		clamps = append(clamps, clamp)
+	}
+	return clamps, errs
+}
+
+// ContentTypes возвращает список типов содержимого, принимаемых обработчиками обновления
+func ContentTypes() []string {
+	return stringList("ContentTypes")
+}
+
+// StatsTemplate возвращает путь к файлу шаблона страницы статистики
+func StatsTemplate() string {
+	return viper.GetString("StatsTemplate")
+}
+
+// RejectPattern возвращает регулярное выражение для отбрасываемых имен метрик
+func RejectPattern() string {
+	return viper.GetString("RejectPattern")
+}
+
+// RetryAfter возвращает задержку в секундах, которую сервер просит выдержать при перегрузке хранилища
+func RetryAfter() int {
+	return viper.GetInt("RetryAfter")
+}
+
+// DBMaxConns возвращает максимальное количество соединений с базой данных
+func DBMaxConns() int {
+	return viper.GetInt("DBMaxConns")
+}
+
+// DBMinConns возвращает количество постоянно открытых соединений с базой данных
+func DBMinConns() int {
+	return viper.GetInt("DBMinConns")
+}
+
+// DBConnLifetime возвращает максимальное время жизни соединения с базой данных
+func DBConnLifetime() time.Duration {
+	return time.Duration(viper.GetInt("DBConnLifetime")) * time.Second
+}
+
+// ReadCacheTTL возвращает время жизни закэшированных чтений из базы данных
+func ReadCacheTTL() time.Duration {
+	return time.Duration(viper.GetInt("ReadCacheTTL")) * time.Second
+}
+
+// BreakerFailures возвращает количество ошибок базы данных подряд, после которого запросы отклоняются сразу
+func BreakerFailures() int {
+	return viper.GetInt("BreakerFailures")
+}
+
+// BreakerCooldown возвращает время, в течение которого запросы к базе данных отклоняются сразу
+func BreakerCooldown() time.Duration {
+	return time.Duration(viper.GetInt("BreakerCooldown")) * time.Second
+}
+
+// ShutdownTimeout возвращает время, отведенное на остановку хранилища и сервера
+func ShutdownTimeout() time.Duration {
+	return time.Duration(viper.GetInt("ShutdownTimeout")) * time.Second
+}
+
+// MaxGzipRatio возвращает допустимое отношение размера распакованного тела запроса к сжатому
+func MaxGzipRatio() int {
+	return viper.GetInt("MaxGzipRatio")
+}
+
+// IngestQuota возвращает количество метрик, принимаемых от одного клиента за окно квоты
+func IngestQuota() int {
+	return viper.GetInt("IngestQuota")
+}
+
+// QuotaWindow возвращает окно квоты на прием метрик
+func QuotaWindow() time.Duration {
+	return time.Duration(viper.GetInt("QuotaWindow")) * time.Second
+}
+
+// Replica возвращает, работает ли сервер как реплика только для чтения
+func Replica() bool {
+	return viper.GetBool("Replica")
+}
+
+// ReplicaURLs возвращает адреса /import реплик, на которые отправляется снимок метрик
+func ReplicaURLs() []string {
+	return stringList("ReplicaURLs")
+}
+
+// ReplicaInterval возвращает интервал отправки снимка метрик на реплики
+func ReplicaInterval() time.Duration {
+	return time.Duration(viper.GetInt("ReplicaInterval")) * time.Second
+}
+
+// DBFallback возвращает флаг хранения метрик в памяти на время недоступности базы данных
+func DBFallback() bool {
+	return viper.GetBool("DBFallback")
+}
+
+// GaugePrecision возвращает количество знаков после запятой для округления gauge, 0 - без округления
+func GaugePrecision() int {
+	return viper.GetInt("GaugePrecision")
+}
+
+// MaxNameLength возвращает максимальную длину имени метрики в байтах, 0 - без ограничения
+func MaxNameLength() int {
+	return viper.GetInt("MaxNameLength")
+}
+
+// MaxLabelLength возвращает максимальную длину ключа и значения метки в байтах, 0 - без ограничения
+func MaxLabelLength() int {
+	return viper.GetInt("MaxLabelLength")
+}
+
+// Debug возвращает флаг отладочного логирования, включая тела запросов
+func Debug() bool {
+	return viper.GetBool("Debug")
+}
+
+// RejectMethodOverride возвращает флаг отклонения запросов с заголовками подмены метода
+func RejectMethodOverride() bool {
+	return viper.GetBool("RejectMethodOverride")
+}
+
+// SlowRequest возвращает время обработки, после которого запрос логируется как медленный
+func SlowRequest() time.Duration {
+	return time.Duration(viper.GetInt("SlowRequest")) * time.Millisecond
+}
+
+// RestoreURL возвращает адрес /dump другого сервера для восстановления при запуске
+func RestoreURL() string {
+	return viper.GetString("RestoreURL")
+}
+
+// TLSMinVersion возвращает минимальную версию TLS, принимаемую сервером
+func TLSMinVersion() string {
+	return viper.GetString("TLSMinVersion")
+}
+
+// TLSCiphers возвращает список разрешенных наборов шифров TLS 1.2
+func TLSCiphers() []string {
+	return stringList("TLSCiphers")
+}
+
+// NoLogPaths возвращает пути запросов, которые не попадают в журнал запросов
+func NoLogPaths() []string {
+	return stringList("NoLogPaths")
+}
+
+// stringList разбирает значение viper как список через запятую
+func stringList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(viper.GetString(key), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// MaxInFlight возвращает максимальное количество одновременно обрабатываемых запросов
+func MaxInFlight() int {
+	return viper.GetInt("MaxInFlight")
+}
+
+// StoreJitter возвращает разброс интервала сохранения на диск в процентах
+func StoreJitter() int {
+	return viper.GetInt("StoreJitter")
+}
+
+// ReplayWindow возвращает окно защиты от повтора подписанных запросов в секундах
+func ReplayWindow() int {
+	return viper.GetInt("ReplayWindow")
+}
+
 // FileStoragePath возвращает путь к файлу хранения
 func FileStoragePath() string {
 	path := viper.GetString("FileStoragePath")
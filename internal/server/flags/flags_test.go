@@ -1,8 +1,11 @@
 package flags
 
 import (
+	"math"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -37,3 +40,146 @@ func TestNewConfig(t *testing.T) {
 	os.Unsetenv("FILE_STORAGE_PATH")
 	os.Unsetenv("RESTORE")
 }
+
+// resetFlags сбрасывает viper и флаги и подменяет аргументы командной строки
+func resetFlags(t *testing.T, args ...string) {
+	viper.Reset()
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	oldArgs := os.Args
+	os.Args = append([]string{"server"}, args...)
+	t.Cleanup(func() { os.Args = oldArgs })
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("Unknown argument", func(t *testing.T) {
+		resetFlags(t, "extra")
+
+		config, err := Load()
+		assert.Error(t, err)
+		assert.Nil(t, config)
+	})
+
+	t.Run("Invalid flag", func(t *testing.T) {
+		resetFlags(t, "--StoreInterval=abc")
+
+		_, err := Load()
+		assert.Error(t, err)
+	})
+
+	t.Run("Missing config file", func(t *testing.T) {
+		resetFlags(t, "-c", filepath.Join(t.TempDir(), "missing.json"))
+
+		_, err := Load()
+		assert.Error(t, err)
+	})
+
+	t.Run("Config file value", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		assert.NoError(t, os.WriteFile(path, []byte(`{"ServerAddress": "file:9090"}`), 0600))
+		resetFlags(t, "-c", path)
+
+		config, err := Load()
+		assert.NoError(t, err)
+		assert.Equal(t, "file:9090", config.ServerAddress)
+	})
+
+	t.Run("Flag overrides config file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		assert.NoError(t, os.WriteFile(path, []byte(`{"ServerAddress": "file:9090"}`), 0600))
+		resetFlags(t, "-c", path, "-a", "flag:9090")
+
+		config, err := Load()
+		assert.NoError(t, err)
+		assert.Equal(t, "flag:9090", config.ServerAddress)
+	})
+
+	t.Run("Metric aliases from config file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		assert.NoError(t, os.WriteFile(path, []byte(`{"MetricAliases": ["OldAlloc=Alloc", "broken"]}`), 0600))
+		resetFlags(t, "-c", path)
+
+		config, err := Load()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"OldAlloc": "Alloc"}, config.MetricAliases)
+	})
+
+	t.Run("Value clamps from config file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		assert.NoError(t, os.WriteFile(path, []byte(`{"ValueClamps": ["cpu.=0:100", "=:1e12", "bad=5:1", "broken"]}`), 0600))
+		resetFlags(t, "-c", path)
+
+		config, err := Load()
+		assert.NoError(t, err)
+		assert.Equal(t, []ValueClamp{
+			{Prefix: "cpu.", Min: 0, Max: 100},
+			{Prefix: "", Min: math.Inf(-1), Max: 1e12},
+		}, config.ValueClamps)
+
+		err = config.Validate()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), `invalid value clamp "bad=5:1": min is greater than max`)
+			assert.Contains(t, err.Error(), `invalid value clamp "broken"`)
+		}
+	})
+
+	t.Run("Shutdown timeout", func(t *testing.T) {
+		resetFlags(t)
+		config, err := Load()
+		assert.NoError(t, err)
+		assert.Equal(t, 5*time.Second, config.ShutdownTimeout)
+
+		t.Setenv("SHUTDOWN_TIMEOUT", "30")
+		resetFlags(t)
+		config, err = Load()
+		assert.NoError(t, err)
+		assert.Equal(t, 30*time.Second, config.ShutdownTimeout)
+	})
+
+	t.Run("Environment overrides flag", func(t *testing.T) {
+		t.Setenv("ADDRESS", "env:9090")
+		resetFlags(t, "-a", "flag:9090")
+
+		config, err := Load()
+		assert.NoError(t, err)
+		assert.Equal(t, "env:9090", config.ServerAddress)
+	})
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Run("Valid config file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		assert.NoError(t, os.WriteFile(path, []byte(`{"ServerAddress": "localhost:9090", "StoreJitter": 10}`), 0600))
+		resetFlags(t, "--config", path)
+
+		config, err := Load()
+		assert.NoError(t, err)
+		assert.NoError(t, config.Validate())
+	})
+
+	t.Run("Invalid config file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		data := `{
+			"ServerAddress": "",
+			"CertFile": "cert.pem",
+			"StoreJitter": 150,
+			"MaxConns": -1,
+			"MetricAliases": ["A=B", "B=C"],
+			"TLSMinVersion": "1.4",
+			"TLSCiphers": "TLS_RSA_WITH_RC4_128_SHA",
+			"DBFallback": true,
+			"BreakerFailures": 0
+		}`
+		assert.NoError(t, os.WriteFile(path, []byte(data), 0600))
+		resetFlags(t, "--config", path)
+
+		config, err := Load()
+		assert.NoError(t, err)
+
+		err = config.Validate()
+		assert.Error(t, err)
+		for _, msg := range []string{"ServerAddress", "CertFile and KeyFile", "StoreJitter", "MaxConns", "A=B", "TLSMinVersion", "TLSCiphers", "DBFallback"} {
+			assert.Contains(t, err.Error(), msg)
+		}
+	})
+}
@@ -4,38 +4,139 @@ package handler
 
 import (
 	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/vova4o/yandexadv/internal/models"
+	"github.com/vova4o/yandexadv/internal/server/middleware"
 )
 
 // UpdateBatchMetricsHandler обработчик для обновления метрик в формате JSON by batch
 func (s *Router) UpdateBatchMetricsHandler(c *gin.Context) {
 	var metrics []models.Metrics
-	if err := c.BindJSON(&metrics); err != nil {
+	if err := c.ShouldBindJSON(&metrics); err != nil {
 		// log.Printf("Failed to bind JSON: %v", err)
-		c.String(http.StatusBadRequest, "bad request")
+		respondBindError(c, err)
+		return
+	}
+
+	if s.maxBatch > 0 && len(metrics) > s.maxBatch {
+		log.Printf("Batch of %d metrics exceeds limit %d", len(metrics), s.maxBatch)
+		c.String(http.StatusRequestEntityTooLarge, "too many metrics in batch")
+		return
+	}
+	if !s.takeQuota(c, len(metrics)) {
 		return
 	}
 
 	// log.Printf("Received POST JSON metrics for update: %v", metrics)
 
-	if err := s.Service.UpdateBatchMetricsServ(metrics); err != nil {
+	if err := s.Service.UpdateBatchMetricsServ(c.Request.Context(), metrics); err != nil {
 		// log.Printf("Failed to update metrics: %v", err)
-		c.String(http.StatusInternalServerError, "internal server error")
+		respondServiceError(c, err, "internal server error")
 		return
 	}
 
 	c.Status(http.StatusOK)
 }
 
-// PingHandler обработчик для проверки подключения к базе данных
+// ValidateHandler проверяет метрики из запроса и возвращает отчет об ошибках, ничего не сохраняя.
+// Принимает как одну метрику, так и массив метрик
+func (s *Router) ValidateHandler(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	var metrics []models.Metrics
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		var metric models.Metrics
+		err = json.Unmarshal(trimmed, &metric)
+		metrics = append(metrics, metric)
+	} else {
+		err = json.Unmarshal(trimmed, &metrics)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.Service.ValidateMetrics(metrics))
+}
+
+// respondBindError отвечает клиенту в зависимости от ошибки разбора тела запроса
+func respondBindError(c *gin.Context, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || errors.Is(err, middleware.ErrRatioExceeded) {
+		c.String(http.StatusRequestEntityTooLarge, "request entity too large")
+		return
+	}
+	c.String(http.StatusBadRequest, "bad request")
+}
+
+// respondServiceError отвечает клиенту кодом, соответствующим ошибке сервиса.
+// fallback используется как тело ответа для неизвестных ошибок
+func respondServiceError(c *gin.Context, err error, fallback string) {
+	var httpErr *models.HTTPError
+	var overloadErr *models.OverloadError
+	switch {
+	case errors.As(err, &overloadErr):
+		seconds := int(math.Ceil(overloadErr.RetryAfter.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.String(http.StatusTooManyRequests, "storage overloaded")
+	case errors.Is(err, models.ErrMetricNotFound):
+		c.String(http.StatusNotFound, models.ErrMetricNotFound.Error())
+	case errors.Is(err, models.ErrInvalidMetricValue):
+		c.String(http.StatusBadRequest, models.ErrInvalidMetricValue.Error())
+	case errors.Is(err, models.ErrNameTooLong):
+		c.String(http.StatusBadRequest, models.ErrNameTooLong.Error())
+	case errors.Is(err, models.ErrMetricNotAllowed):
+		c.String(http.StatusForbidden, models.ErrMetricNotAllowed.Error())
+	case errors.Is(err, models.ErrStorageUnavailable):
+		c.String(http.StatusServiceUnavailable, models.ErrStorageUnavailable.Error())
+	case errors.As(err, &httpErr):
+		c.String(httpErr.Status, httpErr.Message)
+	default:
+		c.String(http.StatusInternalServerError, fallback)
+	}
+}
+
+// PingHandler обработчик для проверки подключения к базе данных.
+// С параметром verbose=true отвечает JSON со временем проверки БД
 func (s *Router) PingHandler(c *gin.Context) {
-	log.Printf("Ping handler called with headers: %+v", c.Request.Header)
-	err := s.Service.PingDB()
+	log.Printf("Ping handler called with headers: %+v", middleware.RedactHeaders(c.Request.Header))
+	start := time.Now()
+	err := s.Service.PingDB(c.Request.Context())
+	latency := time.Since(start)
+
+	if verbose, _ := strconv.ParseBool(c.Query("verbose")); verbose {
+		result := models.PingResult{Status: "ok", DBLatency: float64(latency.Microseconds()) / 1000}
+		status := http.StatusOK
+		if err != nil {
+			log.Printf("Failed to ping database: %v", err)
+			result.Status = "error"
+			status = http.StatusInternalServerError
+		}
+		c.JSON(status, result)
+		return
+	}
+
 	if err != nil {
 		log.Printf("Failed to ping database: %v", err)
 		c.String(http.StatusInternalServerError, "internal server error")
@@ -46,6 +147,151 @@ func (s *Router) PingHandler(c *gin.Context) {
 	c.String(http.StatusOK, "pong")
 }
 
+// StatusHandler обработчик сводного состояния сервера.
+// Недоступность БД или ошибки хранилища не меняют код ответа, а переводят статус в degraded
+func (s *Router) StatusHandler(c *gin.Context) {
+	status := models.Status{
+		Status:  "ok",
+		DB:      "ok",
+		Uptime:  time.Since(s.startTime).Round(time.Second).String(),
+		Version: s.version,
+	}
+
+	if err := s.Service.PingDB(c.Request.Context()); err != nil {
+		log.Printf("Status: database unavailable: %v", err)
+		status.DB = "unavailable"
+		status.Status = "degraded"
+	}
+
+	storageStatus, err := s.Service.StorageStatus(c.Request.Context())
+	if err != nil {
+		log.Printf("Status: failed to get storage status: %v", err)
+		status.Status = "degraded"
+	}
+	if storageStatus.Flush == "error" {
+		status.Status = "degraded"
+	}
+	status.Storage = storageStatus
+
+	c.JSON(http.StatusOK, status)
+}
+
+// CountsHandler обработчик количества метрик по типам
+func (s *Router) CountsHandler(c *gin.Context) {
+	counts, err := s.Service.CountMetrics(c.Request.Context())
+	if err != nil {
+		respondServiceError(c, err, "failed to count metrics")
+		return
+	}
+
+	c.JSON(http.StatusOK, counts)
+}
+
+// HistoryHandler обработчик истории значений gauge-метрики.
+// Параметр limit ограничивает количество последних значений
+func (s *Router) HistoryHandler(c *gin.Context) {
+	limit := 0
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.String(http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	metric := models.Metrics{MType: c.Param("type"), ID: c.Param("name")}
+	points, err := s.Service.History(metric, limit)
+	if errors.Is(err, models.ErrHistoryDisabled) {
+		c.String(http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondServiceError(c, err, "failed to get history")
+		return
+	}
+
+	c.JSON(http.StatusOK, points)
+}
+
+// ImportHandler сохраняет снимок метрик, отправленный основным сервером.
+// Значения заменяют сохраненные, маршрут регистрируется только на репликах с ключом подписи
+func (s *Router) ImportHandler(c *gin.Context) {
+	var metrics []models.Metrics
+	if err := c.ShouldBindJSON(&metrics); err != nil {
+		respondBindError(c, err)
+		return
+	}
+
+	count, err := s.Service.ImportMetrics(c.Request.Context(), metrics)
+	if err != nil {
+		respondServiceError(c, err, "failed to import metrics")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"imported": count})
+}
+
+// CounterDebugHandler обработчик отладочного запроса счетчика:
+// возвращает накопленное значение и последнее примененное приращение
+func (s *Router) CounterDebugHandler(c *gin.Context) {
+	debug, err := s.Service.CounterDebug(c.Request.Context(), c.Param("name"))
+	if err != nil {
+		respondServiceError(c, err, "failed to get counter")
+		return
+	}
+
+	c.JSON(http.StatusOK, debug)
+}
+
+// AdminFlushHandler обработчик принудительного сохранения хранилища.
+// Возвращает количество сохраненных метрик, доступ проверяет AdminAuth
+func (s *Router) AdminFlushHandler(c *gin.Context) {
+	count, err := s.Service.Flush()
+	if errors.Is(err, models.ErrFlushNotSupported) {
+		c.String(http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		respondServiceError(c, err, "failed to flush storage")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"flushed": count})
+}
+
+// DeletePrefixHandler удаляет все метрики, имя которых начинается с префикса из пути,
+// и возвращает их количество. Доступ проверяет AdminAuth
+func (s *Router) DeletePrefixHandler(c *gin.Context) {
+	count, err := s.Service.DeleteByPrefix(c.Request.Context(), c.Param("prefix"))
+	if errors.Is(err, models.ErrDeleteNotSupported) {
+		c.String(http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		respondServiceError(c, err, "failed to delete metrics")
+		return
+	}
+
+	log.Printf("Deleted %d metrics with prefix %q", count, c.Param("prefix"))
+	c.JSON(http.StatusOK, gin.H{"deleted": count})
+}
+
+// AdminDrainHandler переводит сервер в режим только для чтения: обновления получают 503,
+// чтение продолжает работать. Доступ проверяет AdminAuth
+func (s *Router) AdminDrainHandler(c *gin.Context) {
+	s.draining.Store(true)
+	log.Printf("Server is draining, updates are rejected")
+	c.JSON(http.StatusOK, gin.H{"draining": true})
+}
+
+// AdminUndrainHandler снова разрешает обновления после AdminDrainHandler
+func (s *Router) AdminUndrainHandler(c *gin.Context) {
+	s.draining.Store(false)
+	log.Printf("Server is accepting updates again")
+	c.JSON(http.StatusOK, gin.H{"draining": false})
+}
+
 // GetValueHandlerJSON обработчик для передачи значения метрики в формате JSON
 func (s *Router) GetValueHandlerJSON(c *gin.Context) {
 	var metricReq models.Metrics
@@ -60,15 +306,10 @@ func (s *Router) GetValueHandlerJSON(c *gin.Context) {
 	// log.Printf("Received GET JSON request for metric: %v", metricReq)
 
 	// Получение значения метрики
-	metricResp, err := s.Service.GetValueServJSON(metricReq)
+	metricResp, err := s.Service.GetValueServJSON(c.Request.Context(), metricReq)
 	if err != nil {
-		if err == models.ErrMetricNotFound {
-			// log.Printf("Metric not found: %v", err)
-			c.String(http.StatusNotFound, "metric not found")
-			return
-		}
 		// log.Printf("Failed to get updated value: %v", err)
-		c.String(http.StatusInternalServerError, "internal server error")
+		respondServiceError(c, err, "internal server error")
 		return
 	}
 
@@ -78,17 +319,34 @@ func (s *Router) GetValueHandlerJSON(c *gin.Context) {
 	c.JSON(http.StatusOK, metricResp)
 }
 
-// UpdateMetricHandlerJSON обработчик для обновления метрики в формате JSON
+// UpdateMetricHandlerJSON обработчик для обновления метрики в формате JSON.
+// Также принимает метрику в виде полей формы application/x-www-form-urlencoded
 func (s *Router) UpdateMetricHandlerJSON(c *gin.Context) {
 	var metric models.Metrics
-	if err := c.BindJSON(&metric); err != nil {
+	if c.ContentType() == gin.MIMEPOSTForm {
+		if err := c.Request.ParseForm(); err != nil {
+			respondBindError(c, err)
+			return
+		}
+
+		formMetric, err := metricFromForm(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		metric = formMetric
+	} else if err := c.ShouldBindJSON(&metric); err != nil {
 		// log.Printf("Failed to bind JSON: %v", err)
-		c.String(http.StatusBadRequest, "bad request")
+		respondBindError(c, err)
 		return
 	}
 
 	// log.Printf("Received POST JSON metric for update: ID=%s, Type=%s, Delta=%v, Value=%v", metric.ID, metric.MType, metric.Delta, metric.Value)
 
+	if !s.takeQuota(c, 1) {
+		return
+	}
+
 	// // Преобразование указателей в значения
 	// if metric.MType == "gauge" && metric.Value != nil {
 	//     value := *metric.Value
@@ -98,27 +356,17 @@ func (s *Router) UpdateMetricHandlerJSON(c *gin.Context) {
 	//     metric.Delta = &delta
 	// }
 
-	err := s.Service.UpdateServJSON(&metric)
+	err := s.Service.UpdateServJSON(c.Request.Context(), &metric)
 	if err != nil {
-		if httpErr, ok := err.(*models.HTTPError); ok {
-			// log.Printf("Error: %v", httpErr.Message)
-			c.String(httpErr.Status, httpErr.Message)
-			return
-		}
 		// log.Printf("Internal server error: %v", err)
-		c.String(http.StatusInternalServerError, "internal server error")
+		respondServiceError(c, err, "internal server error")
 		return
 	}
 
-	updatedVal, err := s.Service.GetValueServJSON(metric)
+	updatedVal, err := s.Service.GetValueServJSON(c.Request.Context(), metric)
 	if err != nil {
-		if err == models.ErrMetricNotFound {
-			// log.Printf("Metric not found: %v", err)
-			c.String(http.StatusNotFound, "metric not found")
-			return
-		}
 		// log.Printf("Failed to get updated value: %v", err)
-		c.String(http.StatusInternalServerError, "internal server error")
+		respondServiceError(c, err, "internal server error")
 		return
 	}
 
@@ -127,26 +375,123 @@ func (s *Router) UpdateMetricHandlerJSON(c *gin.Context) {
 	c.JSON(http.StatusOK, updatedVal)
 }
 
+// metricFromForm собирает метрику из полей формы id, type, value и delta
+func metricFromForm(c *gin.Context) (models.Metrics, error) {
+	metric := models.Metrics{
+		ID:    c.PostForm("id"),
+		MType: c.PostForm("type"),
+	}
+
+	switch metric.MType {
+	case "gauge":
+		value, err := strconv.ParseFloat(c.PostForm("value"), 64)
+		if err != nil {
+			return metric, errors.New("invalid gauge value")
+		}
+		metric.Value = &value
+	case "counter":
+		delta, err := strconv.ParseInt(c.PostForm("delta"), 10, 64)
+		if err != nil {
+			return metric, errors.New("invalid counter value")
+		}
+		metric.Delta = &delta
+	case "counterf":
+		value, err := strconv.ParseFloat(c.PostForm("value"), 64)
+		if err != nil {
+			return metric, errors.New("invalid counterf value")
+		}
+		metric.Value = &value
+	}
+
+	return metric, nil
+}
+
+// ExportCSVHandler выгружает все метрики в формате CSV
+func (s *Router) ExportCSVHandler(c *gin.Context) {
+	metrics, err := s.Service.ExportMetrics(c.Request.Context())
+	if err != nil {
+		respondServiceError(c, err, "internal server error")
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="metrics.csv"`)
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write([]string{"id", "type", "value", "delta", "last_updated", "labels"})
+	for _, metric := range metrics {
+		var value, delta, updated string
+		if metric.Value != nil {
+			value = strconv.FormatFloat(*metric.Value, 'f', -1, 64)
+		}
+		if metric.Delta != nil {
+			delta = strconv.FormatInt(*metric.Delta, 10)
+		}
+		if !metric.UpdatedAt.IsZero() {
+			updated = metric.UpdatedAt.UTC().Format(time.RFC3339)
+		}
+		_ = w.Write([]string{metric.ID, metric.MType, value, delta, updated, metric.LabelKey()})
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("Error writing CSV export: %v", err)
+	}
+}
+
+// DumpHandler выгружает все метрики в формате JSON.
+// Выгрузку может загрузить при запуске другой сервер
+func (s *Router) DumpHandler(c *gin.Context) {
+	metrics, err := s.Service.ExportMetrics(c.Request.Context())
+	if err != nil {
+		respondServiceError(c, err, "internal server error")
+		return
+	}
+
+	c.JSON(http.StatusOK, metrics)
+}
+
 // StatisticPage обработчик для страницы статистики
 func (s *Router) StatisticPage(c *gin.Context) {
 	log.Printf("StatisticPage handler called")
-	tmpl, metrics, err := s.Service.MetrixStatistic()
+	tmpl, metrics, err := s.Service.MetrixStatistic(c.Request.Context())
 	if err != nil {
 		log.Printf("Error getting metrics: %v", err)
-		c.String(http.StatusInternalServerError, "internal server error")
+		respondServiceError(c, err, "internal server error")
 		return
 	}
 
-	log.Printf("Got metrics: %+v", metrics)
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, metrics); err != nil {
-		log.Printf("Error executing template: %v", err)
+	if len(metrics) == 0 {
+		s.emptyStatisticPage(c)
+		return
+	}
+	if tmpl == nil {
+		log.Printf("Statistics template is not loaded")
 		c.String(http.StatusInternalServerError, "internal server error")
 		return
 	}
 
+	// Шаблон выполняется прямо в ответ (и в gzip-поток, если он включен), чтобы страница
+	// с большим количеством метрик не собиралась целиком в памяти.
+	// Ошибку в середине вывода клиенту уже не передать, она только логируется
+	log.Printf("Rendering statistics page with %d metrics", len(metrics))
+	c.Header("Content-Type", "text/html")
+	c.Status(http.StatusOK)
+	if err := tmpl.Execute(c.Writer, metrics); err != nil {
+		log.Printf("Error executing template: %v", err)
+	}
+}
+
+// emptyStatisticPage отвечает страницей-заглушкой, когда метрик еще нет
+func (s *Router) emptyStatisticPage(c *gin.Context) {
+	text := s.emptyStats
+	if text == "" {
+		text = defaultEmptyStatsText
+	}
+
 	c.Header("Content-Type", "text/html")
-	c.String(http.StatusOK, buf.String())
+	c.String(http.StatusOK, "<!DOCTYPE html><html><head><title>Metrics Statistics</title></head><body><h1>Metrics Statistics</h1><p>%s</p></body></html>", html.EscapeString(text))
 }
 
 // UpdateMetricHandler обработчик для обновления метрики
@@ -183,16 +528,31 @@ func (s *Router) UpdateMetricHandler(c *gin.Context) {
 			MType: metricType,
 			Delta: &delta,
 		}
+	case "counterf":
+		value, err := strconv.ParseFloat(metricValue, 64)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid counterf value")
+			return
+		}
+		metric = models.Metrics{
+			ID:    metricName,
+			MType: metricType,
+			Value: &value,
+		}
 	default:
 		// log.Printf("Invalid metric type: %s", metricType)
 		c.String(http.StatusBadRequest, "invalid metric type")
 		return
 	}
 
-	err := s.Service.UpdateServJSON(&metric)
+	if !s.takeQuota(c, 1) {
+		return
+	}
+
+	err := s.Service.UpdateServJSON(c.Request.Context(), &metric)
 	if err != nil {
 		// log.Printf("Failed to update metric: %v", err)
-		c.String(http.StatusInternalServerError, "failed to update metric")
+		respondServiceError(c, err, "failed to update metric")
 		return
 	}
 
@@ -209,14 +569,52 @@ func (s *Router) GetValueHandler(c *gin.Context) {
 
 	// log.Printf("Received GET TEXT request for metric: %v", metric)
 
-	value, err := s.Service.GetValueServ(metric)
+	stored, err := s.Service.GetValueServJSON(c.Request.Context(), metric)
 	if err != nil {
 		// log.Printf("Failed to get value: %v", err)
+		if errors.Is(err, models.ErrStorageUnavailable) {
+			respondServiceError(c, err, "internal server error")
+			return
+		}
+		c.String(http.StatusNotFound, models.ErrMetricNotFound.Error())
+		return
+	}
+
+	value := stored.ValueString()
+	if value == "" {
 		c.String(http.StatusNotFound, models.ErrMetricNotFound.Error())
 		return
 	}
 
 	// log.Printf("Retrieved value for metric %s of type %s: %v", metric.ID, metric.MType, value)
 
+	etag := metricETag(metric.MType, metric.ID, value, stored.UpdatedAt)
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
 	c.String(http.StatusOK, value)
 }
+
+// metricETag вычисляет слабый ETag по значению метрики и времени ее последнего обновления
+func metricETag(mType, id, value string, updatedAt time.Time) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s:%s:%s:%d", mType, id, value, updatedAt.UnixNano())
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// etagMatches проверяет, совпадает ли ETag с одним из значений заголовка If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
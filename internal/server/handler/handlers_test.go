@@ -2,18 +2,30 @@ package handler
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"html/template"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/vova4o/yandexadv/internal/models"
+	"github.com/vova4o/yandexadv/internal/server/flags"
+	"github.com/vova4o/yandexadv/internal/server/middleware"
+	"github.com/vova4o/yandexadv/package/logger"
+	"go.uber.org/zap"
 )
 
 // MockService is a mock implementation of the Service interface
@@ -21,52 +33,114 @@ type MockService struct {
 	mock.Mock
 }
 
-func (m *MockService) UpdateServ(metric models.Metric) error {
+func (m *MockService) UpdateServ(_ context.Context, metric models.Metric) error {
 	args := m.Called(metric)
 	return args.Error(0)
 }
 
-func (m *MockService) UpdateServJSON(metric *models.Metrics) error {
+func (m *MockService) UpdateServJSON(_ context.Context, metric *models.Metrics) error {
 	args := m.Called(metric)
 	return args.Error(0)
 }
 
-func (m *MockService) GetValueServ(metric models.Metrics) (string, error) {
+func (m *MockService) GetValueServ(_ context.Context, metric models.Metrics) (string, error) {
 	args := m.Called(metric)
 	return args.String(0), args.Error(1)
 }
 
-func (m *MockService) GetValueServJSON(metric models.Metrics) (*models.Metrics, error) {
+func (m *MockService) GetValueServJSON(_ context.Context, metric models.Metrics) (*models.Metrics, error) {
 	args := m.Called(metric)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
 	return args.Get(0).(*models.Metrics), args.Error(1)
 }
 
-func (m *MockService) MetrixStatistic() (*template.Template, map[string]models.Metrics, error) {
+func (m *MockService) MetrixStatistic(_ context.Context) (*template.Template, map[string]models.Metrics, error) {
 	args := m.Called()
 	return args.Get(0).(*template.Template), args.Get(1).(map[string]models.Metrics), args.Error(2)
 }
 
-func (m *MockService) UpdateBatchMetricsServ(metrics []models.Metrics) error {
+func (m *MockService) UpdateBatchMetricsServ(_ context.Context, metrics []models.Metrics) error {
 	args := m.Called(metrics)
 	return args.Error(0)
 }
 
-func (m *MockService) PingDB() error {
+func (m *MockService) PingDB(_ context.Context) error {
 	args := m.Called()
 	return args.Error(0)
 }
 
+func (m *MockService) StorageStatus(_ context.Context) (models.StorageStatus, error) {
+	args := m.Called()
+	return args.Get(0).(models.StorageStatus), args.Error(1)
+}
+
+func (m *MockService) Flush() (int, error) {
+	args := m.Called()
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockService) History(metric models.Metrics, limit int) ([]models.HistoryPoint, error) {
+	args := m.Called(metric, limit)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]models.HistoryPoint), args.Error(1)
+}
+
+func (m *MockService) ValidateMetrics(metrics []models.Metrics) models.ValidationReport {
+	args := m.Called(metrics)
+	return args.Get(0).(models.ValidationReport)
+}
+
+func (m *MockService) ExportMetrics(_ context.Context) ([]models.Metrics, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]models.Metrics), args.Error(1)
+}
+
+func (m *MockService) CountMetrics(_ context.Context) (map[string]int, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]int), args.Error(1)
+}
+
+func (m *MockService) DeleteByPrefix(_ context.Context, prefix string) (int, error) {
+	args := m.Called(prefix)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockService) CounterDebug(_ context.Context, name string) (*models.CounterDebug, error) {
+	args := m.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*models.CounterDebug), args.Error(1)
+}
+
+func (m *MockService) ImportMetrics(_ context.Context, metrics []models.Metrics) (int, error) {
+	args := m.Called(metrics)
+	return args.Int(0), args.Error(1)
+}
+
 func TestGetValueHandler(t *testing.T) {
 	router := gin.Default()
 	mockService := new(MockService)
 	r := &Router{Service: mockService}
 	router.GET("/value/:type/:name", r.GetValueHandler)
 
+	value := 10.5
+
 	tests := []struct {
 		name           string
 		metricType     string
 		metricName     string
-		mockReturn     string
+		mockReturn     *models.Metrics
 		mockError      error
 		expectedStatus int
 		expectedBody   string
@@ -75,7 +149,7 @@ func TestGetValueHandler(t *testing.T) {
 			name:           "Metric found",
 			metricType:     "gauge",
 			metricName:     "metric1",
-			mockReturn:     "10.5",
+			mockReturn:     &models.Metrics{ID: "metric1", MType: "gauge", Value: &value},
 			mockError:      nil,
 			expectedStatus: http.StatusOK,
 			expectedBody:   "10.5",
@@ -84,16 +158,25 @@ func TestGetValueHandler(t *testing.T) {
 			name:           "Metric not found",
 			metricType:     "gauge",
 			metricName:     "metric2",
-			mockReturn:     "",
+			mockReturn:     nil,
 			mockError:      models.ErrMetricNotFound,
 			expectedStatus: http.StatusNotFound,
 			expectedBody:   models.ErrMetricNotFound.Error(),
 		},
+		{
+			name:           "Metric without value",
+			metricType:     "gauge",
+			metricName:     "metric3",
+			mockReturn:     &models.Metrics{ID: "metric3", MType: "gauge"},
+			mockError:      nil,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   models.ErrMetricNotFound.Error(),
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockService.On("GetValueServ", models.Metrics{MType: tt.metricType, ID: tt.metricName}).Return(tt.mockReturn, tt.mockError)
+			mockService.On("GetValueServJSON", models.Metrics{MType: tt.metricType, ID: tt.metricName}).Return(tt.mockReturn, tt.mockError)
 
 			req, _ := http.NewRequest(http.MethodGet, "/value/"+tt.metricType+"/"+tt.metricName, nil)
 			w := httptest.NewRecorder()
@@ -105,6 +188,68 @@ func TestGetValueHandler(t *testing.T) {
 	}
 }
 
+func TestGetValueHandlerETag(t *testing.T) {
+	value := 10.5
+	updatedAt := time.Now()
+	metric := &models.Metrics{ID: "metric1", MType: "gauge", Value: &value, UpdatedAt: updatedAt}
+
+	newRouter := func(m *models.Metrics) *gin.Engine {
+		router := gin.Default()
+		mockService := new(MockService)
+		mockService.On("GetValueServJSON", models.Metrics{MType: "gauge", ID: "metric1"}).Return(m, nil)
+		r := &Router{Service: mockService}
+		router.GET("/value/:type/:name", r.GetValueHandler)
+		return router
+	}
+
+	router := newRouter(metric)
+	req, _ := http.NewRequest(http.MethodGet, "/value/gauge/metric1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.True(t, strings.HasPrefix(etag, `W/"`))
+
+	t.Run("Cache hit", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, "/value/gauge/metric1", nil)
+		req.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Empty(t, w.Body.String())
+	})
+
+	t.Run("Changed value", func(t *testing.T) {
+		newValue := 20.5
+		changed := &models.Metrics{ID: "metric1", MType: "gauge", Value: &newValue, UpdatedAt: updatedAt.Add(time.Second)}
+
+		req, _ := http.NewRequest(http.MethodGet, "/value/gauge/metric1", nil)
+		req.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		newRouter(changed).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "20.5", w.Body.String())
+		assert.NotEmpty(t, w.Header().Get("ETag"))
+		assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	})
+
+	t.Run("Same value updated again", func(t *testing.T) {
+		rewritten := &models.Metrics{ID: "metric1", MType: "gauge", Value: &value, UpdatedAt: updatedAt.Add(time.Second)}
+
+		req, _ := http.NewRequest(http.MethodGet, "/value/gauge/metric1", nil)
+		req.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		newRouter(rewritten).ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "10.5", w.Body.String())
+		assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	})
+}
+
 func TestUpdateMetricHandler(t *testing.T) {
 	router := gin.Default()
 	mockService := new(MockService)
@@ -246,6 +391,55 @@ func TestPingHandler(t *testing.T) {
 	}
 }
 
+func TestPingHandlerVerbose(t *testing.T) {
+	t.Run("Plain response by default", func(t *testing.T) {
+		router := gin.Default()
+		mockService := new(MockService)
+		r := &Router{Service: mockService}
+		router.GET("/ping", r.PingHandler)
+		mockService.On("PingDB").Return(nil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ping?verbose=false", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "pong", w.Body.String())
+	})
+
+	t.Run("Verbose response with latency", func(t *testing.T) {
+		router := gin.Default()
+		mockService := new(MockService)
+		r := &Router{Service: mockService}
+		router.GET("/ping", r.PingHandler)
+		mockService.On("PingDB").Return(nil).Run(func(mock.Arguments) { time.Sleep(5 * time.Millisecond) })
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ping?verbose=true", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var result models.PingResult
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		assert.Equal(t, "ok", result.Status)
+		assert.GreaterOrEqual(t, result.DBLatency, float64(5))
+	})
+
+	t.Run("Verbose response on DB error", func(t *testing.T) {
+		router := gin.Default()
+		mockService := new(MockService)
+		r := &Router{Service: mockService}
+		router.GET("/ping", r.PingHandler)
+		mockService.On("PingDB").Return(errors.New("connection refused"))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ping?verbose=true", nil))
+
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+		var result models.PingResult
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		assert.Equal(t, "error", result.Status)
+	})
+}
+
 func TestUpdateBatchMetricsHandler(t *testing.T) {
     router := gin.Default()
     mockService := new(MockService)
@@ -316,4 +510,773 @@ func float64Ptr(v float64) *float64 {
 
 func int64Ptr(v int64) *int64 {
     return &v
-}
\ No newline at end of file
+}
+
+func TestUpdateMetricHandlerForm(t *testing.T) {
+	router := gin.Default()
+	mockService := new(MockService)
+	r := &Router{Service: mockService}
+	router.POST("/update/", r.UpdateMetricHandlerJSON)
+
+	tests := []struct {
+		name           string
+		form           url.Values
+		metric         *models.Metrics
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Gauge update",
+			form:           url.Values{"id": {"formGauge"}, "type": {"gauge"}, "value": {"10.5"}},
+			metric:         &models.Metrics{ID: "formGauge", MType: "gauge", Value: float64Ptr(10.5)},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"id":"formGauge","type":"gauge","value":10.5}`,
+		},
+		{
+			name:           "Counter update",
+			form:           url.Values{"id": {"formCounter"}, "type": {"counter"}, "delta": {"5"}},
+			metric:         &models.Metrics{ID: "formCounter", MType: "counter", Delta: int64Ptr(5)},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"id":"formCounter","type":"counter","delta":5}`,
+		},
+		{
+			name:           "Invalid gauge value",
+			form:           url.Values{"id": {"formGauge"}, "type": {"gauge"}, "value": {"abc"}},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid gauge value",
+		},
+		{
+			name:           "Missing counter delta",
+			form:           url.Values{"id": {"formCounter"}, "type": {"counter"}},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid counter value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.metric != nil {
+				mockService.On("UpdateServJSON", tt.metric).Return(nil).Once()
+				mockService.On("GetValueServJSON", *tt.metric).Return(tt.metric, nil).Once()
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, "/update/", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedBody, w.Body.String())
+		})
+	}
+
+	mockService.AssertExpectations(t)
+}
+
+func TestStatusHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		pingError      error
+		expectedStatus string
+		expectedDB     string
+	}{
+		{
+			name:           "All systems ok",
+			pingError:      nil,
+			expectedStatus: "ok",
+			expectedDB:     "ok",
+		},
+		{
+			name:           "Database down",
+			pingError:      errors.New("connection refused"),
+			expectedStatus: "degraded",
+			expectedDB:     "unavailable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.Default()
+			mockService := new(MockService)
+			r := &Router{Service: mockService, version: "v1.2.3", startTime: time.Now().Add(-time.Minute)}
+			router.GET("/status", r.StatusHandler)
+
+			mockService.On("PingDB").Return(tt.pingError)
+			mockService.On("StorageStatus").Return(models.StorageStatus{Flush: "disabled", MetricCount: 3}, nil)
+
+			req, _ := http.NewRequest(http.MethodGet, "/status", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var status models.Status
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+			assert.Equal(t, tt.expectedStatus, status.Status)
+			assert.Equal(t, tt.expectedDB, status.DB)
+			assert.Equal(t, "disabled", status.Storage.Flush)
+			assert.Equal(t, 3, status.Storage.MetricCount)
+			assert.Equal(t, "1m0s", status.Uptime)
+			assert.Equal(t, "v1.2.3", status.Version)
+		})
+	}
+}
+
+func TestUpdateMetricHandlerJSONErrorMapping(t *testing.T) {
+	tests := []struct {
+		name           string
+		mockError      error
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Invalid metric value",
+			mockError:      fmt.Errorf("%w: parse error", models.ErrInvalidMetricValue),
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid metric value",
+		},
+		{
+			name:           "Storage unavailable",
+			mockError:      fmt.Errorf("%w: connection refused", models.ErrStorageUnavailable),
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "storage unavailable",
+		},
+		{
+			name:           "Metric not found",
+			mockError:      models.ErrMetricNotFound,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "metric not found",
+		},
+		{
+			name:           "Metric not allowed",
+			mockError:      models.ErrMetricNotAllowed,
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "metric not allowed",
+		},
+		{
+			name:           "Name too long",
+			mockError:      fmt.Errorf("%w: name is 300 bytes, limit 255", models.ErrNameTooLong),
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "metric name or label too long",
+		},
+		{
+			name:           "Type conflict",
+			mockError:      models.ErrMetricTypeConflict,
+			expectedStatus: http.StatusConflict,
+			expectedBody:   "metric type conflict",
+		},
+		{
+			name:           "HTTP error",
+			mockError:      models.NewHTTPError(http.StatusBadRequest, "metricType cannot be empty"),
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "metricType cannot be empty",
+		},
+		{
+			name:           "Unknown error",
+			mockError:      errors.New("service error"),
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   "internal server error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.Default()
+			mockService := new(MockService)
+			r := &Router{Service: mockService}
+			router.POST("/update/", r.UpdateMetricHandlerJSON)
+
+			mockService.On("UpdateServJSON", mock.Anything).Return(tt.mockError)
+
+			req, _ := http.NewRequest(http.MethodPost, "/update/", strings.NewReader(`{"id":"metric1","type":"gauge","value":1}`))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestRequireContentType(t *testing.T) {
+	tests := []struct {
+		name           string
+		contentType    string
+		expectedStatus int
+	}{
+		{name: "JSON", contentType: "application/json; charset=utf-8", expectedStatus: http.StatusOK},
+		{name: "Plain text", contentType: "text/plain", expectedStatus: http.StatusOK},
+		{name: "No content type", contentType: "", expectedStatus: http.StatusOK},
+		{name: "Unsupported XML", contentType: "application/xml", expectedStatus: http.StatusUnsupportedMediaType},
+		{name: "Unsupported multipart", contentType: "multipart/form-data", expectedStatus: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.Default()
+			mockService := new(MockService)
+			r := &Router{Service: mockService, mediaTypes: []string{"application/json", "application/x-www-form-urlencoded", "text/plain"}}
+			router.POST("/update/:type/:name/:value", r.requireContentType(), r.UpdateMetricHandler)
+
+			mockService.On("UpdateServJSON", mock.Anything).Return(nil)
+
+			req, _ := http.NewRequest(http.MethodPost, "/update/gauge/metric1/1", nil)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus == http.StatusUnsupportedMediaType {
+				mockService.AssertNotCalled(t, "UpdateServJSON", mock.Anything)
+			}
+		})
+	}
+}
+
+func TestValidateHandler(t *testing.T) {
+	value := 1.5
+	invalid := models.ValidationReport{Errors: []models.ValidationError{{Index: 0, ID: "g", Errors: []string{"gauge value is missing"}}}}
+
+	tests := []struct {
+		name           string
+		body           string
+		metrics        []models.Metrics
+		report         models.ValidationReport
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Valid batch",
+			body:           `[{"id":"g","type":"gauge","value":1.5}]`,
+			metrics:        []models.Metrics{{ID: "g", MType: "gauge", Value: &value}},
+			report:         models.ValidationReport{Valid: true, Errors: []models.ValidationError{}},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"valid":true,"errors":[]}`,
+		},
+		{
+			name:           "Single invalid metric",
+			body:           ` {"id":"g","type":"gauge"}`,
+			metrics:        []models.Metrics{{ID: "g", MType: "gauge"}},
+			report:         invalid,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"valid":false,"errors":[{"index":0,"id":"g","errors":["gauge value is missing"]}]}`,
+		},
+		{
+			name:           "Malformed JSON",
+			body:           `[{"id":`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.Default()
+			mockService := new(MockService)
+			r := &Router{Service: mockService}
+			router.POST("/validate", r.ValidateHandler)
+
+			if tt.metrics != nil {
+				mockService.On("ValidateMetrics", tt.metrics).Return(tt.report)
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, "/validate", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedBody != "" {
+				assert.JSONEq(t, tt.expectedBody, w.Body.String())
+			}
+			mockService.AssertExpectations(t)
+		})
+	}
+}
+
+func TestExportCSVHandler(t *testing.T) {
+	value := 1.25
+	delta := int64(7)
+	updated := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Metrics exported", func(t *testing.T) {
+		router := gin.Default()
+		mockService := new(MockService)
+		r := &Router{Service: mockService}
+		router.GET("/export.csv", r.ExportCSVHandler)
+
+		mockService.On("ExportMetrics").Return([]models.Metrics{
+			{ID: "PollCount", MType: "counter", Delta: &delta, UpdatedAt: updated},
+			{ID: "Alloc, total", MType: "gauge", Value: &value},
+			{ID: "Alloc, total", MType: "gauge", Value: &value, Labels: map[string]string{"host": "a", "env": "prod"}},
+		}, nil)
+
+		req, _ := http.NewRequest(http.MethodGet, "/export.csv", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "metrics.csv")
+
+		records, err := csv.NewReader(w.Body).ReadAll()
+		assert.NoError(t, err)
+		assert.Len(t, records, 4)
+		assert.Equal(t, []string{"id", "type", "value", "delta", "last_updated", "labels"}, records[0])
+		assert.Equal(t, []string{"PollCount", "counter", "", "7", "2024-05-01T12:00:00Z", ""}, records[1])
+		assert.Equal(t, []string{"Alloc, total", "gauge", "1.25", "", "", ""}, records[2])
+		assert.Equal(t, []string{"Alloc, total", "gauge", "1.25", "", "", "env=prod,host=a"}, records[3])
+	})
+
+	t.Run("Storage unavailable", func(t *testing.T) {
+		router := gin.Default()
+		mockService := new(MockService)
+		r := &Router{Service: mockService}
+		router.GET("/export.csv", r.ExportCSVHandler)
+
+		mockService.On("ExportMetrics").Return(nil, models.ErrStorageUnavailable)
+
+		req, _ := http.NewRequest(http.MethodGet, "/export.csv", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+}
+
+func TestDumpHandler(t *testing.T) {
+	router := gin.Default()
+	mockService := new(MockService)
+	r := &Router{Service: mockService}
+	router.GET("/dump", r.DumpHandler)
+
+	delta := int64(7)
+	mockService.On("ExportMetrics").Return([]models.Metrics{{ID: "PollCount", MType: "counter", Delta: &delta}}, nil)
+
+	req, _ := http.NewRequest(http.MethodGet, "/dump", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var got []models.Metrics
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, "PollCount", got[0].ID)
+		assert.Equal(t, delta, *got[0].Delta)
+	}
+}
+
+func TestUpdateHandlerStorageOverload(t *testing.T) {
+	router := gin.Default()
+	mockService := new(MockService)
+	r := &Router{Service: mockService}
+	router.POST("/update/", r.UpdateMetricHandlerJSON)
+	router.POST("/updates/", r.UpdateBatchMetricsHandler)
+
+	// Сервис оборачивает ошибки хранилища в ErrStorageUnavailable
+	overload := fmt.Errorf("%w: %w", models.ErrStorageUnavailable, &models.OverloadError{RetryAfter: 1500 * time.Millisecond})
+	mockService.On("UpdateServJSON", mock.Anything).Return(overload)
+	mockService.On("UpdateBatchMetricsServ", mock.Anything).Return(overload)
+
+	for _, url := range []string{"/update/", "/updates/"} {
+		body := `{"id":"g","type":"gauge","value":1}`
+		if url == "/updates/" {
+			body = "[" + body + "]"
+		}
+		req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusTooManyRequests, w.Code, url)
+		assert.Equal(t, "2", w.Header().Get("Retry-After"), url)
+	}
+}
+
+func TestStatisticPageEmpty(t *testing.T) {
+	tests := []struct {
+		name         string
+		tmpl         *template.Template
+		emptyStats   string
+		expectedText string
+	}{
+		{
+			name:         "Default placeholder",
+			tmpl:         template.Must(template.New("metrics").Parse(`{{range $key, $metric := .}}{{$key}}{{end}}`)),
+			expectedText: "No metrics yet",
+		},
+		{
+			name:         "Custom placeholder without template",
+			tmpl:         nil,
+			emptyStats:   "Nothing <here>",
+			expectedText: "Nothing &lt;here&gt;",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.Default()
+			mockService := new(MockService)
+			r := &Router{Service: mockService, emptyStats: tt.emptyStats}
+			router.GET("/", r.StatisticPage)
+
+			mockService.On("MetrixStatistic").Return(tt.tmpl, map[string]models.Metrics{}, nil)
+
+			req, _ := http.NewRequest(http.MethodGet, "/", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedText)
+		})
+	}
+}
+
+func TestStatisticPageWithoutTemplate(t *testing.T) {
+	router := gin.Default()
+	mockService := new(MockService)
+	r := &Router{Service: mockService}
+	router.GET("/", r.StatisticPage)
+
+	value := 1.5
+	mockService.On("MetrixStatistic").Return((*template.Template)(nil), map[string]models.Metrics{
+		"gauge:Alloc": {ID: "Alloc", MType: "gauge", Value: &value},
+	}, nil)
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NotContains(t, w.Body.String(), "No metrics yet", "placeholder is shown only when there are no metrics")
+}
+
+func TestStatisticPageStreamsGzip(t *testing.T) {
+	metrics := make(map[string]models.Metrics, 5000)
+	for i := 0; i < 5000; i++ {
+		value := float64(i)
+		id := "metric" + strconv.Itoa(i)
+		metrics["gauge:"+id] = models.Metrics{ID: id, MType: "gauge", Value: &value}
+	}
+	tmpl := template.Must(template.New("metrics").Parse(`<ul>{{range $key, $metric := .}}<li>{{$metric.ID}}: {{$metric.Value}}</li>{{end}}</ul>`))
+
+	m := middleware.New(&logger.Logger{ZapLogger: zap.NewNop()}, &flags.Config{GzipMinSize: 1024})
+	router := gin.New()
+	router.Use(m.GzipMiddleware())
+	mockService := new(MockService)
+	r := &Router{Service: mockService}
+	router.GET("/", r.StatisticPage)
+
+	mockService.On("MetrixStatistic").Return(tmpl, metrics, nil)
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "text/html", w.Header().Get("Content-Type"))
+
+	gz, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	page, err := io.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, 5000, strings.Count(string(page), "<li>"))
+	assert.Contains(t, string(page), "<li>metric4999: 4999</li>")
+	assert.True(t, strings.HasSuffix(string(page), "</ul>"))
+}
+
+func TestUpdateBatchMetricsHandlerLimit(t *testing.T) {
+	router := gin.Default()
+	mockService := new(MockService)
+	r := &Router{Service: mockService, maxBatch: 2}
+	router.POST("/updates/", r.UpdateBatchMetricsHandler)
+
+	batch := []models.Metrics{
+		{ID: "metric1", MType: "gauge", Value: float64Ptr(1)},
+		{ID: "metric2", MType: "gauge", Value: float64Ptr(2)},
+		{ID: "metric3", MType: "gauge", Value: float64Ptr(3)},
+	}
+	body, _ := json.Marshal(batch)
+
+	req, _ := http.NewRequest(http.MethodPost, "/updates/", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "too many metrics in batch", w.Body.String())
+	mockService.AssertNotCalled(t, "UpdateBatchMetricsServ", mock.Anything)
+}
+
+func TestDeletePrefixHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		prefix         string
+		deleted        int
+		deleteError    error
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Matching prefix",
+			prefix:         "billing.",
+			deleted:        2,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"deleted":2}`,
+		},
+		{
+			name:           "Nothing matches",
+			prefix:         "unknown.",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"deleted":0}`,
+		},
+		{
+			name:           "Delete not supported",
+			prefix:         "billing.",
+			deleteError:    models.ErrDeleteNotSupported,
+			expectedStatus: http.StatusNotImplemented,
+			expectedBody:   "storage does not support deletion",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.Default()
+			mockService := new(MockService)
+			r := &Router{Service: mockService}
+			router.DELETE("/values/prefix/:prefix", r.DeletePrefixHandler)
+
+			mockService.On("DeleteByPrefix", tt.prefix).Return(tt.deleted, tt.deleteError)
+
+			req, _ := http.NewRequest(http.MethodDelete, "/values/prefix/"+tt.prefix, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestAdminFlushHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		flushCount     int
+		flushError     error
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Successful flush",
+			flushCount:     3,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"flushed":3}`,
+		},
+		{
+			name:           "Flush not supported",
+			flushError:     models.ErrFlushNotSupported,
+			expectedStatus: http.StatusNotImplemented,
+			expectedBody:   "storage does not support flush",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.Default()
+			mockService := new(MockService)
+			r := &Router{Service: mockService}
+			router.POST("/admin/flush", r.AdminFlushHandler)
+
+			mockService.On("Flush").Return(tt.flushCount, tt.flushError)
+
+			req, _ := http.NewRequest(http.MethodPost, "/admin/flush", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	router := gin.Default()
+	mockService := new(MockService)
+	r := &Router{Service: mockService}
+	router.POST("/admin/drain", r.AdminDrainHandler)
+	router.POST("/admin/undrain", r.AdminUndrainHandler)
+	router.POST("/update/:type/:name/:value", r.rejectWhileDraining(), r.UpdateMetricHandler)
+	router.POST("/updates/", r.rejectWhileDraining(), r.UpdateBatchMetricsHandler)
+	router.GET("/value/:type/:name", r.GetValueHandler)
+
+	value := 1.5
+	mockService.On("UpdateServJSON", mock.Anything).Return(nil)
+	mockService.On("UpdateBatchMetricsServ", mock.Anything).Return(nil)
+	mockService.On("GetValueServJSON", mock.Anything).Return(&models.Metrics{ID: "g", MType: "gauge", Value: &value}, nil)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/g/1.5", "").Code)
+
+	w := do(http.MethodPost, "/admin/drain", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"draining":true}`, w.Body.String())
+
+	// Во время drain обновления отклоняются, а чтение работает
+	assert.Equal(t, http.StatusServiceUnavailable, do(http.MethodPost, "/update/gauge/g/2.5", "").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, do(http.MethodPost, "/updates/", `[{"id":"g","type":"gauge","value":2.5}]`).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/value/gauge/g", "").Code)
+	mockService.AssertNumberOfCalls(t, "UpdateServJSON", 1)
+	mockService.AssertNotCalled(t, "UpdateBatchMetricsServ", mock.Anything)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/admin/undrain", "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/g/3.5", "").Code)
+	mockService.AssertNumberOfCalls(t, "UpdateServJSON", 2)
+}
+
+func TestHistoryHandler(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	points := []models.HistoryPoint{{Value: 1.5, Timestamp: at}, {Value: 2.5, Timestamp: at.Add(time.Second)}}
+
+	tests := []struct {
+		name           string
+		url            string
+		limit          int
+		mockPoints     []models.HistoryPoint
+		mockError      error
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Recent values",
+			url:            "/history/gauge/Alloc?limit=2",
+			limit:          2,
+			mockPoints:     points,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[{"value":1.5,"timestamp":"2024-01-02T03:04:05Z"},{"value":2.5,"timestamp":"2024-01-02T03:04:06Z"}]`,
+		},
+		{
+			name:           "Invalid limit",
+			url:            "/history/gauge/Alloc?limit=abc",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid limit",
+		},
+		{
+			name:           "Unknown metric",
+			url:            "/history/gauge/Unknown",
+			mockError:      models.ErrMetricNotFound,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "metric not found",
+		},
+		{
+			name:           "History disabled",
+			url:            "/history/gauge/Alloc",
+			mockError:      models.ErrHistoryDisabled,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "metric history is disabled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.Default()
+			mockService := new(MockService)
+			r := &Router{Service: mockService}
+			router.GET("/history/:type/:name", r.HistoryHandler)
+
+			mockService.On("History", mock.Anything, tt.limit).Return(tt.mockPoints, tt.mockError)
+
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestCountsHandler(t *testing.T) {
+	t.Run("Counts as JSON", func(t *testing.T) {
+		mockService := new(MockService)
+		r := &Router{Service: mockService}
+		router := gin.New()
+		router.GET("/api/counts", r.CountsHandler)
+
+		mockService.On("CountMetrics").Return(map[string]int{"gauge": 42, "counter": 7}, nil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/counts", nil))
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"gauge":42,"counter":7}`, w.Body.String())
+	})
+
+	t.Run("Storage unavailable", func(t *testing.T) {
+		mockService := new(MockService)
+		r := &Router{Service: mockService}
+		router := gin.New()
+		router.GET("/api/counts", r.CountsHandler)
+
+		mockService.On("CountMetrics").Return(nil, models.ErrStorageUnavailable)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/counts", nil))
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+}
+
+func TestCounterDebugHandler(t *testing.T) {
+	lastDelta := int64(3)
+
+	tests := []struct {
+		name           string
+		debug          *models.CounterDebug
+		mockError      error
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Total and last delta",
+			debug:          &models.CounterDebug{ID: "PollCount", Total: 8, LastDelta: &lastDelta},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"id":"PollCount","total":8,"last_delta":3}`,
+		},
+		{
+			name:           "Unknown counter",
+			mockError:      models.ErrMetricNotFound,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "metric not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.Default()
+			mockService := new(MockService)
+			r := &Router{Service: mockService}
+			router.GET("/value/:type/:name", r.GetValueHandler)
+			router.GET("/debug/counter/:name", r.CounterDebugHandler)
+
+			mockService.On("CounterDebug", "PollCount").Return(tt.debug, tt.mockError)
+
+			req, _ := http.NewRequest(http.MethodGet, "/debug/counter/PollCount", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedBody, w.Body.String())
+			mockService.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// quotaClients максимальное количество отслеживаемых клиентов
+const quotaClients = 10000
+
+// quotaWindow счетчик метрик клиента в текущем окне
+type quotaWindow struct {
+	start time.Time
+	count int
+}
+
+// IngestQuota ограничивает количество метрик, принимаемых от одного клиента за окно времени.
+// Окно клиента начинается с его первого запроса, количество клиентов ограничено capacity
+type IngestQuota struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	capacity int
+	clients  map[string]*quotaWindow
+}
+
+// NewIngestQuota создает квоту в limit метрик за window не более чем для capacity клиентов
+func NewIngestQuota(limit int, window time.Duration, capacity int) *IngestQuota {
+	return &IngestQuota{
+		limit:    limit,
+		window:   window,
+		capacity: capacity,
+		clients:  make(map[string]*quotaWindow),
+	}
+}
+
+// Take учитывает n метрик клиента. Если квота будет превышена, метрики не учитываются
+// и возвращается время до начала следующего окна
+func (q *IngestQuota) Take(client string, n int, now time.Time) (time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	w, ok := q.clients[client]
+	if ok && now.Sub(w.start) >= q.window {
+		w.start, w.count = now, 0
+	}
+	if !ok {
+		q.makeRoom(now)
+		w = &quotaWindow{start: now}
+		q.clients[client] = w
+	}
+
+	if w.count+n > q.limit {
+		return w.start.Add(q.window).Sub(now), false
+	}
+	w.count += n
+	return 0, true
+}
+
+// makeRoom освобождает место для нового клиента: удаляет истекшие окна,
+// а если их нет - окно, начавшееся раньше всех. Вызывается под блокировкой
+func (q *IngestQuota) makeRoom(now time.Time) {
+	if q.capacity <= 0 || len(q.clients) < q.capacity {
+		return
+	}
+
+	var oldest string
+	for client, w := range q.clients {
+		if now.Sub(w.start) >= q.window {
+			delete(q.clients, client)
+			continue
+		}
+		if oldest == "" || w.start.Before(q.clients[oldest].start) {
+			oldest = client
+		}
+	}
+	if len(q.clients) >= q.capacity {
+		delete(q.clients, oldest)
+	}
+}
+
+// newIngestQuota создает квоту, если она включена
+func newIngestQuota(limit int, window time.Duration) *IngestQuota {
+	if limit <= 0 || window <= 0 {
+		return nil
+	}
+	return NewIngestQuota(limit, window, quotaClients)
+}
+
+// takeQuota учитывает n метрик клиента запроса и при превышении квоты отвечает 429
+func (s *Router) takeQuota(c *gin.Context, n int) bool {
+	if s.quota == nil {
+		return true
+	}
+
+	wait, ok := s.quota.Take(c.ClientIP(), n, time.Now())
+	if ok {
+		return true
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.String(http.StatusTooManyRequests, "metric quota exceeded")
+	return false
+}
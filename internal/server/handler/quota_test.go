@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestIngestQuotaThrottlesClient(t *testing.T) {
+	router := gin.New()
+	mockService := new(MockService)
+	r := &Router{Service: mockService, quota: NewIngestQuota(3, time.Hour, 10)}
+	router.POST("/updates/", r.UpdateBatchMetricsHandler)
+	router.POST("/update/:type/:name/:value", r.UpdateMetricHandler)
+
+	mockService.On("UpdateBatchMetricsServ", mock.Anything).Return(nil)
+	mockService.On("UpdateServJSON", mock.Anything).Return(nil)
+
+	do := func(url, body, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	batch := `[{"id":"a","type":"gauge","value":1},{"id":"b","type":"gauge","value":2}]`
+	assert.Equal(t, http.StatusOK, do("/updates/", batch, "10.0.0.1:1000").Code)
+	assert.Equal(t, http.StatusOK, do("/update/gauge/c/3", "", "10.0.0.1:1000").Code)
+
+	// Квота клиента исчерпана, пакет целиком отклоняется
+	w := do("/updates/", batch, "10.0.0.1:1001")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Hour.Seconds(), retryAfter, 5)
+	assert.Equal(t, http.StatusTooManyRequests, do("/update/gauge/c/4", "", "10.0.0.1:1001").Code)
+	mockService.AssertNumberOfCalls(t, "UpdateBatchMetricsServ", 1)
+	mockService.AssertNumberOfCalls(t, "UpdateServJSON", 1)
+
+	// Квота других клиентов не затронута
+	assert.Equal(t, http.StatusOK, do("/updates/", batch, "10.0.0.2:1000").Code)
+}
+
+func TestIngestQuotaWindow(t *testing.T) {
+	now := time.Now()
+	q := NewIngestQuota(2, time.Minute, 2)
+
+	_, ok := q.Take("a", 2, now)
+	assert.True(t, ok)
+	wait, ok := q.Take("a", 1, now.Add(10*time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 50*time.Second, wait)
+
+	// Новое окно начинается после истечения предыдущего
+	_, ok = q.Take("a", 2, now.Add(time.Minute))
+	assert.True(t, ok)
+
+	// При заполнении вытесняется клиент с самым старым окном
+	_, ok = q.Take("b", 2, now.Add(61*time.Second))
+	assert.True(t, ok)
+	_, ok = q.Take("c", 1, now.Add(62*time.Second))
+	assert.True(t, ok)
+	assert.Len(t, q.clients, 2)
+	assert.NotContains(t, q.clients, "a")
+}
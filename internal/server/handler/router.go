@@ -2,85 +2,291 @@ package handler
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/vova4o/yandexadv/internal/models"
+	"github.com/vova4o/yandexadv/internal/server/flags"
+	"golang.org/x/net/netutil"
 )
 
+// defaultEmptyStatsText текст страницы статистики по умолчанию, когда метрик еще нет
+const defaultEmptyStatsText = "No metrics yet"
+
+// unixScheme префикс адреса unix-сокета
+const unixScheme = "unix://"
+
+// ErrCertNotFound ошибка, когда TLS включен, но сертификат или ключ не найдены
+var ErrCertNotFound = errors.New("tls certificate or key not found")
+
 // Router структура для роутера
 type Router struct {
-	Middl      Middlewarer   // middleware
-	mux        *gin.Engine   // роутер
-	Service    Servicer      // сервис
-	server     *http.Server  // сервер
-	stopCh     chan struct{} // канал для остановки сервера
-	mu         sync.Mutex    // мьютекс
-	cryptoPath string        // путь к сертификату
+	Middl       Middlewarer   // middleware
+	mux         *gin.Engine   // роутер
+	Service     Servicer      // сервис
+	server      *http.Server  // сервер
+	stopCh      chan struct{} // канал для остановки сервера
+	mu          sync.Mutex    // мьютекс
+	cryptoPath  string        // путь к каталогу с сертификатами
+	certFile    string        // путь к файлу сертификата
+	keyFile     string        // путь к файлу ключа
+	startTime   time.Time     // время запуска сервера
+	version     string        // версия сборки
+	emptyStats  string        // текст страницы статистики без метрик
+	origins     []string      // источники, которым разрешен CORS
+	socketPath  string        // путь к unix-сокету, если сервер слушает на нем
+	maxBatch    int           // максимальное количество метрик в пакете, 0 - без ограничения
+	maxConns    int           // максимальное количество одновременных соединений, 0 - без ограничения
+	noKeepAlive bool          // отключить keep-alive соединения
+	mediaTypes  []string      // типы содержимого, принимаемые обработчиками обновления
+	draining    atomic.Bool   // режим только для чтения перед остановкой
+	tlsConfig   *tls.Config   // версия и наборы шифров TLS
+	tlsErr      error         // ошибка разбора настроек TLS, сервер с TLS не запускается
+	replica     bool          // реплика только для чтения, обновления отклоняются
+	signed      bool          // задан ключ подписи запросов
+
+	// пути, для которых зарегистрирован OPTIONS для предварительных CORS-запросов
+	preflights map[string]struct{}
+	// квота на количество метрик от одного клиента, nil - без ограничения
+	quota *IngestQuota
 }
 
 // Middlewarer интерфейс для middleware
 type Middlewarer interface {
 	GinZap() gin.HandlerFunc
+	RED() gin.HandlerFunc
+	CORS(origins []string) gin.HandlerFunc
+	REDHandler() gin.HandlerFunc
+	LimitBody() gin.HandlerFunc
+	InFlightLimit() gin.HandlerFunc
+	AdminAuth() gin.HandlerFunc
 	GunzipMiddleware() gin.HandlerFunc
 	GzipMiddleware() gin.HandlerFunc
 	CheckHash() gin.HandlerFunc
+	MethodOverride() gin.HandlerFunc
 }
 
 // Servicer интерфейс для сервиса
 type Servicer interface {
-	UpdateServ(metric models.Metric) error
-	UpdateServJSON(metric *models.Metrics) error
-	GetValueServ(metric models.Metrics) (string, error)
-	GetValueServJSON(metric models.Metrics) (*models.Metrics, error)
-	MetrixStatistic() (*template.Template, map[string]models.Metrics, error)
-	UpdateBatchMetricsServ(metrics []models.Metrics) error
-	PingDB() error
+	UpdateServ(ctx context.Context, metric models.Metric) error
+	UpdateServJSON(ctx context.Context, metric *models.Metrics) error
+	GetValueServ(ctx context.Context, metric models.Metrics) (string, error)
+	GetValueServJSON(ctx context.Context, metric models.Metrics) (*models.Metrics, error)
+	MetrixStatistic(ctx context.Context) (*template.Template, map[string]models.Metrics, error)
+	UpdateBatchMetricsServ(ctx context.Context, metrics []models.Metrics) error
+	PingDB(ctx context.Context) error
+	StorageStatus(ctx context.Context) (models.StorageStatus, error)
+	Flush() (int, error)
+	History(metric models.Metrics, limit int) ([]models.HistoryPoint, error)
+	ValidateMetrics(metrics []models.Metrics) models.ValidationReport
+	ExportMetrics(ctx context.Context) ([]models.Metrics, error)
+	CountMetrics(ctx context.Context) (map[string]int, error)
+	DeleteByPrefix(ctx context.Context, prefix string) (int, error)
+	CounterDebug(ctx context.Context, name string) (*models.CounterDebug, error)
+	ImportMetrics(ctx context.Context, metrics []models.Metrics) (int, error)
 }
 
 // New создание нового роутера
-func New(s Servicer, middleware Middlewarer, path string) *Router {
+func New(s Servicer, middleware Middlewarer, config *flags.Config) *Router {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.Default()
+	tlsConfig, tlsErr := newTLSConfig(config)
 
 	return &Router{
-		Middl:      middleware,
-		mux:        router,
-		Service:    s,
-		stopCh:     make(chan struct{}),
-		cryptoPath: path,
+		Middl:       middleware,
+		mux:         router,
+		Service:     s,
+		stopCh:      make(chan struct{}),
+		cryptoPath:  config.CryptoPath,
+		certFile:    config.CertFile,
+		keyFile:     config.KeyFile,
+		startTime:   time.Now(),
+		emptyStats:  config.EmptyStatsText,
+		origins:     config.AllowedOrigins,
+		maxBatch:    config.MaxBatchSize,
+		maxConns:    config.MaxConns,
+		noKeepAlive: !config.KeepAlive,
+		mediaTypes:  config.ContentTypes,
+		tlsConfig:   tlsConfig,
+		tlsErr:      tlsErr,
+		replica:     config.Replica,
+		signed:      config.SecretKey != "",
+		quota:       newIngestQuota(config.IngestQuota, config.QuotaWindow),
+	}
+}
+
+// newTLSConfig создает настройки TLS из конфигурации, проверенной Config.Validate.
+// Пустая минимальная версия оставляет умолчание crypto/tls
+func newTLSConfig(config *flags.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if config.TLSMinVersion != "" {
+		version, err := flags.ParseTLSVersion(config.TLSMinVersion)
+		if err != nil {
+			return nil, fmt.Errorf("TLSMinVersion: %w", err)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	ciphers, err := flags.ParseCipherSuites(config.TLSCiphers)
+	if err != nil {
+		return nil, fmt.Errorf("TLSCiphers: %w", err)
+	}
+	if len(ciphers) > 0 {
+		tlsConfig.CipherSuites = ciphers
 	}
+	return tlsConfig, nil
+}
+
+// SetBuildInfo задает версию сборки и время запуска для эндпоинта /status
+func (s *Router) SetBuildInfo(version string, startTime time.Time) {
+	s.version = version
+	s.startTime = startTime
 }
 
-// RegisterRoutes регистрация маршрутов
+// RegisterRoutes регистрация маршрутов.
+// Глобально подключаются только middleware, нужные всем запросам, остальные
+// задаются наборами маршрутов: чтение не разбирает тело запроса, CORS подключается
+// только к API, а подпись проверяется только у пакетных обновлений и импорта
 func (s *Router) RegisterRoutes() {
 	s.mux.Use(s.Middl.GinZap())
-	s.mux.Use(s.Middl.GunzipMiddleware())
+	s.mux.Use(s.Middl.RED())
+	s.mux.Use(s.Middl.MethodOverride())
+	s.mux.Use(s.Middl.InFlightLimit())
 	s.mux.Use(s.Middl.GzipMiddleware())
 
-	updatesGroup := s.mux.Group("/updates")
-	updatesGroup.Use(s.Middl.CheckHash())
-	{
-		updatesGroup.POST("/", s.UpdateBatchMetricsHandler)
+	reads := s.routes()
+	api := reads.withCORS()
+	withBody := api.use(s.Middl.LimitBody(), s.Middl.GunzipMiddleware())
+	writes := withBody.use(s.rejectOnReplica(), s.rejectWhileDraining(), s.requireContentType())
+	admin := reads.use(s.Middl.AdminAuth())
+
+	writes.use(s.Middl.CheckHash()).post("/updates/", s.UpdateBatchMetricsHandler)
+	writes.post("/update/:type/:name/:value", s.UpdateMetricHandler)
+	writes.post("/update/", s.UpdateMetricHandlerJSON)
+	withBody.post("/value/", s.GetValueHandlerJSON)
+	withBody.use(s.requireContentType()).post("/validate", s.ValidateHandler)
+	// Импорт снимка основного сервера доступен только репликам с ключом подписи
+	if s.replica && s.signed {
+		withBody.use(s.rejectWhileDraining(), s.Middl.CheckHash()).post("/import", s.ImportHandler)
 	}
 
-	s.mux.POST("/update/:type/:name/:value", s.UpdateMetricHandler)
-	// s.mux.POST("/updates/", s.UpdateBatchMetricsHandler)
-	s.mux.GET("/value/:type/:name", s.GetValueHandler)
-	s.mux.GET("/", s.StatisticPage)
-	s.mux.POST("/update/", s.UpdateMetricHandlerJSON)
-	s.mux.POST("/value/", s.GetValueHandlerJSON)
-	s.mux.GET("/ping", s.PingHandler)
+	api.get("/value/:type/:name", s.GetValueHandler)
+	api.get("/debug/counter/:name", s.CounterDebugHandler)
+	api.get("/history/:type/:name", s.HistoryHandler)
+	api.get("/api/counts", s.CountsHandler)
+
+	reads.get("/", s.StatisticPage)
+	reads.get("/export.csv", s.ExportCSVHandler)
+	reads.get("/dump", s.DumpHandler)
+	reads.get("/ping", s.PingHandler)
+	reads.get("/status", s.StatusHandler)
+	reads.get("/metrics", s.Middl.REDHandler())
+
+	admin.delete("/values/prefix/:prefix", s.rejectOnReplica(), s.rejectWhileDraining(), s.DeletePrefixHandler)
+	admin.post("/admin/flush", s.AdminFlushHandler)
+	admin.post("/admin/drain", s.AdminDrainHandler)
+	admin.post("/admin/undrain", s.AdminUndrainHandler)
 }
 
+// rejectOnReplica отклоняет запросы на изменение метрик с кодом 405, если сервер работает как реплика
+func (s *Router) rejectOnReplica() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.replica {
+			c.Header("Allow", "GET, HEAD")
+			c.String(http.StatusMethodNotAllowed, "server is a read-only replica")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// rejectWhileDraining отклоняет запросы на обновление с кодом 503, пока сервер в режиме drain
+func (s *Router) rejectWhileDraining() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.draining.Load() {
+			c.String(http.StatusServiceUnavailable, "server is draining")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireContentType отклоняет запросы на обновление с типом содержимого не из списка с кодом 415.
+// Запросы без Content-Type пропускаются, при пустом списке проверка отключена
+func (s *Router) requireContentType() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		contentType := c.ContentType()
+		if len(s.mediaTypes) == 0 || contentType == "" {
+			c.Next()
+			return
+		}
+
+		for _, allowed := range s.mediaTypes {
+			if strings.EqualFold(contentType, allowed) {
+				c.Next()
+				return
+			}
+		}
+
+		c.String(http.StatusUnsupportedMediaType, "unsupported content type")
+		c.Abort()
+	}
+}
+
+// tlsEnabled сообщает, запрошен ли запуск сервера по TLS
+func (s *Router) tlsEnabled() bool {
+	return s.cryptoPath != "" || s.certFile != "" || s.keyFile != ""
+}
+
+// getFilesFromPath возвращает пути к сертификату и ключу.
+// Явно заданные пути имеют приоритет, иначе server.pem и server.key ищутся в каталогах cryptoPath.
+// cryptoPath может содержать несколько каталогов через запятую, они проверяются по порядку
 func (s *Router) getFilesFromPath() (string, string, error) {
-	files, err := os.ReadDir(s.cryptoPath)
+	if s.certFile != "" || s.keyFile != "" {
+		if s.certFile == "" || s.keyFile == "" {
+			return "", "", fmt.Errorf("%w: both cert and key files must be specified", ErrCertNotFound)
+		}
+		for _, file := range []string{s.certFile, s.keyFile} {
+			if _, err := os.Stat(file); err != nil {
+				return "", "", fmt.Errorf("%w: %v", ErrCertNotFound, err)
+			}
+		}
+		return s.certFile, s.keyFile, nil
+	}
+
+	for _, dir := range strings.Split(s.cryptoPath, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" {
+			continue
+		}
+		if cert, key, ok := findCertInDir(dir); ok {
+			return cert, key, nil
+		}
+	}
+
+	return "", "", fmt.Errorf("%w: server.pem and server.key expected in %s", ErrCertNotFound, s.cryptoPath)
+}
+
+// findCertInDir ищет server.pem и server.key в каталоге dir
+func findCertInDir(dir string) (string, string, bool) {
+	files, err := os.ReadDir(dir)
 	if err != nil {
-		return "", "", err
+		log.Printf("failed to read cert directory %s: %v", dir, err)
+		return "", "", false
 	}
 
 	var cert, key string
@@ -89,42 +295,98 @@ func (s *Router) getFilesFromPath() (string, string, error) {
 			continue
 		}
 		if file.Name() == "server.pem" {
-			cert = s.cryptoPath + "/server.pem"
+			cert = filepath.Join(dir, "server.pem")
 		}
 		if file.Name() == "server.key" {
-			key = s.cryptoPath + "/server.key"
+			key = filepath.Join(dir, "server.key")
 		}
 	}
 
-	return cert, key, nil
+	return cert, key, cert != "" && key != ""
+}
+
+// unixSocketPath возвращает путь к сокету, если адрес задан как unix:///path
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixScheme), true
+}
+
+// listen открывает слушающий сокет: unix-сокет для адреса unix:///path, иначе TCP
+func (s *Router) listen(addr string) (net.Listener, error) {
+	socketPath, ok := unixSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// Удаляем сокет, оставшийся от предыдущего запуска
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.socketPath = socketPath
+	s.mu.Unlock()
+
+	return listener, nil
 }
 
-// StartServer запуск сервера
+// StartServer запуск сервера.
+// Адрес вида unix:///path запускает сервер на unix-сокете.
+// При maxConns > 0 сервер обслуживает не больше maxConns соединений одновременно
 func (s *Router) StartServer(addr string) error {
 	// Создание http.Server с использованием Gin
+	s.mu.Lock()
 	s.server = &http.Server{
 		Addr:    addr,
 		Handler: s.mux,
 	}
+	s.server.SetKeepAlivesEnabled(!s.noKeepAlive)
+	if s.tlsEnabled() {
+		s.server.TLSConfig = s.tlsConfig.Clone()
+	}
+	s.mu.Unlock()
+
+	var cert, key string
+	if s.tlsEnabled() {
+		if s.tlsErr != nil {
+			log.Println("invalid tls settings", s.tlsErr)
+			return s.tlsErr
+		}
 
-	if s.cryptoPath != "" {
 		// Загрузка сертификата
-		cert, key, err := s.getFilesFromPath()
+		var err error
+		cert, key, err = s.getFilesFromPath()
 		if err != nil {
 			log.Println("failed to load cert", err)
+			return err
 		}
+	}
 
-		if err := s.server.ListenAndServeTLS(cert, key); err != nil && err != http.ErrServerClosed {
-			// Логирование ошибки, если сервер не смог запуститься
-			log.Println("failed to start server", err)
-			panic(err)
-		}
+	listener, err := s.listen(addr)
+	if err != nil {
+		log.Println("failed to listen", err)
+		return err
+	}
+	if s.maxConns > 0 {
+		listener = netutil.LimitListener(listener, s.maxConns)
+	}
+
+	if s.tlsEnabled() {
+		err = s.server.ServeTLS(listener, cert, key)
 	} else {
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			// Логирование ошибки, если сервер не смог запуститься
-			log.Println("failed to start server", err)
-			panic(err)
-		}
+		err = s.server.Serve(listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		// Логирование ошибки, если сервер не смог запуститься
+		log.Println("failed to start server", err)
+		panic(err)
 	}
 
 	<-s.stopCh
@@ -138,5 +400,13 @@ func (s *Router) StopServer(ctx context.Context) error {
 
 	close(s.stopCh)
 	// Остановка сервера с использованием контекста
-	return s.server.Shutdown(ctx)
+	err := s.server.Shutdown(ctx)
+
+	if s.socketPath != "" {
+		if rmErr := os.Remove(s.socketPath); rmErr != nil && !os.IsNotExist(rmErr) {
+			log.Println("failed to remove socket", rmErr)
+		}
+	}
+
+	return err
 }
@@ -1,9 +1,33 @@
 package handler
 
 import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
 	"html/template"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/vova4o/yandexadv/internal/models"
+	"github.com/vova4o/yandexadv/internal/server/flags"
+	"github.com/vova4o/yandexadv/internal/server/middleware"
+	"github.com/vova4o/yandexadv/internal/server/service"
+	"github.com/vova4o/yandexadv/internal/server/storage"
+	"github.com/vova4o/yandexadv/package/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 // mockService представляет собой мок-реализацию интерфейса Servicer
@@ -42,3 +66,388 @@ func (m *mockService) MetrixStatistic() (*template.Template, map[string]models.M
 func (m *mockService) GetValueFuncJSON(metric models.Metrics) (*models.Metrics, error) {
 	return m.getValueFuncJSON(metric)
 }
+
+func TestGetFilesFromPath(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "custom.crt")
+	keyFile := filepath.Join(dir, "custom.key")
+	assert.NoError(t, os.WriteFile(certFile, []byte("cert"), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, []byte("key"), 0600))
+
+	t.Run("Explicit paths", func(t *testing.T) {
+		r := &Router{certFile: certFile, keyFile: keyFile}
+		assert.True(t, r.tlsEnabled())
+
+		cert, key, err := r.getFilesFromPath()
+		assert.NoError(t, err)
+		assert.Equal(t, certFile, cert)
+		assert.Equal(t, keyFile, key)
+	})
+
+	t.Run("Explicit cert without key", func(t *testing.T) {
+		r := &Router{certFile: certFile}
+
+		_, _, err := r.getFilesFromPath()
+		assert.ErrorIs(t, err, ErrCertNotFound)
+	})
+
+	t.Run("Explicit path does not exist", func(t *testing.T) {
+		r := &Router{certFile: filepath.Join(dir, "missing.crt"), keyFile: keyFile}
+
+		_, _, err := r.getFilesFromPath()
+		assert.ErrorIs(t, err, ErrCertNotFound)
+	})
+
+	t.Run("Directory scan", func(t *testing.T) {
+		certDir := t.TempDir()
+		assert.NoError(t, os.WriteFile(filepath.Join(certDir, "server.pem"), []byte("cert"), 0600))
+		assert.NoError(t, os.WriteFile(filepath.Join(certDir, "server.key"), []byte("key"), 0600))
+		r := &Router{cryptoPath: certDir}
+
+		cert, key, err := r.getFilesFromPath()
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(certDir, "server.pem"), cert)
+		assert.Equal(t, filepath.Join(certDir, "server.key"), key)
+	})
+
+	t.Run("Directory search path", func(t *testing.T) {
+		certDir := t.TempDir()
+		assert.NoError(t, os.WriteFile(filepath.Join(certDir, "server.pem"), []byte("cert"), 0600))
+		assert.NoError(t, os.WriteFile(filepath.Join(certDir, "server.key"), []byte("key"), 0600))
+		r := &Router{cryptoPath: filepath.Join(dir, "missing") + "," + dir + ", " + certDir}
+
+		cert, key, err := r.getFilesFromPath()
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(certDir, "server.pem"), cert)
+		assert.Equal(t, filepath.Join(certDir, "server.key"), key)
+	})
+
+	t.Run("Missing cert in directory", func(t *testing.T) {
+		r := &Router{cryptoPath: dir}
+
+		_, _, err := r.getFilesFromPath()
+		assert.ErrorIs(t, err, ErrCertNotFound)
+	})
+}
+
+func TestStartServerMissingCert(t *testing.T) {
+	r := New(nil, nil, &flags.Config{CryptoPath: t.TempDir()})
+
+	err := r.StartServer("127.0.0.1:0")
+	assert.ErrorIs(t, err, ErrCertNotFound)
+}
+
+func TestStartServerUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "server.sock")
+
+	mockService := new(MockService)
+	mockService.On("PingDB").Return(nil)
+
+	r := New(mockService, nil, &flags.Config{})
+	r.mux.GET("/ping", r.PingHandler)
+
+	go r.StartServer("unix://" + socketPath)
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://unix/ping")
+	assert.NoError(t, err)
+	if resp != nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	assert.NoError(t, r.StopServer(context.Background()))
+
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStartServerTLSMinVersion(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "server.sock")
+
+	r := New(new(MockService), nil, &flags.Config{
+		CertFile:      "../../../certs/server.pem",
+		KeyFile:       "../../../certs/server.key",
+		TLSMinVersion: "1.3",
+	})
+
+	go r.StartServer("unix://" + socketPath)
+	defer r.StopServer(context.Background())
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// handshake устанавливает TLS-соединение с ограничением максимальной версии клиента
+	handshake := func(maxVersion uint16) error {
+		conn, err := tls.Dial("unix", socketPath, &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         maxVersion,
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	assert.Error(t, handshake(tls.VersionTLS12), "client below the minimum version must be rejected")
+	assert.NoError(t, handshake(tls.VersionTLS13))
+}
+
+func TestStartServerInvalidTLSSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *flags.Config
+		wantErr string
+	}{
+		{name: "Unknown version", config: &flags.Config{TLSMinVersion: "1.9"}, wantErr: "TLSMinVersion"},
+		{name: "Insecure cipher", config: &flags.Config{TLSCiphers: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, wantErr: "TLSCiphers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.CertFile = "../../../certs/server.pem"
+			tt.config.KeyFile = "../../../certs/server.key"
+			r := New(new(MockService), nil, tt.config)
+
+			// Сервер не запускается с умолчаниями crypto/tls вместо заданных настроек
+			err := r.StartServer("unix://" + filepath.Join(t.TempDir(), "server.sock"))
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestStartServerMaxConns(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "server.sock")
+
+	mockService := new(MockService)
+	mockService.On("PingDB").Return(nil)
+
+	r := New(mockService, nil, &flags.Config{MaxConns: 1, KeepAlive: true})
+	r.mux.GET("/ping", r.PingHandler)
+
+	go r.StartServer("unix://" + socketPath)
+	defer r.StopServer(context.Background())
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(socketPath)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// ping отправляет запрос по соединению и ждет ответа не дольше timeout
+	ping := func(conn net.Conn, timeout time.Duration) error {
+		if _, err := conn.Write([]byte("GET /ping HTTP/1.1\r\nHost: unix\r\n\r\n")); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	first, err := net.Dial("unix", socketPath)
+	assert.NoError(t, err)
+	assert.NoError(t, ping(first, time.Second))
+
+	// Первое соединение остается открытым, второе не обслуживается
+	second, err := net.Dial("unix", socketPath)
+	assert.NoError(t, err)
+	defer second.Close()
+	assert.Error(t, ping(second, 200*time.Millisecond))
+
+	// После закрытия первого соединения второе принимается
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(second), nil)
+	assert.NoError(t, err)
+	if resp != nil {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestRegisterRoutesMiddlewareScope(t *testing.T) {
+	config := &flags.Config{SecretKey: "secret", AllowedOrigins: []string{"http://example.com"}}
+	m := middleware.New(&logger.Logger{ZapLogger: zap.NewNop()}, config)
+	mockService := new(MockService)
+	r := New(mockService, m, config)
+	r.RegisterRoutes()
+
+	value := 1.5
+	mockService.On("GetValueServJSON", mock.Anything).Return(&models.Metrics{ID: "g", MType: "gauge", Value: &value}, nil)
+
+	do := func(method, url string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(`[{"id":"g","type":"gauge","value":2.5}]`))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		r.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// Чтение не требует подписи, пакетное обновление без подписи отклоняется
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/value/gauge/g", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/updates/", nil).Code)
+	mockService.AssertNotCalled(t, "UpdateBatchMetricsServ", mock.Anything)
+
+	// Предварительные CORS-запросы обслуживаются только для API
+	preflight := http.Header{
+		"Origin":                        {"http://example.com"},
+		"Access-Control-Request-Method": {http.MethodPost},
+	}
+	w := do(http.MethodOptions, "/updates/", preflight)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "http://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodOptions, "/dump", preflight).Code)
+}
+
+func TestReplicaMode(t *testing.T) {
+	config := &flags.Config{Replica: true}
+	m := middleware.New(&logger.Logger{ZapLogger: zap.NewNop()}, config)
+	mockService := new(MockService)
+	r := New(mockService, m, config)
+	r.RegisterRoutes()
+
+	value := 1.5
+	stored := &models.Metrics{ID: "g", MType: "gauge", Value: &value}
+	mockService.On("GetValueServJSON", mock.Anything).Return(stored, nil)
+	mockService.On("ExportMetrics").Return([]models.Metrics{*stored}, nil)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tt := range []struct{ method, url, body string }{
+		{http.MethodPost, "/update/gauge/g/2.5", ""},
+		{http.MethodPost, "/update/", `{"id":"g","type":"gauge","value":2.5}`},
+		{http.MethodPost, "/updates/", `[{"id":"g","type":"gauge","value":2.5}]`},
+	} {
+		w := do(tt.method, tt.url, tt.body)
+		assert.Equal(t, http.StatusMethodNotAllowed, w.Code, tt.url)
+		assert.Equal(t, "GET, HEAD", w.Header().Get("Allow"))
+	}
+	mockService.AssertNotCalled(t, "UpdateServJSON", mock.Anything)
+	mockService.AssertNotCalled(t, "UpdateBatchMetricsServ", mock.Anything)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/value/gauge/g", "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/value/", `{"id":"g","type":"gauge"}`).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/dump", "").Code)
+}
+
+func TestImportRoute(t *testing.T) {
+	body := `[{"id":"g","type":"gauge","value":2.5}]`
+	newRouter := func(config *flags.Config) (*Router, *MockService) {
+		m := middleware.New(&logger.Logger{ZapLogger: zap.NewNop()}, config)
+		mockService := new(MockService)
+		mockService.On("ImportMetrics", mock.Anything).Return(1, nil)
+		r := New(mockService, m, config)
+		r.RegisterRoutes()
+		return r, mockService
+	}
+	do := func(r *Router, hash string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(body))
+		if hash != "" {
+			req.Header.Set("HashSHA256", hash)
+		}
+		w := httptest.NewRecorder()
+		r.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// На основном сервере и на реплике без ключа импорт не регистрируется
+	for _, config := range []*flags.Config{{SecretKey: "secret"}, {Replica: true}} {
+		r, mockService := newRouter(config)
+		assert.Equal(t, http.StatusNotFound, do(r, "").Code)
+		mockService.AssertNotCalled(t, "ImportMetrics", mock.Anything)
+	}
+
+	r, mockService := newRouter(&flags.Config{Replica: true, SecretKey: "secret"})
+	assert.Equal(t, http.StatusBadRequest, do(r, "").Code, "unsigned import is rejected")
+	mockService.AssertNotCalled(t, "ImportMetrics", mock.Anything)
+
+	h := hmac.New(sha256.New, []byte("secret"))
+	h.Write([]byte(body))
+	w := do(r, hex.EncodeToString(h.Sum(nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"imported":1}`, w.Body.String())
+}
+
+func TestRegisterRoutesCounterRead(t *testing.T) {
+	config := &flags.Config{}
+	m := middleware.New(&logger.Logger{ZapLogger: zap.NewNop()}, config)
+	mockService := new(MockService)
+	r := New(mockService, m, config)
+	r.RegisterRoutes()
+
+	delta := int64(5)
+	mockService.On("GetValueServJSON", mock.Anything).Return(&models.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}, nil)
+	mockService.On("CounterDebug", "PollCount").Return(&models.CounterDebug{ID: "PollCount", Total: 5}, nil)
+
+	for _, url := range []string{"/value/counter/PollCount", "/debug/counter/PollCount"} {
+		w := httptest.NewRecorder()
+		r.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		assert.Equal(t, http.StatusOK, w.Code, url)
+	}
+	mockService.AssertCalled(t, "GetValueServJSON", mock.Anything)
+	mockService.AssertCalled(t, "CounterDebug", "PollCount")
+}
+
+func TestUpdatesBodyLogging(t *testing.T) {
+	body := `[{"id":"PaymentToken","type":"gauge","value":1}]`
+
+	// send отправляет пакет через все слои сервера, уровень логгера задается так же, как в main
+	send := func(debug bool) *observer.ObservedLogs {
+		level := zap.InfoLevel
+		if debug {
+			level = zap.DebugLevel
+		}
+		core, logs := observer.New(level)
+		log := &logger.Logger{ZapLogger: zap.New(core)}
+
+		config := &flags.Config{Debug: debug}
+		r := New(service.New(storage.NewMemStorage(), log, config), middleware.New(log, config), config)
+		r.RegisterRoutes()
+
+		req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.mux.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return logs
+	}
+
+	t.Run("Body not logged by default", func(t *testing.T) {
+		for _, entry := range send(false).All() {
+			for _, value := range entry.ContextMap() {
+				assert.NotContains(t, fmt.Sprint(value), "PaymentToken")
+			}
+		}
+	})
+
+	t.Run("Body logged at debug level", func(t *testing.T) {
+		logs := send(true).FilterMessage("Metrics batch").All()
+		if assert.Len(t, logs, 1) {
+			assert.Equal(t, zap.DebugLevel, logs[0].Level)
+			assert.Contains(t, fmt.Sprint(logs[0].ContextMap()["metrics"]), "PaymentToken")
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeSet набор маршрутов с общими middleware.
+// Middleware набора выполняются только для его маршрутов, после глобальных middleware роутера
+type routeSet struct {
+	router     *Router
+	middleware []gin.HandlerFunc
+	cors       gin.HandlerFunc // проверка CORS, для маршрутов регистрируется OPTIONS
+}
+
+// routes создает набор маршрутов без middleware
+func (s *Router) routes() *routeSet {
+	return &routeSet{router: s}
+}
+
+// use возвращает копию набора с дополнительными middleware
+func (r *routeSet) use(middleware ...gin.HandlerFunc) *routeSet {
+	next := *r
+	next.middleware = append(append([]gin.HandlerFunc(nil), r.middleware...), middleware...)
+	return &next
+}
+
+// withCORS возвращает копию набора с проверкой CORS, если заданы разрешенные источники
+func (r *routeSet) withCORS() *routeSet {
+	if len(r.router.origins) == 0 {
+		return r
+	}
+	cors := r.router.Middl.CORS(r.router.origins)
+	next := r.use(cors)
+	next.cors = cors
+	return next
+}
+
+// handle регистрирует маршрут с middleware набора.
+// Для наборов с CORS на тот же путь регистрируется OPTIONS для предварительных запросов
+func (r *routeSet) handle(method, path string, handlers ...gin.HandlerFunc) {
+	chain := append(append([]gin.HandlerFunc(nil), r.middleware...), handlers...)
+	r.router.mux.Handle(method, path, chain...)
+
+	if r.cors == nil {
+		return
+	}
+	if r.router.preflights == nil {
+		r.router.preflights = make(map[string]struct{})
+	}
+	if _, ok := r.router.preflights[path]; ok {
+		return
+	}
+	r.router.preflights[path] = struct{}{}
+	r.router.mux.OPTIONS(path, r.cors, func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+}
+
+// get регистрирует GET маршрут
+func (r *routeSet) get(path string, handlers ...gin.HandlerFunc) {
+	r.handle(http.MethodGet, path, handlers...)
+}
+
+// post регистрирует POST маршрут
+func (r *routeSet) post(path string, handlers ...gin.HandlerFunc) {
+	r.handle(http.MethodPost, path, handlers...)
+}
+
+// delete регистрирует DELETE маршрут
+func (r *routeSet) delete(path string, handlers ...gin.HandlerFunc) {
+	r.handle(http.MethodDelete, path, handlers...)
+}
@@ -0,0 +1,85 @@
+package lifecycle
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Group отслеживает фоновые горутины сервера и позволяет дождаться их завершения
+type Group struct {
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	running map[string]int // количество работающих горутин по имени
+}
+
+// Go запускает fn в отдельной горутине, учитывая ее под именем name
+func (g *Group) Go(name string, fn func()) {
+	g.mu.Lock()
+	if g.running == nil {
+		g.running = make(map[string]int)
+	}
+	g.running[name]++
+	g.mu.Unlock()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer g.finish(name)
+		fn()
+	}()
+}
+
+// finish снимает горутину с учета
+func (g *Group) finish(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.running[name]--
+	if g.running[name] == 0 {
+		delete(g.running, name)
+	}
+}
+
+// Wait ждет завершения всех горутин, но не дольше ctx.
+// Возвращает имена горутин, не завершившихся вовремя
+func (g *Group) Wait(ctx context.Context) []string {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	names := make([]string, 0, len(g.running))
+	for name := range g.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StopWithin вызывает stop и ждет его завершения. Если stop не уложился в ctx, вызывается late,
+// но ожидание продолжается: прерванное сохранение оставило бы данные неполными
+func StopWithin(ctx context.Context, stop func() error, late func()) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- stop()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		late()
+	}
+	return <-done
+}
@@ -0,0 +1,70 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupWait(t *testing.T) {
+	t.Run("All goroutines finish on shutdown", func(t *testing.T) {
+		var g Group
+		stop := make(chan struct{})
+		for _, name := range []string{"server", "pprof", "flusher"} {
+			g.Go(name, func() { <-stop })
+		}
+
+		close(stop)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.Empty(t, g.Wait(ctx))
+	})
+
+	t.Run("Stuck goroutine reported", func(t *testing.T) {
+		var g Group
+		stop := make(chan struct{})
+		defer close(stop)
+
+		g.Go("done", func() {})
+		g.Go("stuck", func() { <-stop })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, []string{"stuck"}, g.Wait(ctx))
+	})
+}
+
+func TestStopWithin(t *testing.T) {
+	t.Run("Stop finished in time", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		errStop := errors.New("flush failed")
+		late := false
+		assert.ErrorIs(t, StopWithin(ctx, func() error { return errStop }, func() { late = true }), errStop)
+		assert.False(t, late)
+	})
+
+	t.Run("Slow stop reported and awaited", func(t *testing.T) {
+		timeout := 50 * time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		var lateAfter time.Duration
+		start := time.Now()
+		finished := false
+		err := StopWithin(ctx, func() error {
+			time.Sleep(2 * timeout)
+			finished = true
+			return nil
+		}, func() { lateAfter = time.Since(start) })
+		assert.NoError(t, err)
+		assert.True(t, finished, "stop is not abandoned")
+		assert.GreaterOrEqual(t, lateAfter, timeout)
+		assert.Less(t, lateAfter, 2*timeout)
+	})
+}
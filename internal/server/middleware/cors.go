@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Заголовки и методы, разрешенные для кросс-доменных запросов
+const (
+	corsAllowMethods = "GET, POST, OPTIONS"
+	corsAllowHeaders = "Content-Type, Content-Encoding, Accept-Encoding, HashSHA256, X-Nonce, X-Timestamp"
+	corsMaxAge       = "600"
+)
+
+// CORS - middleware для кросс-доменных запросов из браузера.
+// Разрешены только источники из origins, "*" разрешает любой источник
+func (m Middleware) CORS(origins []string) gin.HandlerFunc {
+	allowed := make(map[string]struct{}, len(origins))
+	wildcard := false
+	for _, origin := range origins {
+		if origin == "*" {
+			wildcard = true
+		}
+		allowed[origin] = struct{}{}
+	}
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		_, ok := allowed[origin]
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+
+		if !ok && !wildcard {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if wildcard && !ok {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Vary", "Origin")
+		}
+
+		if preflight {
+			c.Header("Access-Control-Allow-Methods", corsAllowMethods)
+			c.Header("Access-Control-Allow-Headers", corsAllowHeaders)
+			c.Header("Access-Control-Max-Age", corsMaxAge)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Next()
+	}
+}
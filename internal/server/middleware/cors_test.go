@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name            string
+		origins         []string
+		method          string
+		origin          string
+		requestMethod   string
+		expectedStatus  int
+		expectedOrigin  string
+		expectedMethods string
+	}{
+		{
+			name:           "Allowed origin",
+			origins:        []string{"https://dash.example.com"},
+			method:         http.MethodGet,
+			origin:         "https://dash.example.com",
+			expectedStatus: http.StatusOK,
+			expectedOrigin: "https://dash.example.com",
+		},
+		{
+			name:           "Disallowed origin",
+			origins:        []string{"https://dash.example.com"},
+			method:         http.MethodGet,
+			origin:         "https://evil.example.com",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:            "Preflight request",
+			origins:         []string{"https://dash.example.com"},
+			method:          http.MethodOptions,
+			origin:          "https://dash.example.com",
+			requestMethod:   http.MethodPost,
+			expectedStatus:  http.StatusNoContent,
+			expectedOrigin:  "https://dash.example.com",
+			expectedMethods: corsAllowMethods,
+		},
+		{
+			name:           "Preflight from disallowed origin",
+			origins:        []string{"https://dash.example.com"},
+			method:         http.MethodOptions,
+			origin:         "https://evil.example.com",
+			requestMethod:  http.MethodPost,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Wildcard",
+			origins:        []string{"*"},
+			method:         http.MethodGet,
+			origin:         "https://any.example.com",
+			expectedStatus: http.StatusOK,
+			expectedOrigin: "*",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMiddleware()
+			router := gin.New()
+			router.Use(m.CORS(tt.origins))
+			router.GET("/value/", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(tt.method, "/value/", nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.requestMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedOrigin, w.Header().Get("Access-Control-Allow-Origin"))
+			assert.Equal(t, tt.expectedMethods, w.Header().Get("Access-Control-Allow-Methods"))
+		})
+	}
+}
@@ -1,60 +1,162 @@
 package middleware
 
 import (
+	"compress/flate"
 	"compress/gzip"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/vova4o/yandexadv/internal/server/flags"
 	"github.com/vova4o/yandexadv/package/logger"
 	"go.uber.org/zap"
 )
 
 // Middleware структура для middleware
 type Middleware struct {
-	SecretKey string
-	Logger    *logger.Logger
+	SecretKey   string
+	MaxBodySize int64
+	Logger      *logger.Logger
+	REDMetrics  *REDMetrics
+	MaxInFlight int
+	Nonces      *NonceCache
+	AdminToken  string
+	GzipMinSize int
+	GzipReaders *BoundedPool
+	GzipWriters *BoundedPool
+	Debug       bool          // логировать тела запросов на уровне debug
+	NoOverride  bool          // отклонять запросы с заголовками подмены метода
+	SlowRequest time.Duration // запросы дольше логируются на уровне warn, 0 отключает
+	SkipPaths   []string      // пути, запросы к которым не логируются
+	MaxRatio    int           // допустимая степень сжатия тела запроса, 0 отключает проверку
 }
 
 // New создание нового middleware
-func New(log *logger.Logger, key string) *Middleware {
+func New(log *logger.Logger, config *flags.Config) *Middleware {
 	return &Middleware{
-		Logger:    log,
-		SecretKey: key,
+		Logger:      log,
+		SecretKey:   config.SecretKey,
+		MaxBodySize: config.MaxBodySize,
+		REDMetrics:  NewREDMetrics(),
+		MaxInFlight: config.MaxInFlight,
+		Nonces:      newNonces(config.ReplayWindow),
+		AdminToken:  config.AdminToken,
+		GzipMinSize: config.GzipMinSize,
+		GzipReaders: newGzipReaderPool(config.GzipPoolSize),
+		GzipWriters: newGzipWriterPool(config.GzipPoolSize),
+		Debug:       config.Debug,
+		NoOverride:  config.RejectOverride,
+		SlowRequest: config.SlowRequest,
+		SkipPaths:   config.NoLogPaths,
+		MaxRatio:    config.MaxGzipRatio,
 	}
 }
 
+// newNonces создает кэш nonce, если включена защита от повтора запросов
+func newNonces(windowSeconds int) *NonceCache {
+	if windowSeconds <= 0 {
+		return nil
+	}
+	return NewNonceCache(time.Duration(windowSeconds)*time.Second, nonceCacheSize)
+}
+
 // GzipReader - обертка для gzip.Reader
 type GzipReader struct {
 	io.ReadCloser
 	reader *gzip.Reader
 }
 
-// GzipWriter - обертка для gzip.Writer
+// DeflateReader - обертка для flate.Reader
+type DeflateReader struct {
+	io.ReadCloser
+	reader io.ReadCloser
+}
+
+// ErrRatioExceeded ошибка превышения допустимой степени сжатия тела запроса
+var ErrRatioExceeded = errors.New("decompression ratio exceeded")
+
+// ratioMinSize объем распакованных данных, до которого степень сжатия не проверяется,
+// чтобы не отклонять небольшие хорошо сжимаемые запросы
+const ratioMinSize = 16 << 10
+
+// countingReader - обертка, считающая прочитанные байты
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+// Read - чтение данных с подсчетом байт
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// ratioReader - обертка над распаковщиком, прерывающая чтение, как только объем
+// распакованных данных превысит объем прочитанных сжатых более чем в maxRatio раз
+type ratioReader struct {
+	io.ReadCloser
+	compressed *countingReader
+	read       int64
+	maxRatio   int64
+}
+
+// Read - чтение распакованных данных с проверкой степени сжатия
+func (r *ratioReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if r.read > ratioMinSize && r.read > r.compressed.n*r.maxRatio {
+		return n, ErrRatioExceeded
+	}
+	return n, err
+}
+
+// GzipWriter - обертка для gzip.Writer.
+// Ответ буферизуется до minSize байт, ответы меньше порога отправляются без сжатия
 type GzipWriter struct {
 	gin.ResponseWriter
-	writer *gzip.Writer
+	writer  *gzip.Writer
+	minSize int
+	buf     []byte
+	pool    *BoundedPool
+	pooled  bool // writer взят из пула и должен быть в него возвращен
+	skip    bool // ответ уже сжат и передается как есть
 }
 
-// Пул объектов для gzip.Reader и gzip.Writer
-var gzipReaderPool = sync.Pool{
-	New: func() interface{} {
-		return new(gzip.Reader)
-	},
+// compressedTypes типы содержимого, которые уже сжаты и повторно не сжимаются
+var compressedTypes = map[string]struct{}{
+	"application/gzip":    {},
+	"application/x-gzip":  {},
+	"application/zip":     {},
+	"application/zstd":    {},
+	"application/x-xz":    {},
+	"application/x-bzip2": {},
+	"image/jpeg":          {},
+	"image/png":           {},
+	"image/gif":           {},
+	"image/webp":          {},
 }
 
-var gzipWriterPool = sync.Pool{
-	New: func() interface{} {
-		return gzip.NewWriter(nil)
-	},
+// alreadyCompressed сообщает, что ответ уже сжат: обработчик задал Content-Encoding
+// или Content-Type указывает на сжатый формат
+func alreadyCompressed(header http.Header) bool {
+	if header.Get("Content-Encoding") != "" {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(header.Get("Content-Type"), ";")
+	_, ok := compressedTypes[strings.ToLower(strings.TrimSpace(mediaType))]
+	return ok
 }
 
 // Read - чтение данных из gzip.Reader
@@ -62,15 +164,79 @@ func (g *GzipReader) Read(p []byte) (int, error) {
 	return g.reader.Read(p)
 }
 
-// Write - запись данных в gzip.Writer
+// Read - чтение данных из flate.Reader
+func (d *DeflateReader) Read(p []byte) (int, error) {
+	return d.reader.Read(p)
+}
+
+// Write - запись данных в gzip.Writer, пока ответ не достиг порога данные копятся в буфере
 func (g *GzipWriter) Write(data []byte) (int, error) {
-	return g.writer.Write(data)
+	if g.writer != nil {
+		return g.writer.Write(data)
+	}
+	if g.skip || alreadyCompressed(g.Header()) {
+		g.skip = true
+		if err := g.flushBuf(); err != nil {
+			return 0, err
+		}
+		return g.ResponseWriter.Write(data)
+	}
+
+	g.buf = append(g.buf, data...)
+	if len(g.buf) < g.minSize {
+		return len(data), nil
+	}
+	if err := g.startGzip(); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// WriteString - запись строки через Write, чтобы она не миновала сжатие
+func (g *GzipWriter) WriteString(s string) (int, error) {
+	return g.Write([]byte(s))
+}
+
+// startGzip включает сжатие ответа и записывает накопленный буфер
+func (g *GzipWriter) startGzip() error {
+	g.Header().Set("Content-Encoding", "gzip")
+	g.Header().Del("Content-Length")
+
+	w, pooled := g.pool.Get()
+	g.writer, g.pooled = w.(*gzip.Writer), pooled
+	g.writer.Reset(g.ResponseWriter)
+
+	_, err := g.writer.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+// flushBuf отправляет накопленный буфер без сжатия
+func (g *GzipWriter) flushBuf() error {
+	if len(g.buf) == 0 {
+		return nil
+	}
+	_, err := g.ResponseWriter.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+// Close - завершение ответа: отправка несжатого буфера или закрытие gzip-потока
+func (g *GzipWriter) Close() error {
+	if g.writer == nil {
+		return g.flushBuf()
+	}
+
+	err := g.writer.Close()
+	g.pool.Put(g.writer, g.pooled)
+	g.writer = nil
+	return err
 }
 
 // CheckHash - проверка хэша
 func (m Middleware) CheckHash() gin.HandlerFunc {
+	m.Logger.Info("Request signature check", zap.Bool("key_configured", m.SecretKey != ""))
 	return func(c *gin.Context) {
-		m.Logger.Info("SecretKey", zap.String("SecretKey", m.SecretKey))
 		if m.SecretKey == "" {
 			c.Next()
 			return
@@ -86,20 +252,38 @@ func (m Middleware) CheckHash() gin.HandlerFunc {
 		// Чтение данных из тела запроса
 		data, err := io.ReadAll(c.Request.Body)
 		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) || errors.Is(err, ErrRatioExceeded) {
+				c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+				return
+			}
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
-		m.Logger.Info("data", zap.String("data", string(data)))
+		if m.Debug {
+			m.Logger.Debug("data", zap.String("data", string(data)))
+		}
 
 		c.Request.Body = io.NopCloser(strings.NewReader(string(data)))
 
-		expectedHash := calculateHash(data, []byte(m.SecretKey))
+		nonce := c.GetHeader(NonceHeader)
+		timestamp := c.GetHeader(TimestampHeader)
+
+		expectedHash := calculateHash(signedData(data, nonce, timestamp), []byte(m.SecretKey))
 		m.Logger.Info("Hash check", zap.String("result", fmt.Sprintf("%v", expectedHash == hash)))
 		if hash != expectedHash {
 			c.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 
+		if m.Nonces != nil {
+			if err := m.Nonces.Check(nonce, timestamp, time.Now()); err != nil {
+				m.Logger.Warn("Rejected signed request", zap.Error(err))
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+
 		c.Next()
 
 		// Добавление хэша в заголовок ответа на этапе формирования ответа
@@ -109,6 +293,20 @@ func (m Middleware) CheckHash() gin.HandlerFunc {
 	}
 }
 
+// secretHeaders заголовки, значения которых не попадают в логи
+var secretHeaders = []string{"Authorization", "Cookie", "HashSHA256"}
+
+// RedactHeaders возвращает копию заголовков, в которой значения секретных заголовков заменены на [REDACTED]
+func RedactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range secretHeaders {
+		if _, ok := redacted[http.CanonicalHeaderKey(name)]; ok {
+			redacted.Set(name, "[REDACTED]")
+		}
+	}
+	return redacted
+}
+
 // calculateHash вычисляет HMAC-SHA256 хэш из данных и ключа
 func calculateHash(data, key []byte) string {
 	h := hmac.New(sha256.New, key)
@@ -116,45 +314,135 @@ func calculateHash(data, key []byte) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// GunzipMiddleware - middleware для распаковки запросов
+// AdminAuth - проверка bearer-токена администратора.
+// Без токена возвращает 401, с неверным токеном 403, при пустом AdminToken эндпоинты отключены (404)
+func (m Middleware) AdminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m.AdminToken == "" {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(m.AdminToken)) != 1 {
+			m.Logger.Warn("Rejected admin request", zap.String("path", c.Request.URL.Path))
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// InFlightLimit - ограничение количества одновременно обрабатываемых запросов.
+// Запросы сверх MaxInFlight получают 503, при MaxInFlight = 0 ограничения нет
+func (m Middleware) InFlightLimit() gin.HandlerFunc {
+	var inFlight atomic.Int64
+	return func(c *gin.Context) {
+		if m.MaxInFlight <= 0 {
+			c.Next()
+			return
+		}
+
+		defer inFlight.Add(-1)
+		if inFlight.Add(1) > int64(m.MaxInFlight) {
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+		c.Next()
+	}
+}
+
+// LimitBody - ограничение размера тела запроса.
+// Должен стоять перед GunzipMiddleware, чтобы лимит применялся к сжатому потоку
+func (m Middleware) LimitBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m.MaxBodySize <= 0 {
+			c.Next()
+			return
+		}
+
+		if c.Request.ContentLength > m.MaxBodySize {
+			c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, m.MaxBodySize)
+		c.Next()
+	}
+}
+
+// GunzipMiddleware - middleware для распаковки запросов.
+// Декодер выбирается по заголовку Content-Encoding: gzip или deflate,
+// для неизвестных кодировок возвращается 415.
+// При заданном MaxRatio чтение тела прерывается с ErrRatioExceeded,
+// когда степень сжатия превышает допустимую
 func (m Middleware) GunzipMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if strings.Contains(c.GetHeader("Content-Encoding"), "gzip") {
-			gz := gzipReaderPool.Get().(*gzip.Reader)
-			defer gzipReaderPool.Put(gz)
+		compressed := &countingReader{reader: c.Request.Body}
 
-			if err := gz.Reset(c.Request.Body); err != nil {
+		switch strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding"))) {
+		case "", "identity":
+			c.Next()
+			return
+		case "gzip", "x-gzip":
+			pool := m.readerPool()
+			r, pooled := pool.Get()
+			gz := r.(*gzip.Reader)
+			defer pool.Put(gz, pooled)
+
+			if err := gz.Reset(compressed); err != nil {
 				c.AbortWithStatus(http.StatusBadRequest)
 				return
 			}
 			defer gz.Close()
 
 			c.Request.Body = &GzipReader{c.Request.Body, gz}
+		case "deflate":
+			fl := flate.NewReader(compressed)
+			defer fl.Close()
+
+			c.Request.Body = &DeflateReader{c.Request.Body, fl}
+		default:
+			c.AbortWithStatus(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if m.MaxRatio > 0 {
+			c.Request.Body = &ratioReader{ReadCloser: c.Request.Body, compressed: compressed, maxRatio: int64(m.MaxRatio)}
 		}
 		c.Next()
 	}
 }
 
-// GzipMiddleware - middleware для сжатия ответов
+// GzipMiddleware - middleware для сжатия ответов не меньше GzipMinSize байт
 func (m Middleware) GzipMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") {
-			gz := gzipWriterPool.Get().(*gzip.Writer)
-			defer gzipWriterPool.Put(gz)
+			gw := &GzipWriter{ResponseWriter: c.Writer, minSize: m.GzipMinSize, pool: m.writerPool()}
+			defer gw.Close()
 
-			gz.Reset(c.Writer)
-			defer gz.Close()
-
-			c.Writer = &GzipWriter{c.Writer, gz}
-			c.Header("Content-Encoding", "gzip")
+			c.Writer = gw
 		}
 		c.Next()
 	}
 }
 
-// GinZap возвращает middleware для логирования запросов с использованием zap
+// GinZap возвращает middleware для логирования запросов с использованием zap.
+// Запросы к путям из SkipPaths не логируются
 func (m Middleware) GinZap() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if slices.Contains(m.SkipPaths, c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
 		start := time.Now()
 		path := c.Request.URL.Path
 		raw := c.Request.URL.RawQuery
@@ -191,7 +479,7 @@ func (m Middleware) GinZap() gin.HandlerFunc {
 			}
 		}
 
-		m.Logger.Info("incoming request",
+		fields := []zap.Field{
 			zap.String("method", c.Request.Method),
 			zap.String("path", path),
 			zap.Duration("latency", latency),
@@ -200,6 +488,13 @@ func (m Middleware) GinZap() gin.HandlerFunc {
 			zap.String("user_agent", c.Request.UserAgent()),
 			zap.Int("content_length", contentLengthInt),
 			zap.Duration("parsed_latency", parsedLatency),
-		)
+		}
+
+		// Медленные запросы поднимаются до warn, чтобы их было видно без чтения всего лога
+		if m.SlowRequest > 0 && latency > m.SlowRequest {
+			m.Logger.Warn("slow request", append(fields, zap.Duration("threshold", m.SlowRequest))...)
+			return
+		}
+		m.Logger.Info("incoming request", fields...)
 	}
 }
@@ -1 +1,625 @@
 package middleware
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/vova4o/yandexadv/package/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// newTestMiddleware создает middleware с логгером, который ничего не пишет
+func newTestMiddleware() *Middleware {
+	return &Middleware{
+		Logger: &logger.Logger{ZapLogger: zap.NewNop()},
+	}
+}
+
+// gzipBytes сжимает данные для тестов
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+// readBodyHandler читает тело запроса и возвращает его размер
+func readBodyHandler(c *gin.Context) {
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		var status = http.StatusBadRequest
+		if _, ok := err.(*http.MaxBytesError); ok {
+			status = http.StatusRequestEntityTooLarge
+		}
+		c.Status(status)
+		return
+	}
+	c.String(http.StatusOK, "%d", len(data))
+}
+
+func TestLimitBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newTestMiddleware()
+	m.MaxBodySize = 64
+
+	router := gin.New()
+	router.Use(m.LimitBody())
+	router.Use(m.GunzipMiddleware())
+	router.POST("/update/", readBodyHandler)
+
+	tests := []struct {
+		name           string
+		body           []byte
+		gzip           bool
+		expectedStatus int
+	}{
+		{
+			name:           "Body within limit",
+			body:           bytes.Repeat([]byte("a"), 64),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Oversized body",
+			body:           bytes.Repeat([]byte("a"), 65),
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "Limit applies to compressed stream",
+			body:           bytes.Repeat([]byte("a"), 1024),
+			gzip:           true,
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.body
+			if tt.gzip {
+				body = gzipBytes(t, body)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(body))
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestLimitBodyUnknownLength(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newTestMiddleware()
+	m.MaxBodySize = 16
+	m.SecretKey = "secret"
+
+	router := gin.New()
+	router.Use(m.LimitBody())
+	router.Use(m.CheckHash())
+	router.POST("/updates/", readBodyHandler)
+
+	req := httptest.NewRequest(http.MethodPost, "/updates/", io.NopCloser(bytes.NewReader(bytes.Repeat([]byte("a"), 32))))
+	req.ContentLength = -1
+	req.Header.Set("HashSHA256", "hash")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+// deflateBytes сжимает данные алгоритмом deflate для тестов
+func deflateBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	fl, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	assert.NoError(t, err)
+	_, err = fl.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, fl.Close())
+	return buf.Bytes()
+}
+
+func TestGunzipMiddlewareEncodings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newTestMiddleware()
+	router := gin.New()
+	router.Use(m.GunzipMiddleware())
+	router.POST("/update/", func(c *gin.Context) {
+		data, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		c.String(http.StatusOK, string(data))
+	})
+
+	payload := []byte(`{"id":"metric1","type":"gauge","value":1}`)
+
+	tests := []struct {
+		name           string
+		encoding       string
+		body           []byte
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "No encoding",
+			body:           payload,
+			expectedStatus: http.StatusOK,
+			expectedBody:   string(payload),
+		},
+		{
+			name:           "Gzip",
+			encoding:       "gzip",
+			body:           gzipBytes(t, payload),
+			expectedStatus: http.StatusOK,
+			expectedBody:   string(payload),
+		},
+		{
+			name:           "Deflate",
+			encoding:       "deflate",
+			body:           deflateBytes(t, payload),
+			expectedStatus: http.StatusOK,
+			expectedBody:   string(payload),
+		},
+		{
+			name:           "Unsupported encoding",
+			encoding:       "br",
+			body:           payload,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestGunzipMiddlewareRatio(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newTestMiddleware()
+	m.MaxRatio = 100
+
+	var decompressed int
+	router := gin.New()
+	router.Use(m.GunzipMiddleware())
+	router.POST("/update/", func(c *gin.Context) {
+		data, err := io.ReadAll(c.Request.Body)
+		decompressed = len(data)
+		if errors.Is(err, ErrRatioExceeded) {
+			c.Status(http.StatusRequestEntityTooLarge)
+			return
+		}
+		assert.NoError(t, err)
+		c.Status(http.StatusOK)
+	})
+
+	t.Run("High ratio payload aborted early", func(t *testing.T) {
+		bomb := gzipBytes(t, make([]byte, 8<<20))
+		assert.Greater(t, 8<<20, len(bomb)*100)
+
+		req := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(bomb))
+		req.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Less(t, decompressed, 1<<20, "decompression stops long before the end of the payload")
+	})
+
+	t.Run("Regular payload passes", func(t *testing.T) {
+		payload := bytes.Repeat([]byte(`{"id":"metric1","type":"gauge","value":1}`), 100)
+
+		req := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(gzipBytes(t, payload)))
+		req.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, len(payload), decompressed)
+	})
+}
+
+func TestInFlightLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newTestMiddleware()
+	m.MaxInFlight = 2
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	router := gin.New()
+	router.Use(m.InFlightLimit())
+	router.GET("/slow", func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		c.Status(http.StatusOK)
+	})
+
+	var wg sync.WaitGroup
+	codes := make(chan int, m.MaxInFlight)
+	for i := 0; i < m.MaxInFlight; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+			codes <- w.Code
+		}()
+	}
+	for i := 0; i < m.MaxInFlight; i++ {
+		<-started
+	}
+
+	// Запрос сверх лимита отклоняется, пока предыдущие не завершены
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	// После завершения запросов лимит снова свободен
+	go func() { <-started }()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestCheckHashReplayProtection(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newTestMiddleware()
+	m.SecretKey = "secret"
+	m.Nonces = NewNonceCache(time.Minute, 10)
+
+	router := gin.New()
+	router.Use(m.CheckHash())
+	router.POST("/updates/", readBodyHandler)
+
+	body := []byte(`[{"id":"metric1","type":"gauge","value":1}]`)
+	send := func(nonce, timestamp string) int {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		req.Header.Set("HashSHA256", calculateHash(signedData(body, nonce, timestamp), []byte(m.SecretKey)))
+		if nonce != "" {
+			req.Header.Set(NonceHeader, nonce)
+			req.Header.Set(TimestampHeader, timestamp)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	t.Run("Fresh request accepted", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send("nonce-1", now))
+	})
+
+	t.Run("Replayed request rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, send("nonce-1", now))
+	})
+
+	t.Run("Stale timestamp rejected", func(t *testing.T) {
+		stale := strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10)
+		assert.Equal(t, http.StatusBadRequest, send("nonce-2", stale))
+	})
+
+	t.Run("Missing nonce rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, send("", ""))
+	})
+}
+
+func TestCheckHashBodyLogging(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	body := []byte(`[{"id":"PaymentToken","type":"gauge","value":1}]`)
+	send := func(debug bool) *observer.ObservedLogs {
+		core, logs := observer.New(zap.DebugLevel)
+		m := &Middleware{Logger: &logger.Logger{ZapLogger: zap.New(core)}, SecretKey: "secret", Debug: debug}
+
+		router := gin.New()
+		router.Use(m.CheckHash())
+		router.POST("/updates/", readBodyHandler)
+
+		req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		req.Header.Set("HashSHA256", calculateHash(signedData(body, "", ""), []byte(m.SecretKey)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return logs
+	}
+
+	t.Run("Body not logged by default", func(t *testing.T) {
+		logs := send(false)
+		for _, entry := range logs.All() {
+			for _, value := range entry.ContextMap() {
+				assert.NotContains(t, fmt.Sprint(value), "PaymentToken")
+			}
+		}
+	})
+
+	t.Run("Body logged at debug level", func(t *testing.T) {
+		logs := send(true).FilterMessage("data").All()
+		if assert.Len(t, logs, 1) {
+			assert.Equal(t, zap.DebugLevel, logs[0].Level)
+			assert.Equal(t, string(body), logs[0].ContextMap()["data"])
+		}
+	})
+}
+
+func TestCheckHashNeverLogsSecretKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const secret = "very-secret-key"
+	core, logs := observer.New(zap.DebugLevel)
+	m := &Middleware{Logger: &logger.Logger{ZapLogger: zap.New(core)}, SecretKey: secret, Debug: true}
+
+	router := gin.New()
+	router.Use(m.CheckHash())
+	router.POST("/updates/", readBodyHandler)
+
+	body := []byte(`[{"id":"metric1","type":"gauge","value":1}]`)
+	for _, hash := range []string{calculateHash(body, []byte(secret)), "wrong"} {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		req.Header.Set("HashSHA256", hash)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.NotEmpty(t, logs.All())
+	for _, entry := range logs.All() {
+		assert.NotContains(t, entry.Message, secret)
+		for _, value := range entry.ContextMap() {
+			assert.NotContains(t, fmt.Sprint(value), secret)
+		}
+	}
+}
+
+func TestGinZapSlowRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	core, logs := observer.New(zap.DebugLevel)
+	m := &Middleware{Logger: &logger.Logger{ZapLogger: zap.New(core)}, SlowRequest: 20 * time.Millisecond}
+
+	router := gin.New()
+	router.Use(m.GinZap())
+	router.GET("/fast", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/slow", func(c *gin.Context) {
+		time.Sleep(40 * time.Millisecond)
+		c.Status(http.StatusOK)
+	})
+
+	for _, path := range []string{"/fast", "/slow"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	entries := logs.All()
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, zap.InfoLevel, entries[0].Level)
+		assert.Equal(t, "/fast", entries[0].ContextMap()["path"])
+
+		assert.Equal(t, zap.WarnLevel, entries[1].Level)
+		assert.Equal(t, "slow request", entries[1].Message)
+		assert.Equal(t, "/slow", entries[1].ContextMap()["path"])
+		assert.GreaterOrEqual(t, entries[1].ContextMap()["latency"], 40*time.Millisecond)
+	}
+}
+
+func TestGinZapSkipPaths(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	core, logs := observer.New(zap.DebugLevel)
+	m := &Middleware{Logger: &logger.Logger{ZapLogger: zap.New(core)}, SkipPaths: []string{"/ping", "/healthz"}}
+
+	router := gin.New()
+	router.Use(m.GinZap())
+	for _, path := range []string{"/ping", "/healthz", "/value/gauge/Alloc"} {
+		router.GET(path, func(c *gin.Context) { c.Status(http.StatusOK) })
+	}
+
+	for _, path := range []string{"/ping", "/healthz?verbose=true", "/value/gauge/Alloc"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	entries := logs.All()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "/value/gauge/Alloc", entries[0].ContextMap()["path"])
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer token")
+	header.Set("HashSHA256", "abc")
+	header.Set("Content-Type", "application/json")
+
+	redacted := RedactHeaders(header)
+	assert.Equal(t, "[REDACTED]", redacted.Get("Authorization"))
+	assert.Equal(t, "[REDACTED]", redacted.Get("HashSHA256"))
+	assert.Equal(t, "application/json", redacted.Get("Content-Type"))
+	assert.Equal(t, "Bearer token", header.Get("Authorization"), "original headers must not change")
+	assert.NotContains(t, redacted, "Cookie")
+}
+
+func TestNonceCacheCapacity(t *testing.T) {
+	cache := NewNonceCache(time.Minute, 2)
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	assert.NoError(t, cache.Check("a", ts, now))
+	assert.NoError(t, cache.Check("b", ts, now))
+	assert.NoError(t, cache.Check("c", ts, now))
+	assert.Len(t, cache.seen, 2)
+	assert.ErrorIs(t, cache.Check("c", ts, now), ErrNonceReplay)
+}
+
+func TestAdminAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		adminToken     string
+		authorization  string
+		expectedStatus int
+	}{
+		{
+			name:           "Valid token",
+			adminToken:     "admin-secret",
+			authorization:  "Bearer admin-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Invalid token",
+			adminToken:     "admin-secret",
+			authorization:  "Bearer wrong",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Missing token",
+			adminToken:     "admin-secret",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Admin endpoints disabled",
+			authorization:  "Bearer admin-secret",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMiddleware()
+			m.AdminToken = tt.adminToken
+
+			router := gin.New()
+			router.Use(m.AdminAuth())
+			router.POST("/admin/flush", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/flush", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestGzipMiddlewareThreshold(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newTestMiddleware()
+	m.GzipMinSize = 64
+
+	large := bytes.Repeat([]byte("a"), 128)
+	router := gin.New()
+	router.Use(m.GzipMiddleware())
+	router.GET("/small", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	router.GET("/large", func(c *gin.Context) {
+		c.String(http.StatusOK, string(large))
+	})
+
+	t.Run("Small response uncompressed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/small", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "ok", w.Body.String())
+	})
+
+	t.Run("Large response gzipped", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/large", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+
+		gz, err := gzip.NewReader(w.Body)
+		assert.NoError(t, err)
+		data, err := io.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.Equal(t, large, data)
+	})
+}
+
+func TestGzipMiddlewareAlreadyCompressed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newTestMiddleware()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(bytes.Repeat([]byte("metric "), 100))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	compressed := buf.Bytes()
+
+	router := gin.New()
+	router.Use(m.GzipMiddleware())
+	router.GET("/archive", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/gzip", compressed)
+	})
+	router.GET("/encoded", func(c *gin.Context) {
+		c.Header("Content-Encoding", "gzip")
+		c.Data(http.StatusOK, "application/json", compressed)
+	})
+
+	for _, path := range []string{"/archive", "/encoded"} {
+		t.Run(path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, compressed, w.Body.Bytes(), "compressed body is sent as is")
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Заголовки защиты от повтора подписанных запросов
+const (
+	NonceHeader     = "X-Nonce"
+	TimestampHeader = "X-Timestamp"
+)
+
+// nonceCacheSize максимальное количество запоминаемых nonce
+const nonceCacheSize = 10000
+
+// Ошибки проверки nonce
+var (
+	ErrNonceMissing = errors.New("nonce or timestamp is missing")
+	ErrNonceStale   = errors.New("request timestamp is outside the replay window")
+	ErrNonceReplay  = errors.New("nonce has already been used")
+)
+
+// NonceCache хранит недавно использованные nonce в пределах окна
+type NonceCache struct {
+	mu       sync.Mutex
+	window   time.Duration
+	capacity int
+	seen     map[string]time.Time
+	order    []string // nonce в порядке добавления для вытеснения старых
+}
+
+// NewNonceCache создает кэш nonce с окном window и не более чем capacity записями
+func NewNonceCache(window time.Duration, capacity int) *NonceCache {
+	return &NonceCache{
+		window:   window,
+		capacity: capacity,
+		seen:     make(map[string]time.Time),
+	}
+}
+
+// Check проверяет свежесть метки времени и уникальность nonce и запоминает nonce.
+// timestamp - unix-время в секундах
+func (n *NonceCache) Check(nonce, timestamp string, now time.Time) error {
+	if nonce == "" || timestamp == "" {
+		return ErrNonceMissing
+	}
+
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrNonceMissing
+	}
+	if diff := now.Sub(time.Unix(sec, 0)); diff > n.window || diff < -n.window {
+		return ErrNonceStale
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.evict(now)
+	if _, ok := n.seen[nonce]; ok {
+		return ErrNonceReplay
+	}
+
+	if n.capacity > 0 && len(n.order) >= n.capacity {
+		delete(n.seen, n.order[0])
+		n.order = n.order[1:]
+	}
+	n.seen[nonce] = now
+	n.order = append(n.order, nonce)
+
+	return nil
+}
+
+// evict удаляет nonce, которые уже не могут пройти проверку метки времени.
+// Вызывается под блокировкой
+func (n *NonceCache) evict(now time.Time) {
+	i := 0
+	for ; i < len(n.order); i++ {
+		if now.Sub(n.seen[n.order[i]]) <= 2*n.window {
+			break
+		}
+		delete(n.seen, n.order[i])
+	}
+	n.order = n.order[i:]
+}
+
+// signedData возвращает данные, покрываемые подписью запроса
+func signedData(data []byte, nonce, timestamp string) []byte {
+	if nonce == "" {
+		return data
+	}
+	signed := make([]byte, 0, len(data)+len(nonce)+len(timestamp))
+	signed = append(signed, data...)
+	signed = append(signed, nonce...)
+	return append(signed, timestamp...)
+}
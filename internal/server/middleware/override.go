@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// methodOverrideHeaders заголовки, которыми прокси и клиенты подменяют метод запроса
+var methodOverrideHeaders = []string{"X-HTTP-Method-Override", "X-HTTP-Method", "X-Method-Override"}
+
+// MethodOverride - защита от подмены метода запроса заголовками.
+// Учитывается только настоящий метод HTTP: при NoOverride запросы с такими
+// заголовками отклоняются с кодом 400, иначе заголовки удаляются
+func (m Middleware) MethodOverride() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, name := range methodOverrideHeaders {
+			if c.Request.Header.Get(name) == "" {
+				continue
+			}
+			if m.NoOverride {
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			c.Request.Header.Del(name)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMethodOverride(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	newRouter := func(reject bool, updates, reads *int) *gin.Engine {
+		m := newTestMiddleware()
+		m.NoOverride = reject
+
+		router := gin.New()
+		router.Use(m.MethodOverride())
+		router.POST("/update/", func(c *gin.Context) {
+			*updates++
+			assert.Empty(t, c.GetHeader("X-HTTP-Method-Override"), "override header must not reach handlers")
+			c.Status(http.StatusOK)
+		})
+		router.GET("/update/", func(c *gin.Context) {
+			*reads++
+			assert.Empty(t, c.GetHeader("X-HTTP-Method-Override"), "override header must not reach handlers")
+			c.Status(http.StatusOK)
+		})
+		return router
+	}
+
+	send := func(router *gin.Engine, method, override string) int {
+		req := httptest.NewRequest(method, "/update/", nil)
+		req.Header.Set("X-HTTP-Method-Override", override)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("Override rejected", func(t *testing.T) {
+		updates, reads := 0, 0
+		router := newRouter(true, &updates, &reads)
+
+		assert.Equal(t, http.StatusBadRequest, send(router, http.MethodGet, http.MethodPost))
+		assert.Equal(t, http.StatusBadRequest, send(router, http.MethodPost, http.MethodGet))
+		assert.Zero(t, updates)
+		assert.Zero(t, reads)
+	})
+
+	t.Run("Override stripped", func(t *testing.T) {
+		updates, reads := 0, 0
+		router := newRouter(false, &updates, &reads)
+
+		// Запрос обрабатывается по настоящему методу, а не по заголовку
+		assert.Equal(t, http.StatusOK, send(router, http.MethodGet, http.MethodPost))
+		assert.Zero(t, updates, "GET must not become a POST update")
+		assert.Equal(t, 1, reads)
+
+		assert.Equal(t, http.StatusOK, send(router, http.MethodPost, http.MethodGet))
+		assert.Equal(t, 1, updates)
+		assert.Equal(t, 1, reads)
+	})
+
+	t.Run("Request without override", func(t *testing.T) {
+		updates, reads := 0, 0
+		router := newRouter(true, &updates, &reads)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 1, updates)
+	})
+}
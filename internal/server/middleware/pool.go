@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"sync"
+)
+
+// BoundedPool - пул объектов с ограничением на количество одновременно выданных из него объектов.
+// Запросы сверх лимита получают новый объект, который после использования выбрасывается
+type BoundedPool struct {
+	pool  sync.Pool
+	slots chan struct{} // семафор, nil означает пул без ограничения
+}
+
+// NewBoundedPool создает пул, выдающий не более size объектов одновременно, size <= 0 снимает ограничение
+func NewBoundedPool(size int, newFn func() interface{}) *BoundedPool {
+	p := &BoundedPool{pool: sync.Pool{New: newFn}}
+	if size > 0 {
+		p.slots = make(chan struct{}, size)
+	}
+	return p
+}
+
+// Get возвращает объект и признак того, что он взят из пула и должен быть возвращен через Put
+func (p *BoundedPool) Get() (interface{}, bool) {
+	if p.slots == nil {
+		return p.pool.Get(), true
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		return p.pool.Get(), true
+	default:
+		return p.pool.New(), false
+	}
+}
+
+// Put возвращает объект в пул, объекты, созданные сверх лимита, выбрасываются
+func (p *BoundedPool) Put(x interface{}, pooled bool) {
+	if !pooled {
+		return
+	}
+
+	p.pool.Put(x)
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// Пулы по умолчанию без ограничения, используются если у Middleware не заданы свои
+var (
+	defaultGzipReaderPool = newGzipReaderPool(0)
+	defaultGzipWriterPool = newGzipWriterPool(0)
+)
+
+// newGzipReaderPool создает пул gzip.Reader
+func newGzipReaderPool(size int) *BoundedPool {
+	return NewBoundedPool(size, func() interface{} {
+		return new(gzip.Reader)
+	})
+}
+
+// newGzipWriterPool создает пул gzip.Writer
+func newGzipWriterPool(size int) *BoundedPool {
+	return NewBoundedPool(size, func() interface{} {
+		return gzip.NewWriter(nil)
+	})
+}
+
+// readerPool возвращает пул gzip.Reader для распаковки запросов
+func (m Middleware) readerPool() *BoundedPool {
+	if m.GzipReaders != nil {
+		return m.GzipReaders
+	}
+	return defaultGzipReaderPool
+}
+
+// writerPool возвращает пул gzip.Writer для сжатия ответов
+func (m Middleware) writerPool() *BoundedPool {
+	if m.GzipWriters != nil {
+		return m.GzipWriters
+	}
+	return defaultGzipWriterPool
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoundedPool(t *testing.T) {
+	t.Run("Excess objects are not pooled", func(t *testing.T) {
+		var created atomic.Int64
+		pool := NewBoundedPool(2, func() interface{} {
+			created.Add(1)
+			return new(int)
+		})
+
+		var pooled int
+		objs := make([]interface{}, 5)
+		flags := make([]bool, 5)
+		for i := range objs {
+			objs[i], flags[i] = pool.Get()
+			if flags[i] {
+				pooled++
+			}
+		}
+		assert.Equal(t, 2, pooled)
+		assert.Equal(t, int64(5), created.Load())
+
+		for i := range objs {
+			pool.Put(objs[i], flags[i])
+		}
+
+		_, ok := pool.Get()
+		assert.True(t, ok, "slot should be released after Put")
+	})
+
+	t.Run("Concurrent use stays within the limit", func(t *testing.T) {
+		const size = 4
+		pool := NewBoundedPool(size, func() interface{} { return new(int) })
+
+		var inUse, maxInUse atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				x, pooled := pool.Get()
+				if pooled {
+					n := inUse.Add(1)
+					for {
+						m := maxInUse.Load()
+						if n <= m || maxInUse.CompareAndSwap(m, n) {
+							break
+						}
+					}
+					inUse.Add(-1)
+				}
+				pool.Put(x, pooled)
+			}()
+		}
+		wg.Wait()
+
+		assert.LessOrEqual(t, maxInUse.Load(), int64(size))
+		assert.Zero(t, len(pool.slots))
+	})
+
+	t.Run("Zero size is unlimited", func(t *testing.T) {
+		pool := NewBoundedPool(0, func() interface{} { return new(int) })
+		for i := 0; i < 10; i++ {
+			_, ok := pool.Get()
+			assert.True(t, ok)
+		}
+	})
+}
+
+// BenchmarkGzipMiddlewarePool сравнивает ограниченный и неограниченный пул gzip.Writer под конкурентной нагрузкой
+func BenchmarkGzipMiddlewarePool(b *testing.B) {
+	gin.SetMode(gin.TestMode)
+	body := strings.Repeat("metric ", 512)
+
+	for _, bc := range []struct {
+		name string
+		size int
+	}{
+		{name: "Unlimited", size: 0},
+		{name: "Limited", size: 4},
+	} {
+		size := bc.size
+		b.Run(bc.name, func(b *testing.B) {
+			m := newTestMiddleware()
+			m.GzipWriters = newGzipWriterPool(size)
+
+			router := gin.New()
+			router.Use(m.GzipMiddleware())
+			router.GET("/", func(c *gin.Context) {
+				c.String(http.StatusOK, body)
+			})
+
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					req := httptest.NewRequest(http.MethodGet, "/", nil)
+					req.Header.Set("Accept-Encoding", "gzip")
+					w := httptest.NewRecorder()
+					router.ServeHTTP(w, req)
+					if w.Header().Get("Content-Encoding") != "gzip" {
+						b.Fatal("response is not gzipped")
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unmatchedRoute метка маршрута для запросов, не попавших ни в один маршрут
+const unmatchedRoute = "unmatched"
+
+// durationBuckets границы гистограммы длительности запросов в секундах
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// redKey ключ счетчиков запросов
+type redKey struct {
+	method string
+	route  string
+	status int
+}
+
+// routeKey ключ гистограммы длительности
+type routeKey struct {
+	method string
+	route  string
+}
+
+// histogram гистограмма длительности запросов
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// PrometheusWriter источник дополнительных метрик для обработчика /metrics
+type PrometheusWriter interface {
+	WritePrometheus(w io.Writer)
+}
+
+// REDMetrics хранит метрики запросов (rate, errors, duration) по маршрутам
+type REDMetrics struct {
+	mu         sync.Mutex
+	requests   map[redKey]uint64
+	errors     map[redKey]uint64
+	durations  map[routeKey]*histogram
+	collectors []PrometheusWriter
+}
+
+// NewREDMetrics создает пустой набор метрик запросов
+func NewREDMetrics() *REDMetrics {
+	return &REDMetrics{
+		requests:  make(map[redKey]uint64),
+		errors:    make(map[redKey]uint64),
+		durations: make(map[routeKey]*histogram),
+	}
+}
+
+// Observe учитывает один обработанный запрос.
+// Ошибкой считается ответ со статусом 5xx
+func (r *REDMetrics) Observe(method, route string, status int, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := redKey{method: method, route: route, status: status}
+	r.requests[key]++
+	if status >= http.StatusInternalServerError {
+		r.errors[key]++
+	}
+
+	rk := routeKey{method: method, route: route}
+	h, ok := r.durations[rk]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(durationBuckets))}
+		r.durations[rk] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// Register добавляет источник метрик, который выводится вместе с метриками запросов
+func (r *REDMetrics) Register(c PrometheusWriter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, c)
+}
+
+// WritePrometheus записывает метрики в текстовом формате Prometheus
+func (r *REDMetrics) WritePrometheus(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP http_requests_total Total number of HTTP requests.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for _, key := range sortedRedKeys(r.requests) {
+		fmt.Fprintf(w, "http_requests_total{method=%q,route=%q,status=\"%d\"} %d\n", key.method, key.route, key.status, r.requests[key])
+	}
+
+	fmt.Fprintln(w, "# HELP http_request_errors_total Total number of HTTP requests answered with 5xx.")
+	fmt.Fprintln(w, "# TYPE http_request_errors_total counter")
+	for _, key := range sortedRedKeys(r.errors) {
+		fmt.Fprintf(w, "http_request_errors_total{method=%q,route=%q,status=\"%d\"} %d\n", key.method, key.route, key.status, r.errors[key])
+	}
+
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds HTTP request duration in seconds.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	routeKeys := make([]routeKey, 0, len(r.durations))
+	for key := range r.durations {
+		routeKeys = append(routeKeys, key)
+	}
+	sort.Slice(routeKeys, func(i, j int) bool {
+		if routeKeys[i].route != routeKeys[j].route {
+			return routeKeys[i].route < routeKeys[j].route
+		}
+		return routeKeys[i].method < routeKeys[j].method
+	})
+	for _, key := range routeKeys {
+		h := r.durations[key]
+		for i, bound := range durationBuckets {
+			le := strconv.FormatFloat(bound, 'f', -1, 64)
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{method=%q,route=%q,le=%q} %d\n", key.method, key.route, le, h.buckets[i])
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{method=%q,route=%q,le=\"+Inf\"} %d\n", key.method, key.route, h.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{method=%q,route=%q} %g\n", key.method, key.route, h.sum)
+		fmt.Fprintf(w, "http_request_duration_seconds_count{method=%q,route=%q} %d\n", key.method, key.route, h.count)
+	}
+
+	for _, c := range r.collectors {
+		c.WritePrometheus(w)
+	}
+}
+
+// sortedRedKeys возвращает ключи счетчиков в стабильном порядке
+func sortedRedKeys(m map[redKey]uint64) []redKey {
+	keys := make([]redKey, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	return keys
+}
+
+// RED - middleware для сбора метрик запросов по методу, маршруту и статусу
+func (m Middleware) RED() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m.REDMetrics == nil {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		m.REDMetrics.Observe(c.Request.Method, route, c.Writer.Status(), time.Since(start))
+	}
+}
+
+// REDHandler - обработчик, отдающий метрики запросов в формате Prometheus
+func (m Middleware) REDHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		c.Status(http.StatusOK)
+		if m.REDMetrics != nil {
+			m.REDMetrics.WritePrometheus(c.Writer)
+		}
+	}
+}
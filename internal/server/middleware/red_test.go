@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestREDMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newTestMiddleware()
+	m.REDMetrics = NewREDMetrics()
+
+	router := gin.New()
+	router.Use(m.RED())
+	router.GET("/ping", func(c *gin.Context) {
+		c.String(http.StatusOK, "pong")
+	})
+	router.GET("/fail", func(c *gin.Context) {
+		c.Status(http.StatusInternalServerError)
+	})
+	router.GET("/metrics", m.REDHandler())
+
+	for _, path := range []string{"/ping", "/ping", "/fail", "/missing"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/ping",status="200"} 2`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, body, `http_request_errors_total{method="GET",route="/fail",status="500"} 1`)
+	assert.NotContains(t, body, `http_request_errors_total{method="GET",route="/ping"`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="GET",route="/ping"} 2`)
+	assert.Contains(t, body, `http_request_duration_seconds_bucket{method="GET",route="/ping",le="+Inf"} 2`)
+}
+
+// staticCollector источник метрик с фиксированным выводом
+type staticCollector string
+
+func (c staticCollector) WritePrometheus(w io.Writer) {
+	io.WriteString(w, string(c))
+}
+
+func TestREDHandlerCollectors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	m := newTestMiddleware()
+	m.REDMetrics = NewREDMetrics()
+	m.REDMetrics.Register(staticCollector("storage_flush_failures_total 3\n"))
+
+	router := gin.New()
+	router.GET("/metrics", m.REDHandler())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "storage_flush_failures_total 3")
+}
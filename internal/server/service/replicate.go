@@ -0,0 +1,191 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vova4o/yandexadv/internal/models"
+	"go.uber.org/zap"
+)
+
+// replicateTimeout ограничение времени отправки снимка одной реплике
+const replicateTimeout = 10 * time.Second
+
+// ImportMetrics сохраняет снимок метрик с другого сервера как есть:
+// значения счетчиков заменяют сохраненные, а не добавляются к ним.
+// Метрики проверяются и фильтруются так же, как при обновлении.
+// Возвращает количество сохраненных метрик
+func (s *Service) ImportMetrics(ctx context.Context, metrics []models.Metrics) (int, error) {
+	imported := make([]models.Metrics, 0, len(metrics))
+	for _, metric := range metrics {
+		prepared, err := s.prepareImport(metric)
+		if errors.Is(err, errMetricRejected) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		imported = append(imported, prepared)
+	}
+	if len(imported) == 0 {
+		return 0, nil
+	}
+
+	if err := s.Storage.UpdateBatch(ctx, imported); err != nil {
+		s.logger.Error("Failed to import metrics", zap.Error(err))
+		return 0, storageError(err)
+	}
+
+	return len(imported), nil
+}
+
+// prepareImport проверяет метрику снимка и применяет к ней псевдонимы,
+// ограничения значений и округление
+func (s *Service) prepareImport(metric models.Metrics) (models.Metrics, error) {
+	if err := s.admitJSON(&metric); err != nil {
+		return metric, err
+	}
+
+	prepared := models.Metrics{MType: metric.MType, ID: metric.ID, Labels: metric.Labels}
+	switch metric.MType {
+	case "gauge":
+		if metric.Value == nil {
+			return metric, fmt.Errorf("%w: gauge value is missing", models.ErrInvalidMetricValue)
+		}
+		value := s.roundGauge(s.clamp(metric.ID, *metric.Value))
+		prepared.Value = &value
+	case "counter":
+		if metric.Delta == nil {
+			return metric, fmt.Errorf("%w: counter delta is missing", models.ErrInvalidMetricValue)
+		}
+		total := s.clampInt(metric.ID, *metric.Delta)
+		prepared.Delta = &total
+	case "counterf":
+		if metric.Value == nil || math.IsNaN(*metric.Value) || math.IsInf(*metric.Value, 0) || *metric.Value < 0 {
+			return metric, fmt.Errorf("%w: counterf value is not a finite non-negative number", models.ErrInvalidMetricValue)
+		}
+		total := s.clamp(metric.ID, *metric.Value)
+		prepared.Value = &total
+	default:
+		return metric, models.NewHTTPError(http.StatusBadRequest, "unknown metric type")
+	}
+	return prepared, nil
+}
+
+// Replicator периодически отправляет снимок метрик (как в /dump) на /import реплик
+type Replicator struct {
+	service  *Service
+	urls     []string
+	interval time.Duration
+	key      string // ключ подписи запросов, пустой - без подписи
+	client   *http.Client
+}
+
+// Replicator создает отправку снимков метрик сервиса на адреса urls раз в interval
+func (s *Service) Replicator(urls []string, interval time.Duration, key string) *Replicator {
+	return &Replicator{
+		service:  s,
+		urls:     urls,
+		interval: interval,
+		key:      key,
+		client:   &http.Client{Timeout: replicateTimeout},
+	}
+}
+
+// Run отправляет снимки, пока не отменен ctx
+func (r *Replicator) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Replicate(ctx)
+		}
+	}
+}
+
+// Replicate отправляет текущий снимок метрик всем репликам и возвращает количество успешных отправок.
+// Ошибки реплик только логируются и не влияют на работу сервера и отправку остальным репликам
+func (r *Replicator) Replicate(ctx context.Context) int {
+	metrics, err := r.service.ExportMetrics(ctx)
+	if err != nil {
+		r.service.logger.Error("Failed to export metrics for replication", zap.Error(err))
+		return 0
+	}
+
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		r.service.logger.Error("Failed to marshal metrics for replication", zap.Error(err))
+		return 0
+	}
+
+	sent := 0
+	for _, url := range r.urls {
+		if err := r.push(ctx, url, data); err != nil {
+			r.service.logger.Warn("Failed to replicate metrics", zap.String("url", url), zap.Error(err))
+			continue
+		}
+		sent++
+	}
+	return sent
+}
+
+// push отправляет снимок на адрес url
+func (r *Replicator) push(ctx context.Context, url string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create replication request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if r.key != "" {
+		if err := signRequest(req, data, r.key); err != nil {
+			return err
+		}
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signRequest подписывает запрос так же, как агент: HMAC-SHA256 тела, nonce и метки времени
+func signRequest(req *http.Request, data []byte, key string) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := hex.EncodeToString(b)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	h.Write([]byte(nonce))
+	h.Write([]byte(timestamp))
+
+	req.Header.Set("X-Nonce", nonce)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("HashSHA256", hex.EncodeToString(h.Sum(nil)))
+	return nil
+}
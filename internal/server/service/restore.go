@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vova4o/yandexadv/internal/models"
+)
+
+// restoreTimeout ограничение времени загрузки состояния с другого сервера
+const restoreTimeout = 10 * time.Second
+
+// RestoreRemote загружает метрики из /dump другого сервера по адресу url
+// и сохраняет их с заменой значений. Возвращает количество загруженных метрик
+func (s *Service) RestoreRemote(ctx context.Context, url string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, restoreTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create restore request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to fetch %s: unexpected status %s", url, resp.Status)
+	}
+
+	var metrics []models.Metrics
+	if err := json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+		return 0, fmt.Errorf("failed to decode dump: %w", err)
+	}
+
+	// Снимок загружается как при импорте: значения счетчиков заменяют сохраненные,
+	// поэтому повторный запуск с уже восстановленным состоянием не удваивает их
+	restored, err := s.ImportMetrics(ctx, metrics)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load dump: %w", err)
+	}
+
+	return restored, nil
+}
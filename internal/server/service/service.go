@@ -1,53 +1,112 @@
 package service
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"math"
 	"net/http"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/vova4o/yandexadv/internal/models"
+	"github.com/vova4o/yandexadv/internal/server/flags"
 	"github.com/vova4o/yandexadv/package/logger"
 	"go.uber.org/zap"
 )
 
 // Service структура для бизнес-логики
 type Service struct {
-	Storage Storager
-	logger  *logger.Logger
+	Storage   Storager
+	logger    *logger.Logger
+	whitelist map[string]struct{} // разрешенные имена метрик, пустой список отключает проверку
+	aliases   map[string]string   // старые имена метрик и их новые имена
+	reject    *regexp.Regexp      // имена метрик, которые отбрасываются, nil отключает проверку
+	precision int                 // количество знаков после запятой для gauge, 0 - без округления
+	maxName   int                 // максимальная длина имени метрики, 0 - без ограничения
+	maxLabel  int                 // максимальная длина ключа и значения метки, 0 - без ограничения
+	clamps    []flags.ValueClamp  // ограничения значений, от самого длинного префикса к короткому
+	typeCheck bool                // отклонять метрики, имя которых занято метрикой другого типа
+
+	tmplPath string                            // файл шаблона страницы статистики, пустой - встроенный шаблон
+	tmpl     atomic.Pointer[template.Template] // загруженный шаблон страницы статистики
+
+	deltaMu    sync.Mutex
+	lastDeltas map[string]int64 // последние примененные приращения счетчиков, не сохраняются между запусками
 }
 
 // Storager интерфейс для хранилища
 type Storager interface {
-	UpdateBatch(metrics []models.Metrics) error
-	UpdateMetric(metric models.Metrics) error
-	GetValue(metric models.Metrics) (*models.Metrics, error)
-	MetrixStatistic() (map[string]models.Metrics, error)
-	Ping() error
+	UpdateBatch(ctx context.Context, metrics []models.Metrics) error
+	UpdateMetric(ctx context.Context, metric models.Metrics) error
+	UpdateIfNewer(ctx context.Context, metric models.Metrics, ts time.Time) (bool, error)
+	GetValue(ctx context.Context, metric models.Metrics) (*models.Metrics, error)
+	MetrixStatistic(ctx context.Context) (map[string]models.Metrics, error)
+	Ping(ctx context.Context) error
 }
 
 // New создание нового сервиса
-func New(s Storager, logger *logger.Logger) *Service {
+func New(s Storager, logger *logger.Logger, config *flags.Config) *Service {
+	whitelist := make(map[string]struct{}, len(config.MetricWhitelist))
+	for _, name := range config.MetricWhitelist {
+		whitelist[name] = struct{}{}
+	}
+
+	var reject *regexp.Regexp
+	if config.RejectPattern != "" {
+		var err error
+		if reject, err = regexp.Compile(config.RejectPattern); err != nil {
+			logger.Error("Invalid metric reject pattern, check disabled", zap.Error(err))
+		}
+	}
+
+	clamps := append([]flags.ValueClamp(nil), config.ValueClamps...)
+	sort.SliceStable(clamps, func(i, j int) bool { return len(clamps[i].Prefix) > len(clamps[j].Prefix) })
+
 	return &Service{
-		Storage: s,
-		logger:  logger,
+		Storage:   s,
+		logger:    logger,
+		whitelist: whitelist,
+		aliases:   config.MetricAliases,
+		reject:    reject,
+		precision: config.GaugePrecision,
+		maxName:   config.MaxNameLength,
+		maxLabel:  config.MaxLabelLength,
+		clamps:    clamps,
+		typeCheck: !config.AllowTypeChange,
+		tmplPath:  config.StatsTemplate,
 	}
 }
 
 // UpdateBatchMetricsServ обновление метрик в формате JSON by batch
-func (s *Service) UpdateBatchMetricsServ(metrics []models.Metrics) error {
+func (s *Service) UpdateBatchMetricsServ(ctx context.Context, metrics []models.Metrics) error {
 	if len(metrics) == 0 {
 		log.Printf("Empty metrics")
 		return models.NewHTTPError(http.StatusBadRequest, "Empty metrics")
 	}
 	// add this line just for github
-	s.logger.Info("Received POST JSON metrics for update", zap.Any("metrics", metrics))
+	s.logger.Info("Received POST JSON metrics for update", zap.Int("count", len(metrics)))
+	s.logger.Debug("Metrics batch", zap.Any("metrics", metrics))
 
-	for _, metric := range metrics {
-		err := s.UpdateServJSON(&metric)
+	batch := s.coalesceBatch(metrics)
+	if err := s.checkBatchTypes(ctx, batch); err != nil {
+		return err
+	}
+
+	for _, metric := range batch {
+		err := s.UpdateServJSON(ctx, &metric)
+		if errors.Is(err, errMetricRejected) {
+			continue
+		}
 		if err != nil {
 			log.Printf("failed to update metric: %v", err)
 			s.logger.Error("Failed to update metric", zap.Error(err))
@@ -58,22 +117,206 @@ func (s *Service) UpdateBatchMetricsServ(metrics []models.Metrics) error {
 	return nil
 }
 
+// coalesceBatch объединяет повторы одной метрики в пакете: для gauge
+// остается последнее значение, для counter и counterf приращения суммируются.
+// Порядок метрик сохраняется по первому вхождению, метрики без значения
+// не объединяются, чтобы их отклонила проверка
+func (s *Service) coalesceBatch(metrics []models.Metrics) []models.Metrics {
+	result := make([]models.Metrics, 0, len(metrics))
+	index := make(map[string]int, len(metrics))
+
+	for _, metric := range metrics {
+		valid := (metric.MType == "gauge" && metric.Value != nil) ||
+			(metric.MType == "counter" && metric.Delta != nil) ||
+			(metric.MType == "counterf" && metric.Value != nil)
+		if !valid {
+			result = append(result, metric)
+			continue
+		}
+
+		key := metric.MType + ":" + s.alias(metric.ID) + ":" + metric.LabelKey()
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(result)
+			result = append(result, metric)
+			continue
+		}
+
+		switch metric.MType {
+		case "counter":
+			sum := *result[i].Delta + *metric.Delta
+			metric.Delta = &sum
+		case "counterf":
+			sum := *result[i].Value + *metric.Value
+			metric.Value = &sum
+		}
+		result[i] = metric
+	}
+
+	return result
+}
+
+// flushStatuser хранилище, которое периодически сохраняет данные на диск
+type flushStatuser interface {
+	FlushStatus() (time.Time, error)
+}
+
+// StorageStatus состояние хранилища: сохранение на диск и количество метрик
+func (s *Service) StorageStatus(ctx context.Context) (models.StorageStatus, error) {
+	status := models.StorageStatus{Flush: "disabled"}
+
+	if fs, ok := s.Storage.(flushStatuser); ok {
+		lastFlush, err := fs.FlushStatus()
+		status.Flush = "ok"
+		if err != nil {
+			status.Flush = "error"
+		}
+		if !lastFlush.IsZero() {
+			status.LastFlush = &lastFlush
+		}
+	}
+
+	metrics, err := s.Storage.MetrixStatistic(ctx)
+	if err != nil {
+		return status, err
+	}
+	status.MetricCount = len(metrics)
+
+	return status, nil
+}
+
+// flusher хранилище, которое умеет принудительно сохранять данные
+type flusher interface {
+	Flush() (int, error)
+}
+
+// Flush принудительно сохраняет данные хранилища и возвращает количество сохраненных метрик
+func (s *Service) Flush() (int, error) {
+	fs, ok := s.Storage.(flusher)
+	if !ok {
+		return 0, models.ErrFlushNotSupported
+	}
+
+	count, err := fs.Flush()
+	if err != nil {
+		log.Printf("failed to flush storage: %v", err)
+		return 0, storageError(err)
+	}
+
+	return count, nil
+}
+
+// prefixDeleter хранилище, которое умеет удалять метрики по префиксу имени
+type prefixDeleter interface {
+	DeleteByPrefix(ctx context.Context, prefix string) (int, error)
+}
+
+// DeleteByPrefix удаляет метрики, имя которых начинается с prefix, и возвращает их количество
+func (s *Service) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	if prefix == "" {
+		return 0, models.NewHTTPError(http.StatusBadRequest, "prefix must not be empty")
+	}
+
+	pd, ok := s.Storage.(prefixDeleter)
+	if !ok {
+		return 0, models.ErrDeleteNotSupported
+	}
+
+	count, err := pd.DeleteByPrefix(ctx, prefix)
+	if err != nil {
+		if errors.Is(err, models.ErrDeleteNotSupported) {
+			return 0, err
+		}
+		log.Printf("failed to delete metrics: %v", err)
+		return 0, storageError(err)
+	}
+
+	return count, nil
+}
+
+// typeCounter хранилище, которое умеет считать метрики по типам без их выборки
+type typeCounter interface {
+	CountByType(ctx context.Context) (map[string]int, error)
+}
+
+// CountMetrics возвращает количество метрик каждого типа.
+// Типы gauge и counter присутствуют в ответе всегда
+func (s *Service) CountMetrics(ctx context.Context) (map[string]int, error) {
+	var counts map[string]int
+	if tc, ok := s.Storage.(typeCounter); ok {
+		var err error
+		if counts, err = tc.CountByType(ctx); err != nil {
+			log.Printf("failed to count metrics: %v", err)
+			return nil, storageError(err)
+		}
+	} else {
+		metrics, err := s.Storage.MetrixStatistic(ctx)
+		if err != nil {
+			log.Printf("failed to get metrics: %v", err)
+			return nil, storageError(err)
+		}
+		counts = make(map[string]int)
+		for _, metric := range metrics {
+			counts[metric.MType]++
+		}
+	}
+
+	for _, mType := range []string{"gauge", "counter"} {
+		if _, ok := counts[mType]; !ok {
+			counts[mType] = 0
+		}
+	}
+	return counts, nil
+}
+
+// historian хранилище, которое хранит историю значений метрик
+type historian interface {
+	History(mType, id string, limit int) ([]models.HistoryPoint, error)
+}
+
+// History возвращает не более limit последних значений gauge-метрики
+func (s *Service) History(metric models.Metrics, limit int) ([]models.HistoryPoint, error) {
+	metric.ID = s.alias(metric.ID)
+
+	if metric.MType != "gauge" {
+		return nil, models.NewHTTPError(http.StatusBadRequest, "history is kept only for gauge metrics")
+	}
+
+	h, ok := s.Storage.(historian)
+	if !ok {
+		return nil, models.ErrHistoryDisabled
+	}
+
+	points, err := h.History(metric.MType, metric.ID, limit)
+	if errors.Is(err, models.ErrHistoryDisabled) {
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("failed to get history: %v", err)
+		return nil, storageError(err)
+	}
+
+	return points, nil
+}
+
 // PingDB проверка подключения к базе данных
-func (s *Service) PingDB() error {
-	return s.Storage.Ping()
+func (s *Service) PingDB(ctx context.Context) error {
+	return s.Storage.Ping(ctx)
 }
 
 // GetValueServJSON получение значения метрики в формате JSON
-func (s *Service) GetValueServJSON(metric models.Metrics) (*models.Metrics, error) {
+func (s *Service) GetValueServJSON(ctx context.Context, metric models.Metrics) (*models.Metrics, error) {
+	metric.ID = s.alias(metric.ID)
+
 	// Проверка метрики
 	if err := validateMetricJSON(&metric); err != nil {
 		return nil, err
 	}
 
-	value, err := s.Storage.GetValue(metric)
+	value, err := s.Storage.GetValue(ctx, metric)
 	if err != nil {
 		log.Printf("failed to get value: %v", err)
-		return nil, err
+		return nil, storageError(err)
 	}
 	if value.Delta == nil && value.Value == nil {
 		return nil, models.ErrMetricNotFound
@@ -83,56 +326,141 @@ func (s *Service) GetValueServJSON(metric models.Metrics) (*models.Metrics, erro
 
 }
 
-// UpdateServJSON обновление метрики в формате JSON
-func (s *Service) UpdateServJSON(metric *models.Metrics) error {
+// admitJSON применяет псевдоним имени и проверяет, что метрику можно сохранить
+func (s *Service) admitJSON(metric *models.Metrics) error {
+	metric.ID = s.alias(metric.ID)
+
 	// Проверка метрики
 	if err := validateMetricJSON(metric); err != nil {
 		return err
 	}
 
+	if err := s.checkLength(metric.ID, metric.Labels); err != nil {
+		return err
+	}
+
+	if err := s.checkWhitelist(metric.ID); err != nil {
+		return err
+	}
+
+	return s.checkRejected(metric.ID)
+}
+
+// admitUpdate проверяет метрику перед обновлением: имя, фильтры и значение нужного типу поля
+func (s *Service) admitUpdate(metric *models.Metrics) error {
+	if err := s.admitJSON(metric); err != nil {
+		return err
+	}
+
 	switch metric.MType {
 	case "gauge":
-		s.Storage.UpdateMetric(models.Metrics{
-			MType: metric.MType,
-			ID:    metric.ID,
-			Value: metric.Value,
-		})
-
+		if metric.Value == nil {
+			log.Printf("gauge %s has no value", metric.ID)
+			return fmt.Errorf("%w: gauge value is missing", models.ErrInvalidMetricValue)
+		}
 	case "counter":
-		// Получение старого значения счетчика
-		counterVal, err := s.GetValueServ(models.Metrics{
-			MType: metric.MType,
-			ID:    metric.ID,
-		})
-		if err != nil {
-			if errors.Is(err, models.ErrMetricNotFound) || errors.Is(err, sql.ErrNoRows) {
-				counterVal = "0"
-			} else {
-				return err
-			}
+		if metric.Delta == nil {
+			log.Printf("counter %s has no delta", metric.ID)
+			return fmt.Errorf("%w: counter delta is missing", models.ErrInvalidMetricValue)
+		}
+	case "counterf":
+		if metric.Value == nil {
+			log.Printf("counterf %s has no value", metric.ID)
+			return fmt.Errorf("%w: counterf value is missing", models.ErrInvalidMetricValue)
 		}
+		if v := *metric.Value; math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+			return fmt.Errorf("%w: counterf value %v is not a finite non-negative number", models.ErrInvalidMetricValue, v)
+		}
+	default:
+		log.Printf("unknown metric type: %s", metric.MType)
+		return models.NewHTTPError(http.StatusBadRequest, "unknown metric type")
+	}
+	return nil
+}
+
+// UpdateIfNewer обновляет gauge-метрику, только если ts новее времени ее последнего обновления.
+// Запоздавшие записи не перезаписывают более свежие значения. Возвращает true, если метрика обновлена
+func (s *Service) UpdateIfNewer(ctx context.Context, metric *models.Metrics, ts time.Time) (bool, error) {
+	if err := s.admitJSON(metric); err != nil {
+		return false, err
+	}
+
+	if metric.MType != "gauge" {
+		return false, fmt.Errorf("%w: conditional update supports only gauges", models.ErrInvalidMetricValue)
+	}
+	if err := s.checkTypeConflict(ctx, metric.ID, metric.Labels, metric.MType); err != nil {
+		return false, err
+	}
+	if metric.Value == nil {
+		return false, fmt.Errorf("%w: gauge value is missing", models.ErrInvalidMetricValue)
+	}
 
-		if counterVal == "" {
-			counterVal = "0"
+	value := s.roundGauge(s.clamp(metric.ID, *metric.Value))
+	updated, err := s.Storage.UpdateIfNewer(ctx, models.Metrics{
+		MType:  metric.MType,
+		ID:     metric.ID,
+		Value:  &value,
+		Labels: metric.Labels,
+	}, ts)
+	if err != nil {
+		log.Printf("failed to update metric: %v", err)
+		return false, storageError(err)
+	}
+	return updated, nil
+}
+
+// UpdateServJSON обновление метрики в формате JSON
+func (s *Service) UpdateServJSON(ctx context.Context, metric *models.Metrics) error {
+	if err := s.admitUpdate(metric); err != nil {
+		return err
+	}
+
+	if err := s.checkTypeConflict(ctx, metric.ID, metric.Labels, metric.MType); err != nil {
+		return err
+	}
+
+	switch metric.MType {
+	case "gauge":
+		value := s.roundGauge(s.clamp(metric.ID, *metric.Value))
+		err := s.Storage.UpdateMetric(ctx, models.Metrics{
+			MType:  metric.MType,
+			ID:     metric.ID,
+			Value:  &value,
+			Labels: metric.Labels,
+		})
+		if err != nil {
+			log.Printf("failed to update metric: %v", err)
+			return storageError(err)
 		}
 
-		counterInt, err := strconv.Atoi(counterVal)
+	case "counter":
+		// Получение старого значения счетчика
+		counterInt, err := s.storedCounter(ctx, models.Metrics{
+			MType:  metric.MType,
+			ID:     metric.ID,
+			Labels: metric.Labels,
+		})
 		if err != nil {
-			log.Printf("failed to convert value to int: %v", err)
-			return models.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to convert value to int: %v", err))
+			return err
 		}
 
 		// Добавление старого значения к новому
-		totalValue := *metric.Delta + int64(counterInt)
-		err = s.Storage.UpdateMetric(models.Metrics{
-			MType: metric.MType,
-			ID:    metric.ID,
-			Delta: &totalValue,
+		delta := s.clampInt(metric.ID, *metric.Delta)
+		totalValue := delta + counterInt
+		err = s.Storage.UpdateMetric(ctx, models.Metrics{
+			MType:  metric.MType,
+			ID:     metric.ID,
+			Delta:  &totalValue,
+			Labels: metric.Labels,
 		})
 		if err != nil {
 			log.Printf("failed to update metric: %v", err)
-			return err
+			return storageError(err)
 		}
+		s.recordDelta(*metric, delta)
+
+	case "counterf":
+		return s.addCounterF(ctx, metric.ID, metric.Labels, *metric.Value)
 	default:
 		log.Printf("unknown metric type: %s", metric.MType)
 		return models.NewHTTPError(http.StatusBadRequest, "unknown metric type")
@@ -142,42 +470,14 @@ func (s *Service) UpdateServJSON(metric *models.Metrics) error {
 }
 
 // MetrixStatistic получение статистики метрик
-func (s *Service) MetrixStatistic() (*template.Template, map[string]models.Metrics, error) {
-	metrics, err := s.Storage.MetrixStatistic()
+func (s *Service) MetrixStatistic(ctx context.Context) (*template.Template, map[string]models.Metrics, error) {
+	metrics, err := s.Storage.MetrixStatistic(ctx)
 	if err != nil {
 		log.Printf("failed to get metrics: %v", err)
-		return nil, nil, models.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to get metrics: %v", err))
-	}
-
-	tmpl, err := template.New("metrics").Parse(`
-		<!DOCTYPE html>
-		<html>
-		<head>
-			<title>Metrics Statistics</title>
-		</head>
-		<body>
-			<h1>Metrics Statistics</h1>
-			<table border="1">
-				<tr>
-					<th>Metric Name</th>
-					<th>Metric Value</th>
-				</tr>
-				{{range $key, $metric := .}}
-				<tr>
-					<td>{{$key}}</td>
-					<td>
-						{{if eq $metric.MType "gauge"}}
-							{{$metric.Value}}
-						{{else}}
-							{{$metric.Delta}}
-						{{end}}
-					</td>
-				</tr>
-				{{end}}
-			</table>
-		</body>
-		</html>
-	`)
+		return nil, nil, storageError(err)
+	}
+
+	tmpl, err := s.statsTemplate()
 	if err != nil {
 		log.Printf("failed to parse template: %v", err)
 		return nil, nil, models.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to parse template: %v", err))
@@ -186,43 +486,84 @@ func (s *Service) MetrixStatistic() (*template.Template, map[string]models.Metri
 	return tmpl, metrics, nil
 }
 
+// ExportMetrics возвращает все метрики, отсортированные по типу, имени и меткам
+func (s *Service) ExportMetrics(ctx context.Context) ([]models.Metrics, error) {
+	stored, err := s.Storage.MetrixStatistic(ctx)
+	if err != nil {
+		log.Printf("failed to get metrics: %v", err)
+		return nil, storageError(err)
+	}
+
+	metrics := make([]models.Metrics, 0, len(stored))
+	for _, metric := range stored {
+		metrics = append(metrics, metric)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		if metrics[i].ID != metrics[j].ID {
+			return metrics[i].ID < metrics[j].ID
+		}
+		return metrics[i].LabelKey() < metrics[j].LabelKey()
+	})
+
+	return metrics, nil
+}
+
 // GetValueServ получение значения метрики
-func (s *Service) GetValueServ(metric models.Metrics) (string, error) {
+func (s *Service) GetValueServ(ctx context.Context, metric models.Metrics) (string, error) {
+	metric.ID = s.alias(metric.ID)
+
 	// Проверка метрики
 	if err := validateMetricJSON(&metric); err != nil {
 		return "", err
 	}
 
-	value, err := s.Storage.GetValue(metric)
+	value, err := s.Storage.GetValue(ctx, metric)
 	if err != nil {
 		log.Printf("failed to get value: %v", err)
-		return "", err
+		return "", storageError(err)
 	}
 
-	var valueStr string
 	switch metric.MType {
-	case "gauge":
-		if value.Value != nil {
-			valueStr = fmt.Sprintf("%v", *value.Value)
-		}
-	case "counter":
-		if value.Delta != nil {
-			valueStr = fmt.Sprintf("%v", *value.Delta)
-		}
+	case "gauge", "counter", "counterf":
 	default:
 		return "", fmt.Errorf("unsupported metric type: %s", metric.MType)
 	}
+	valueStr := value.ValueString()
+	if valueStr == "" {
+		return "", models.ErrMetricNotFound
+	}
 
 	return valueStr, nil
 }
 
 // UpdateServ обновление метрики
-func (s *Service) UpdateServ(metric models.Metric) error {
+func (s *Service) UpdateServ(ctx context.Context, metric models.Metric) error {
+	metric.Name = s.alias(metric.Name)
+
 	// Проверка метрики
 	if err := validateMetric(metric); err != nil {
 		return err
 	}
 
+	if err := s.checkLength(metric.Name, nil); err != nil {
+		return err
+	}
+
+	if err := s.checkWhitelist(metric.Name); err != nil {
+		return err
+	}
+
+	if err := s.checkRejected(metric.Name); err != nil {
+		return err
+	}
+
+	if err := s.checkTypeConflict(ctx, metric.Name, nil, metric.Type); err != nil {
+		return err
+	}
+
 	switch metric.Type {
 	case "gauge":
 		valueStr, ok := metric.Value.(string)
@@ -234,14 +575,19 @@ func (s *Service) UpdateServ(metric models.Metric) error {
 		valueFloat, err := strconv.ParseFloat(valueStr, 64)
 		if err != nil {
 			log.Printf("failed to convert value to float: %v", err)
-			return models.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to convert value to float: %v", err))
+			return fmt.Errorf("%w: %v", models.ErrInvalidMetricValue, err)
 		}
+		valueFloat = s.roundGauge(s.clamp(metric.Name, valueFloat))
 
-		s.Storage.UpdateMetric(models.Metrics{
+		err = s.Storage.UpdateMetric(ctx, models.Metrics{
 			MType: metric.Type,
 			ID:    metric.Name,
 			Value: &valueFloat,
 		})
+		if err != nil {
+			log.Printf("failed to update metric: %v", err)
+			return storageError(err)
+		}
 
 	case "counter":
 		// Обработка для типа counter
@@ -254,35 +600,46 @@ func (s *Service) UpdateServ(metric models.Metric) error {
 		valueInt, err := strconv.ParseInt(valueStr, 10, 64)
 		if err != nil {
 			log.Printf("failed to convert value to int64: %v", err)
-			return models.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to convert value to int64: %v", err))
+			return fmt.Errorf("%w: %v", models.ErrInvalidMetricValue, err)
 		}
 
 		// Получение старого значения счетчика
-		counterVal, err := s.GetValueServ(models.Metrics{
+		counterInt, err := s.storedCounter(ctx, models.Metrics{
 			MType: metric.Type,
 			ID:    metric.Name,
 		})
 		if err != nil {
-			if errors.Is(err, models.ErrMetricNotFound) {
-				counterVal = "0"
-			} else {
-				return err
-			}
-		}
-
-		counterInt, err := strconv.ParseInt(counterVal, 10, 64)
-		if err != nil {
-			log.Printf("failed to convert value to int64: %v", err)
-			return models.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to convert value to int64: %v", err))
+			return err
 		}
 
 		// Добавление старого значения к новому
-		totalValue := valueInt + counterInt
-		s.Storage.UpdateMetric(models.Metrics{
+		delta := s.clampInt(metric.Name, valueInt)
+		totalValue := delta + counterInt
+		err = s.Storage.UpdateMetric(ctx, models.Metrics{
 			MType: metric.Type,
 			ID:    metric.Name,
 			Delta: &totalValue,
 		})
+		if err != nil {
+			log.Printf("failed to update metric: %v", err)
+			return storageError(err)
+		}
+		s.recordDelta(models.Metrics{MType: metric.Type, ID: metric.Name}, delta)
+
+	case "counterf":
+		valueStr, ok := metric.Value.(string)
+		if !ok {
+			log.Printf("failed to assert value to string: %v", metric.Value)
+			return models.NewHTTPError(http.StatusInternalServerError, "failed to assert value to string")
+		}
+
+		delta, err := strconv.ParseFloat(valueStr, 64)
+		if err != nil {
+			log.Printf("failed to convert value to float: %v", err)
+			return fmt.Errorf("%w: %v", models.ErrInvalidMetricValue, err)
+		}
+
+		return s.addCounterF(ctx, metric.Name, nil, delta)
 
 	default:
 		return models.NewHTTPError(http.StatusBadRequest, "unsupported metric type")
@@ -291,6 +648,279 @@ func (s *Service) UpdateServ(metric models.Metric) error {
 	return nil
 }
 
+// uncachedReader хранилище с кэшем чтений, которое умеет читать метрику мимо кэша
+type uncachedReader interface {
+	GetValueUncached(ctx context.Context, metric models.Metrics) (*models.Metrics, error)
+}
+
+// storedValue читает сохраненную метрику для обновления накопленной суммы. Кэш чтений обходится,
+// чтобы не потерять приращения, записанные в то же хранилище другими серверами
+func (s *Service) storedValue(ctx context.Context, metric models.Metrics) (*models.Metrics, error) {
+	if r, ok := s.Storage.(uncachedReader); ok {
+		return r.GetValueUncached(ctx, metric)
+	}
+	return s.Storage.GetValue(ctx, metric)
+}
+
+// storedCounter возвращает сохраненное значение счетчика, для отсутствующего счетчика - 0
+func (s *Service) storedCounter(ctx context.Context, metric models.Metrics) (int64, error) {
+	stored, err := s.storedValue(ctx, metric)
+	switch {
+	case errors.Is(err, models.ErrMetricNotFound) || errors.Is(err, sql.ErrNoRows):
+		return 0, nil
+	case err != nil:
+		log.Printf("failed to get value: %v", err)
+		return 0, storageError(err)
+	case stored.Delta == nil:
+		return 0, nil
+	}
+	return *stored.Delta, nil
+}
+
+// addCounterF прибавляет приращение delta к накопленному значению counterf-метрики.
+// Приращение должно быть конечным неотрицательным числом
+func (s *Service) addCounterF(ctx context.Context, id string, labels map[string]string, delta float64) error {
+	if math.IsNaN(delta) || math.IsInf(delta, 0) || delta < 0 {
+		return fmt.Errorf("%w: counterf value %v is not a finite non-negative number", models.ErrInvalidMetricValue, delta)
+	}
+	delta = s.clamp(id, delta)
+
+	total := delta
+	stored, err := s.storedValue(ctx, models.Metrics{MType: "counterf", ID: id, Labels: labels})
+	switch {
+	case err == nil:
+		if stored.Value != nil {
+			total += *stored.Value
+		}
+	case errors.Is(err, models.ErrMetricNotFound):
+	default:
+		log.Printf("failed to get value: %v", err)
+		return storageError(err)
+	}
+
+	err = s.Storage.UpdateMetric(ctx, models.Metrics{
+		MType:  "counterf",
+		ID:     id,
+		Value:  &total,
+		Labels: labels,
+	})
+	if err != nil {
+		log.Printf("failed to update metric: %v", err)
+		return storageError(err)
+	}
+
+	return nil
+}
+
+// roundGauge округляет значение gauge до заданного количества знаков после запятой
+func (s *Service) roundGauge(value float64) float64 {
+	if s.precision <= 0 {
+		return value
+	}
+	scale := math.Pow10(s.precision)
+	if math.IsInf(value*scale, 0) {
+		// значение слишком велико, округлять нечего
+		return value
+	}
+	return math.Round(value*scale) / scale
+}
+
+// storageError оборачивает ошибку хранилища в ErrStorageUnavailable.
+// Отсутствие метрики остается ErrMetricNotFound, уже обернутые ошибки не оборачиваются повторно
+func storageError(err error) error {
+	if errors.Is(err, models.ErrMetricNotFound) || errors.Is(err, models.ErrStorageUnavailable) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", models.ErrStorageUnavailable, err)
+}
+
+// deltaKey возвращает ключ последнего приращения счетчика с учетом меток
+func deltaKey(metric models.Metrics) string {
+	return metric.ID + ":" + metric.LabelKey()
+}
+
+// recordDelta запоминает последнее примененное приращение счетчика
+func (s *Service) recordDelta(metric models.Metrics, delta int64) {
+	s.deltaMu.Lock()
+	defer s.deltaMu.Unlock()
+
+	if s.lastDeltas == nil {
+		s.lastDeltas = make(map[string]int64)
+	}
+	s.lastDeltas[deltaKey(metric)] = delta
+}
+
+// CounterDebug возвращает накопленное значение счетчика name без меток и последнее примененное приращение.
+// Приращение неизвестно, если после запуска сервера счетчик не обновлялся
+func (s *Service) CounterDebug(ctx context.Context, name string) (*models.CounterDebug, error) {
+	metric := models.Metrics{MType: "counter", ID: s.alias(name)}
+
+	stored, err := s.Storage.GetValue(ctx, metric)
+	if err != nil {
+		return nil, storageError(err)
+	}
+
+	debug := &models.CounterDebug{ID: metric.ID}
+	if stored.Delta != nil {
+		debug.Total = *stored.Delta
+	}
+
+	s.deltaMu.Lock()
+	defer s.deltaMu.Unlock()
+	if delta, ok := s.lastDeltas[deltaKey(metric)]; ok {
+		debug.LastDelta = &delta
+	}
+
+	return debug, nil
+}
+
+// clamp ограничивает значение метрики id границами с самым длинным подходящим префиксом
+func (s *Service) clamp(id string, value float64) float64 {
+	for _, c := range s.clamps {
+		if !strings.HasPrefix(id, c.Prefix) {
+			continue
+		}
+		clamped := math.Min(math.Max(value, c.Min), c.Max)
+		if clamped != value {
+			s.logger.Warn("Metric value clamped",
+				zap.String("id", id), zap.Float64("value", value), zap.Float64("clamped", clamped))
+		}
+		return clamped
+	}
+	return value
+}
+
+// clampInt ограничивает целое значение метрики id, дробные границы округляются внутрь диапазона
+func (s *Service) clampInt(id string, value int64) int64 {
+	clamped := s.clamp(id, float64(value))
+	switch {
+	case clamped > float64(value):
+		return int64(math.Ceil(clamped))
+	case clamped < float64(value):
+		return int64(math.Floor(clamped))
+	}
+	return value
+}
+
+// alias возвращает новое имя метрики, если для id задан псевдоним
+func (s *Service) alias(id string) string {
+	if newID, ok := s.aliases[id]; ok {
+		return newID
+	}
+	return id
+}
+
+// ValidateMetrics проверяет метрики так же, как при обновлении, но ничего не сохраняет
+func (s *Service) ValidateMetrics(metrics []models.Metrics) models.ValidationReport {
+	report := models.ValidationReport{Valid: true, Errors: []models.ValidationError{}}
+	for i, metric := range metrics {
+		if err := s.admitUpdate(&metric); err != nil {
+			report.Valid = false
+			report.Errors = append(report.Errors, models.ValidationError{Index: i, ID: metric.ID, Errors: []string{err.Error()}})
+		}
+	}
+	return report
+}
+
+// checkLength проверяет длину имени метрики и ее меток
+func (s *Service) checkLength(id string, labels map[string]string) error {
+	if s.maxName > 0 && len(id) > s.maxName {
+		log.Printf("metric name rejected: %d bytes, limit %d", len(id), s.maxName)
+		return fmt.Errorf("%w: name is %d bytes, limit %d", models.ErrNameTooLong, len(id), s.maxName)
+	}
+	if s.maxLabel <= 0 {
+		return nil
+	}
+	for key, value := range labels {
+		if len(key) > s.maxLabel || len(value) > s.maxLabel {
+			log.Printf("metric %s rejected: label %.32q exceeds %d bytes", id, key, s.maxLabel)
+			return fmt.Errorf("%w: label exceeds %d bytes", models.ErrNameTooLong, s.maxLabel)
+		}
+	}
+	return nil
+}
+
+// checkWhitelist проверяет, что метрика входит в список разрешенных
+func (s *Service) checkWhitelist(id string) error {
+	if len(s.whitelist) == 0 {
+		return nil
+	}
+	if _, ok := s.whitelist[id]; !ok {
+		log.Printf("metric %s rejected: not in whitelist", id)
+		return models.ErrMetricNotAllowed
+	}
+	return nil
+}
+
+// errMetricRejected ошибка для метрик, имя которых совпало с RejectPattern
+var errMetricRejected = fmt.Errorf("%w: name matches reject pattern", models.ErrMetricNotAllowed)
+
+// checkRejected проверяет, что имя метрики не совпадает с шаблоном отбрасываемых имен
+func (s *Service) checkRejected(id string) error {
+	if s.reject == nil || !s.reject.MatchString(id) {
+		return nil
+	}
+	log.Printf("warning: metric %s dropped: name matches reject pattern %s", id, s.reject)
+	return errMetricRejected
+}
+
+// metricTypes типы метрик, которые принимает сервер
+var metricTypes = []string{"gauge", "counter", "counterf"}
+
+// checkTypeConflict проверяет, что метрика с таким именем и метками не хранится под другим типом.
+// Хранилище различает метрики по типу, поэтому ищется каждый из остальных известных типов
+func (s *Service) checkTypeConflict(ctx context.Context, id string, labels map[string]string, mType string) error {
+	if !s.typeCheck || !slices.Contains(metricTypes, mType) {
+		return nil
+	}
+
+	for _, other := range metricTypes {
+		if other == mType {
+			continue
+		}
+		existing, err := s.Storage.GetValue(ctx, models.Metrics{ID: id, MType: other, Labels: labels})
+		if err != nil || existing == nil || existing.MType == "" {
+			continue
+		}
+
+		s.logger.Warn("Metric type conflict",
+			zap.String("id", id), zap.String("stored", other), zap.String("received", mType))
+		return models.ErrMetricTypeConflict
+	}
+
+	return nil
+}
+
+// checkBatchTypes проверяет конфликты типов до сохранения пакета, чтобы пакет с конфликтом не применялся частично.
+// Метрика не должна встречаться в пакете под разными типами и не должна храниться под другим типом.
+// Метрики, которые не пройдут проверку при обновлении, пропускаются
+func (s *Service) checkBatchTypes(ctx context.Context, metrics []models.Metrics) error {
+	if !s.typeCheck {
+		return nil
+	}
+
+	types := make(map[string]string, len(metrics))
+	for _, metric := range metrics {
+		if err := s.admitJSON(&metric); err != nil || !slices.Contains(metricTypes, metric.MType) {
+			continue
+		}
+
+		key := metric.ID + ":" + metric.LabelKey()
+		if other, ok := types[key]; ok && other != metric.MType {
+			s.logger.Warn("Metric type conflict in batch",
+				zap.String("id", metric.ID), zap.String("first", other), zap.String("received", metric.MType))
+			return models.ErrMetricTypeConflict
+		}
+		types[key] = metric.MType
+
+		if err := s.checkTypeConflict(ctx, metric.ID, metric.Labels, metric.MType); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // validateMetric проверяет метрику на наличие ошибок
 func validateMetric(metric models.Metric) error {
 	if metric.Type == "" || metric.Value == "" || metric.Name == "" {
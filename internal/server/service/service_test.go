@@ -1,13 +1,33 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/vova4o/yandexadv/internal/models"
+	"github.com/vova4o/yandexadv/internal/server/flags"
+	"github.com/vova4o/yandexadv/internal/server/storage"
+	"github.com/vova4o/yandexadv/package/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 // MockStorager is a mock implementation of the Storager interface
@@ -15,17 +35,22 @@ type MockStorager struct {
 	mock.Mock
 }
 
-func (m *MockStorager) UpdateBatch(metrics []models.Metrics) error {
+func (m *MockStorager) UpdateBatch(_ context.Context, metrics []models.Metrics) error {
 	args := m.Called(metrics)
 	return args.Error(0)
 }
 
-func (m *MockStorager) UpdateMetric(metric models.Metrics) error {
+func (m *MockStorager) UpdateMetric(_ context.Context, metric models.Metrics) error {
 	args := m.Called(metric)
 	return args.Error(0)
 }
 
-func (m *MockStorager) GetValue(metric models.Metrics) (*models.Metrics, error) {
+func (m *MockStorager) UpdateIfNewer(_ context.Context, metric models.Metrics, ts time.Time) (bool, error) {
+	args := m.Called(metric, ts)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockStorager) GetValue(_ context.Context, metric models.Metrics) (*models.Metrics, error) {
 	args := m.Called(metric)
 	if args.Get(0) != nil {
 		return args.Get(0).(*models.Metrics), args.Error(1)
@@ -33,12 +58,12 @@ func (m *MockStorager) GetValue(metric models.Metrics) (*models.Metrics, error)
 	return nil, args.Error(1)
 }
 
-func (m *MockStorager) MetrixStatistic() (map[string]models.Metrics, error) {
+func (m *MockStorager) MetrixStatistic(_ context.Context) (map[string]models.Metrics, error) {
 	args := m.Called()
 	return args.Get(0).(map[string]models.Metrics), args.Error(1)
 }
 
-func (m *MockStorager) Ping() error {
+func (m *MockStorager) Ping(_ context.Context) error {
 	args := m.Called()
 	return args.Error(0)
 }
@@ -57,7 +82,7 @@ func TestUpdateServJSON(t *testing.T) {
 
 		mockStorage.On("UpdateMetric", *metric).Return(nil)
 
-		err := service.UpdateServJSON(metric)
+		err := service.UpdateServJSON(context.Background(), metric)
 		assert.NoError(t, err)
 		mockStorage.AssertExpectations(t)
 	})
@@ -84,7 +109,7 @@ func TestUpdateServJSON(t *testing.T) {
 			return m.MType == "counter" && m.ID == "test_metric_counter" && *m.Delta == expectedValue
 		})).Return(nil)
 
-		err := service.UpdateServJSON(metric)
+		err := service.UpdateServJSON(context.Background(), metric)
 		assert.NoError(t, err)
 		mockStorage.AssertExpectations(t)
 	})
@@ -95,7 +120,7 @@ func TestUpdateServJSON(t *testing.T) {
 			ID:    "test_metric_unknown",
 		}
 
-		err := service.UpdateServJSON(metric)
+		err := service.UpdateServJSON(context.Background(), metric)
 		assert.Error(t, err)
 		httpErr, ok := err.(*models.HTTPError)
 		if ok {
@@ -122,7 +147,7 @@ func TestGetValueServJSON(t *testing.T) {
 			Value: &expectedValue,
 		}, nil)
 
-		value, err := service.GetValueServJSON(metric)
+		value, err := service.GetValueServJSON(context.Background(), metric)
 		assert.NoError(t, err)
 		assert.NotNil(t, value)
 		assert.Equal(t, expectedValue, *value.Value)
@@ -141,7 +166,7 @@ func TestGetValueServJSON(t *testing.T) {
 			Delta: &expectedDelta,
 		}, nil)
 
-		value, err := service.GetValueServJSON(metric)
+		value, err := service.GetValueServJSON(context.Background(), metric)
 		assert.NoError(t, err)
 		assert.NotNil(t, value)
 		assert.Equal(t, expectedDelta, *value.Delta)
@@ -171,7 +196,7 @@ func TestMetrixStatistic(t *testing.T) {
 
 		mockStorage.On("MetrixStatistic").Return(expectedMetrics, nil)
 
-		tmpl, metrics, err := service.MetrixStatistic()
+		tmpl, metrics, err := service.MetrixStatistic(context.Background())
 		assert.NoError(t, err)
 		assert.NotNil(t, tmpl)
 		assert.Equal(t, expectedMetrics, metrics)
@@ -179,6 +204,45 @@ func TestMetrixStatistic(t *testing.T) {
 	})
 }
 
+func TestReloadTemplate(t *testing.T) {
+	value := 1.5
+	metrics := map[string]models.Metrics{"gauge:Alloc": {ID: "Alloc", MType: "gauge", Value: &value}}
+	mockStorage := new(MockStorager)
+	mockStorage.On("MetrixStatistic").Return(metrics, nil)
+
+	render := func(t *testing.T, service *Service) string {
+		tmpl, metrics, err := service.MetrixStatistic(context.Background())
+		assert.NoError(t, err)
+		var buf bytes.Buffer
+		assert.NoError(t, tmpl.Execute(&buf, metrics))
+		return buf.String()
+	}
+
+	path := filepath.Join(t.TempDir(), "stats.html")
+	assert.NoError(t, os.WriteFile(path, []byte(`{{range .}}custom {{.ID}}={{.Value}};{{end}}`), 0600))
+	service := &Service{Storage: mockStorage, tmplPath: path}
+
+	t.Run("Built-in template before loading", func(t *testing.T) {
+		assert.Contains(t, render(t, service), "Metrics Statistics")
+	})
+
+	t.Run("Custom template file", func(t *testing.T) {
+		assert.NoError(t, service.ReloadTemplate())
+		assert.Equal(t, "custom Alloc=1.5;", render(t, service))
+	})
+
+	t.Run("Invalid template keeps the previous one", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte(`{{range .}}`), 0600))
+		assert.Error(t, service.ReloadTemplate())
+		assert.Equal(t, "custom Alloc=1.5;", render(t, service))
+	})
+
+	t.Run("Missing template file", func(t *testing.T) {
+		missing := &Service{Storage: mockStorage, tmplPath: filepath.Join(t.TempDir(), "missing.html")}
+		assert.Error(t, missing.ReloadTemplate())
+	})
+}
+
 func TestGetValueServ(t *testing.T) {
 	mockStorage := new(MockStorager)
 	service := &Service{Storage: mockStorage}
@@ -195,7 +259,7 @@ func TestGetValueServ(t *testing.T) {
 			Value: &expectedValue,
 		}, nil)
 
-		value, err := service.GetValueServ(metric)
+		value, err := service.GetValueServ(context.Background(), metric)
 		assert.NoError(t, err)
 		assert.Equal(t, strconv.FormatFloat(expectedValue, 'f', -1, 64), value)
 		mockStorage.AssertExpectations(t)
@@ -213,11 +277,26 @@ func TestGetValueServ(t *testing.T) {
 			Delta: &expectedDelta,
 		}, nil)
 
-		value, err := service.GetValueServ(metric)
+		value, err := service.GetValueServ(context.Background(), metric)
 		assert.NoError(t, err)
 		assert.Equal(t, strconv.FormatInt(expectedDelta, 10), value)
 		mockStorage.AssertExpectations(t)
 	})
+
+	t.Run("Metric without value", func(t *testing.T) {
+		metric := models.Metrics{
+			MType: "gauge",
+			ID:    "test_metric_empty",
+		}
+		mockStorage.On("GetValue", metric).Return(&models.Metrics{
+			MType: "gauge",
+			ID:    "test_metric_empty",
+		}, nil)
+
+		value, err := service.GetValueServ(context.Background(), metric)
+		assert.ErrorIs(t, err, models.ErrMetricNotFound)
+		assert.Empty(t, value)
+	})
 }
 
 func TestUpdateServ(t *testing.T) {
@@ -238,7 +317,7 @@ func TestUpdateServ(t *testing.T) {
 			Value: &expectedValue,
 		}).Return(nil)
 
-		err := service.UpdateServ(metric)
+		err := service.UpdateServ(context.Background(), metric)
 		assert.NoError(t, err)
 		mockStorage.AssertExpectations(t)
 	})
@@ -264,8 +343,869 @@ func TestUpdateServ(t *testing.T) {
 			return m.MType == "counter" && m.ID == "test_metric_counter" && *m.Delta == expectedDelta
 		})).Return(nil)
 
-		err := service.UpdateServ(metric)
+		err := service.UpdateServ(context.Background(), metric)
 		assert.NoError(t, err)
 		mockStorage.AssertExpectations(t)
 	})
 }
+
+func TestUpdateServJSONTypeConflict(t *testing.T) {
+	newService := func(typeCheck bool) *Service {
+		return &Service{Storage: storage.NewMemStorage(), logger: &logger.Logger{ZapLogger: zap.NewNop()}, typeCheck: typeCheck}
+	}
+	storedDelta := int64(5)
+	newValue := 1.5
+
+	t.Run("Type change rejected", func(t *testing.T) {
+		service := newService(true)
+		assert.NoError(t, service.UpdateServJSON(context.Background(), &models.Metrics{MType: "counter", ID: "shared", Delta: &storedDelta}))
+
+		err := service.UpdateServJSON(context.Background(), &models.Metrics{MType: "gauge", ID: "shared", Value: &newValue})
+		assert.ErrorIs(t, err, models.ErrMetricTypeConflict)
+
+		httpErr, ok := err.(*models.HTTPError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusConflict, httpErr.Status)
+
+		err = service.UpdateServ(context.Background(), models.Metric{Type: "gauge", Name: "shared", Value: "1.5"})
+		assert.ErrorIs(t, err, models.ErrMetricTypeConflict)
+
+		_, err = service.GetValueServ(context.Background(), models.Metrics{MType: "gauge", ID: "shared"})
+		assert.ErrorIs(t, err, models.ErrMetricNotFound)
+	})
+
+	t.Run("Other labels accepted", func(t *testing.T) {
+		service := newService(true)
+		assert.NoError(t, service.UpdateServJSON(context.Background(), &models.Metrics{MType: "counter", ID: "shared", Delta: &storedDelta, Labels: map[string]string{"host": "a"}}))
+
+		err := service.UpdateServJSON(context.Background(), &models.Metrics{MType: "gauge", ID: "shared", Value: &newValue, Labels: map[string]string{"host": "b"}})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Type change allowed by flag", func(t *testing.T) {
+		service := newService(false)
+		assert.NoError(t, service.UpdateServJSON(context.Background(), &models.Metrics{MType: "counter", ID: "shared", Delta: &storedDelta}))
+
+		err := service.UpdateServJSON(context.Background(), &models.Metrics{MType: "gauge", ID: "shared", Value: &newValue})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Same type accepted", func(t *testing.T) {
+		service := newService(true)
+		assert.NoError(t, service.UpdateServJSON(context.Background(), &models.Metrics{MType: "gauge", ID: "shared", Value: &newValue}))
+		assert.NoError(t, service.UpdateServJSON(context.Background(), &models.Metrics{MType: "gauge", ID: "shared", Value: &newValue}))
+	})
+
+	t.Run("Conflict logged", func(t *testing.T) {
+		core, logs := observer.New(zap.WarnLevel)
+		service := newService(true)
+		service.logger = &logger.Logger{ZapLogger: zap.New(core)}
+		assert.NoError(t, service.UpdateServJSON(context.Background(), &models.Metrics{MType: "counter", ID: "shared", Delta: &storedDelta}))
+
+		err := service.UpdateServJSON(context.Background(), &models.Metrics{MType: "gauge", ID: "shared", Value: &newValue})
+		assert.ErrorIs(t, err, models.ErrMetricTypeConflict)
+		if assert.Equal(t, 1, logs.Len()) {
+			entry := logs.All()[0]
+			assert.Equal(t, "Metric type conflict", entry.Message)
+			assert.Equal(t, map[string]interface{}{"id": "shared", "stored": "counter", "received": "gauge"}, entry.ContextMap())
+		}
+	})
+}
+
+func TestUpdateBatchMetricsServTypeConflict(t *testing.T) {
+	newService := func() *Service {
+		return &Service{Storage: storage.NewMemStorage(), logger: &logger.Logger{ZapLogger: zap.NewNop()}, typeCheck: true}
+	}
+	delta := int64(5)
+	value := 1.5
+
+	t.Run("Conflict within batch", func(t *testing.T) {
+		service := newService()
+		err := service.UpdateBatchMetricsServ(context.Background(), []models.Metrics{
+			{MType: "gauge", ID: "Alloc", Value: &value},
+			{MType: "counter", ID: "shared", Delta: &delta},
+			{MType: "gauge", ID: "shared", Value: &value},
+		})
+		assert.ErrorIs(t, err, models.ErrMetricTypeConflict)
+
+		metrics, err := service.ExportMetrics(context.Background())
+		assert.NoError(t, err)
+		assert.Empty(t, metrics)
+	})
+
+	t.Run("Conflict with stored metric", func(t *testing.T) {
+		service := newService()
+		assert.NoError(t, service.UpdateServJSON(context.Background(), &models.Metrics{MType: "counter", ID: "shared", Delta: &delta}))
+
+		err := service.UpdateBatchMetricsServ(context.Background(), []models.Metrics{
+			{MType: "gauge", ID: "Alloc", Value: &value},
+			{MType: "gauge", ID: "shared", Value: &value},
+		})
+		assert.ErrorIs(t, err, models.ErrMetricTypeConflict)
+
+		_, err = service.GetValueServ(context.Background(), models.Metrics{MType: "gauge", ID: "Alloc"})
+		assert.ErrorIs(t, err, models.ErrMetricNotFound)
+	})
+
+	t.Run("Different labels accepted", func(t *testing.T) {
+		service := newService()
+		err := service.UpdateBatchMetricsServ(context.Background(), []models.Metrics{
+			{MType: "counter", ID: "shared", Delta: &delta, Labels: map[string]string{"host": "a"}},
+			{MType: "gauge", ID: "shared", Value: &value, Labels: map[string]string{"host": "b"}},
+		})
+		assert.NoError(t, err)
+	})
+}
+
+func TestUpdateServJSONWhitelist(t *testing.T) {
+	value := 1.5
+
+	t.Run("Allowed metric", func(t *testing.T) {
+		mockStorage := new(MockStorager)
+		service := &Service{Storage: mockStorage, whitelist: map[string]struct{}{"Alloc": {}}}
+
+		metric := models.Metrics{MType: "gauge", ID: "Alloc", Value: &value}
+		mockStorage.On("UpdateMetric", metric).Return(nil)
+
+		err := service.UpdateServJSON(context.Background(), &metric)
+		assert.NoError(t, err)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("Rejected metric", func(t *testing.T) {
+		mockStorage := new(MockStorager)
+		service := &Service{Storage: mockStorage, whitelist: map[string]struct{}{"Alloc": {}}}
+
+		err := service.UpdateServJSON(context.Background(), &models.Metrics{MType: "gauge", ID: "Unknown", Value: &value})
+		assert.ErrorIs(t, err, models.ErrMetricNotAllowed)
+		mockStorage.AssertNotCalled(t, "UpdateMetric", mock.Anything)
+	})
+}
+
+func TestUpdateServJSONRejectPattern(t *testing.T) {
+	value := 1.5
+	reject := regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
+	t.Run("Non-matching name accepted", func(t *testing.T) {
+		mockStorage := new(MockStorager)
+		service := &Service{Storage: mockStorage, reject: reject}
+
+		metric := models.Metrics{MType: "gauge", ID: "Alloc", Value: &value}
+		mockStorage.On("UpdateMetric", metric).Return(nil)
+
+		assert.NoError(t, service.UpdateServJSON(context.Background(), &metric))
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("Matching name rejected", func(t *testing.T) {
+		mockStorage := new(MockStorager)
+		service := &Service{Storage: mockStorage, reject: reject}
+
+		err := service.UpdateServJSON(context.Background(), &models.Metrics{MType: "gauge", ID: "req_3f2b8c1e-9a4d-4c6b-8e2f-1a2b3c4d5e6f", Value: &value})
+		assert.ErrorIs(t, err, models.ErrMetricNotAllowed)
+		mockStorage.AssertNotCalled(t, "UpdateMetric", mock.Anything)
+	})
+
+	t.Run("Matching names dropped from batch", func(t *testing.T) {
+		mockStorage := new(MockStorager)
+		service := &Service{Storage: mockStorage, reject: reject, logger: &logger.Logger{ZapLogger: zap.NewNop()}}
+
+		accepted := models.Metrics{MType: "gauge", ID: "Alloc", Value: &value}
+		mockStorage.On("UpdateMetric", accepted).Return(nil).Once()
+
+		err := service.UpdateBatchMetricsServ(context.Background(), []models.Metrics{
+			{MType: "gauge", ID: "session_3f2b8c1e-9a4d-4c6b-8e2f-1a2b3c4d5e6f", Value: &value},
+			accepted,
+		})
+		assert.NoError(t, err)
+		mockStorage.AssertExpectations(t)
+	})
+}
+
+func TestServiceMetricAliases(t *testing.T) {
+	mockStorage := new(MockStorager)
+	service := &Service{Storage: mockStorage, aliases: map[string]string{"OldAlloc": "Alloc"}}
+
+	value := 42.5
+	stored := models.Metrics{MType: "gauge", ID: "Alloc", Value: &value}
+	mockStorage.On("UpdateMetric", stored).Return(nil)
+	mockStorage.On("GetValue", models.Metrics{MType: "gauge", ID: "Alloc"}).Return(&stored, nil)
+
+	err := service.UpdateServJSON(context.Background(), &models.Metrics{MType: "gauge", ID: "OldAlloc", Value: &value})
+	assert.NoError(t, err)
+
+	// Значение читается по новому имени и по старому через псевдоним
+	for _, id := range []string{"Alloc", "OldAlloc"} {
+		got, err := service.GetValueServJSON(context.Background(), models.Metrics{MType: "gauge", ID: id})
+		assert.NoError(t, err)
+		assert.Equal(t, "Alloc", got.ID)
+		assert.Equal(t, value, *got.Value)
+	}
+	mockStorage.AssertExpectations(t)
+}
+
+func TestUpdateServJSONLabels(t *testing.T) {
+	mockStorage := new(MockStorager)
+	service := &Service{Storage: mockStorage}
+	labels := map[string]string{"host": "a"}
+
+	previous := int64(10)
+	mockStorage.On("GetValue", models.Metrics{MType: "counter", ID: "PollCount", Labels: labels}).
+		Return(&models.Metrics{MType: "counter", ID: "PollCount", Delta: &previous, Labels: labels}, nil)
+	mockStorage.On("UpdateMetric", mock.MatchedBy(func(m models.Metrics) bool {
+		return m.ID == "PollCount" && m.LabelKey() == "host=a" && *m.Delta == 15
+	})).Return(nil)
+
+	delta := int64(5)
+	err := service.UpdateServJSON(context.Background(), &models.Metrics{MType: "counter", ID: "PollCount", Delta: &delta, Labels: labels})
+	assert.NoError(t, err)
+	mockStorage.AssertExpectations(t)
+}
+
+func TestUpdateServJSONMissingValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric models.Metrics
+	}{
+		{
+			name:   "Gauge with null value",
+			metric: models.Metrics{MType: "gauge", ID: "Alloc"},
+		},
+		{
+			name:   "Counter with null delta",
+			metric: models.Metrics{MType: "counter", ID: "PollCount"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockStorager)
+			service := &Service{Storage: mockStorage}
+
+			assert.NotPanics(t, func() {
+				err := service.UpdateServJSON(context.Background(), &tt.metric)
+				assert.ErrorIs(t, err, models.ErrInvalidMetricValue)
+			})
+			mockStorage.AssertNotCalled(t, "UpdateMetric", mock.Anything)
+			mockStorage.AssertNotCalled(t, "GetValue", mock.Anything)
+		})
+	}
+}
+
+func TestValidateMetrics(t *testing.T) {
+	value := 1.5
+	negative := -1.0
+	delta := int64(2)
+	nan := math.NaN()
+
+	service := &Service{
+		Storage:   new(MockStorager),
+		whitelist: map[string]struct{}{"Alloc": {}, "PollCount": {}, "Energy": {}},
+		aliases:   map[string]string{"OldAlloc": "Alloc"},
+	}
+
+	// Проверка принимает то же, что и обновление
+	t.Run("Valid payload", func(t *testing.T) {
+		report := service.ValidateMetrics([]models.Metrics{
+			{ID: "OldAlloc", MType: "gauge", Value: &value},
+			{ID: "PollCount", MType: "counter", Delta: &delta},
+			{ID: "PollCount", MType: "counter", Delta: &delta, Value: &value},
+			{ID: "Alloc", MType: "gauge", Value: &nan},
+			{ID: "Energy", MType: "counterf", Value: &value},
+		})
+		assert.True(t, report.Valid)
+		assert.Empty(t, report.Errors)
+	})
+
+	t.Run("Invalid payload", func(t *testing.T) {
+		report := service.ValidateMetrics([]models.Metrics{
+			{ID: "Alloc", MType: "gauge", Value: &value},
+			{ID: "Alloc", MType: "gauge"},
+			{ID: "PollCount", MType: "counter"},
+			{ID: "", MType: "histogram"},
+			{ID: "Alloc", MType: "histogram"},
+			{ID: "Energy", MType: "counterf", Value: &negative},
+			{ID: "Unknown", MType: "counter", Delta: &delta},
+		})
+		assert.False(t, report.Valid)
+		assert.Equal(t, []models.ValidationError{
+			{Index: 1, ID: "Alloc", Errors: []string{"invalid metric value: gauge value is missing"}},
+			{Index: 2, ID: "PollCount", Errors: []string{"invalid metric value: counter delta is missing"}},
+			{Index: 3, ID: "", Errors: []string{"metricName cannot be empty"}},
+			{Index: 4, ID: "Alloc", Errors: []string{"unknown metric type"}},
+			{Index: 5, ID: "Energy", Errors: []string{"invalid metric value: counterf value -1 is not a finite non-negative number"}},
+			{Index: 6, ID: "Unknown", Errors: []string{models.ErrMetricNotAllowed.Error()}},
+		}, report.Errors)
+	})
+
+	mockStorage := service.Storage.(*MockStorager)
+	mockStorage.AssertNotCalled(t, "UpdateMetric", mock.Anything)
+}
+
+func TestServiceSentinelErrors(t *testing.T) {
+	t.Run("Invalid gauge value", func(t *testing.T) {
+		mockStorage := new(MockStorager)
+		service := &Service{Storage: mockStorage}
+
+		mockStorage.On("GetValue", models.Metrics{MType: "gauge", ID: "test_metric"}).Return(nil, models.ErrMetricNotFound)
+
+		err := service.UpdateServ(context.Background(), models.Metric{Type: "gauge", Name: "test_metric", Value: "abc"})
+		assert.ErrorIs(t, err, models.ErrInvalidMetricValue)
+	})
+
+	t.Run("Storage unavailable", func(t *testing.T) {
+		mockStorage := new(MockStorager)
+		service := &Service{Storage: mockStorage}
+
+		storageErr := errors.New("connection refused")
+		mockStorage.On("GetValue", models.Metrics{MType: "gauge", ID: "test_metric"}).Return(nil, storageErr)
+
+		_, err := service.GetValueServJSON(context.Background(), models.Metrics{MType: "gauge", ID: "test_metric"})
+		assert.ErrorIs(t, err, models.ErrStorageUnavailable)
+		assert.ErrorIs(t, err, storageErr)
+	})
+}
+
+func TestUpdateServJSONGaugePrecision(t *testing.T) {
+	tests := []struct {
+		name      string
+		precision int
+		value     float64
+		want      float64
+	}{
+		{name: "Disabled", precision: 0, value: 1.23456, want: 1.23456},
+		{name: "Two places", precision: 2, value: 1.23556, want: 1.24},
+		{name: "Four places", precision: 4, value: -0.123449, want: -0.1234},
+		{name: "Huge value kept", precision: 10, value: 1e300, want: 1e300},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockStorager)
+			service := &Service{Storage: mockStorage, precision: tt.precision}
+
+			want := tt.want
+			mockStorage.On("UpdateMetric", models.Metrics{MType: "gauge", ID: "Alloc", Value: &want}).Return(nil)
+
+			value := tt.value
+			assert.NoError(t, service.UpdateServJSON(context.Background(), &models.Metrics{MType: "gauge", ID: "Alloc", Value: &value}))
+			mockStorage.AssertExpectations(t)
+		})
+	}
+
+	t.Run("URL update rounded", func(t *testing.T) {
+		mockStorage := new(MockStorager)
+		service := &Service{Storage: mockStorage, precision: 1}
+
+		want := 3.1
+		mockStorage.On("UpdateMetric", models.Metrics{MType: "gauge", ID: "Alloc", Value: &want}).Return(nil)
+
+		assert.NoError(t, service.UpdateServ(context.Background(), models.Metric{Type: "gauge", Name: "Alloc", Value: "3.14159"}))
+		mockStorage.AssertExpectations(t)
+	})
+}
+
+func TestUpdateBatchMetricsServDuplicates(t *testing.T) {
+	newService := func() (*Service, *MockStorager) {
+		mockStorage := new(MockStorager)
+		return &Service{Storage: mockStorage, logger: &logger.Logger{ZapLogger: zap.NewNop()}}, mockStorage
+	}
+
+	t.Run("Last gauge wins", func(t *testing.T) {
+		service, mockStorage := newService()
+
+		first, second := 1.0, 2.0
+		mockStorage.On("UpdateMetric", models.Metrics{MType: "gauge", ID: "Alloc", Value: &second}).Return(nil).Once()
+
+		err := service.UpdateBatchMetricsServ(context.Background(), []models.Metrics{
+			{MType: "gauge", ID: "Alloc", Value: &first},
+			{MType: "gauge", ID: "Alloc", Value: &second},
+		})
+		assert.NoError(t, err)
+		mockStorage.AssertExpectations(t)
+		mockStorage.AssertNumberOfCalls(t, "UpdateMetric", 1)
+	})
+
+	t.Run("Counters summed", func(t *testing.T) {
+		service, mockStorage := newService()
+
+		first, second, previous := int64(3), int64(4), int64(10)
+		total := int64(17)
+		mockStorage.On("GetValue", models.Metrics{MType: "counter", ID: "PollCount"}).
+			Return(&models.Metrics{MType: "counter", ID: "PollCount", Delta: &previous}, nil).Once()
+		mockStorage.On("UpdateMetric", models.Metrics{MType: "counter", ID: "PollCount", Delta: &total}).Return(nil).Once()
+
+		err := service.UpdateBatchMetricsServ(context.Background(), []models.Metrics{
+			{MType: "counter", ID: "PollCount", Delta: &first},
+			{MType: "counter", ID: "PollCount", Delta: &second},
+		})
+		assert.NoError(t, err)
+		mockStorage.AssertExpectations(t)
+		assert.Equal(t, int64(3), first, "batch metrics must not be modified")
+	})
+
+	t.Run("Same name different type kept apart", func(t *testing.T) {
+		service, mockStorage := newService()
+
+		value, delta := 1.5, int64(2)
+		mockStorage.On("UpdateMetric", models.Metrics{MType: "gauge", ID: "Shared", Value: &value}).Return(nil).Once()
+		mockStorage.On("GetValue", models.Metrics{MType: "counter", ID: "Shared"}).Return(nil, models.ErrMetricNotFound).Once()
+		mockStorage.On("UpdateMetric", models.Metrics{MType: "counter", ID: "Shared", Delta: &delta}).Return(nil).Once()
+
+		err := service.UpdateBatchMetricsServ(context.Background(), []models.Metrics{
+			{MType: "gauge", ID: "Shared", Value: &value},
+			{MType: "counter", ID: "Shared", Delta: &delta},
+		})
+		assert.NoError(t, err)
+		mockStorage.AssertExpectations(t)
+	})
+}
+
+func TestUpdateServJSONMaxLength(t *testing.T) {
+	value := 1.5
+	tests := []struct {
+		name    string
+		metric  models.Metrics
+		wantErr bool
+	}{
+		{name: "Name at limit", metric: models.Metrics{MType: "gauge", ID: strings.Repeat("a", 8), Value: &value}},
+		{name: "Name over limit", metric: models.Metrics{MType: "gauge", ID: strings.Repeat("a", 9), Value: &value}, wantErr: true},
+		{name: "Label at limit", metric: models.Metrics{MType: "gauge", ID: "Alloc", Value: &value, Labels: map[string]string{"host": strings.Repeat("b", 4)}}},
+		{name: "Label value over limit", metric: models.Metrics{MType: "gauge", ID: "Alloc", Value: &value, Labels: map[string]string{"host": strings.Repeat("b", 5)}}, wantErr: true},
+		{name: "Label key over limit", metric: models.Metrics{MType: "gauge", ID: "Alloc", Value: &value, Labels: map[string]string{"hosts": "b"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockStorage := new(MockStorager)
+			service := &Service{Storage: mockStorage, maxName: 8, maxLabel: 4}
+			mockStorage.On("UpdateMetric", mock.Anything).Return(nil)
+
+			metric := tt.metric
+			err := service.UpdateServJSON(context.Background(), &metric)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, models.ErrNameTooLong)
+				mockStorage.AssertNotCalled(t, "UpdateMetric", mock.Anything)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	t.Run("URL update over limit", func(t *testing.T) {
+		service := &Service{Storage: new(MockStorager), maxName: 8}
+		err := service.UpdateServ(context.Background(), models.Metric{Type: "gauge", Name: strings.Repeat("a", 9), Value: "1"})
+		assert.ErrorIs(t, err, models.ErrNameTooLong)
+	})
+}
+
+func TestCountMetrics(t *testing.T) {
+	value, delta := 1.5, int64(1)
+	mixed := []models.Metrics{
+		{MType: "gauge", ID: "Alloc", Value: &value},
+		{MType: "gauge", ID: "HeapInuse", Value: &value},
+		{MType: "gauge", ID: "Alloc", Value: &value, Labels: map[string]string{"host": "a"}},
+		{MType: "counter", ID: "PollCount", Delta: &delta},
+		{MType: "counter", ID: "Alloc", Delta: &delta},
+	}
+
+	t.Run("Counted by storage", func(t *testing.T) {
+		memStorage := storage.NewMemStorage()
+		assert.NoError(t, memStorage.UpdateBatch(context.Background(), mixed))
+		service := &Service{Storage: memStorage}
+
+		counts, err := service.CountMetrics(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"gauge": 3, "counter": 2}, counts)
+	})
+
+	t.Run("Counted from statistic", func(t *testing.T) {
+		mockStorage := new(MockStorager)
+		service := &Service{Storage: mockStorage}
+		mockStorage.On("MetrixStatistic").Return(map[string]models.Metrics{
+			"gauge:Alloc":     mixed[0],
+			"gauge:HeapInuse": mixed[1],
+		}, nil)
+
+		counts, err := service.CountMetrics(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"gauge": 2, "counter": 0}, counts)
+	})
+
+	t.Run("Storage error", func(t *testing.T) {
+		mockStorage := new(MockStorager)
+		service := &Service{Storage: mockStorage}
+		mockStorage.On("MetrixStatistic").Return(map[string]models.Metrics(nil), errors.New("connection refused"))
+
+		_, err := service.CountMetrics(context.Background())
+		assert.ErrorIs(t, err, models.ErrStorageUnavailable)
+	})
+}
+
+func TestUpdateIfNewer(t *testing.T) {
+	ts := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Gauge passed to storage", func(t *testing.T) {
+		mockStorage := new(MockStorager)
+		service := &Service{Storage: mockStorage, aliases: map[string]string{"OldAlloc": "Alloc"}}
+
+		value := 1.5
+		mockStorage.On("UpdateIfNewer", models.Metrics{MType: "gauge", ID: "Alloc", Value: &value}, ts).Return(false, nil)
+
+		updated, err := service.UpdateIfNewer(context.Background(), &models.Metrics{MType: "gauge", ID: "OldAlloc", Value: &value}, ts)
+		assert.NoError(t, err)
+		assert.False(t, updated)
+		mockStorage.AssertExpectations(t)
+	})
+
+	t.Run("Counter rejected", func(t *testing.T) {
+		mockStorage := new(MockStorager)
+		service := &Service{Storage: mockStorage}
+
+		delta := int64(1)
+		_, err := service.UpdateIfNewer(context.Background(), &models.Metrics{MType: "counter", ID: "PollCount", Delta: &delta}, ts)
+		assert.ErrorIs(t, err, models.ErrInvalidMetricValue)
+		mockStorage.AssertNotCalled(t, "UpdateIfNewer", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Timestamps against memory storage", func(t *testing.T) {
+		service := &Service{Storage: storage.NewMemStorage()}
+		update := func(value float64, at time.Time) bool {
+			updated, err := service.UpdateIfNewer(context.Background(), &models.Metrics{MType: "gauge", ID: "Alloc", Value: &value}, at)
+			assert.NoError(t, err)
+			return updated
+		}
+
+		assert.True(t, update(1, ts), "first write")
+		assert.True(t, update(2, ts.Add(time.Second)), "newer timestamp")
+		assert.False(t, update(3, ts), "older timestamp")
+		assert.False(t, update(4, ts.Add(time.Second)), "equal timestamp")
+
+		got, err := service.GetValueServ(context.Background(), models.Metrics{MType: "gauge", ID: "Alloc"})
+		assert.NoError(t, err)
+		assert.Equal(t, "2", got)
+	})
+}
+
+func TestRestoreRemote(t *testing.T) {
+	value, delta := 1.5, int64(7)
+	source := &Service{Storage: storage.NewMemStorage(), logger: &logger.Logger{ZapLogger: zap.NewNop()}}
+	assert.NoError(t, source.UpdateBatchMetricsServ(context.Background(), []models.Metrics{
+		{MType: "gauge", ID: "Alloc", Value: &value},
+		{MType: "counter", ID: "PollCount", Delta: &delta},
+	}))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dump" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		metrics, err := source.ExportMetrics(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(metrics)
+	}))
+	defer server.Close()
+
+	t.Run("Loaded from dump", func(t *testing.T) {
+		target := &Service{Storage: storage.NewMemStorage(), logger: &logger.Logger{ZapLogger: zap.NewNop()}}
+
+		n, err := target.RestoreRemote(context.Background(), server.URL+"/dump")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		got, err := target.GetValueServ(context.Background(), models.Metrics{MType: "counter", ID: "PollCount"})
+		assert.NoError(t, err)
+		assert.Equal(t, "7", got)
+	})
+
+	t.Run("Populated storage not doubled", func(t *testing.T) {
+		target := &Service{Storage: storage.NewMemStorage(), logger: &logger.Logger{ZapLogger: zap.NewNop()}}
+		stored := int64(5)
+		assert.NoError(t, target.UpdateServJSON(context.Background(), &models.Metrics{MType: "counter", ID: "PollCount", Delta: &stored}))
+
+		for i := 0; i < 2; i++ {
+			_, err := target.RestoreRemote(context.Background(), server.URL+"/dump")
+			assert.NoError(t, err)
+		}
+
+		got, err := target.GetValueServ(context.Background(), models.Metrics{MType: "counter", ID: "PollCount"})
+		assert.NoError(t, err)
+		assert.Equal(t, "7", got, "counters are replaced by the dump, not added to")
+	})
+
+	t.Run("Fetch failure leaves storage empty", func(t *testing.T) {
+		target := &Service{Storage: storage.NewMemStorage(), logger: &logger.Logger{ZapLogger: zap.NewNop()}}
+
+		_, err := target.RestoreRemote(context.Background(), server.URL+"/missing")
+		assert.Error(t, err)
+
+		metrics, err := target.ExportMetrics(context.Background())
+		assert.NoError(t, err)
+		assert.Empty(t, metrics)
+	})
+}
+
+func TestReplicate(t *testing.T) {
+	value, delta := 1.5, int64(7)
+	source := &Service{Storage: storage.NewMemStorage(), logger: &logger.Logger{ZapLogger: zap.NewNop()}}
+	assert.NoError(t, source.UpdateBatchMetricsServ(context.Background(), []models.Metrics{
+		{MType: "gauge", ID: "Alloc", Value: &value},
+		{MType: "counter", ID: "PollCount", Delta: &delta},
+	}))
+
+	// Реплика уже содержит устаревшее значение счетчика, которое импорт должен заменить
+	replica := &Service{Storage: storage.NewMemStorage(), logger: &logger.Logger{ZapLogger: zap.NewNop()}}
+	stale := int64(3)
+	assert.NoError(t, replica.UpdateServJSON(context.Background(), &models.Metrics{MType: "counter", ID: "PollCount", Delta: &stale}))
+
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		h := hmac.New(sha256.New, []byte("secret"))
+		h.Write(body)
+		h.Write([]byte(r.Header.Get("X-Nonce") + r.Header.Get("X-Timestamp")))
+		if r.Header.Get("HashSHA256") != hex.EncodeToString(h.Sum(nil)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var metrics []models.Metrics
+		if r.URL.Path != "/import" || json.Unmarshal(body, &metrics) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, err := replica.ImportMetrics(r.Context(), metrics); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fake.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	// Недоступная реплика не мешает отправке остальным
+	replicator := source.Replicator([]string{failing.URL + "/import", fake.URL + "/import"}, time.Hour, "secret")
+	assert.Equal(t, 1, replicator.Replicate(context.Background()))
+
+	got, err := replica.GetValueServ(context.Background(), models.Metrics{MType: "counter", ID: "PollCount"})
+	assert.NoError(t, err)
+	assert.Equal(t, "7", got)
+	got, err = replica.GetValueServ(context.Background(), models.Metrics{MType: "gauge", ID: "Alloc"})
+	assert.NoError(t, err)
+	assert.Equal(t, "1.5", got)
+}
+
+func TestImportMetricsValidation(t *testing.T) {
+	newService := func() *Service {
+		return &Service{
+			Storage:   storage.NewMemStorage(),
+			logger:    &logger.Logger{ZapLogger: zap.NewNop()},
+			whitelist: map[string]struct{}{"Alloc": {}, "PollCount": {}, "Debug": {}},
+			aliases:   map[string]string{"OldAlloc": "Alloc"},
+			reject:    regexp.MustCompile(`^Debug`),
+			clamps:    []flags.ValueClamp{{Prefix: "Alloc", Min: 0, Max: 100}},
+		}
+	}
+	value, delta := 250.0, int64(7)
+
+	t.Run("Filters applied", func(t *testing.T) {
+		service := newService()
+		n, err := service.ImportMetrics(context.Background(), []models.Metrics{
+			{MType: "gauge", ID: "OldAlloc", Value: &value},
+			{MType: "counter", ID: "PollCount", Delta: &delta},
+			{MType: "gauge", ID: "Debug", Value: &value},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n, "metrics matching the reject pattern are skipped")
+
+		got, err := service.GetValueServ(context.Background(), models.Metrics{MType: "gauge", ID: "Alloc"})
+		assert.NoError(t, err)
+		assert.Equal(t, "100", got, "aliases and clamps are applied")
+	})
+
+	t.Run("Invalid metrics rejected", func(t *testing.T) {
+		for _, metric := range []models.Metrics{
+			{MType: "gauge", ID: "Unknown", Value: &value},
+			{MType: "gauge", ID: "Alloc"},
+			{MType: "histogram", ID: "Alloc", Value: &value},
+		} {
+			service := newService()
+			_, err := service.ImportMetrics(context.Background(), []models.Metrics{metric})
+			assert.Error(t, err, metric.ID)
+
+			metrics, err := service.ExportMetrics(context.Background())
+			assert.NoError(t, err)
+			assert.Empty(t, metrics)
+		}
+	})
+}
+
+func TestUpdateServJSONCounterF(t *testing.T) {
+	newService := func() *Service {
+		return &Service{Storage: storage.NewMemStorage(), logger: &logger.Logger{ZapLogger: zap.NewNop()}}
+	}
+
+	t.Run("Deltas accumulated", func(t *testing.T) {
+		service := newService()
+		for _, delta := range []float64{0.5, 0.25} {
+			d := delta
+			assert.NoError(t, service.UpdateServJSON(context.Background(), &models.Metrics{ID: "Energy", MType: "counterf", Value: &d}))
+		}
+		assert.NoError(t, service.UpdateServ(context.Background(), models.Metric{Type: "counterf", Name: "Energy", Value: "1.25"}))
+
+		got, err := service.GetValueServ(context.Background(), models.Metrics{ID: "Energy", MType: "counterf"})
+		assert.NoError(t, err)
+		assert.Equal(t, "2", got)
+	})
+
+	t.Run("Batch duplicates summed", func(t *testing.T) {
+		service := newService()
+		first, second := 0.5, 1.5
+		assert.NoError(t, service.UpdateBatchMetricsServ(context.Background(), []models.Metrics{
+			{ID: "Energy", MType: "counterf", Value: &first},
+			{ID: "Energy", MType: "counterf", Value: &second},
+		}))
+
+		got, err := service.GetValueServJSON(context.Background(), models.Metrics{ID: "Energy", MType: "counterf"})
+		assert.NoError(t, err)
+		if assert.NotNil(t, got.Value) {
+			assert.Equal(t, 2.0, *got.Value)
+		}
+	})
+
+	t.Run("Existing types unchanged", func(t *testing.T) {
+		service := newService()
+		value := 3.5
+		assert.NoError(t, service.UpdateServJSON(context.Background(), &models.Metrics{ID: "Energy", MType: "gauge", Value: &value}))
+		assert.NoError(t, service.UpdateServJSON(context.Background(), &models.Metrics{ID: "Energy", MType: "counterf", Value: &value}))
+
+		got, err := service.GetValueServ(context.Background(), models.Metrics{ID: "Energy", MType: "gauge"})
+		assert.NoError(t, err)
+		assert.Equal(t, "3.5", got)
+	})
+
+	t.Run("Negative delta rejected", func(t *testing.T) {
+		service := newService()
+		negative := -1.0
+		err := service.UpdateServJSON(context.Background(), &models.Metrics{ID: "Energy", MType: "counterf", Value: &negative})
+		assert.ErrorIs(t, err, models.ErrInvalidMetricValue)
+
+		err = service.UpdateServJSON(context.Background(), &models.Metrics{ID: "Energy", MType: "counterf"})
+		assert.ErrorIs(t, err, models.ErrInvalidMetricValue)
+	})
+}
+
+func TestUpdateServCounterBypassesCache(t *testing.T) {
+	ctx := context.Background()
+	shared := storage.NewMemStorage()
+	nop := &logger.Logger{ZapLogger: zap.NewNop()}
+	cached := &Service{Storage: storage.NewCachedStorage(shared, time.Hour), logger: nop}
+	other := &Service{Storage: shared, logger: nop}
+
+	delta := int64(1)
+	assert.NoError(t, cached.UpdateServJSON(ctx, &models.Metrics{MType: "counter", ID: "PollCount", Delta: &delta}))
+	energy := 0.5
+	assert.NoError(t, cached.UpdateServJSON(ctx, &models.Metrics{MType: "counterf", ID: "Energy", Value: &energy}))
+
+	// Чтения кэшируют суммы, после чего другой сервер увеличивает счетчики в общем хранилище
+	_, err := cached.GetValueServ(ctx, models.Metrics{MType: "counter", ID: "PollCount"})
+	assert.NoError(t, err)
+	_, err = cached.GetValueServ(ctx, models.Metrics{MType: "counterf", ID: "Energy"})
+	assert.NoError(t, err)
+	delta = 2
+	assert.NoError(t, other.UpdateServJSON(ctx, &models.Metrics{MType: "counter", ID: "PollCount", Delta: &delta}))
+	assert.NoError(t, other.UpdateServJSON(ctx, &models.Metrics{MType: "counterf", ID: "Energy", Value: &energy}))
+
+	delta = 4
+	assert.NoError(t, cached.UpdateServJSON(ctx, &models.Metrics{MType: "counter", ID: "PollCount", Delta: &delta}))
+	assert.NoError(t, cached.UpdateServ(ctx, models.Metric{Type: "counter", Name: "PollCount", Value: "1"}))
+	assert.NoError(t, cached.UpdateServJSON(ctx, &models.Metrics{MType: "counterf", ID: "Energy", Value: &energy}))
+
+	got, err := other.GetValueServ(ctx, models.Metrics{MType: "counter", ID: "PollCount"})
+	assert.NoError(t, err)
+	assert.Equal(t, "8", got, "increments of the other server are kept")
+
+	got, err = other.GetValueServ(ctx, models.Metrics{MType: "counterf", ID: "Energy"})
+	assert.NoError(t, err)
+	assert.Equal(t, "1.5", got)
+}
+
+func TestServiceValueClamps(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	service := New(storage.NewMemStorage(), &logger.Logger{ZapLogger: zap.New(core)}, &flags.Config{
+		ValueClamps: []flags.ValueClamp{
+			{Prefix: "", Min: -1000, Max: 1000},
+			{Prefix: "cpu.", Min: 0, Max: 100},
+		},
+	})
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		id      string
+		value   float64
+		want    string
+		clamped bool
+	}{
+		{name: "Below min", id: "cpu.user", value: -5, want: "0", clamped: true},
+		{name: "Above max", id: "cpu.user", value: 250, want: "100", clamped: true},
+		{name: "Within range", id: "cpu.user", value: 42.5, want: "42.5"},
+		{name: "Global clamp", id: "Alloc", value: 1e9, want: "1000", clamped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := logs.Len()
+			value := tt.value
+			assert.NoError(t, service.UpdateServJSON(ctx, &models.Metrics{ID: tt.id, MType: "gauge", Value: &value}))
+
+			got, err := service.GetValueServ(ctx, models.Metrics{ID: tt.id, MType: "gauge"})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.clamped, logs.Len() > before, "clamping is logged")
+		})
+	}
+
+	t.Run("Counter delta clamped", func(t *testing.T) {
+		assert.NoError(t, service.UpdateServ(ctx, models.Metric{Type: "counter", Name: "cpu.ticks", Value: "500"}))
+
+		got, err := service.GetValueServ(ctx, models.Metrics{ID: "cpu.ticks", MType: "counter"})
+		assert.NoError(t, err)
+		assert.Equal(t, "100", got)
+	})
+}
+
+func TestCounterDebug(t *testing.T) {
+	service := &Service{Storage: storage.NewMemStorage(), logger: &logger.Logger{ZapLogger: zap.NewNop()}}
+	ctx := context.Background()
+
+	_, err := service.CounterDebug(ctx, "PollCount")
+	assert.ErrorIs(t, err, models.ErrMetricNotFound)
+
+	first := int64(5)
+	assert.NoError(t, service.UpdateServJSON(ctx, &models.Metrics{ID: "PollCount", MType: "counter", Delta: &first}))
+	assert.NoError(t, service.UpdateServ(ctx, models.Metric{Type: "counter", Name: "PollCount", Value: "3"}))
+
+	debug, err := service.CounterDebug(ctx, "PollCount")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "PollCount", debug.ID)
+		assert.Equal(t, int64(8), debug.Total)
+		if assert.NotNil(t, debug.LastDelta) {
+			assert.Equal(t, int64(3), *debug.LastDelta)
+		}
+	}
+
+	// После перезапуска приращение неизвестно, накопленное значение читается из хранилища
+	restarted := &Service{Storage: service.Storage, logger: service.logger}
+	debug, err = restarted.CounterDebug(ctx, "PollCount")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(8), debug.Total)
+		assert.Nil(t, debug.LastDelta)
+	}
+}
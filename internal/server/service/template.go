@@ -0,0 +1,73 @@
+package service
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+)
+
+// defaultStatsTemplate встроенный шаблон страницы статистики
+const defaultStatsTemplate = `
+		<!DOCTYPE html>
+		<html>
+		<head>
+			<title>Metrics Statistics</title>
+		</head>
+		<body>
+			<h1>Metrics Statistics</h1>
+			<table border="1">
+				<tr>
+					<th>Metric Name</th>
+					<th>Metric Value</th>
+				</tr>
+				{{range $key, $metric := .}}
+				<tr>
+					<td>{{$metric.ID}}{{with $metric.LabelKey}} ({{.}}){{end}}</td>
+					<td>
+						{{if or (eq $metric.MType "gauge") (eq $metric.MType "counterf")}}
+							{{$metric.Value}}
+						{{else}}
+							{{$metric.Delta}}
+						{{end}}
+					</td>
+				</tr>
+				{{end}}
+			</table>
+		</body>
+		</html>
+	`
+
+// parseStatsTemplate разбирает шаблон страницы статистики из файла path или встроенный, если path пустой
+func parseStatsTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return template.New("metrics").Parse(defaultStatsTemplate)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template %s: %w", path, err)
+	}
+	return template.New("metrics").Parse(string(data))
+}
+
+// ReloadTemplate перечитывает шаблон страницы статистики.
+// При ошибке продолжает использоваться ранее загруженный шаблон
+func (s *Service) ReloadTemplate() error {
+	tmpl, err := parseStatsTemplate(s.tmplPath)
+	if err != nil {
+		return err
+	}
+
+	s.tmpl.Store(tmpl)
+	log.Printf("statistics template loaded from %q", s.tmplPath)
+	return nil
+}
+
+// statsTemplate возвращает загруженный шаблон страницы статистики или встроенный, если шаблон еще не загружен
+func (s *Service) statsTemplate() (*template.Template, error) {
+	if tmpl := s.tmpl.Load(); tmpl != nil {
+		return tmpl, nil
+	}
+	return parseStatsTemplate("")
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vova4o/yandexadv/internal/models"
+	"go.uber.org/zap"
+)
+
+// Состояния автоматического выключателя
+const (
+	BreakerClosed   = "closed"    // запросы выполняются, ошибки подсчитываются
+	BreakerOpen     = "open"      // запросы отклоняются сразу до окончания паузы
+	BreakerHalfOpen = "half-open" // выполняется один пробный запрос
+)
+
+// errBreakerOpen ошибка запроса, отклоненного без обращения к хранилищу
+var errBreakerOpen = fmt.Errorf("%w: circuit breaker is open", models.ErrStorageUnavailable)
+
+// BreakerStorage автоматический выключатель перед хранилищем.
+// После threshold ошибок подряд запросы в течение cooldown отклоняются с ErrStorageUnavailable,
+// затем пропускается один пробный запрос: при успехе выключатель замыкается, при ошибке снова размыкается
+type BreakerStorage struct {
+	Storager
+	threshold int
+	cooldown  time.Duration
+	logger    Loggerer
+	mu        sync.Mutex
+	state     string
+	failures  int       // ошибок подряд в замкнутом состоянии
+	openedAt  time.Time // время последнего размыкания
+	probing   bool      // пробный запрос уже выполняется
+}
+
+// NewBreakerStorage создает выключатель перед хранилищем s
+func NewBreakerStorage(s Storager, threshold int, cooldown time.Duration, logger Loggerer) *BreakerStorage {
+	return &BreakerStorage{
+		Storager:  s,
+		threshold: threshold,
+		cooldown:  cooldown,
+		logger:    logger,
+		state:     BreakerClosed,
+	}
+}
+
+// State возвращает текущее состояние выключателя
+func (b *BreakerStorage) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow проверяет, можно ли выполнить запрос, и сообщает, является ли он пробным
+func (b *BreakerStorage) allow() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false, errBreakerOpen
+		}
+		b.state = BreakerHalfOpen
+		b.logger.Info("Circuit breaker half-open, probing storage")
+	case BreakerClosed:
+		return false, nil
+	}
+
+	if b.probing {
+		return false, errBreakerOpen
+	}
+	b.probing = true
+	return true, nil
+}
+
+// record учитывает результат запроса
+func (b *BreakerStorage) record(probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failed := isBreakerFailure(err)
+	if probe {
+		b.probing = false
+		if failed {
+			b.open(err)
+			return
+		}
+		b.state = BreakerClosed
+		b.failures = 0
+		b.logger.Info("Circuit breaker closed, storage recovered")
+		return
+	}
+
+	if b.state != BreakerClosed {
+		return
+	}
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.open(err)
+	}
+}
+
+// open размыкает выключатель, вызывается под b.mu
+func (b *BreakerStorage) open(err error) {
+	b.state = BreakerOpen
+	b.failures = 0
+	b.openedAt = time.Now()
+	b.logger.Error("Circuit breaker open, storage requests fail fast",
+		zap.Duration("cooldown", b.cooldown), zap.Error(err))
+}
+
+// isBreakerFailure сообщает, говорит ли ошибка о недоступности хранилища.
+// Отсутствие метрики, перегрузка пула и отмена запроса клиентом к ним не относятся
+func isBreakerFailure(err error) bool {
+	if err == nil || errors.Is(err, models.ErrMetricNotFound) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var overload *models.OverloadError
+	return !errors.As(err, &overload)
+}
+
+// call выполняет запрос через выключатель
+func (b *BreakerStorage) call(fn func() error) error {
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	b.record(probe, err)
+	return err
+}
+
+// UpdateBatch обновляет метрики через выключатель
+func (b *BreakerStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	return b.call(func() error {
+		return b.Storager.UpdateBatch(ctx, metrics)
+	})
+}
+
+// UpdateMetric обновляет метрику через выключатель
+func (b *BreakerStorage) UpdateMetric(ctx context.Context, metric models.Metrics) error {
+	return b.call(func() error {
+		return b.Storager.UpdateMetric(ctx, metric)
+	})
+}
+
+// UpdateIfNewer условно обновляет метрику через выключатель
+func (b *BreakerStorage) UpdateIfNewer(ctx context.Context, metric models.Metrics, ts time.Time) (bool, error) {
+	var updated bool
+	err := b.call(func() (err error) {
+		updated, err = b.Storager.UpdateIfNewer(ctx, metric, ts)
+		return err
+	})
+	return updated, err
+}
+
+// GetValue читает метрику через выключатель
+func (b *BreakerStorage) GetValue(ctx context.Context, metric models.Metrics) (*models.Metrics, error) {
+	var m *models.Metrics
+	err := b.call(func() (err error) {
+		m, err = b.Storager.GetValue(ctx, metric)
+		return err
+	})
+	return m, err
+}
+
+// MetrixStatistic читает все метрики через выключатель
+func (b *BreakerStorage) MetrixStatistic(ctx context.Context) (map[string]models.Metrics, error) {
+	var metrics map[string]models.Metrics
+	err := b.call(func() (err error) {
+		metrics, err = b.Storager.MetrixStatistic(ctx)
+		return err
+	})
+	return metrics, err
+}
+
+// CountByType возвращает количество метрик каждого типа через выключатель
+func (b *BreakerStorage) CountByType(ctx context.Context) (map[string]int, error) {
+	var counts map[string]int
+	err := b.call(func() (err error) {
+		if counter, ok := b.Storager.(interface {
+			CountByType(ctx context.Context) (map[string]int, error)
+		}); ok {
+			counts, err = counter.CountByType(ctx)
+			return err
+		}
+
+		metrics, err := b.Storager.MetrixStatistic(ctx)
+		if err != nil {
+			return err
+		}
+		counts = countByType(metrics)
+		return nil
+	})
+	return counts, err
+}
+
+// DeleteByPrefix удаляет метрики через выключатель
+func (b *BreakerStorage) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	deleter, ok := b.Storager.(interface {
+		DeleteByPrefix(ctx context.Context, prefix string) (int, error)
+	})
+	if !ok {
+		return 0, models.ErrDeleteNotSupported
+	}
+
+	var deleted int
+	err := b.call(func() (err error) {
+		deleted, err = deleter.DeleteByPrefix(ctx, prefix)
+		return err
+	})
+	return deleted, err
+}
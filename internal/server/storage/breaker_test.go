@@ -0,0 +1,111 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vova4o/yandexadv/internal/models"
+	"github.com/vova4o/yandexadv/internal/server/storage"
+	"go.uber.org/zap"
+)
+
+// failingStorage возвращает ошибку err из GetValue и считает обращения
+type failingStorage struct {
+	storage.Storager
+	err   error
+	calls int
+}
+
+func (s *failingStorage) GetValue(_ context.Context, metric models.Metrics) (*models.Metrics, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &metric, nil
+}
+
+// nopLogger логгер, отбрасывающий сообщения
+type nopLogger struct{}
+
+func (nopLogger) Error(string, ...zap.Field) {}
+func (nopLogger) Info(string, ...zap.Field)  {}
+
+func TestBreakerStorage(t *testing.T) {
+	ctx := context.Background()
+	metric := models.Metrics{ID: "Alloc", MType: "gauge"}
+	errDown := errors.New("connection refused")
+
+	t.Run("Opens after consecutive failures", func(t *testing.T) {
+		backend := &failingStorage{err: errDown}
+		b := storage.NewBreakerStorage(backend, 3, time.Hour, nopLogger{})
+
+		for i := 0; i < 3; i++ {
+			_, err := b.GetValue(ctx, metric)
+			assert.ErrorIs(t, err, errDown)
+		}
+		assert.Equal(t, storage.BreakerOpen, b.State())
+
+		_, err := b.GetValue(ctx, metric)
+		assert.ErrorIs(t, err, models.ErrStorageUnavailable)
+		assert.Equal(t, 3, backend.calls, "open breaker fails fast without calling storage")
+	})
+
+	t.Run("Success resets failure count", func(t *testing.T) {
+		backend := &failingStorage{err: errDown}
+		b := storage.NewBreakerStorage(backend, 2, time.Hour, nopLogger{})
+
+		_, _ = b.GetValue(ctx, metric)
+		backend.err = nil
+		_, err := b.GetValue(ctx, metric)
+		assert.NoError(t, err)
+		backend.err = errDown
+		_, _ = b.GetValue(ctx, metric)
+
+		assert.Equal(t, storage.BreakerClosed, b.State())
+	})
+
+	t.Run("Not found is not a failure", func(t *testing.T) {
+		backend := &failingStorage{err: models.ErrMetricNotFound}
+		b := storage.NewBreakerStorage(backend, 1, time.Hour, nopLogger{})
+
+		_, err := b.GetValue(ctx, metric)
+		assert.ErrorIs(t, err, models.ErrMetricNotFound)
+		assert.Equal(t, storage.BreakerClosed, b.State())
+	})
+
+	t.Run("Half-open probe closes on success", func(t *testing.T) {
+		backend := &failingStorage{err: errDown}
+		b := storage.NewBreakerStorage(backend, 1, 20*time.Millisecond, nopLogger{})
+
+		_, _ = b.GetValue(ctx, metric)
+		assert.Equal(t, storage.BreakerOpen, b.State())
+
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, storage.BreakerHalfOpen, b.State())
+
+		backend.err = nil
+		_, err := b.GetValue(ctx, metric)
+		assert.NoError(t, err)
+		assert.Equal(t, storage.BreakerClosed, b.State())
+		assert.Equal(t, 2, backend.calls)
+	})
+
+	t.Run("Half-open probe reopens on failure", func(t *testing.T) {
+		backend := &failingStorage{err: errDown}
+		b := storage.NewBreakerStorage(backend, 1, 20*time.Millisecond, nopLogger{})
+
+		_, _ = b.GetValue(ctx, metric)
+		time.Sleep(30 * time.Millisecond)
+
+		_, err := b.GetValue(ctx, metric)
+		assert.ErrorIs(t, err, errDown)
+		assert.Equal(t, storage.BreakerOpen, b.State())
+
+		_, err = b.GetValue(ctx, metric)
+		assert.ErrorIs(t, err, models.ErrStorageUnavailable)
+		assert.Equal(t, 2, backend.calls)
+	})
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vova4o/yandexadv/internal/models"
+)
+
+// CachedStorage кэширует чтения отдельных метрик из вложенного хранилища.
+// Записи через кэш сбрасывают закэшированные значения затронутых метрик
+type CachedStorage struct {
+	Storager
+	ttl     time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	gen     uint64 // счетчик записей, чтение не кэшируется, если во время него была запись
+	entries map[string]cacheEntry
+}
+
+// cacheEntry закэшированное значение метрики
+type cacheEntry struct {
+	metric  models.Metrics
+	expires time.Time
+}
+
+// NewCachedStorage создает кэш чтений перед хранилищем s со временем жизни записей ttl
+func NewCachedStorage(s Storager, ttl time.Duration) *CachedStorage {
+	return &CachedStorage{
+		Storager: s,
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  make(map[string]cacheEntry),
+	}
+}
+
+// GetValue возвращает метрику из кэша или читает ее из хранилища
+func (c *CachedStorage) GetValue(ctx context.Context, metric models.Metrics) (*models.Metrics, error) {
+	key := StorageKey(metric)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && c.now().Before(entry.expires) {
+		c.mu.Unlock()
+		m := copyMetric(entry.metric)
+		return &m, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	m, err := c.Storager.GetValue(ctx, metric)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.gen == gen {
+		c.entries[key] = cacheEntry{metric: copyMetric(*m), expires: c.now().Add(c.ttl)}
+	}
+	c.mu.Unlock()
+
+	return m, nil
+}
+
+// GetValueUncached читает метрику из вложенного хранилища мимо кэша.
+// Используется при обновлении счетчиков: в то же хранилище могут писать другие серверы,
+// и закэшированная сумма могла устареть
+func (c *CachedStorage) GetValueUncached(ctx context.Context, metric models.Metrics) (*models.Metrics, error) {
+	return c.Storager.GetValue(ctx, metric)
+}
+
+// UpdateMetric обновляет метрику и сбрасывает ее значение в кэше
+func (c *CachedStorage) UpdateMetric(ctx context.Context, metric models.Metrics) error {
+	defer c.invalidate(metric)
+	return c.Storager.UpdateMetric(ctx, metric)
+}
+
+// UpdateIfNewer условно обновляет метрику и сбрасывает ее значение в кэше
+func (c *CachedStorage) UpdateIfNewer(ctx context.Context, metric models.Metrics, ts time.Time) (bool, error) {
+	defer c.invalidate(metric)
+	return c.Storager.UpdateIfNewer(ctx, metric, ts)
+}
+
+// UpdateBatch обновляет метрики и сбрасывает их значения в кэше
+func (c *CachedStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	defer c.invalidate(metrics...)
+	return c.Storager.UpdateBatch(ctx, metrics)
+}
+
+// CountByType возвращает количество метрик каждого типа из вложенного хранилища
+func (c *CachedStorage) CountByType(ctx context.Context) (map[string]int, error) {
+	if counter, ok := c.Storager.(interface {
+		CountByType(ctx context.Context) (map[string]int, error)
+	}); ok {
+		return counter.CountByType(ctx)
+	}
+
+	metrics, err := c.Storager.MetrixStatistic(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return countByType(metrics), nil
+}
+
+// DeleteByPrefix удаляет метрики из вложенного хранилища и очищает кэш
+func (c *CachedStorage) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	deleter, ok := c.Storager.(interface {
+		DeleteByPrefix(ctx context.Context, prefix string) (int, error)
+	})
+	if !ok {
+		return 0, models.ErrDeleteNotSupported
+	}
+
+	defer c.invalidateAll()
+	return deleter.DeleteByPrefix(ctx, prefix)
+}
+
+// invalidateAll удаляет из кэша все метрики
+func (c *CachedStorage) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.entries = make(map[string]cacheEntry)
+}
+
+// invalidate удаляет метрики из кэша
+func (c *CachedStorage) invalidate(metrics ...models.Metrics) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, metric := range metrics {
+		delete(c.entries, StorageKey(metric))
+	}
+}
+
+// copyMetric копирует метрику вместе со значениями, на которые она ссылается
+func copyMetric(m models.Metrics) models.Metrics {
+	if m.Value != nil {
+		v := *m.Value
+		m.Value = &v
+	}
+	if m.Delta != nil {
+		d := *m.Delta
+		m.Delta = &d
+	}
+	return m
+}
@@ -0,0 +1,90 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vova4o/yandexadv/internal/models"
+	"github.com/vova4o/yandexadv/internal/server/storage"
+)
+
+// countingStorage считает обращения к GetValue вложенного хранилища
+type countingStorage struct {
+	storage.Storager
+	reads int
+}
+
+func (s *countingStorage) GetValue(ctx context.Context, metric models.Metrics) (*models.Metrics, error) {
+	s.reads++
+	return s.Storager.GetValue(ctx, metric)
+}
+
+func TestCachedStorage(t *testing.T) {
+	value := 1.5
+	gauge := models.Metrics{ID: "Alloc", MType: "gauge", Value: &value}
+
+	newCache := func(ttl time.Duration) (*storage.CachedStorage, *countingStorage) {
+		backend := &countingStorage{Storager: storage.NewMemStorage()}
+		assert.NoError(t, backend.UpdateMetric(context.Background(), gauge))
+		return storage.NewCachedStorage(backend, ttl), backend
+	}
+
+	t.Run("Second read within TTL served from cache", func(t *testing.T) {
+		cache, backend := newCache(time.Minute)
+
+		for i := 0; i < 2; i++ {
+			m, err := cache.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge"})
+			assert.NoError(t, err)
+			if assert.NotNil(t, m.Value) {
+				assert.Equal(t, value, *m.Value)
+			}
+		}
+		assert.Equal(t, 1, backend.reads)
+	})
+
+	t.Run("Write invalidates cached value", func(t *testing.T) {
+		cache, backend := newCache(time.Minute)
+
+		_, err := cache.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge"})
+		assert.NoError(t, err)
+
+		updated := 2.5
+		assert.NoError(t, cache.UpdateBatch(context.Background(), []models.Metrics{{ID: "Alloc", MType: "gauge", Value: &updated}}))
+
+		m, err := cache.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge"})
+		assert.NoError(t, err)
+		if assert.NotNil(t, m.Value) {
+			assert.Equal(t, updated, *m.Value)
+		}
+		assert.Equal(t, 2, backend.reads)
+	})
+
+	t.Run("Expired entry read again", func(t *testing.T) {
+		cache, backend := newCache(10 * time.Millisecond)
+
+		_, err := cache.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge"})
+		assert.NoError(t, err)
+		time.Sleep(20 * time.Millisecond)
+		_, err = cache.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, 2, backend.reads)
+	})
+
+	t.Run("Cached value not shared with callers", func(t *testing.T) {
+		cache, _ := newCache(time.Minute)
+
+		_, err := cache.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge"})
+		assert.NoError(t, err)
+
+		m, err := cache.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge"})
+		assert.NoError(t, err)
+		*m.Value = 100
+
+		m, err = cache.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge"})
+		assert.NoError(t, err)
+		assert.Equal(t, 1.5, *m.Value)
+	})
+}
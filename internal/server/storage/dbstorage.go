@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -10,25 +11,50 @@ import (
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/vova4o/yandexadv/internal/models"
 	"github.com/vova4o/yandexadv/internal/server/flags"
+	"github.com/vova4o/yandexadv/internal/server/storage/migrations"
 	"go.uber.org/zap"
 )
 
 // DBStorage структура для хранилища
 type DBStorage struct {
-	DB     *pgxpool.Pool
-	logger Loggerer
+	DB         *pgxpool.Pool
+	logger     Loggerer
+	retryAfter time.Duration // ожидание соединения и задержка для клиентов при исчерпании пула, 0 - ждать без ограничения
 }
 
 const maxRetries = 3
 const retryDelay = 1 * time.Second
 
+// upsertMetricStmt имя подготовленного запроса обновления метрики
+const upsertMetricStmt = "upsert_metric"
+
+// upsertMetricSQL запрос добавления или обновления метрики
+const upsertMetricSQL = `INSERT INTO metrics (type, name, labels, value, delta, timestamp)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (type, name, labels) DO UPDATE SET
+		value = EXCLUDED.value,
+		delta = EXCLUDED.delta,
+		timestamp = EXCLUDED.timestamp`
+
+// upsertIfNewerSQL запрос добавления метрики или ее обновления, если новое время больше сохраненного
+const upsertIfNewerSQL = `INSERT INTO metrics (type, name, labels, value, delta, timestamp)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (type, name, labels) DO UPDATE SET
+		value = EXCLUDED.value,
+		delta = EXCLUDED.delta,
+		timestamp = EXCLUDED.timestamp
+	WHERE metrics.timestamp < EXCLUDED.timestamp`
+
 // DBConnect подключение к базе данных
 func DBConnect(config *flags.Config, logger Loggerer) (*DBStorage, error) {
-	var db *pgxpool.Pool
-	var err error
+	poolConfig, err := NewPoolConfig(config)
+	if err != nil {
+		return nil, err
+	}
 
+	var db *pgxpool.Pool
 	for i := 0; i < maxRetries; i++ {
-		db, err = pgxpool.Connect(context.Background(), config.DBDSN)
+		db, err = pgxpool.ConnectConfig(context.Background(), poolConfig)
 		if err == nil {
 			break
 		}
@@ -42,17 +68,85 @@ func DBConnect(config *flags.Config, logger Loggerer) (*DBStorage, error) {
 	}
 
 	return &DBStorage{
-		DB:     db,
-		logger: logger,
+		DB:         db,
+		logger:     logger,
+		retryAfter: time.Duration(config.RetryAfter) * time.Second,
 	}, nil
 }
 
+// NewPoolConfig разбирает строку подключения и применяет настройки пула из конфигурации.
+// Нулевые значения оставляют настройки pgxpool по умолчанию
+func NewPoolConfig(config *flags.Config) (*pgxpool.Config, error) {
+	poolConfig, err := pgxpool.ParseConfig(config.DBDSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database DSN: %w", err)
+	}
+
+	if config.DBMaxConns > 0 {
+		poolConfig.MaxConns = int32(config.DBMaxConns)
+	}
+	if config.DBMinConns > 0 {
+		poolConfig.MinConns = int32(config.DBMinConns)
+	}
+	if config.DBConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = config.DBConnLifetime
+	}
+
+	return poolConfig, nil
+}
+
+// acquire берет соединение из пула для записи. Запрос ждет в очереди пула не дольше retryAfter;
+// если за это время все соединения остались заняты, возвращается OverloadError
+func (d *DBStorage) acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	if d.retryAfter <= 0 {
+		conn, err := d.DB.Acquire(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to acquire connection: %w", err)
+		}
+		return conn, nil
+	}
+
+	acquireCtx, cancel := context.WithTimeout(ctx, d.retryAfter)
+	defer cancel()
+
+	conn, err := d.DB.Acquire(acquireCtx)
+	if err == nil {
+		return conn, nil
+	}
+
+	// Истекло только ожидание соединения, а не запрос клиента, и пул по-прежнему занят
+	stat := d.DB.Stat()
+	if ctx.Err() == nil && errors.Is(acquireCtx.Err(), context.DeadlineExceeded) && stat.AcquiredConns() >= stat.MaxConns() {
+		d.logger.Info("Database pool exhausted", zap.Int32("acquired", stat.AcquiredConns()))
+		return nil, &models.OverloadError{RetryAfter: d.retryAfter}
+	}
+	return nil, fmt.Errorf("failed to acquire connection: %w", err)
+}
+
 // Ping проверка подключения к базе данных
-func (d *DBStorage) Ping() error {
+func (d *DBStorage) Ping(ctx context.Context) error {
 	if d.DB == nil {
 		return fmt.Errorf("database is not connected")
 	}
-	return d.DB.Ping(context.Background())
+	return d.DB.Ping(ctx)
+}
+
+// labelsParam возвращает метки для записи в базу, у метрики без меток это пустой объект
+func labelsParam(metric models.Metrics) map[string]string {
+	if metric.Labels == nil {
+		return map[string]string{}
+	}
+	return metric.Labels
+}
+
+// prepareUpsert подготавливает запрос обновления метрики на соединении.
+// Подготовленные запросы живут в соединении: повторный вызов берет их из кэша pgx
+// без обращения к базе, а закрываются они вместе с соединениями пула в Stop
+func prepareUpsert(ctx context.Context, conn *pgx.Conn) error {
+	if _, err := conn.Prepare(ctx, upsertMetricStmt, upsertMetricSQL); err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	return nil
 }
 
 // Stop закрытие подключения к базе данных
@@ -60,47 +154,47 @@ func (d *DBStorage) Stop() error {
 	if d.DB == nil {
 		return nil
 	}
+	// закрытие пула закрывает соединения вместе с подготовленными на них запросами
 	d.DB.Close()
 	return nil
 }
 
-// CreateTables создание таблиц
+// CreateTables создание таблиц: применяет миграции схемы из пакета migrations
 func (d *DBStorage) CreateTables() error {
-	_, err := d.DB.Exec(context.Background(), `CREATE TABLE IF NOT EXISTS metrics (
-		id SERIAL PRIMARY KEY,
-		type TEXT NOT NULL,
-		name TEXT NOT NULL UNIQUE,
-		value DOUBLE PRECISION,
-		delta BIGINT,
-		timestamp TIMESTAMP NOT NULL
-	);
-	CREATE INDEX IF NOT EXISTS idx_metrics_name ON metrics (name);`)
+	applied, err := migrations.Apply(context.Background(), d.DB)
 	if err != nil {
-		return fmt.Errorf("failed to create table: %w", err)
+		return fmt.Errorf("failed to apply migrations: %w", err)
+	}
+	if applied > 0 {
+		d.logger.Info("Database migrations applied", zap.Int("count", applied))
 	}
 	return nil
 }
 
 // UpdateBatch обновление метрик
-func (d *DBStorage) UpdateBatch(metrics []models.Metrics) error {
+func (d *DBStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
 	d.logger.Info("UpdateBatch", zap.String("metrics", fmt.Sprintf("%v", metrics)))
 
-	tx, err := d.DB.Begin(context.Background())
+	conn, err := d.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
 	if err != nil {
 		log.Println("Db failed to begin transaction", err)
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	defer tx.Rollback(context.Background())
+	defer tx.Rollback(ctx)
+
+	if err := prepareUpsert(ctx, tx.Conn()); err != nil {
+		return err
+	}
 
 	for _, metric := range metrics {
-		_, err = tx.Exec(context.Background(),
-			`INSERT INTO metrics (name, type, value, delta, timestamp)
-            VALUES ($1, $2, $3, $4, $5)
-            ON CONFLICT (name) DO UPDATE
-            SET value = EXCLUDED.value,
-                delta = EXCLUDED.delta,
-                timestamp = EXCLUDED.timestamp`,
-			metric.ID, metric.MType, metric.Value, metric.Delta, time.Now(),
+		_, err = tx.Exec(ctx, upsertMetricStmt,
+			metric.MType, metric.ID, labelsParam(metric), metric.Value, metric.Delta, time.Now(),
 		)
 		if err != nil {
 			log.Println("Db failed to insert or update", err)
@@ -108,7 +202,7 @@ func (d *DBStorage) UpdateBatch(metrics []models.Metrics) error {
 		}
 	}
 
-	err = tx.Commit(context.Background())
+	err = tx.Commit(ctx)
 	if err != nil {
 		log.Println("Db failed to commit transaction", err)
 		return fmt.Errorf("failed to commit transaction: %w", err)
@@ -148,15 +242,18 @@ func (d *DBStorage) UpdateBatch(metrics []models.Metrics) error {
 // }
 
 // UpdateMetric добавление метрики
-func (d *DBStorage) UpdateMetric(metric models.Metrics) error {
-	_, err := d.DB.Exec(context.Background(), `INSERT INTO metrics (type, name, value, delta, timestamp)
-	VALUES ($1, $2, $3, $4, $5)
-	 ON CONFLICT (name) DO UPDATE SET
-        type = EXCLUDED.type,
-        value = EXCLUDED.value,
-        delta = EXCLUDED.delta,
-        timestamp = EXCLUDED.timestamp`,
-		metric.MType, metric.ID, metric.Value, metric.Delta, time.Now())
+func (d *DBStorage) UpdateMetric(ctx context.Context, metric models.Metrics) error {
+	conn, err := d.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if err := prepareUpsert(ctx, conn.Conn()); err != nil {
+		return err
+	}
+
+	_, err = conn.Exec(ctx, upsertMetricStmt, metric.MType, metric.ID, labelsParam(metric), metric.Value, metric.Delta, time.Now())
 	if err != nil {
 		log.Println("Db failed to insert", err)
 		return fmt.Errorf("failed to insert metric: %w", err)
@@ -164,6 +261,22 @@ func (d *DBStorage) UpdateMetric(metric models.Metrics) error {
 	return nil
 }
 
+// UpdateIfNewer обновляет метрику, только если ts новее времени ее последнего обновления.
+// Возвращает true, если метрика добавлена или обновлена
+func (d *DBStorage) UpdateIfNewer(ctx context.Context, metric models.Metrics, ts time.Time) (bool, error) {
+	conn, err := d.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Release()
+
+	tag, err := conn.Exec(ctx, upsertIfNewerSQL, metric.MType, metric.ID, labelsParam(metric), metric.Value, metric.Delta, ts)
+	if err != nil {
+		return false, fmt.Errorf("failed to update metric: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
 // // UpdateMetric добавление метрики
 // func (d *DBStorage) UpdateMetric(metric models.Metrics) error {
 // 	_, err := d.DB.Exec(context.Background(), `INSERT INTO metrics (type, name, value, delta, timestamp)
@@ -177,18 +290,18 @@ func (d *DBStorage) UpdateMetric(metric models.Metrics) error {
 // }
 
 // MetrixStatistic получение статистики метрик
-func (d *DBStorage) MetrixStatistic() (map[string]models.Metrics, error) {
+func (d *DBStorage) MetrixStatistic(ctx context.Context) (map[string]models.Metrics, error) {
 	query := `
-        SELECT id, type, name, value, delta, timestamp
+        SELECT id, type, name, labels, value, delta, timestamp
         FROM (
-            SELECT id, type, name, value, delta, timestamp,
-                ROW_NUMBER() OVER (PARTITION BY name ORDER BY timestamp DESC) as rn
+            SELECT id, type, name, labels, value, delta, timestamp,
+                ROW_NUMBER() OVER (PARTITION BY type, name, labels ORDER BY timestamp DESC) as rn
             FROM metrics
         ) subquery
         WHERE rn = 1;
     `
 
-	rows, err := d.DB.Query(context.Background(), query)
+	rows, err := d.DB.Query(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to select metrics: %w", err)
 	}
@@ -198,12 +311,14 @@ func (d *DBStorage) MetrixStatistic() (map[string]models.Metrics, error) {
 	for rows.Next() {
 		var metric models.Metrics
 		var id int
-		var timestamp time.Time
-		err = rows.Scan(&id, &metric.MType, &metric.ID, &metric.Value, &metric.Delta, &timestamp)
+		err = rows.Scan(&id, &metric.MType, &metric.ID, &metric.Labels, &metric.Value, &metric.Delta, &metric.UpdatedAt)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan metrics: %w", err)
 		}
-		metrics[metric.ID] = metric
+		if len(metric.Labels) == 0 {
+			metric.Labels = nil
+		}
+		metrics[StorageKey(metric)] = metric
 	}
 
 	if err = rows.Err(); err != nil {
@@ -213,14 +328,48 @@ func (d *DBStorage) MetrixStatistic() (map[string]models.Metrics, error) {
 	return metrics, nil
 }
 
-// GetValue получение значения метрики по ID метрики
-func (d *DBStorage) GetValue(metric models.Metrics) (*models.Metrics, error) {
-	row := d.DB.QueryRow(context.Background(), `SELECT id, type, name, value, delta, timestamp FROM metrics WHERE name = $1 ORDER BY timestamp DESC LIMIT 1`, metric.ID)
+// DeleteByPrefix удаляет метрики, имя которых начинается с prefix, и возвращает их количество
+func (d *DBStorage) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	// Сравнение начала строки вместо LIKE, чтобы % и _ в префиксе не были шаблоном
+	tag, err := d.DB.Exec(ctx, `DELETE FROM metrics WHERE left(name, char_length($1)) = $1`, prefix)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete metrics: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// CountByType возвращает количество метрик каждого типа без выборки значений
+func (d *DBStorage) CountByType(ctx context.Context) (map[string]int, error) {
+	rows, err := d.DB.Query(ctx, `SELECT type, count(DISTINCT (name, labels)) FROM metrics GROUP BY type`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count metrics: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var mType string
+		var count int
+		if err = rows.Scan(&mType, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan metric counts: %w", err)
+		}
+		counts[mType] = count
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over metric counts: %w", err)
+	}
+
+	return counts, nil
+}
+
+// GetValue получение значения метрики по типу и ID метрики
+func (d *DBStorage) GetValue(ctx context.Context, metric models.Metrics) (*models.Metrics, error) {
+	row := d.DB.QueryRow(ctx, `SELECT id, type, name, labels, value, delta, timestamp FROM metrics WHERE name = $1 AND type = $2 AND labels = $3 ORDER BY timestamp DESC LIMIT 1`, metric.ID, metric.MType, labelsParam(metric))
 
 	var m models.Metrics
 	var id int
-	var timestamp time.Time
-	err := row.Scan(&id, &m.MType, &m.ID, &m.Value, &m.Delta, &timestamp)
+	err := row.Scan(&id, &m.MType, &m.ID, &m.Labels, &m.Value, &m.Delta, &m.UpdatedAt)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			// Если метрика не найдена, возвращаем значение по умолчанию
@@ -230,6 +379,9 @@ func (d *DBStorage) GetValue(metric models.Metrics) (*models.Metrics, error) {
 		}
 		return nil, fmt.Errorf("failed to select metric: %w", err)
 	}
+	if len(m.Labels) == 0 {
+		m.Labels = nil
+	}
 
 	return &m, nil
 }
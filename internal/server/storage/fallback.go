@@ -0,0 +1,365 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/vova4o/yandexadv/internal/models"
+	"go.uber.org/zap"
+)
+
+// fallbackRetryInterval интервал проверки восстановления базы данных
+const fallbackRetryInterval = 5 * time.Second
+
+// FallbackStorage переключается на хранение в памяти, пока основное хранилище недоступно
+// (не подключилось при запуске или вернуло ошибку соединения), и воспроизводит
+// накопленные записи, когда оно восстанавливается.
+// Во время недоступности чтения видят только метрики, записанные в память,
+// а счетчики накапливают приращения, которые при воспроизведении добавляются к значениям в базе
+type FallbackStorage struct {
+	mu       sync.Mutex
+	primary  Storager                                    // nil, пока основное хранилище не подключено
+	connect  func(ctx context.Context) (Storager, error) // подключение основного хранилища
+	mem      *MemStorage                                 // метрики, записанные во время недоступности
+	pending  map[string]models.Metrics                   // записи для воспроизведения, у счетчиков - приращения
+	active   bool                                        // запросы обслуживаются из памяти
+	logger   Loggerer
+	interval time.Duration
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewFallbackStorage создает хранилище с запасным хранением в памяти перед primary.
+// Если primary равен nil, хранилище сразу работает в памяти и раз в interval
+// пытается подключиться через connect
+func NewFallbackStorage(primary Storager, connect func(ctx context.Context) (Storager, error), interval time.Duration, logger Loggerer) *FallbackStorage {
+	f := &FallbackStorage{
+		primary:  primary,
+		connect:  connect,
+		mem:      NewMemStorage(),
+		pending:  make(map[string]models.Metrics),
+		active:   primary == nil,
+		logger:   logger,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+// run периодически проверяет восстановление основного хранилища
+func (f *FallbackStorage) run() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			f.recover(context.Background())
+		}
+	}
+}
+
+// Active сообщает, обслуживаются ли запросы из памяти
+func (f *FallbackStorage) Active() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.active
+}
+
+// current возвращает основное хранилище или nil, если запросы обслуживаются из памяти
+func (f *FallbackStorage) current() Storager {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.active {
+		return nil
+	}
+	return f.primary
+}
+
+// activate переключает хранилище на работу в памяти
+func (f *FallbackStorage) activate(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.active {
+		f.active = true
+		f.logger.Error("Storage unavailable, falling back to memory", zap.Error(err))
+	}
+}
+
+// recover подключает основное хранилище и воспроизводит в нем накопленные записи
+func (f *FallbackStorage) recover(ctx context.Context) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.active {
+		return
+	}
+	if f.primary == nil {
+		primary, err := f.connect(ctx)
+		if err != nil {
+			f.logger.Error("Storage still unavailable", zap.Error(err))
+			return
+		}
+		f.primary = primary
+	}
+	if err := f.primary.Ping(ctx); err != nil {
+		return
+	}
+
+	if err := f.replay(ctx); err != nil {
+		f.logger.Error("Failed to replay buffered writes", zap.Error(err))
+		return
+	}
+
+	f.logger.Info("Storage recovered, buffered writes replayed", zap.Int("count", len(f.pending)))
+	f.active = false
+	f.mem = NewMemStorage()
+	f.pending = make(map[string]models.Metrics)
+}
+
+// replay записывает накопленные метрики в основное хранилище, вызывается под f.mu.
+// Приращения счетчиков добавляются к значениям, сохраненным в основном хранилище
+func (f *FallbackStorage) replay(ctx context.Context) error {
+	if len(f.pending) == 0 {
+		return nil
+	}
+
+	batch := make([]models.Metrics, 0, len(f.pending))
+	for _, metric := range f.pending {
+		if isCounterType(metric.MType) {
+			stored, err := f.primary.GetValue(ctx, metric)
+			switch {
+			case err == nil:
+				metric = addCounters(metric, *stored)
+			case !errors.Is(err, models.ErrMetricNotFound):
+				return err
+			}
+		}
+		batch = append(batch, metric)
+	}
+
+	return f.primary.UpdateBatch(ctx, batch)
+}
+
+// isUnavailable сообщает, говорит ли ошибка о потере соединения с хранилищем: это ErrStorageUnavailable,
+// сетевые ошибки и коды SQLSTATE класса 08 и 57P01-57P03 (остановка или перезапуск сервера базы данных)
+func isUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, models.ErrStorageUnavailable) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "57P01", "57P02", "57P03":
+			return true
+		}
+		return strings.HasPrefix(pgErr.Code, "08")
+	}
+	return false
+}
+
+// isCounterType сообщает, хранит ли метрика накопленную сумму
+func isCounterType(mType string) bool {
+	return mType == "counter" || mType == "counterf"
+}
+
+// addCounters возвращает счетчик metric, увеличенный на значение base
+func addCounters(metric, base models.Metrics) models.Metrics {
+	metric = copyMetric(metric)
+	if metric.Delta != nil && base.Delta != nil {
+		*metric.Delta += *base.Delta
+	}
+	if metric.Value != nil && base.Value != nil {
+		*metric.Value += *base.Value
+	}
+	return metric
+}
+
+// buffer сохраняет метрики в памяти и запоминает их для воспроизведения.
+// Для счетчиков запоминается приращение относительно значения в памяти
+func (f *FallbackStorage) buffer(ctx context.Context, metrics []models.Metrics) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, metric := range metrics {
+		key := StorageKey(metric)
+		pending := copyMetric(metric)
+		if isCounterType(metric.MType) {
+			if prev, err := f.mem.GetValue(ctx, metric); err == nil {
+				pending = subCounters(pending, *prev)
+			}
+			if acc, ok := f.pending[key]; ok {
+				pending = addCounters(pending, acc)
+			}
+		}
+		f.pending[key] = pending
+	}
+
+	return f.mem.UpdateBatch(ctx, metrics)
+}
+
+// subCounters возвращает счетчик metric, уменьшенный на значение base
+func subCounters(metric, base models.Metrics) models.Metrics {
+	if metric.Delta != nil && base.Delta != nil {
+		*metric.Delta -= *base.Delta
+	}
+	if metric.Value != nil && base.Value != nil {
+		*metric.Value -= *base.Value
+	}
+	return metric
+}
+
+// write выполняет запись в основном хранилище, а при его недоступности - в памяти
+func (f *FallbackStorage) write(ctx context.Context, metrics []models.Metrics, fn func(s Storager) error) error {
+	if primary := f.current(); primary != nil {
+		err := fn(primary)
+		if !isUnavailable(err) {
+			return err
+		}
+		f.activate(err)
+	}
+	return f.buffer(ctx, metrics)
+}
+
+// UpdateBatch обновляет метрики
+func (f *FallbackStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	return f.write(ctx, metrics, func(s Storager) error {
+		return s.UpdateBatch(ctx, metrics)
+	})
+}
+
+// UpdateMetric обновляет метрику
+func (f *FallbackStorage) UpdateMetric(ctx context.Context, metric models.Metrics) error {
+	return f.write(ctx, []models.Metrics{metric}, func(s Storager) error {
+		return s.UpdateMetric(ctx, metric)
+	})
+}
+
+// UpdateIfNewer условно обновляет метрику. Во время недоступности основного хранилища
+// метрика записывается в память безусловно, так как время ее сохранения в базе неизвестно
+func (f *FallbackStorage) UpdateIfNewer(ctx context.Context, metric models.Metrics, ts time.Time) (bool, error) {
+	updated := true
+	err := f.write(ctx, []models.Metrics{metric}, func(s Storager) error {
+		ok, err := s.UpdateIfNewer(ctx, metric, ts)
+		if err == nil {
+			updated = ok
+		}
+		return err
+	})
+	return updated, err
+}
+
+// GetValue возвращает метрику из основного хранилища или из памяти
+func (f *FallbackStorage) GetValue(ctx context.Context, metric models.Metrics) (*models.Metrics, error) {
+	if primary := f.current(); primary != nil {
+		m, err := primary.GetValue(ctx, metric)
+		if !isUnavailable(err) {
+			return m, err
+		}
+		f.activate(err)
+	}
+	return f.mem.GetValue(ctx, metric)
+}
+
+// MetrixStatistic возвращает все метрики из основного хранилища или из памяти
+func (f *FallbackStorage) MetrixStatistic(ctx context.Context) (map[string]models.Metrics, error) {
+	if primary := f.current(); primary != nil {
+		metrics, err := primary.MetrixStatistic(ctx)
+		if !isUnavailable(err) {
+			return metrics, err
+		}
+		f.activate(err)
+	}
+	return f.mem.MetrixStatistic(ctx)
+}
+
+// CountByType возвращает количество метрик каждого типа из основного хранилища или из памяти
+func (f *FallbackStorage) CountByType(ctx context.Context) (map[string]int, error) {
+	if primary := f.current(); primary != nil {
+		var counts map[string]int
+		var err error
+		if counter, ok := primary.(interface {
+			CountByType(ctx context.Context) (map[string]int, error)
+		}); ok {
+			counts, err = counter.CountByType(ctx)
+		} else {
+			var metrics map[string]models.Metrics
+			if metrics, err = primary.MetrixStatistic(ctx); err == nil {
+				counts = countByType(metrics)
+			}
+		}
+		if !isUnavailable(err) {
+			return counts, err
+		}
+		f.activate(err)
+	}
+	return f.mem.CountByType(ctx)
+}
+
+// DeleteByPrefix удаляет метрики из основного хранилища.
+// Удаление не воспроизводится после восстановления, поэтому во время недоступности оно отклоняется
+func (f *FallbackStorage) DeleteByPrefix(ctx context.Context, prefix string) (int, error) {
+	primary := f.current()
+	if primary == nil {
+		return 0, fmt.Errorf("%w: deletion is not available while running from memory", models.ErrStorageUnavailable)
+	}
+
+	deleter, ok := primary.(interface {
+		DeleteByPrefix(ctx context.Context, prefix string) (int, error)
+	})
+	if !ok {
+		return 0, models.ErrDeleteNotSupported
+	}
+
+	deleted, err := deleter.DeleteByPrefix(ctx, prefix)
+	if isUnavailable(err) {
+		f.activate(err)
+	}
+	return deleted, err
+}
+
+// Ping проверяет основное хранилище. Работа в памяти считается доступностью
+func (f *FallbackStorage) Ping(ctx context.Context) error {
+	if primary := f.current(); primary != nil {
+		return primary.Ping(ctx)
+	}
+	return nil
+}
+
+// Stop останавливает проверку восстановления и основное хранилище
+func (f *FallbackStorage) Stop() error {
+	f.stopOnce.Do(func() { close(f.done) })
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.active && len(f.pending) > 0 {
+		f.logger.Error("Buffered writes lost on shutdown", zap.Int("count", len(f.pending)))
+	}
+	if f.primary == nil {
+		return nil
+	}
+	return f.primary.Stop()
+}
@@ -0,0 +1,187 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/vova4o/yandexadv/internal/models"
+	"github.com/vova4o/yandexadv/internal/server/storage"
+)
+
+// flakyStorage хранилище в памяти, которое можно сделать недоступным
+type flakyStorage struct {
+	*storage.MemStorage
+	down atomic.Bool
+}
+
+func (s *flakyStorage) err() error {
+	if s.down.Load() {
+		return fmt.Errorf("%w: connection refused", models.ErrStorageUnavailable)
+	}
+	return nil
+}
+
+func (s *flakyStorage) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.MemStorage.UpdateBatch(ctx, metrics)
+}
+
+func (s *flakyStorage) UpdateMetric(ctx context.Context, metric models.Metrics) error {
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.MemStorage.UpdateMetric(ctx, metric)
+}
+
+func (s *flakyStorage) GetValue(ctx context.Context, metric models.Metrics) (*models.Metrics, error) {
+	if err := s.err(); err != nil {
+		return nil, err
+	}
+	return s.MemStorage.GetValue(ctx, metric)
+}
+
+func (s *flakyStorage) Ping(context.Context) error {
+	return s.err()
+}
+
+func TestFallbackStorage(t *testing.T) {
+	ctx := context.Background()
+	counter := func(delta int64) models.Metrics {
+		return models.Metrics{ID: "requests", MType: "counter", Delta: &delta}
+	}
+	gauge := func(value float64) models.Metrics {
+		return models.Metrics{ID: "Alloc", MType: "gauge", Value: &value}
+	}
+
+	t.Run("DB down then recovery with replay", func(t *testing.T) {
+		primary := &flakyStorage{MemStorage: storage.NewMemStorage()}
+		f := storage.NewFallbackStorage(primary, nil, 5*time.Millisecond, nopLogger{})
+		defer f.Stop()
+
+		assert.NoError(t, f.UpdateMetric(ctx, counter(100)))
+		assert.False(t, f.Active())
+
+		primary.down.Store(true)
+
+		// Сервис пишет в счетчик накопленную сумму: без значения в памяти - само приращение
+		assert.NoError(t, f.UpdateMetric(ctx, counter(5)))
+		assert.True(t, f.Active())
+		assert.NoError(t, f.UpdateMetric(ctx, counter(8)))
+		assert.NoError(t, f.UpdateBatch(ctx, []models.Metrics{gauge(1.5)}))
+
+		m, err := f.GetValue(ctx, gauge(0))
+		if assert.NoError(t, err) {
+			assert.Equal(t, 1.5, *m.Value, "writes are readable from memory while DB is down")
+		}
+
+		primary.down.Store(false)
+		assert.Eventually(t, func() bool { return !f.Active() }, time.Second, 5*time.Millisecond)
+
+		m, err = primary.MemStorage.GetValue(ctx, counter(0))
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(108), *m.Delta, "counter increments are added to the stored value")
+		}
+		m, err = primary.MemStorage.GetValue(ctx, gauge(0))
+		if assert.NoError(t, err) {
+			assert.Equal(t, 1.5, *m.Value)
+		}
+
+		m, err = f.GetValue(ctx, counter(0))
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(108), *m.Delta, "reads go to DB after recovery")
+		}
+	})
+
+	t.Run("DB unreachable at startup", func(t *testing.T) {
+		primary := &flakyStorage{MemStorage: storage.NewMemStorage()}
+		var reachable atomic.Bool
+		connect := func(context.Context) (storage.Storager, error) {
+			if !reachable.Load() {
+				return nil, errors.New("connection refused")
+			}
+			return primary, nil
+		}
+
+		f := storage.NewFallbackStorage(nil, connect, 5*time.Millisecond, nopLogger{})
+		defer f.Stop()
+
+		assert.True(t, f.Active())
+		assert.NoError(t, f.UpdateMetric(ctx, gauge(2.5)))
+		assert.NoError(t, f.Ping(ctx))
+
+		time.Sleep(20 * time.Millisecond)
+		assert.True(t, f.Active())
+
+		reachable.Store(true)
+		assert.Eventually(t, func() bool { return !f.Active() }, time.Second, 5*time.Millisecond)
+
+		m, err := primary.MemStorage.GetValue(ctx, gauge(0))
+		if assert.NoError(t, err) {
+			assert.Equal(t, 2.5, *m.Value)
+		}
+	})
+	t.Run("Connection errors classified", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			err      error
+			fallback bool
+		}{
+			{"Network error", fmt.Errorf("failed to insert metric: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), true},
+			{"Server shutdown", fmt.Errorf("failed to insert metric: %w", &pgconn.PgError{Code: "57P01"}), true},
+			{"Connection exception", &pgconn.PgError{Code: "08006"}, true},
+			{"Constraint violation", &pgconn.PgError{Code: "23505"}, false},
+			{"Other error", errors.New("failed to insert metric"), false},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				primary := &failingStorage{Storager: storage.NewMemStorage(), err: tt.err}
+				f := storage.NewFallbackStorage(primary, nil, time.Hour, nopLogger{})
+				defer f.Stop()
+
+				_, err := f.GetValue(ctx, gauge(0))
+				assert.Equal(t, tt.fallback, f.Active())
+				if tt.fallback {
+					assert.ErrorIs(t, err, models.ErrMetricNotFound, "read served from memory")
+				} else {
+					assert.ErrorIs(t, err, tt.err)
+				}
+			})
+		}
+	})
+
+	t.Run("Delete and count forwarded", func(t *testing.T) {
+		primary := &flakyStorage{MemStorage: storage.NewMemStorage()}
+		f := storage.NewFallbackStorage(primary, nil, time.Hour, nopLogger{})
+		defer f.Stop()
+
+		assert.NoError(t, f.UpdateBatch(ctx, []models.Metrics{gauge(1), counter(2)}))
+
+		counts, err := f.CountByType(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"gauge": 1, "counter": 1}, counts)
+
+		deleted, err := f.DeleteByPrefix(ctx, "All")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+
+		primary.down.Store(true)
+		assert.NoError(t, f.UpdateMetric(ctx, gauge(3)))
+		assert.True(t, f.Active())
+
+		counts, err = f.CountByType(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int{"gauge": 1}, counts, "counts come from memory while DB is down")
+
+		_, err = f.DeleteByPrefix(ctx, "All")
+		assert.ErrorIs(t, err, models.ErrStorageUnavailable)
+	})
+}
@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"math/rand"
 	"os"
 	"sync"
 	"time"
@@ -19,6 +21,24 @@ type FileAndMemStorage struct {
 	Encoder     *json.Encoder
 	MS          MemStorage
 	mu          sync.Mutex
+	lastFlush   time.Time // время последнего успешного сохранения
+	flushErr    error     // ошибка последнего сохранения
+	flushStats  FlushStats
+
+	stop     chan struct{}  // сигнал остановки фонового сохранения
+	stopOnce sync.Once      // защита от повторного закрытия stop
+	flusher  sync.WaitGroup // горутина фонового сохранения
+
+	flushMu  sync.Mutex // защита flushing и next
+	flushing bool       // сохранение выполняется
+	next     *flushCall // повторное сохранение для запросов, поступивших во время текущего
+}
+
+// flushCall повторное сохранение, результата которого ждут объединенные запросы
+type flushCall struct {
+	done  chan struct{}
+	count int
+	err   error
 }
 
 // NewFileStorage создание нового хранилища
@@ -27,34 +47,127 @@ func NewFileStorage() *FileAndMemStorage {
 		MS: MemStorage{
 			MemStorage: make(map[string]models.Metrics),
 		},
+		stop: make(chan struct{}),
 	}
 }
 
 // SaveMemStorageToFile сохранение данных из памяти в файл
 func (s *FileAndMemStorage) SaveMemStorageToFile() error {
+	_, err := s.flush()
+	return err
+}
+
+// Flush немедленно сохраняет данные в файл и возвращает количество сохраненных метрик
+func (s *FileAndMemStorage) Flush() (int, error) {
+	return s.flush()
+}
+
+// flush сохраняет данные в файл. Одновременно выполняется только одно сохранение: запросы,
+// поступившие во время него, объединяются в одно повторное сохранение и получают его результат
+func (s *FileAndMemStorage) flush() (int, error) {
+	s.flushMu.Lock()
+	if s.flushing {
+		if s.next == nil {
+			s.next = &flushCall{done: make(chan struct{})}
+		}
+		call := s.next
+		s.flushMu.Unlock()
+
+		<-call.done
+		return call.count, call.err
+	}
+	s.flushing = true
+	s.flushMu.Unlock()
+
+	count, err := s.saveLocked()
+
+	// Повторные сохранения выполняет вызов, начавший первое
+	for {
+		s.flushMu.Lock()
+		call := s.next
+		s.next = nil
+		if call == nil {
+			s.flushing = false
+			s.flushMu.Unlock()
+			return count, err
+		}
+		s.flushMu.Unlock()
+
+		call.count, call.err = s.saveLocked()
+		close(call.done)
+	}
+}
+
+// saveLocked сохраняет данные в файл под блокировкой и возвращает количество сохраненных метрик
+func (s *FileAndMemStorage) saveLocked() (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.FileStorage == nil {
+		return 0, fmt.Errorf("file storage is not opened")
+	}
+	if err := s.save(); err != nil {
+		return 0, err
+	}
+
+	return len(s.MS.MemStorage), nil
+}
+
+// save записывает данные из памяти в файл и учитывает длительность сохранения.
+// Вызывается под блокировкой
+func (s *FileAndMemStorage) save() error {
+	start := time.Now()
+	err := s.write()
+	s.flushStats.Observe(time.Since(start), err)
+
+	if err != nil {
+		s.flushErr = err
+		return err
+	}
+
+	s.lastFlush = time.Now()
+	s.flushErr = nil
+
+	return nil
+}
+
+// write перезаписывает файл текущими данными из памяти
+func (s *FileAndMemStorage) write() error {
 	// Очистка файла
 	if err := s.FileStorage.Truncate(0); err != nil {
-		log.Fatal(err)
 		return fmt.Errorf("failed to truncate file: %w", err)
 	}
 
 	// Установка указателя файла в начало
 	if _, err := s.FileStorage.Seek(0, 0); err != nil {
-		log.Fatal(err)
 		return fmt.Errorf("failed to seek file: %w", err)
 	}
 
 	if err := s.Encoder.Encode(s.MS.MemStorage); err != nil {
-		log.Fatal(err)
 		return fmt.Errorf("failed to encode metrics: %w", err)
 	}
 
 	return nil
 }
 
+// FlushStatus возвращает время последнего успешного сохранения и ошибку последней попытки
+func (s *FileAndMemStorage) FlushStatus() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastFlush, s.flushErr
+}
+
+// FlushStats возвращает статистику сохранений в файл
+func (s *FileAndMemStorage) FlushStats() *FlushStats {
+	return &s.flushStats
+}
+
+// WritePrometheus записывает статистику сохранений в текстовом формате Prometheus
+func (s *FileAndMemStorage) WritePrometheus(w io.Writer) {
+	s.flushStats.WritePrometheus(w)
+}
+
 // LoadMemStorageFromFile загрузка данных из файла в память
 func (s *FileAndMemStorage) LoadMemStorageFromFile() error {
 	s.mu.Lock()
@@ -78,12 +191,22 @@ func (s *FileAndMemStorage) LoadMemStorageFromFile() error {
 			return fmt.Errorf("failed to decode metric: %w", err)
 		}
 
-		s.MS.MemStorage = metrics
+		s.MS.MemStorage = migrateKeys(metrics)
 	}
 
 	return nil
 }
 
+// migrateKeys переводит ключи метрик в формат type:id.
+// Файлы старого формата хранили метрики по одному ID
+func migrateKeys(metrics map[string]models.Metrics) map[string]models.Metrics {
+	migrated := make(map[string]models.Metrics, len(metrics))
+	for _, metric := range metrics {
+		migrated[StorageKey(metric)] = metric
+	}
+	return migrated
+}
+
 // StartFileStorageLogic запуск логики хранения данных в файле
 func StartFileStorageLogic(config *flags.Config, s *FileAndMemStorage, logger Loggerer) {
 	if config.FileStoragePath != "" {
@@ -103,18 +226,40 @@ func StartFileStorageLogic(config *flags.Config, s *FileAndMemStorage, logger Lo
 		}
 	}
 
+	s.flusher.Add(1)
 	go func() {
+		defer s.flusher.Done()
 		for {
 			interval := time.Duration(config.StoreInterval) * time.Second
 			// if interval == 0 {
 			// 	interval = 100 * time.Microsecond // Установите разумное значение по умолчанию
 			// }
-			time.Sleep(interval)
-			s.SaveMemStorageToFile()
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(JitteredInterval(interval, config.StoreJitter, rand.Float64)):
+				if err := s.SaveMemStorageToFile(); err != nil {
+					logger.Error("Failed to save data to file", zap.Error(err))
+				}
+			}
 		}
 	}()
 }
 
+// JitteredInterval возвращает интервал, случайно отклоненный от base не более чем на percent процентов.
+// random должна возвращать число в диапазоне [0, 1)
+func JitteredInterval(base time.Duration, percent int, random func() float64) time.Duration {
+	if percent <= 0 || base <= 0 {
+		return base
+	}
+	if percent > 100 {
+		percent = 100
+	}
+
+	spread := float64(base) * float64(percent) / 100
+	return base + time.Duration(spread*(2*random()-1))
+}
+
 // OpenFile открытие файла для хранения данных
 func (s *FileAndMemStorage) OpenFile(filename string) error {
 	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0755)
@@ -130,33 +275,47 @@ func (s *FileAndMemStorage) OpenFile(filename string) error {
 	return nil
 }
 
-// Stop закрытие файла
+// Stop остановка фонового сохранения, сохранение данных и закрытие файла
 func (s *FileAndMemStorage) Stop() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.flusher.Wait()
+
 	s.SaveMemStorageToFile()
 	return s.FileStorage.Close()
 }
 
 // Ping проверка подключения к файлу
-func (s *FileAndMemStorage) Ping() error {
+func (s *FileAndMemStorage) Ping(_ context.Context) error {
 	return nil
 }
 
 // UpdateMetric обновление метрики
-func (s *FileAndMemStorage) UpdateMetric(metric models.Metrics) error {
+func (s *FileAndMemStorage) UpdateMetric(_ context.Context, metric models.Metrics) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.MS.MemStorage[metric.ID] = metric
+	s.MS.store(metric)
 
 	return nil
 }
 
-// GetValue получение значения метрики по ID метрики
-func (s *FileAndMemStorage) GetValue(metric models.Metrics) (*models.Metrics, error) {
+// UpdateIfNewer обновляет метрику, только если ts новее времени ее последнего обновления.
+// Возвращает true, если метрика обновлена
+func (s *FileAndMemStorage) UpdateIfNewer(_ context.Context, metric models.Metrics, ts time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.MS.storeIfNewer(metric, ts), nil
+}
+
+// GetValue получение значения метрики по типу и ID метрики
+func (s *FileAndMemStorage) GetValue(_ context.Context, metric models.Metrics) (*models.Metrics, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if val, ok := s.MS.MemStorage[metric.ID]; ok {
+	key := StorageKey(metric)
+	if val, ok := s.MS.MemStorage[key]; ok {
+		val.UpdatedAt = s.MS.updated[key]
 		return &val, nil
 	}
 
@@ -164,27 +323,53 @@ func (s *FileAndMemStorage) GetValue(metric models.Metrics) (*models.Metrics, er
 }
 
 // MetrixStatistic получение статистики метрик
-func (s *FileAndMemStorage) MetrixStatistic() (map[string]models.Metrics, error) {
+func (s *FileAndMemStorage) MetrixStatistic(_ context.Context) (map[string]models.Metrics, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	var metrics = make(map[string]models.Metrics)
 
-	for metricType, metricValues := range s.MS.MemStorage {
-		metrics[metricType] = metricValues
+	for key, metric := range s.MS.MemStorage {
+		metric.UpdatedAt = s.MS.updated[key]
+		metrics[key] = metric
 	}
 
 	return metrics, nil
 }
 
+// CountByType возвращает количество метрик каждого типа
+func (s *FileAndMemStorage) CountByType(_ context.Context) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return countByType(s.MS.MemStorage), nil
+}
+
+// DeleteByPrefix удаляет метрики, имя которых начинается с prefix, и возвращает их количество.
+// Файл обновляется при следующем сохранении
+func (s *FileAndMemStorage) DeleteByPrefix(_ context.Context, prefix string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.MS.deleteByPrefix(prefix), nil
+}
+
 // UpdateBatch обновление метрик по пакетно
-func (s *FileAndMemStorage) UpdateBatch(metrics []models.Metrics) error {
+func (s *FileAndMemStorage) UpdateBatch(_ context.Context, metrics []models.Metrics) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for _, metric := range metrics {
-		s.MS.MemStorage[metric.ID] = metric
+		s.MS.store(metric)
 	}
 
 	return nil
 }
+
+// History возвращает не более limit последних значений метрики
+func (s *FileAndMemStorage) History(mType, id string, limit int) ([]models.HistoryPoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.MS.historyLocked(mType, id, limit)
+}
@@ -1,12 +1,21 @@
 package storage_test
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/vova4o/yandexadv/internal/models"
+	"github.com/vova4o/yandexadv/internal/server/flags"
 	"github.com/vova4o/yandexadv/internal/server/storage"
 )
 
@@ -21,39 +30,39 @@ func TestFileAndMemStorage_UpdateBatch(t *testing.T) {
 	value1 := float64(10)
 	value2 := float64(20)
 	metrics := []models.Metrics{
-		{ID: "metric1", Value: &value1},
-		{ID: "metric2", Value: &value2},
+		{ID: "metric1", MType: "gauge", Value: &value1},
+		{ID: "metric2", MType: "gauge", Value: &value2},
 	}
 
-	err := fileStorage.UpdateBatch(metrics)
+	err := fileStorage.UpdateBatch(context.Background(), metrics)
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(fileStorage.MS.MemStorage))
-	assert.Equal(t, metrics[0], fileStorage.MS.MemStorage["metric1"])
-	assert.Equal(t, metrics[1], fileStorage.MS.MemStorage["metric2"])
+	assert.Equal(t, metrics[0], fileStorage.MS.MemStorage[storage.MetricKey("gauge", "metric1")])
+	assert.Equal(t, metrics[1], fileStorage.MS.MemStorage[storage.MetricKey("gauge", "metric2")])
 }
 
 func TestFileAndMemStorage_UpdateMetric(t *testing.T) {
 	fileStorage := storage.NewFileStorage()
 	value := float64(10)
-	metric := models.Metrics{ID: "metric1", Value: &value}
+	metric := models.Metrics{ID: "metric1", MType: "gauge", Value: &value}
 
-	err := fileStorage.UpdateMetric(metric)
+	err := fileStorage.UpdateMetric(context.Background(), metric)
 	assert.NoError(t, err)
-	assert.Equal(t, metric, fileStorage.MS.MemStorage["metric1"])
+	assert.Equal(t, metric, fileStorage.MS.MemStorage[storage.MetricKey("gauge", "metric1")])
 }
 
 func TestFileAndMemStorage_GetValue(t *testing.T) {
 	fileStorage := storage.NewFileStorage()
 	value := float64(10)
-	metric := models.Metrics{ID: "metric1", Value: &value}
-	fileStorage.MS.MemStorage[metric.ID] = metric
+	metric := models.Metrics{ID: "metric1", MType: "gauge", Value: &value}
+	fileStorage.MS.MemStorage[storage.MetricKey(metric.MType, metric.ID)] = metric
 
-	val, err := fileStorage.GetValue(metric)
+	val, err := fileStorage.GetValue(context.Background(), metric)
 	assert.NoError(t, err)
 	assert.Equal(t, &metric, val)
 
 	nonExistentMetric := models.Metrics{ID: "nonexistent"}
-	val, err = fileStorage.GetValue(nonExistentMetric)
+	val, err = fileStorage.GetValue(context.Background(), nonExistentMetric)
 	assert.Error(t, err)
 	assert.Nil(t, val)
 }
@@ -63,21 +72,25 @@ func TestFileAndMemStorage_MetrixStatistic(t *testing.T) {
 	value1 := float64(10)
 	value2 := float64(20)
 	metrics := []models.Metrics{
-		{ID: "metric1", Value: &value1},
-		{ID: "metric2", Value: &value2},
+		{ID: "metric1", MType: "gauge", Value: &value1},
+		{ID: "metric2", MType: "gauge", Value: &value2},
 	}
-	fileStorage.UpdateBatch(metrics)
+	fileStorage.UpdateBatch(context.Background(), metrics)
 
-	stats, err := fileStorage.MetrixStatistic()
+	stats, err := fileStorage.MetrixStatistic(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(stats))
-	assert.Equal(t, metrics[0], stats["metric1"])
-	assert.Equal(t, metrics[1], stats["metric2"])
+	for i, id := range []string{"metric1", "metric2"} {
+		stat := stats[storage.MetricKey("gauge", id)]
+		assert.False(t, stat.UpdatedAt.IsZero())
+		stat.UpdatedAt = metrics[i].UpdatedAt
+		assert.Equal(t, metrics[i], stat)
+	}
 }
 
 func TestFileAndMemStorage_Ping(t *testing.T) {
 	fileStorage := storage.NewFileStorage()
-	err := fileStorage.Ping()
+	err := fileStorage.Ping(context.Background())
 	assert.NoError(t, err)
 }
 
@@ -104,8 +117,8 @@ func TestFileAndMemStorage_SaveMemStorageToFile(t *testing.T) {
 	fileStorage.Encoder = json.NewEncoder(file)
 
 	value := float64(10)
-	metric := models.Metrics{ID: "metric1", Value: &value}
-	fileStorage.MS.MemStorage[metric.ID] = metric
+	metric := models.Metrics{ID: "metric1", MType: "gauge", Value: &value}
+	fileStorage.MS.MemStorage[storage.MetricKey(metric.MType, metric.ID)] = metric
 
 	err = fileStorage.SaveMemStorageToFile()
 	assert.NoError(t, err)
@@ -117,7 +130,7 @@ func TestFileAndMemStorage_SaveMemStorageToFile(t *testing.T) {
 	err = decoder.Decode(&metrics)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(metrics))
-	assert.Equal(t, metric, metrics["metric1"])
+	assert.Equal(t, metric, metrics[storage.MetricKey("gauge", "metric1")])
 }
 
 func TestFileAndMemStorage_LoadMemStorageFromFile(t *testing.T) {
@@ -130,7 +143,8 @@ func TestFileAndMemStorage_LoadMemStorageFromFile(t *testing.T) {
 	fileStorage.Encoder = json.NewEncoder(file)
 
 	value := float64(10)
-	metric := models.Metrics{ID: "metric1", Value: &value}
+	metric := models.Metrics{ID: "metric1", MType: "gauge", Value: &value}
+	// Файл старого формата: метрики хранятся по ID без типа
 	metrics := map[string]models.Metrics{
 		metric.ID: metric,
 	}
@@ -143,7 +157,217 @@ func TestFileAndMemStorage_LoadMemStorageFromFile(t *testing.T) {
 	err = fileStorage.LoadMemStorageFromFile()
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(fileStorage.MS.MemStorage))
-	assert.Equal(t, metric, fileStorage.MS.MemStorage["metric1"])
+	assert.Equal(t, metric, fileStorage.MS.MemStorage[storage.MetricKey("gauge", "metric1")])
+}
+
+func TestFileAndMemStorage_SameIDDifferentTypes(t *testing.T) {
+	fileStorage := storage.NewFileStorage()
+	file, err := os.CreateTemp("", "testfile")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	fileStorage.FileStorage = file
+	fileStorage.Encoder = json.NewEncoder(file)
+
+	value := float64(1.5)
+	delta := int64(3)
+	metrics := []models.Metrics{
+		{ID: "shared", MType: "gauge", Value: &value},
+		{ID: "shared", MType: "counter", Delta: &delta},
+	}
+	assert.NoError(t, fileStorage.UpdateBatch(context.Background(), metrics))
+	assert.NoError(t, fileStorage.SaveMemStorageToFile())
+
+	// Обе метрики переживают сохранение и восстановление
+	restored := storage.NewFileStorage()
+	restored.FileStorage = file
+	assert.NoError(t, restored.LoadMemStorageFromFile())
+	assert.Equal(t, 2, len(restored.MS.MemStorage))
+
+	val, err := restored.GetValue(context.Background(), models.Metrics{ID: "shared", MType: "gauge"})
+	assert.NoError(t, err)
+	assert.Equal(t, value, *val.Value)
+
+	val, err = restored.GetValue(context.Background(), models.Metrics{ID: "shared", MType: "counter"})
+	assert.NoError(t, err)
+	assert.Equal(t, delta, *val.Delta)
+}
+
+func TestFileAndMemStorage_Flush(t *testing.T) {
+	fileStorage := storage.NewFileStorage()
+
+	_, err := fileStorage.Flush()
+	assert.Error(t, err)
+
+	file, err := os.CreateTemp("", "testfile")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	fileStorage.FileStorage = file
+	fileStorage.Encoder = json.NewEncoder(file)
+
+	value := float64(10)
+	assert.NoError(t, fileStorage.UpdateMetric(context.Background(), models.Metrics{ID: "metric1", MType: "gauge", Value: &value}))
+
+	count, err := fileStorage.Flush()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	lastFlush, flushErr := fileStorage.FlushStatus()
+	assert.NoError(t, flushErr)
+	assert.False(t, lastFlush.IsZero())
+}
+
+func TestFileAndMemStorage_FlushStats(t *testing.T) {
+	fileStorage := storage.NewFileStorage()
+
+	file, err := os.CreateTemp("", "testfile")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	fileStorage.FileStorage = file
+	fileStorage.Encoder = json.NewEncoder(file)
+
+	_, err = fileStorage.Flush()
+	assert.NoError(t, err)
+
+	total, failures := fileStorage.FlushStats().Count()
+	assert.Equal(t, uint64(1), total)
+	assert.Zero(t, failures)
+	assert.Positive(t, fileStorage.FlushStats().LastDuration())
+
+	file.Close()
+	_, err = fileStorage.Flush()
+	assert.Error(t, err)
+
+	_, flushErr := fileStorage.FlushStatus()
+	assert.Error(t, flushErr)
+
+	var buf bytes.Buffer
+	fileStorage.WritePrometheus(&buf)
+	assert.Contains(t, buf.String(), "storage_flush_duration_seconds_count 2")
+	assert.Contains(t, buf.String(), "storage_flush_failures_total 1")
+}
+
+// slowWriter считает записи и максимальное количество одновременных записей
+type slowWriter struct {
+	inFlight atomic.Int32
+	maxSeen  atomic.Int32
+	writes   atomic.Int32
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	n := w.inFlight.Add(1)
+	defer w.inFlight.Add(-1)
+	for {
+		seen := w.maxSeen.Load()
+		if n <= seen || w.maxSeen.CompareAndSwap(seen, n) {
+			break
+		}
+	}
+	w.writes.Add(1)
+	time.Sleep(20 * time.Millisecond)
+	return len(p), nil
+}
+
+func TestFileAndMemStorage_SaveCoalescing(t *testing.T) {
+	fileStorage := storage.NewFileStorage()
+
+	file, err := os.CreateTemp("", "testfile")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	writer := &slowWriter{}
+	fileStorage.FileStorage = file
+	fileStorage.Encoder = json.NewEncoder(writer)
+
+	const calls = 20
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				assert.NoError(t, fileStorage.SaveMemStorageToFile())
+				return
+			}
+			_, err := fileStorage.Flush()
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), writer.maxSeen.Load(), "flushes must not overlap")
+	assert.Positive(t, writer.writes.Load())
+	assert.Less(t, writer.writes.Load(), int32(calls), "concurrent requests must be coalesced")
+
+	total, _ := fileStorage.FlushStats().Count()
+	assert.Equal(t, uint64(writer.writes.Load()), total)
+}
+
+// blockingWriter задерживает первую запись до release, а следующие завершает ошибкой
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+	writes  atomic.Int32
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	if w.writes.Add(1) == 1 {
+		close(w.started)
+		<-w.release
+		return len(p), nil
+	}
+	return 0, errors.New("disk full")
+}
+
+func TestFileAndMemStorage_CoalescedSaveError(t *testing.T) {
+	fileStorage := storage.NewFileStorage()
+
+	file, err := os.CreateTemp("", "testfile")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	writer := &blockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+	fileStorage.FileStorage = file
+	fileStorage.Encoder = json.NewEncoder(writer)
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := fileStorage.Flush()
+		first <- err
+	}()
+	<-writer.started
+
+	coalesced := make(chan error, 1)
+	go func() {
+		coalesced <- fileStorage.SaveMemStorageToFile()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(writer.release)
+
+	assert.NoError(t, <-first)
+	assert.Error(t, <-coalesced, "coalesced request gets the result of the follow-up save")
+	assert.Equal(t, int32(2), writer.writes.Load())
+}
+
+func TestFileAndMemStorage_StopFinishesFlusher(t *testing.T) {
+	config := &flags.Config{
+		FileStoragePath: filepath.Join(t.TempDir(), "metrics.json"),
+		StoreInterval:   3600,
+	}
+	fileStorage := storage.NewFileStorage()
+	storage.StartFileStorageLogic(config, fileStorage, NewMockLogger())
+
+	done := make(chan error)
+	go func() { done <- fileStorage.Stop() }()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Stop did not wait for the flusher to finish")
+	}
 }
 
 // func TestStartFileStorageLogic(t *testing.T) {
@@ -168,3 +392,28 @@ func TestFileAndMemStorage_LoadMemStorageFromFile(t *testing.T) {
 //     // Проверка вызова методов
 //     mockLogger.AssertExpectations(t)
 // }
+
+func TestJitteredInterval(t *testing.T) {
+	base := 10 * time.Second
+
+	t.Run("Jitter disabled", func(t *testing.T) {
+		assert.Equal(t, base, storage.JitteredInterval(base, 0, rand.Float64))
+	})
+
+	t.Run("Intervals vary within window", func(t *testing.T) {
+		lower, upper := 9*time.Second, 11*time.Second
+		seen := make(map[time.Duration]struct{})
+		for i := 0; i < 100; i++ {
+			interval := storage.JitteredInterval(base, 10, rand.Float64)
+			assert.GreaterOrEqual(t, interval, lower)
+			assert.LessOrEqual(t, interval, upper)
+			seen[interval] = struct{}{}
+		}
+		assert.Greater(t, len(seen), 1)
+	})
+
+	t.Run("Window bounds", func(t *testing.T) {
+		assert.Equal(t, 9*time.Second, storage.JitteredInterval(base, 10, func() float64 { return 0 }))
+		assert.Equal(t, 11*time.Second, storage.JitteredInterval(base, 10, func() float64 { return 1 }))
+	})
+}
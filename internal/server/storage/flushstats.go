@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// FlushStats статистика сохранений хранилища в файл
+type FlushStats struct {
+	mu       sync.Mutex
+	count    uint64        // количество сохранений
+	failures uint64        // количество неудачных сохранений
+	sum      float64       // суммарная длительность сохранений в секундах
+	last     time.Duration // длительность последнего сохранения
+}
+
+// Observe учитывает одно сохранение длительностью d, завершившееся ошибкой err
+func (f *FlushStats) Observe(d time.Duration, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.count++
+	f.sum += d.Seconds()
+	f.last = d
+	if err != nil {
+		f.failures++
+	}
+}
+
+// Count возвращает количество сохранений и количество неудачных из них
+func (f *FlushStats) Count() (total, failures uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.count, f.failures
+}
+
+// LastDuration возвращает длительность последнего сохранения
+func (f *FlushStats) LastDuration() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.last
+}
+
+// WritePrometheus записывает статистику в текстовом формате Prometheus
+func (f *FlushStats) WritePrometheus(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP storage_flush_duration_seconds Storage flush duration in seconds.")
+	fmt.Fprintln(w, "# TYPE storage_flush_duration_seconds summary")
+	fmt.Fprintf(w, "storage_flush_duration_seconds_sum %g\n", f.sum)
+	fmt.Fprintf(w, "storage_flush_duration_seconds_count %d\n", f.count)
+
+	fmt.Fprintln(w, "# HELP storage_flush_last_duration_seconds Duration of the last storage flush in seconds.")
+	fmt.Fprintln(w, "# TYPE storage_flush_last_duration_seconds gauge")
+	fmt.Fprintf(w, "storage_flush_last_duration_seconds %g\n", f.last.Seconds())
+
+	fmt.Fprintln(w, "# HELP storage_flush_failures_total Total number of failed storage flushes.")
+	fmt.Fprintln(w, "# TYPE storage_flush_failures_total counter")
+	fmt.Fprintf(w, "storage_flush_failures_total %d\n", f.failures)
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/vova4o/yandexadv/internal/models"
+)
+
+// History хранит последние значения gauge-метрик.
+// Не потокобезопасна, вызывается под блокировкой владельца хранилища
+type History struct {
+	size   int
+	points map[string][]models.HistoryPoint
+}
+
+// NewHistory создает историю, хранящую не более size значений каждой метрики
+func NewHistory(size int) *History {
+	return &History{
+		size:   size,
+		points: make(map[string][]models.HistoryPoint),
+	}
+}
+
+// add запоминает значение gauge-метрики, вытесняя самое старое при переполнении
+func (h *History) add(key string, metric models.Metrics, at time.Time) {
+	if metric.MType != "gauge" || metric.Value == nil {
+		return
+	}
+
+	points := append(h.points[key], models.HistoryPoint{Value: *metric.Value, Timestamp: at})
+	if len(points) > h.size {
+		points = append(points[:0:0], points[len(points)-h.size:]...)
+	}
+	h.points[key] = points
+}
+
+// get возвращает не более limit последних значений метрики, limit <= 0 возвращает все
+func (h *History) get(key string, limit int) []models.HistoryPoint {
+	points := h.points[key]
+	if limit > 0 && len(points) > limit {
+		points = points[len(points)-limit:]
+	}
+	return append([]models.HistoryPoint(nil), points...)
+}
@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"context"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/vova4o/yandexadv/internal/models"
 )
@@ -9,9 +12,27 @@ import (
 // MemStorage структура для хранилища в памяти
 type MemStorage struct {
 	MemStorage map[string]models.Metrics
+	updated    map[string]time.Time // время последнего обновления метрик
+	history    *History             // история значений gauge-метрик, nil если отключена
 	mu         sync.Mutex
 }
 
+// MetricKey возвращает ключ хранения метрики в формате type:id,
+// чтобы метрики разных типов с одинаковым ID не перезаписывали друг друга
+func MetricKey(mType, id string) string {
+	return mType + ":" + id
+}
+
+// StorageKey возвращает ключ хранения метрики с учетом меток в формате type:id{k=v,...},
+// для метрики без меток совпадает с MetricKey
+func StorageKey(metric models.Metrics) string {
+	key := MetricKey(metric.MType, metric.ID)
+	if labels := metric.LabelKey(); labels != "" {
+		key += "{" + labels + "}"
+	}
+	return key
+}
+
 // NewMemStorage создание нового хранилища в памяти
 func NewMemStorage() *MemStorage {
 	return &MemStorage{
@@ -20,47 +41,166 @@ func NewMemStorage() *MemStorage {
 }
 
 // UpdateBatch обновление метрик по пакетно
-func (s *MemStorage) UpdateBatch(metrics []models.Metrics) error {
+func (s *MemStorage) UpdateBatch(_ context.Context, metrics []models.Metrics) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for _, metric := range metrics {
-		s.MemStorage[metric.ID] = metric
+		s.store(metric)
 	}
 
 	return nil
 }
 
 // MetrixStatistic получение статистики метрик
-func (s *MemStorage) MetrixStatistic() (map[string]models.Metrics, error) {
+func (s *MemStorage) MetrixStatistic(_ context.Context) (map[string]models.Metrics, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	var metrics = make(map[string]models.Metrics)
 
-	for metricType, metricValues := range s.MemStorage {
-		metrics[metricType] = metricValues
+	for key, metric := range s.MemStorage {
+		metric.UpdatedAt = s.updated[key]
+		metrics[key] = metric
 	}
 
 	return metrics, nil
 }
 
 // UpdateMetric обновление метрики
-func (s *MemStorage) UpdateMetric(metric models.Metrics) error {
+func (s *MemStorage) UpdateMetric(_ context.Context, metric models.Metrics) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.MemStorage[metric.ID] = metric
+	s.store(metric)
 
 	return nil
 }
 
-// GetValue получение значения метрики по ID метрики
-func (s *MemStorage) GetValue(metric models.Metrics) (*models.Metrics, error) {
+// store сохраняет метрику, время ее обновления и историю значений.
+// Вызывается под блокировкой владельца хранилища
+func (s *MemStorage) store(metric models.Metrics) {
+	s.storeAt(metric, time.Now())
+}
+
+// storeAt сохраняет метрику с заданным временем обновления.
+// Вызывается под блокировкой владельца хранилища
+func (s *MemStorage) storeAt(metric models.Metrics, at time.Time) {
+	key := StorageKey(metric)
+
+	s.MemStorage[key] = metric
+	if s.updated == nil {
+		s.updated = make(map[string]time.Time)
+	}
+	s.updated[key] = at
+	if s.history != nil {
+		s.history.add(key, metric, at)
+	}
+}
+
+// storeIfNewer сохраняет метрику, только если ts новее времени ее последнего обновления.
+// Вызывается под блокировкой владельца хранилища
+func (s *MemStorage) storeIfNewer(metric models.Metrics, ts time.Time) bool {
+	if updated, ok := s.updated[StorageKey(metric)]; ok && !ts.After(updated) {
+		return false
+	}
+	s.storeAt(metric, ts)
+	return true
+}
+
+// UpdateIfNewer обновляет метрику, только если ts новее времени ее последнего обновления.
+// Возвращает true, если метрика обновлена
+func (s *MemStorage) UpdateIfNewer(_ context.Context, metric models.Metrics, ts time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.storeIfNewer(metric, ts), nil
+}
+
+// CountByType возвращает количество метрик каждого типа
+func (s *MemStorage) CountByType(_ context.Context) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return countByType(s.MemStorage), nil
+}
+
+// DeleteByPrefix удаляет метрики, имя которых начинается с prefix, и возвращает их количество
+func (s *MemStorage) DeleteByPrefix(_ context.Context, prefix string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.deleteByPrefix(prefix), nil
+}
+
+// deleteByPrefix удаляет метрики вместе с временем обновления и историей.
+// Вызывается под блокировкой владельца хранилища
+func (s *MemStorage) deleteByPrefix(prefix string) int {
+	deleted := 0
+	for key, metric := range s.MemStorage {
+		if !strings.HasPrefix(metric.ID, prefix) {
+			continue
+		}
+		delete(s.MemStorage, key)
+		delete(s.updated, key)
+		if s.history != nil {
+			delete(s.history.points, key)
+		}
+		deleted++
+	}
+	return deleted
+}
+
+// countByType считает метрики каждого типа
+func countByType(metrics map[string]models.Metrics) map[string]int {
+	counts := make(map[string]int)
+	for _, metric := range metrics {
+		counts[metric.MType]++
+	}
+	return counts
+}
+
+// EnableHistory включает хранение последних size значений каждой gauge-метрики
+func (s *MemStorage) EnableHistory(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if size > 0 {
+		s.history = NewHistory(size)
+	}
+}
+
+// History возвращает не более limit последних значений метрики
+func (s *MemStorage) History(mType, id string, limit int) ([]models.HistoryPoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.historyLocked(mType, id, limit)
+}
+
+// historyLocked возвращает историю метрики.
+// Вызывается под блокировкой владельца хранилища
+func (s *MemStorage) historyLocked(mType, id string, limit int) ([]models.HistoryPoint, error) {
+	if s.history == nil {
+		return nil, models.ErrHistoryDisabled
+	}
+
+	key := MetricKey(mType, id)
+	if _, ok := s.MemStorage[key]; !ok {
+		return nil, models.ErrMetricNotFound
+	}
+
+	return s.history.get(key, limit), nil
+}
+
+// GetValue получение значения метрики по типу и ID метрики
+func (s *MemStorage) GetValue(_ context.Context, metric models.Metrics) (*models.Metrics, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if val, ok := s.MemStorage[metric.ID]; ok {
+	key := StorageKey(metric)
+	if val, ok := s.MemStorage[key]; ok {
+		val.UpdatedAt = s.updated[key]
 		return &val, nil
 	}
 
@@ -68,7 +208,7 @@ func (s *MemStorage) GetValue(metric models.Metrics) (*models.Metrics, error) {
 }
 
 // Ping проверка подключения к памяти
-func (s *MemStorage) Ping() error {
+func (s *MemStorage) Ping(_ context.Context) error {
 	return nil
 }
 
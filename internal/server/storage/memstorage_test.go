@@ -1,7 +1,9 @@
 package storage_test
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/vova4o/yandexadv/internal/models"
@@ -19,39 +21,39 @@ func TestMemStorage_UpdateBatch(t *testing.T) {
 	value1 := float64(10)
 	value2 := float64(20)
 	metrics := []models.Metrics{
-		{ID: "metric1", Value: &value1},
-		{ID: "metric2", Value: &value2},
+		{ID: "metric1", MType: "gauge", Value: &value1},
+		{ID: "metric2", MType: "gauge", Value: &value2},
 	}
 
-	err := memStorage.UpdateBatch(metrics)
+	err := memStorage.UpdateBatch(context.Background(), metrics)
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(memStorage.MemStorage))
-	assert.Equal(t, metrics[0], memStorage.MemStorage["metric1"])
-	assert.Equal(t, metrics[1], memStorage.MemStorage["metric2"])
+	assert.Equal(t, metrics[0], memStorage.MemStorage[storage.MetricKey("gauge", "metric1")])
+	assert.Equal(t, metrics[1], memStorage.MemStorage[storage.MetricKey("gauge", "metric2")])
 }
 
 func TestMemStorage_UpdateMetric(t *testing.T) {
 	memStorage := storage.NewMemStorage()
 	value1 := float64(10)
-	metric := models.Metrics{ID: "metric1", Value: &value1}
+	metric := models.Metrics{ID: "metric1", MType: "gauge", Value: &value1}
 
-	err := memStorage.UpdateMetric(metric)
+	err := memStorage.UpdateMetric(context.Background(), metric)
 	assert.NoError(t, err)
-	assert.Equal(t, metric, memStorage.MemStorage["metric1"])
+	assert.Equal(t, metric, memStorage.MemStorage[storage.MetricKey("gauge", "metric1")])
 }
 
 func TestMemStorage_GetValue(t *testing.T) {
 	memStorage := storage.NewMemStorage()
 	value1 := float64(10)
-	metric := models.Metrics{ID: "metric1", Value: &value1}
-	memStorage.MemStorage[metric.ID] = metric
+	metric := models.Metrics{ID: "metric1", MType: "gauge", Value: &value1}
+	memStorage.MemStorage[storage.MetricKey(metric.MType, metric.ID)] = metric
 
-	val, err := memStorage.GetValue(metric)
+	val, err := memStorage.GetValue(context.Background(), metric)
 	assert.NoError(t, err)
 	assert.Equal(t, &metric, val)
 
 	nonExistentMetric := models.Metrics{ID: "nonexistent"}
-	val, err = memStorage.GetValue(nonExistentMetric)
+	val, err = memStorage.GetValue(context.Background(), nonExistentMetric)
 	assert.Error(t, err)
 	assert.Nil(t, val)
 }
@@ -61,21 +63,25 @@ func TestMemStorage_MetrixStatistic(t *testing.T) {
 	val1 := float64(10)
 	val2 := float64(20)
 	metrics := []models.Metrics{
-		{ID: "metric1", Value: &val1},
-		{ID: "metric2", Value: &val2},
+		{ID: "metric1", MType: "gauge", Value: &val1},
+		{ID: "metric2", MType: "gauge", Value: &val2},
 	}
-	memStorage.UpdateBatch(metrics)
+	memStorage.UpdateBatch(context.Background(), metrics)
 
-	stats, err := memStorage.MetrixStatistic()
+	stats, err := memStorage.MetrixStatistic(context.Background())
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(stats))
-	assert.Equal(t, metrics[0], stats["metric1"])
-	assert.Equal(t, metrics[1], stats["metric2"])
+	for i, id := range []string{"metric1", "metric2"} {
+		stat := stats[storage.MetricKey("gauge", id)]
+		assert.False(t, stat.UpdatedAt.IsZero())
+		stat.UpdatedAt = metrics[i].UpdatedAt
+		assert.Equal(t, metrics[i], stat)
+	}
 }
 
 func TestMemStorage_Ping(t *testing.T) {
 	memStorage := storage.NewMemStorage()
-	err := memStorage.Ping()
+	err := memStorage.Ping(context.Background())
 	assert.NoError(t, err)
 }
 
@@ -84,3 +90,167 @@ func TestMemStorage_Stop(t *testing.T) {
 	err := memStorage.Stop()
 	assert.NoError(t, err)
 }
+
+func TestMemStorage_UpdatedAt(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	value := float64(10)
+	metric := models.Metrics{ID: "metric1", MType: "gauge", Value: &value}
+
+	before := time.Now()
+	err := memStorage.UpdateMetric(context.Background(), metric)
+	assert.NoError(t, err)
+
+	val, err := memStorage.GetValue(context.Background(), metric)
+	assert.NoError(t, err)
+	assert.False(t, val.UpdatedAt.Before(before))
+}
+
+func TestMemStorage_SameIDDifferentTypes(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	value := float64(1.5)
+	delta := int64(3)
+	gauge := models.Metrics{ID: "shared", MType: "gauge", Value: &value}
+	counter := models.Metrics{ID: "shared", MType: "counter", Delta: &delta}
+
+	assert.NoError(t, memStorage.UpdateMetric(context.Background(), gauge))
+	assert.NoError(t, memStorage.UpdateMetric(context.Background(), counter))
+	assert.Equal(t, 2, len(memStorage.MemStorage))
+
+	val, err := memStorage.GetValue(context.Background(), models.Metrics{ID: "shared", MType: "gauge"})
+	assert.NoError(t, err)
+	assert.Equal(t, "gauge", val.MType)
+	assert.Equal(t, value, *val.Value)
+
+	val, err = memStorage.GetValue(context.Background(), models.Metrics{ID: "shared", MType: "counter"})
+	assert.NoError(t, err)
+	assert.Equal(t, "counter", val.MType)
+	assert.Equal(t, delta, *val.Delta)
+}
+
+func TestMemStorage_SameIDDifferentLabels(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+	prod, dev := float64(1), float64(2)
+	plain := float64(3)
+	metrics := []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &prod, Labels: map[string]string{"host": "a", "env": "prod"}},
+		{ID: "Alloc", MType: "gauge", Value: &dev, Labels: map[string]string{"host": "a", "env": "dev"}},
+		{ID: "Alloc", MType: "gauge", Value: &plain},
+	}
+
+	assert.NoError(t, memStorage.UpdateBatch(context.Background(), metrics))
+	assert.Equal(t, 3, len(memStorage.MemStorage))
+
+	val, err := memStorage.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge", Labels: map[string]string{"env": "dev", "host": "a"}})
+	assert.NoError(t, err)
+	assert.Equal(t, dev, *val.Value)
+	assert.Equal(t, "env=dev,host=a", val.LabelKey())
+
+	val, err = memStorage.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge"})
+	assert.NoError(t, err)
+	assert.Equal(t, plain, *val.Value)
+	assert.Nil(t, val.Labels)
+
+	_, err = memStorage.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge", Labels: map[string]string{"env": "test"}})
+	assert.ErrorIs(t, err, models.ErrMetricNotFound)
+
+	// Разделители в значениях меток не должны склеивать разные наборы меток
+	joined, split := float64(4), float64(5)
+	assert.NoError(t, memStorage.UpdateBatch(context.Background(), []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &joined, Labels: map[string]string{"a": "1,b=2"}},
+		{ID: "Alloc", MType: "gauge", Value: &split, Labels: map[string]string{"a": "1", "b": "2"}},
+	}))
+	assert.Equal(t, 5, len(memStorage.MemStorage))
+
+	val, err = memStorage.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge", Labels: map[string]string{"a": "1,b=2"}})
+	assert.NoError(t, err)
+	assert.Equal(t, joined, *val.Value)
+}
+
+func TestMemStorage_History(t *testing.T) {
+	memStorage := storage.NewMemStorage()
+
+	_, err := memStorage.History("gauge", "metric1", 0)
+	assert.ErrorIs(t, err, models.ErrHistoryDisabled)
+
+	memStorage.EnableHistory(3)
+	for i := 1; i <= 5; i++ {
+		value := float64(i)
+		assert.NoError(t, memStorage.UpdateMetric(context.Background(), models.Metrics{ID: "metric1", MType: "gauge", Value: &value}))
+	}
+
+	points, err := memStorage.History("gauge", "metric1", 0)
+	assert.NoError(t, err)
+	assert.Len(t, points, 3)
+	for i, point := range points {
+		assert.Equal(t, float64(i+3), point.Value)
+	}
+
+	points, err = memStorage.History("gauge", "metric1", 2)
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+	assert.Equal(t, float64(5), points[1].Value)
+
+	_, err = memStorage.History("gauge", "unknown", 0)
+	assert.ErrorIs(t, err, models.ErrMetricNotFound)
+}
+
+func TestMemStorage_UpdateIfNewer(t *testing.T) {
+	ts := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		at          time.Time
+		wantUpdated bool
+		wantValue   float64
+	}{
+		{name: "Newer timestamp applied", at: ts.Add(time.Second), wantUpdated: true, wantValue: 2},
+		{name: "Older timestamp ignored", at: ts.Add(-time.Second), wantValue: 1},
+		{name: "Equal timestamp ignored", at: ts, wantValue: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memStorage := storage.NewMemStorage()
+			first, second := 1.0, 2.0
+
+			updated, err := memStorage.UpdateIfNewer(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge", Value: &first}, ts)
+			assert.NoError(t, err)
+			assert.True(t, updated, "missing metric is always stored")
+
+			updated, err = memStorage.UpdateIfNewer(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge", Value: &second}, tt.at)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantUpdated, updated)
+
+			val, err := memStorage.GetValue(context.Background(), models.Metrics{ID: "Alloc", MType: "gauge"})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantValue, *val.Value)
+		})
+	}
+}
+
+func TestMemStorage_DeleteByPrefix(t *testing.T) {
+	value, delta := 1.5, int64(1)
+	memStorage := storage.NewMemStorage()
+	memStorage.EnableHistory(10)
+	assert.NoError(t, memStorage.UpdateBatch(context.Background(), []models.Metrics{
+		{ID: "billing.Alloc", MType: "gauge", Value: &value},
+		{ID: "billing.Requests", MType: "counter", Delta: &delta},
+		{ID: "billing.Alloc", MType: "gauge", Value: &value, Labels: map[string]string{"host": "a"}},
+		{ID: "Alloc", MType: "gauge", Value: &value},
+	}))
+
+	deleted, err := memStorage.DeleteByPrefix(context.Background(), "unknown.")
+	assert.NoError(t, err)
+	assert.Zero(t, deleted)
+
+	deleted, err = memStorage.DeleteByPrefix(context.Background(), "billing.")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, deleted)
+
+	metrics, err := memStorage.MetrixStatistic(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 1)
+	assert.Contains(t, metrics, "gauge:Alloc")
+
+	_, err = memStorage.History("gauge", "billing.Alloc", 0)
+	assert.ErrorIs(t, err, models.ErrMetricNotFound)
+}
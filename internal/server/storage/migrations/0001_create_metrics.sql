@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS metrics (
+	id SERIAL PRIMARY KEY,
+	type TEXT NOT NULL,
+	name TEXT NOT NULL,
+	value DOUBLE PRECISION,
+	delta BIGINT,
+	timestamp TIMESTAMP NOT NULL
+);
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_name_key;
+CREATE INDEX IF NOT EXISTS idx_metrics_name ON metrics (name);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_metrics_type_name ON metrics (type, name);
@@ -0,0 +1,3 @@
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+DROP INDEX IF EXISTS idx_metrics_type_name;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_metrics_type_name_labels ON metrics (type, name, labels);
@@ -0,0 +1,111 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	t.Run("Embedded migrations ordered", func(t *testing.T) {
+		migrations, err := Load()
+		assert.NoError(t, err)
+		if !assert.NotEmpty(t, migrations) {
+			return
+		}
+		assert.Equal(t, 1, migrations[0].Version)
+		assert.Equal(t, "0001_create_metrics", migrations[0].Name)
+		for i := 1; i < len(migrations); i++ {
+			assert.Less(t, migrations[i-1].Version, migrations[i].Version)
+		}
+	})
+
+	t.Run("Sorted by version", func(t *testing.T) {
+		migrations, err := load(fstest.MapFS{
+			"10_ten.sql": {Data: []byte("SELECT 10")},
+			"2_two.sql":  {Data: []byte("SELECT 2")},
+		})
+		assert.NoError(t, err)
+		if !assert.Len(t, migrations, 2) {
+			return
+		}
+		assert.Equal(t, 2, migrations[0].Version)
+		assert.Equal(t, "SELECT 10", migrations[1].SQL)
+	})
+
+	t.Run("Invalid name", func(t *testing.T) {
+		_, err := load(fstest.MapFS{"init.sql": {Data: []byte("SELECT 1")}})
+		assert.Error(t, err)
+	})
+
+	t.Run("Duplicate version", func(t *testing.T) {
+		_, err := load(fstest.MapFS{
+			"1_a.sql":  {Data: []byte("SELECT 1")},
+			"01_b.sql": {Data: []byte("SELECT 1")},
+		})
+		assert.Error(t, err)
+	})
+}
+
+// TestApply применяет миграции к пустой схеме, требует DATABASE_DSN
+func TestApply(t *testing.T) {
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("DATABASE_DSN is not set")
+	}
+
+	ctx := context.Background()
+	schema := fmt.Sprintf("migrations_test_%d", time.Now().UnixNano())
+
+	admin, err := pgxpool.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	_, err = admin.Exec(ctx, "CREATE SCHEMA "+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poolConfig.ConnConfig.RuntimeParams["search_path"] = schema
+	db, err := pgxpool.ConnectConfig(ctx, poolConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrations, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := Apply(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(migrations), applied)
+
+	var versions int
+	assert.NoError(t, db.QueryRow(ctx, "SELECT count(*) FROM schema_migrations").Scan(&versions))
+	assert.Equal(t, len(migrations), versions)
+
+	_, err = db.Exec(ctx, "INSERT INTO metrics (type, name, value, timestamp) VALUES ('gauge', 'Alloc', 1, now())")
+	assert.NoError(t, err)
+
+	applied, err = Apply(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Zero(t, applied, "already applied migrations must be skipped")
+}
@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"time"
 
 	"github.com/vova4o/yandexadv/internal/models"
 	"github.com/vova4o/yandexadv/internal/server/flags"
@@ -10,11 +13,12 @@ import (
 
 // Storager интерфейс для хранилища
 type Storager interface {
-	UpdateBatch(metrics []models.Metrics) error
-	UpdateMetric(metric models.Metrics) error
-	GetValue(metric models.Metrics) (*models.Metrics, error)
-	MetrixStatistic() (map[string]models.Metrics, error)
-	Ping() error
+	UpdateBatch(ctx context.Context, metrics []models.Metrics) error
+	UpdateMetric(ctx context.Context, metric models.Metrics) error
+	UpdateIfNewer(ctx context.Context, metric models.Metrics, ts time.Time) (bool, error)
+	GetValue(ctx context.Context, metric models.Metrics) (*models.Metrics, error)
+	MetrixStatistic(ctx context.Context) (map[string]models.Metrics, error)
+	Ping(ctx context.Context) error
 	Stop() error
 }
 
@@ -28,24 +32,53 @@ type Loggerer interface {
 func Init(config *flags.Config, logger Loggerer) Storager {
 	if config.FileStoragePath == "" && config.DBDSN == "" {
 		logger.Error("No storage selected using default: MemoryStorage")
-		return NewMemStorage()
+		stor := NewMemStorage()
+		stor.EnableHistory(config.HistorySize)
+		return stor
 	} else if config.DBDSN != "" {
 		logger.Info("Selected storage: DB")
-		DB, err := DBConnect(config, logger)
-		if err != nil {
-			logger.Error("Failed to connect to database: %v", zap.Error(err))
-			log.Fatalf("Failed to connect to database: %v", err)
+		if config.HistorySize > 0 {
+			logger.Info("Metric history is not supported by DB storage")
+		}
+		stor, err := openDB(config, logger)
+		if config.DBFallback {
+			if err != nil {
+				logger.Error("Database unavailable, starting with memory storage", zap.Error(err))
+			}
+			connect := func(context.Context) (Storager, error) { return openDB(config, logger) }
+			stor = NewFallbackStorage(stor, connect, fallbackRetryInterval, logger)
+		} else if err != nil {
+			logger.Error("Failed to open database: %v", zap.Error(err))
+			log.Fatalf("Failed to open database: %v", err)
 		}
-		err = DB.CreateTables()
-		if err != nil {
-			logger.Error("Failed to create tables: %v", zap.Error(err))
-			log.Fatalf("Failed to create tables: %v", err)
+		if config.ReadCacheTTL > 0 {
+			logger.Info("DB read cache enabled", zap.Duration("ttl", config.ReadCacheTTL))
+			return NewCachedStorage(stor, config.ReadCacheTTL)
 		}
-		return DB
+		return stor
 	} else {
 		logger.Info("Selected storage: File")
 		stor := NewFileStorage()
+		stor.MS.EnableHistory(config.HistorySize)
 		StartFileStorageLogic(config, stor, logger)
 		return stor
 	}
 }
+
+// openDB подключается к базе данных, применяет миграции и при необходимости
+// добавляет перед ней автоматический выключатель
+func openDB(config *flags.Config, logger Loggerer) (Storager, error) {
+	DB, err := DBConnect(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := DB.CreateTables(); err != nil {
+		DB.Stop()
+		return nil, fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	if config.BreakerFailures > 0 {
+		return NewBreakerStorage(DB, config.BreakerFailures, config.BreakerCooldown, logger), nil
+	}
+	return DB, nil
+}